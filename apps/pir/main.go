@@ -2,11 +2,13 @@ package main
 
 import (
 	"log"
+	"math/big"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/ldsec/lattigo-pets21/apps/pir/smudging"
 	"github.com/ldsec/lattigo/v2/bfv"
 	"github.com/ldsec/lattigo/v2/dbfv"
 	"github.com/ldsec/lattigo/v2/drlwe"
@@ -83,6 +85,7 @@ func main() {
 	// $go run main.go arg1 arg2
 	// arg1: number of parties
 	// arg2: number of Go routines
+	// arg3: statistical security of the smudging noise, in bits
 	// MinDelta number of parties for n=8192: 512 parties (this is a memory intensive process)
 
 	N := 3 // Default number of parties
@@ -98,6 +101,9 @@ func main() {
 		check(err)
 	}
 
+	smudgingSecurity, err := smudging.SecurityArg(os.Args[1:], 2)
+	check(err)
+
 	// Index of the ciphertext to retrieve.
 	queryIndex := 2
 
@@ -180,7 +186,7 @@ func main() {
 	result := requestphase(params, queryIndex, NGoRoutine, encQuery, encInputs, plainMask, rlk, rtk)
 
 	// Collective (partial) decryption (key switch)
-	encOut := cksphase(params, P, result)
+	encOut := cksphase(params, P, result, smudgingSecurity)
 
 	l.Println("> Result:")
 
@@ -199,13 +205,16 @@ func main() {
 		elapsedCKGParty+elapsedRKGParty+elapsedRTGParty+elapsedEncryptParty+elapsedRequestParty+elapsedPCKSParty+elapsedDecParty)
 }
 
-func cksphase(params bfv.Parameters, P []*party, result *bfv.Ciphertext) *bfv.Ciphertext {
+func cksphase(params bfv.Parameters, P []*party, result *bfv.Ciphertext, smudgingSecurity int) *bfv.Ciphertext {
 	l := log.New(os.Stderr, "", 0)
 
 	l.Println("> CKS Phase")
 
 	cks := dbfv.NewCKSProtocol(params, 3.19) // Collective public-key re-encryption
 
+	smudgingSampler, err := smudging.NewShareSampler(params, smudgingSecurity, requestNoise(params, len(P)), len(P)-1)
+	check(err)
+
 	for _, pi := range P {
 		pi.cksShare = cks.AllocateShare()
 	}
@@ -215,6 +224,7 @@ func cksphase(params bfv.Parameters, P []*party, result *bfv.Ciphertext) *bfv.Ci
 	elapsedPCKSParty = runTimedParty(func() {
 		for _, pi := range P[1:] {
 			cks.GenShare(pi.sk, zero, result, pi.cksShare)
+			params.RingQ().Add(pi.cksShare.Value, smudgingSampler.ReadNew(), pi.cksShare.Value)
 		}
 	}, len(P)-1)
 
@@ -230,6 +240,23 @@ func cksphase(params bfv.Parameters, P []*party, result *bfv.Ciphertext) *bfv.Ci
 	return encOut
 }
 
+// requestNoise returns the bound of the noise of the result of the request
+// phase with nParties parties, from the parameters alone: the query, encrypted
+// under the collective public key, is multiplied by the plaintext mask of a
+// row, summed over its slots by the log2(N) rotations and additions of the
+// inner sum, and multiplied by the row, and the products of the rows are
+// summed and relinearized.
+func requestNoise(params bfv.Parameters, nParties int) *big.Int {
+	fresh := smudging.PublicKeyNoise(params, nParties)
+	noise := smudging.PlainMulNoise(params, fresh)
+	step := new(big.Int).Add(smudging.KeySwitchNoise(params, nParties), smudging.WrapNoise(params))
+	for i := uint64(0); i < params.LogN(); i++ {
+		noise.Lsh(noise, 1).Add(noise, step)
+	}
+	noise = smudging.MulNoise(params, nParties, noise, fresh)
+	return noise.Mul(noise, big.NewInt(int64(nParties)))
+}
+
 func genparties(params bfv.Parameters, N int, sampler *ring.TernarySampler, ringQP *ring.Ring) []*party {
 
 	P := make([]*party, N)
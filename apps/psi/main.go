@@ -2,11 +2,13 @@ package main
 
 import (
 	"log"
+	"math/big"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/ldsec/lattigo-pets21/apps/pir/smudging"
 	"github.com/ldsec/lattigo/v2/bfv"
 	"github.com/ldsec/lattigo/v2/dbfv"
 	"github.com/ldsec/lattigo/v2/drlwe"
@@ -73,6 +75,7 @@ func main() {
 	// $go run main.go arg1 arg2
 	// arg1: number of parties
 	// arg2: number of Go routines
+	// arg3: statistical security of the smudging noise, in bits
 
 	// Largest for n=8192: 512 parties
 	N := 8 // Default number of parties
@@ -88,6 +91,9 @@ func main() {
 		check(err)
 	}
 
+	smudgingSecurity, err := smudging.SecurityArg(os.Args[1:], 2)
+	check(err)
+
 	// Creating encryption parameters from a default params with logN=14, logQP=438 with a plaintext modulus T=65537
 	paramsDef := bfv.PN14QP438
 	paramsDef.T = 65537
@@ -141,7 +147,7 @@ func main() {
 
 	encRes := evalPhase(params, NGoRoutine, encInputs, rlk)
 
-	encOut := pcksPhase(params, tpk, encRes, P)
+	encOut := pcksPhase(params, tpk, encRes, P, smudgingSecurity)
 
 	// Decrypt the result with the target secret key
 	l.Println("> Result:")
@@ -266,6 +272,18 @@ func evalPhase(params bfv.Parameters, NGoRoutine int, encInputs []*bfv.Ciphertex
 	return
 }
 
+// evalNoise returns the bound of the noise of the result of the evaluation
+// phase with nParties parties, from the parameters alone: the inputs,
+// encrypted under the collective public key, are multiplied pairwise and
+// relinearized along the levels of a binary tree.
+func evalNoise(params bfv.Parameters, nParties int) *big.Int {
+	noise := smudging.PublicKeyNoise(params, nParties)
+	for nLvl := nParties / 2; nLvl > 0; nLvl = nLvl >> 1 {
+		noise = smudging.MulNoise(params, nParties, noise, noise)
+	}
+	return noise
+}
+
 func genparties(params bfv.Parameters, N int, sampler *ring.TernarySampler, ringQP *ring.Ring) []*party {
 
 	// Create each party, and allocate the memory for all the shares that the protocols will need
@@ -302,7 +320,7 @@ func genInputs(params bfv.Parameters, P []*party) (expRes []uint64) {
 	return
 }
 
-func pcksPhase(params bfv.Parameters, tpk *rlwe.PublicKey, encRes *bfv.Ciphertext, P []*party) (encOut *bfv.Ciphertext) {
+func pcksPhase(params bfv.Parameters, tpk *rlwe.PublicKey, encRes *bfv.Ciphertext, P []*party, smudgingSecurity int) (encOut *bfv.Ciphertext) {
 
 	l := log.New(os.Stderr, "", 0)
 
@@ -311,6 +329,9 @@ func pcksPhase(params bfv.Parameters, tpk *rlwe.PublicKey, encRes *bfv.Ciphertex
 
 	pcks := dbfv.NewPCKSProtocol(params, 3.19)
 
+	smudgingSampler, err := smudging.NewShareSampler(params, smudgingSecurity, evalNoise(params, len(P)), len(P))
+	check(err)
+
 	for _, pi := range P {
 		pi.pcksShare = pcks.AllocateBFVShares()
 	}
@@ -319,6 +340,7 @@ func pcksPhase(params bfv.Parameters, tpk *rlwe.PublicKey, encRes *bfv.Ciphertex
 	elapsedPCKSParty = runTimedParty(func() {
 		for _, pi := range P {
 			pcks.GenShare(pi.sk, tpk, encRes, pi.pcksShare)
+			params.RingQ().Add(pi.pcksShare.Value[0], smudgingSampler.ReadNew(), pi.pcksShare.Value[0])
 		}
 	}, len(P))
 
@@ -0,0 +1,237 @@
+// Package smudging samples the smudging noise that floods the noise of the
+// ciphertexts the parties reveal, and bounds that noise a priori from the
+// parameters and the circuit, without decrypting.
+package smudging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// DefaultSecurity is the statistical security of the smudging noise, in bits,
+// when not given.
+const DefaultSecurity = 40
+
+// DigitBits is the size of the digits by which the smudging noise is sampled,
+// and proven with ZK.
+const DigitBits = 16
+
+var ErrNoiseBudget = errors.New("noise budget exceeded")
+
+// Sampler samples the smudging noise that floods a noise of infinity norm at
+// most noise, so that the statistical distance between a flooded coefficient
+// and the smudging noise alone is at most 2^-security, and at most
+// N*2^-security over the N coefficients of a polynomial.
+//
+// The smudging noise is uniform over an interval of 2^k integers around 0,
+// whose statistical distance to its shift by the noise is at most noise/2^k,
+// hence k = security + log2(noise). It is sampled as the sum of digits
+// d_i*2^(16i), each d_i uniform in [-2^15, 2^15) but the last, which is
+// smaller when 16 does not divide k.
+type Sampler struct {
+	Widths []uint     // size of each digit
+	Scales []*big.Int // 2^(16i) for each digit
+	Bound  *big.Int   // infinity norm of the smudging noise
+
+	rq   *ring.Ring
+	prng utils.PRNG
+	buf  []byte
+}
+
+func NewSampler(rq *ring.Ring, security int, noise *big.Int) *Sampler {
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		panic(err)
+	}
+	ss := &Sampler{rq: rq, prng: prng, Bound: new(big.Int), buf: make([]byte, 8*rq.N)}
+	k := uint(security + noise.BitLen())
+	for shift := uint(0); shift < k; shift += DigitBits {
+		width := k - shift
+		if width > DigitBits {
+			width = DigitBits
+		}
+		scale := new(big.Int).Lsh(big.NewInt(1), shift)
+		ss.Widths = append(ss.Widths, width)
+		ss.Scales = append(ss.Scales, scale)
+		ss.Bound.Add(ss.Bound, new(big.Int).Lsh(scale, width-1))
+	}
+	return ss
+}
+
+// NewShareSampler returns the sampler of the smudging noise of the shares of
+// n parties that switch the key of a ciphertext of noise at most noise. The
+// shares carry a smudging noise that floods the noise of the ciphertext, which
+// the decryption under the new key would otherwise reveal. It returns an
+// ErrNoiseBudget error if the noise with the n smudging noises can exceed the
+// budget of the parameters.
+func NewShareSampler(params bfv.Parameters, security int, noise *big.Int, n int) (*Sampler, error) {
+	ss := NewSampler(params.RingQ(), security, noise)
+	total := new(big.Int).Mul(ss.Bound, big.NewInt(int64(n)))
+	if err := CheckNoiseBudget(params, total.Add(total, noise), security); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// SecurityArg returns the statistical security of the smudging noise given as
+// the argument i of the command line args, or DefaultSecurity without it.
+func SecurityArg(args []string, i int) (int, error) {
+	if len(args) <= i {
+		return DefaultSecurity, nil
+	}
+	security, err := strconv.Atoi(args[i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid statistical security of the smudging noise: %w", err)
+	}
+	if security <= 0 {
+		return 0, fmt.Errorf("invalid statistical security of the smudging noise: %d bits", security)
+	}
+	return security, nil
+}
+
+// DigitBounds returns the infinity norm of each digit of the smudging noise.
+func (ss *Sampler) DigitBounds() []uint64 {
+	bounds := make([]uint64, len(ss.Widths))
+	for i, width := range ss.Widths {
+		bounds[i] = 1 << (width - 1)
+	}
+	return bounds
+}
+
+// Read returns the digits of a new smudging noise.
+func (ss *Sampler) Read() [][]int64 {
+	digits := make([][]int64, len(ss.Widths))
+	for i, width := range ss.Widths {
+		ss.prng.Clock(ss.buf)
+		digits[i] = make([]int64, ss.rq.N)
+		for j := range digits[i] {
+			digits[i][j] = int64(binary.BigEndian.Uint64(ss.buf[8*j:])&(1<<width-1)) - 1<<(width-1)
+		}
+	}
+	return digits
+}
+
+// Poly returns the smudging noise of the digits, in R_Q.
+func (ss *Sampler) Poly(digits [][]int64) *ring.Poly {
+	p := ss.rq.NewPoly()
+	tmp := ss.rq.NewPoly()
+	for i, digit := range digits {
+		ss.rq.SetCoefficientsInt64(digit, tmp)
+		ss.rq.MulScalarBigint(tmp, ss.Scales[i], tmp)
+		ss.rq.Add(p, tmp, p)
+	}
+	return p
+}
+
+// ReadNew returns a new smudging noise, in R_Q.
+func (ss *Sampler) ReadNew() *ring.Poly {
+	return ss.Poly(ss.Read())
+}
+
+// FreshNoise returns the bound of the noise of a fresh encryption.
+func FreshNoise(params bfv.Parameters) *big.Int {
+	return new(big.Int).SetUint64(uint64(6 * params.Sigma()))
+}
+
+// NoiseBudget returns the bound under which the noise of a ciphertext leaves
+// its decryption correct, (Δ-r)/2 where Q = Δt + r: decrypting Δm + v yields
+// the rounding of m + (tv - rm)/Q.
+func NoiseBudget(params bfv.Parameters) *big.Int {
+	q := params.RingQ().ModulusBigint
+	t := new(big.Int).SetUint64(params.T())
+	delta, r := new(big.Int).QuoRem(q, t, new(big.Int))
+	return delta.Sub(delta, r).Rsh(delta, 1)
+}
+
+// WrapNoise returns Q mod t, the noise added when the sum or the product of
+// plaintexts scaled by Δ exceeds t by one.
+func WrapNoise(params bfv.Parameters) *big.Int {
+	return new(big.Int).Mod(params.RingQ().ModulusBigint, new(big.Int).SetUint64(params.T()))
+}
+
+// ExpansionFactor returns the heuristic bound on the infinity norm of the
+// product of two independent polynomials of centered coefficients relative to
+// the product of their norms, 2*sqrt(N) instead of N in the worst case.
+func ExpansionFactor(params bfv.Parameters) *big.Int {
+	return big.NewInt(2 * int64(math.Ceil(math.Sqrt(float64(params.N())))))
+}
+
+// PublicKeyNoise returns the bound of the noise of an encryption under the
+// collective public key of n parties, e0 + e*u + e1*s with a public key of
+// noise n*e and s of norm n.
+func PublicKeyNoise(params bfv.Parameters, n int) *big.Int {
+	pk := new(big.Int).Mul(ExpansionFactor(params), big.NewInt(int64(n)))
+	pk.Lsh(pk, 1).Add(pk, big.NewInt(1))
+	return pk.Mul(pk, FreshNoise(params))
+}
+
+// PlainMulNoise returns the bound of the noise of the product of a ciphertext
+// of noise e by a plaintext in [0, t): e*b, and -(Q mod t)*k for the
+// a*b = [a*b]_t + t*k in R, whose coefficients are below N*t^2.
+func PlainMulNoise(params bfv.Parameters, e *big.Int) *big.Int {
+	nt := new(big.Int).SetUint64(params.N() * params.T())
+	noise := new(big.Int).Add(e, WrapNoise(params))
+	return noise.Mul(noise, nt)
+}
+
+// KeySwitchNoise returns the heuristic bound of the noise added by a key
+// switching, such as a relinearization or a rotation, under the key of n
+// parties, L*δ^2*n^2*e for the L moduli of Q and the expansion factor δ.
+func KeySwitchNoise(params bfv.Parameters, n int) *big.Int {
+	noise := new(big.Int).Mul(ExpansionFactor(params), big.NewInt(int64(n)))
+	noise.Mul(noise, noise).Mul(noise, FreshNoise(params))
+	return noise.Mul(noise, big.NewInt(int64(params.QCount())))
+}
+
+// MulNoise returns the heuristic bound of the noise of the relinearized
+// product of ciphertexts of noise e1 and e2, under the collective key s of n
+// parties, of norm n. With c0 + c1*s = Δm + e + Qk for each, k of norm
+// K = (1 + δn)/2 + 1 for the expansion factor δ, the tensoring scaled by t/Q
+// yields
+//
+//	2(Q mod t)*N*t                the wrap of m1*m2, of norm below N*t^2
+//	N*t*(e1 + e2)                 m1*e2 + m2*e1
+//	2(Q mod t)*N*t*K              (Q mod t)*(m1*k2 + m2*k1)
+//	N*t*K*(e1 + e2)               t*(e1*k2 + e2*k1)
+//	(1 + δn)^2 + L*δ^2*n^2*e      the rounding and the relinearization
+//
+// where the products with the messages, which are not centered, are bounded
+// in the worst case, as are those with k: the coefficients of c1 in [0, Q)
+// are not centered either, so that those of k follow a random walk, which
+// the noise of the product inherits.
+func MulNoise(params bfv.Parameters, n int, e1, e2 *big.Int) *big.Int {
+	delta := ExpansionFactor(params)
+	t := new(big.Int).SetUint64(params.T())
+	nt := new(big.Int).Mul(t, new(big.Int).SetUint64(params.N()))
+	e := new(big.Int).Add(e1, e2)
+	dn := new(big.Int).Mul(delta, big.NewInt(int64(n)))
+	k := new(big.Int).Add(dn, big.NewInt(3))
+	k.Rsh(k, 1)
+
+	wrap := new(big.Int).Mul(WrapNoise(params), nt)
+	wrap.Lsh(wrap, 1)
+	noise := new(big.Int).Mul(wrap, new(big.Int).Add(k, big.NewInt(1)))
+	noise.Add(noise, new(big.Int).Mul(nt, e))
+	noise.Add(noise, new(big.Int).Mul(nt, new(big.Int).Mul(k, e)))
+	dn.Add(dn, big.NewInt(1))
+	noise.Add(noise, dn.Mul(dn, dn))
+	return noise.Add(noise, KeySwitchNoise(params, n))
+}
+
+// CheckNoiseBudget returns an ErrNoiseBudget error if a noise of the given
+// bound does not leave the decryption correct under the parameters.
+func CheckNoiseBudget(params bfv.Parameters, noise *big.Int, security int) error {
+	if budget := NoiseBudget(params); noise.Cmp(budget) >= 0 {
+		return fmt.Errorf("%w: the noise of %d bits with the smudging of %d bits of statistical security exceeds the budget of %d bits of the parameters (logN=%d, logQ=%d)",
+			ErrNoiseBudget, noise.BitLen(), security, budget.BitLen(), params.LogN(), params.RingQ().ModulusBigint.BitLen())
+	}
+	return nil
+}
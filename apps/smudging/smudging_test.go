@@ -0,0 +1,222 @@
+package smudging
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+func testParameters(t *testing.T, paramsDef bfv.ParametersLiteral) bfv.Parameters {
+	paramsDef.T = 65537
+	params, err := bfv.NewParametersFromLiteral(paramsDef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+// TestSamplerBounds checks that the smudging noise is 2^(security+log2(noise))
+// wide, which floods the noise with the statistical security, and that the
+// sampled noise stays within its bound.
+func TestSamplerBounds(t *testing.T) {
+	rq := testParameters(t, bfv.PN13QP218).RingQ()
+	for _, tc := range []struct {
+		security int
+		noise    int64
+		digits   int
+	}{
+		{40, 1, 3},
+		{40, 49, 3},
+		{40, 1 << 8, 4},
+		{30, 1 << 17, 3},
+		{16, 1, 2},
+	} {
+		noise := big.NewInt(tc.noise)
+		ss := NewSampler(rq, tc.security, noise)
+		if k := tc.security + noise.BitLen(); ss.Bound.BitLen() != k {
+			t.Errorf("security %d, noise %d: bound of %d bits instead of %d", tc.security, tc.noise, ss.Bound.BitLen(), k)
+		}
+		// The noise over the width of the interval, 2*bound, is at most 2^-security
+		if width := new(big.Int).Lsh(ss.Bound, 1); new(big.Int).Lsh(noise, uint(tc.security)).Cmp(width) > 0 {
+			t.Errorf("security %d, noise %d: interval of %d bits too narrow", tc.security, tc.noise, width.BitLen())
+		}
+		if len(ss.Widths) != tc.digits {
+			t.Errorf("security %d, noise %d: %d digits instead of %d", tc.security, tc.noise, len(ss.Widths), tc.digits)
+		}
+
+		digits := ss.Read()
+		for i, bound := range ss.DigitBounds() {
+			for _, d := range digits[i] {
+				if d < -int64(bound) || d > int64(bound) {
+					t.Fatalf("security %d, noise %d: digit %d of norm %d, above %d", tc.security, tc.noise, i, d, bound)
+				}
+			}
+		}
+		for j := uint64(0); j < rq.N; j++ {
+			v := new(big.Int)
+			for i, digit := range digits {
+				v.Add(v, new(big.Int).Mul(big.NewInt(digit[j]), ss.Scales[i]))
+			}
+			if v.CmpAbs(ss.Bound) > 0 {
+				t.Fatalf("security %d, noise %d: coefficient %d of %d bits, above the bound", tc.security, tc.noise, j, v.BitLen())
+			}
+		}
+	}
+}
+
+func TestCheckNoiseBudget(t *testing.T) {
+	params := testParameters(t, bfv.PN13QP218)
+	budget := NoiseBudget(params)
+	for _, tc := range []struct {
+		name  string
+		noise *big.Int
+		err   error
+	}{
+		{"fresh", FreshNoise(params), nil},
+		{"below the budget", new(big.Int).Sub(budget, big.NewInt(1)), nil},
+		{"budget", budget, ErrNoiseBudget},
+		{"above the budget", new(big.Int).Lsh(budget, 1), ErrNoiseBudget},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := CheckNoiseBudget(params, tc.noise, 40); !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+		})
+	}
+}
+
+// TestNewShareSampler checks that the smudging noise of every share counts
+// against the noise budget.
+func TestNewShareSampler(t *testing.T) {
+	params := testParameters(t, bfv.PN13QP218)
+	noise := new(big.Int).Rsh(NoiseBudget(params), 50)
+	for _, tc := range []struct {
+		n   int
+		err error
+	}{
+		{1, nil},
+		{256, nil},
+		{1 << 20, ErrNoiseBudget},
+	} {
+		if _, err := NewShareSampler(params, 40, noise, tc.n); !errors.Is(err, tc.err) {
+			t.Errorf("%d shares: got error %v instead of %v", tc.n, err, tc.err)
+		}
+	}
+}
+
+func TestSecurityArg(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		security int
+		valid    bool
+	}{
+		{[]string{"4", "1"}, DefaultSecurity, true},
+		{[]string{"4", "1", "30"}, 30, true},
+		{[]string{"4", "1", "0"}, 0, false},
+		{[]string{"4", "1", "bits"}, 0, false},
+	} {
+		security, err := SecurityArg(tc.args, 2)
+		if (err == nil) != tc.valid || security != tc.security {
+			t.Errorf("args %v: got %d bits, error %v", tc.args, security, err)
+		}
+	}
+}
+
+// measureNoise returns the infinity norm of the noise of ct under sk, which
+// only a test knows.
+func measureNoise(params bfv.Parameters, sk *rlwe.SecretKey, ct *bfv.Ciphertext) *big.Int {
+	encoder := bfv.NewEncoder(params)
+	decryptor := bfv.NewDecryptor(params, sk)
+	// The decoding scales the plaintext down in place
+	plain := bfv.NewPlaintext(params)
+	encoder.EncodeUint(encoder.DecodeUintNew(decryptor.DecryptNew(ct)), plain)
+	pt := decryptor.DecryptNew(ct)
+	params.RingQ().Sub(pt.Value, plain.Value, pt.Value)
+
+	coeffs := make([]*big.Int, params.N())
+	params.RingQ().PolyToBigint(pt.Value, coeffs)
+	q := params.RingQ().ModulusBigint
+	half := new(big.Int).Rsh(q, 1)
+	noise := new(big.Int)
+	for _, c := range coeffs {
+		if c.Cmp(half) > 0 {
+			c.Sub(q, c)
+		}
+		if c.Cmp(noise) > 0 {
+			noise.Set(c)
+		}
+	}
+	return noise
+}
+
+// TestNoiseBounds checks that the bounds derived from the parameters are above
+// the noise measured under the collective key of the parties, for uniform
+// plaintexts.
+func TestNoiseBounds(t *testing.T) {
+	const nParties = 4
+	params := testParameters(t, bfv.PN14QP438)
+	prng, err := utils.NewKeyedPRNG([]byte("noise bounds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kgen := bfv.NewKeyGenerator(params)
+	ckg := dbfv.NewCKGProtocol(params)
+	crp := ring.NewUniformSampler(prng, params.RingQP()).ReadNew()
+	sk := bfv.NewSecretKey(params)
+	ckgCombined := ckg.AllocateShares()
+	for i := 0; i < nParties; i++ {
+		ski := kgen.GenSecretKey()
+		params.RingQP().Add(sk.Value, ski.Value, sk.Value)
+		share := ckg.AllocateShares()
+		ckg.GenShare(ski, crp, share)
+		ckg.AggregateShares(share, ckgCombined, ckgCombined)
+	}
+	pk := bfv.NewPublicKey(params)
+	ckg.GenPublicKey(ckgCombined, crp, pk)
+	rlk := kgen.GenRelinearizationKey(sk, 1)
+
+	encoder := bfv.NewEncoder(params)
+	encryptor := bfv.NewEncryptorFromPk(params, pk)
+	evaluator := bfv.NewEvaluator(params, rlwe.EvaluationKey{Rlk: rlk})
+	rt, err := ring.NewRing(params.N(), []uint64{params.T()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uniform := ring.NewUniformSampler(prng, rt)
+	encrypt := func() *bfv.Ciphertext {
+		pt := bfv.NewPlaintext(params)
+		encoder.EncodeUint(uniform.ReadNew().Coeffs[0], pt)
+		return encryptor.EncryptNew(pt)
+	}
+
+	fresh := PublicKeyNoise(params, nParties)
+	a, b := encrypt(), encrypt()
+	mask := bfv.NewPlaintextMul(params)
+	encoder.EncodeUintMul(uniform.ReadNew().Coeffs[0], mask)
+	masked := evaluator.MulNew(a, mask)
+	product := evaluator.RelinearizeNew(evaluator.MulNew(a, b))
+	// The bounds hold for independent operands, unlike a product squared
+	other := evaluator.RelinearizeNew(evaluator.MulNew(encrypt(), encrypt()))
+	for _, tc := range []struct {
+		name  string
+		ct    *bfv.Ciphertext
+		bound *big.Int
+	}{
+		{"public key encryption", a, fresh},
+		{"plaintext product", masked, PlainMulNoise(params, fresh)},
+		{"product", product, MulNoise(params, nParties, fresh, fresh)},
+		{"product of products", evaluator.RelinearizeNew(evaluator.MulNew(product, other)), MulNoise(params, nParties, MulNoise(params, nParties, fresh, fresh), MulNoise(params, nParties, fresh, fresh))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if noise := measureNoise(params, sk, tc.ct); noise.Cmp(tc.bound) > 0 {
+				t.Fatalf("noise of %d bits above the bound of %d bits", noise.BitLen(), tc.bound.BitLen())
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BATCH_WINDOW is the number of batches a triple generation session starts
+// ahead, so that a party computes on a batch while the messages of the others
+// are on the network.
+const BATCH_WINDOW = 4
+
+// numBatches returns the number of batches of n triples needed for nTriple triples.
+func numBatches(nTriple, n uint64) uint64 {
+	return (nTriple + n - 1) / n
+}
+
+// tripleOutput emits the triples of the batches of a session in the order of
+// the batches, whatever the order in which they complete, so that the i-th
+// triples of the parties are shares of the same triple.
+type tripleOutput struct {
+	out     chan Triple
+	needed  uint64
+	next    uint64
+	pending map[uint64][]Triple
+}
+
+func newTripleOutput(out chan Triple, needed uint64) *tripleOutput {
+	return &tripleOutput{out: out, needed: needed, pending: make(map[uint64][]Triple)}
+}
+
+// add emits the triples of batch once the ones of the previous batches are,
+// up to the number of triples needed.
+func (to *tripleOutput) add(ctx context.Context, batch uint64, triples []Triple) error {
+	to.pending[batch] = triples
+	for {
+		triples, ready := to.pending[to.next]
+		if !ready {
+			return nil
+		}
+		delete(to.pending, to.next)
+		to.next++
+		for _, t := range triples {
+			if to.needed == 0 {
+				return nil
+			}
+			select {
+			case to.out <- t:
+				to.needed--
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// printSessionComm prints the communication of each session and returns their sum.
+func printSessionComm(sessions []*Session) (comm uint64) {
+	for _, sess := range sessions {
+		sent, received := sess.Sum()
+		fmt.Printf("\t%s comm: %d\n", sess.SessionKey, sent+received)
+		comm += sent + received
+	}
+	return
+}
+
+// runSessions runs the function of each of the nSessions sessions concurrently,
+// and cancels them all as soon as one fails. It returns the first error.
+func runSessions(ctx context.Context, nSessions int, run func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, nSessions)
+	for i := 0; i < nSessions; i++ {
+		go func(i int) {
+			err := run(ctx, i)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}(i)
+	}
+
+	var first error
+	for i := 0; i < nSessions; i++ {
+		if err := <-errs; err != nil && (first == nil || errors.Is(first, context.Canceled)) {
+			first = err
+		}
+	}
+	return first
+}
+
+// tripleGenerator is a triple generation protocol, HE or MHE, which emits the
+// triples of its batches to a channel closed once Run returns.
+type tripleGenerator interface {
+	BindNetwork(sess *Session)
+	Run(ctx context.Context, nTriple uint64) error
+	tripleChannel() <-chan Triple
+}
+
+// tripleGeneration runs the sessions of a triple generation protocol of a
+// party, each followed by the check of its triples if check is set.
+type tripleGeneration struct {
+	lp       *LocalParty
+	mux      *Mux
+	tree     Tree
+	t        uint64
+	protocol ProtocolID
+	check    TripleCheck
+
+	// newGenerator returns the protocol of a new session
+	newGenerator func() tripleGenerator
+}
+
+// generate runs the session id of the triple generation for nTriple triples,
+// followed by their check.
+func (g *tripleGeneration) generate(ctx context.Context, id, nTriple uint64) (sess, checkSess *Session, triples []Triple, err error) {
+	if sess, err = g.mux.Session(g.protocol, id); err != nil {
+		return nil, nil, nil, err
+	}
+	generator := g.newGenerator()
+	generator.BindNetwork(sess)
+
+	// The triples are consumed as the batches complete
+	triples = make([]Triple, 0, g.check.Generated(nTriple))
+	consumed := make(chan struct{})
+	go func() {
+		for t := range generator.tripleChannel() {
+			triples = append(triples, t)
+		}
+		close(consumed)
+	}()
+	err = generator.Run(ctx, g.check.Generated(nTriple))
+	<-consumed
+	if err != nil || g.check == CheckNone {
+		return sess, nil, triples, err
+	}
+
+	if checkSess, err = g.mux.Session(ProtocolTripleCheck, id); err != nil {
+		return sess, nil, nil, err
+	}
+	tripleCheckProtocol := g.lp.NewTripleCheckProtocol(g.t, g.tree)
+	tripleCheckProtocol.BindNetwork(checkSess)
+	triples, err = tripleCheckProtocol.Run(ctx, g.check, triples)
+	return sess, checkSess, triples, err
+}
+
+// run runs nSessions concurrent sessions of nTriple triples each and then
+// closes the mux. It returns the sessions, the check sessions if check is set,
+// the triples of each session and the time the sessions took.
+func (g *tripleGeneration) run(ctx context.Context, nSessions int, nTriple uint64) (sessions, checkSessions []*Session, triples [][]Triple, elapsed time.Duration, err error) {
+	sessions = make([]*Session, nSessions)
+	if g.check != CheckNone {
+		checkSessions = make([]*Session, nSessions)
+	}
+	triples = make([][]Triple, nSessions)
+	start := time.Now()
+	err = runSessions(ctx, nSessions, func(ctx context.Context, i int) (err error) {
+		var checkSess *Session
+		sessions[i], checkSess, triples[i], err = g.generate(ctx, uint64(i), nTriple)
+		if g.check != CheckNone {
+			checkSessions[i] = checkSess
+		}
+		return err
+	})
+	elapsed = time.Since(start)
+	if errClose := g.mux.Close(); err == nil {
+		err = errClose
+	}
+	return sessions, checkSessions, triples, elapsed, err
+}
+
+// printGeneration prints the communication of the sessions of a triple
+// generation and of their checks, and the time they took.
+func printGeneration(sessions, checkSessions []*Session, elapsed time.Duration) {
+	comm := printSessionComm(sessions)
+	if checkSessions != nil {
+		fmt.Println("Check Comm:", printSessionComm(checkSessions))
+	}
+	fmt.Println("Time:", elapsed.Nanoseconds())
+	fmt.Println("Comm:", comm)
+}
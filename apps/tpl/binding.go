@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// binding is the network plumbing embedded by the protocols: the receiving
+// loop of their session, and the sending loops of their remotes, which report
+// their first error to the protocol.
+type binding struct {
+	session  *Session
+	sending  sync.WaitGroup
+	sendErrs chan error
+	done     chan struct{} // closed once the protocol stops receiving
+	stops    []func()
+}
+
+// bind starts the receiving loop of sess, which passes each envelope
+// received, or the failure of the session, to receive until it returns false.
+// receive should give up once done is closed.
+func (b *binding) bind(sess *Session, receive func(env *Envelope, err error) bool) {
+	b.session = sess
+	b.sendErrs = make(chan error, 1)
+	b.done = make(chan struct{})
+	go func() {
+		for {
+			env, err := sess.Recv()
+			if err == io.EOF || !receive(env, err) {
+				return
+			}
+		}
+	}()
+}
+
+// startSending starts a sending loop, which stop makes return once it sent
+// the messages queued so far.
+func (b *binding) startSending(stop func(), loop func()) {
+	b.stops = append(b.stops, stop)
+	b.sending.Add(1)
+	go func() {
+		loop()
+		b.sending.Done()
+	}()
+}
+
+// bindMessages binds sess for a protocol exchanging MHETripleGenMessage: the
+// envelopes received are passed on ch, and the messages queued for each
+// remote are sent by its sending loop. The send errors of the peers for which
+// tolerated returns true are left to the session, which reports their failure.
+func (b *binding) bindMessages(sess *Session, ch chan MHETripleGenMessage, remotes []*MHETripleGenRemote, tolerated func(peer PartyID) bool) {
+	b.bind(sess, func(env *Envelope, err error) bool {
+		var msg MHETripleGenMessage
+		if err != nil {
+			msg.err = err
+		} else {
+			msg = MHETripleGenMessage{
+				PartyID: env.Sender,
+				Batch:   env.Batch,
+				Data:    env.Payload,
+				Round:   int(env.Round),
+			}
+		}
+		select {
+		case ch <- msg:
+			return true
+		case <-b.done:
+			return false
+		}
+	})
+
+	for _, rp := range remotes {
+		rp := rp
+		b.startSending(func() { close(rp.Chan) }, func() {
+			for m := range rp.Chan {
+				if err := sess.Send(rp.ID, m.Batch, uint64(m.Round), m.Data); err != nil {
+					if tolerated != nil && tolerated(rp.ID) {
+						continue
+					}
+					reportSendError(b.sendErrs, &ProtocolError{Session: sess.SessionKey, Peer: rp.ID, Batch: m.Batch, Round: uint64(m.Round), Err: err})
+				}
+			}
+		})
+	}
+}
+
+// unbindNetwork flushes the messages to the remotes, closes the session and
+// returns the first error of the sending loops.
+func (b *binding) unbindNetwork() error {
+	for _, stop := range b.stops {
+		stop()
+	}
+	b.stops = nil
+	b.sending.Wait()
+	if b.session == nil {
+		return nil
+	}
+	close(b.done)
+	b.session.Close()
+	select {
+	case err := <-b.sendErrs:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	mrand "math/rand"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// CHECK_SAMPLE is the number of triples of a session opened by the sample check.
+const CHECK_SAMPLE = 128
+
+// TripleCheck is the verification of the triples generated by a session.
+type TripleCheck string
+
+const (
+	CheckNone TripleCheck = ""
+
+	// CheckSacrifice generates twice the triples, and sacrifices a triple to
+	// check each of the others with the Beaver open-and-check.
+	CheckSacrifice TripleCheck = "sacrifice"
+
+	// CheckSample generates CHECK_SAMPLE extra triples, and opens a random
+	// sample of CHECK_SAMPLE triples to check them directly, for debugging.
+	CheckSample TripleCheck = "sample"
+)
+
+func ParseTripleCheck(s string) (TripleCheck, error) {
+	switch check := TripleCheck(s); check {
+	case CheckNone, CheckSacrifice, CheckSample:
+		return check, nil
+	}
+	return CheckNone, fmt.Errorf("unknown triple check %q, should be %s or %s", s, CheckSacrifice, CheckSample)
+}
+
+// Generated returns the number of triples a session generates for nTriple
+// checked triples.
+func (check TripleCheck) Generated(nTriple uint64) uint64 {
+	switch check {
+	case CheckSacrifice:
+		return 2 * nTriple
+	case CheckSample:
+		return nTriple + CHECK_SAMPLE
+	}
+	return nTriple
+}
+
+// TripleCheckProtocol checks the triples generated by a session, by opening
+// values computed from the shares of the triples.
+//
+// The check catches the parties that deviate in the generation of the
+// triples. Since the openings are not authenticated, it does not prevent a
+// party from forging the opened values.
+type TripleCheckProtocol struct {
+	*OpenProtocol
+}
+
+func (lp *LocalParty) NewTripleCheckProtocol(t uint64, tree Tree) *TripleCheckProtocol {
+	return &TripleCheckProtocol{OpenProtocol: lp.NewOpenProtocol(t, tree)}
+}
+
+// Run checks the triples with check, and returns the checked triples, which
+// exclude the sacrificed or opened ones. It stops with ErrCheckFailed if the
+// check fails, and with an error if ctx is cancelled, if a peer fails, or if
+// nothing is received from the peers for READ_TIMEOUT.
+func (tcp *TripleCheckProtocol) Run(ctx context.Context, check TripleCheck, triples []Triple) ([]Triple, error) {
+	var err error
+	switch check {
+	case CheckSacrifice:
+		triples, err = tcp.sacrifice(ctx, triples)
+	case CheckSample:
+		triples, err = tcp.sample(ctx, triples)
+	}
+	if errUnbind := tcp.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return nil, err
+	}
+	return triples, nil
+}
+
+// sacrifice checks each triple (a, b, c) of the first half of triples with
+// the triple (f, g, h) at the same position in the second half: for a random
+// r, the parties open rho = r*a - f and sigma = b - g, and then
+// r*c - h - sigma*f - rho*g - sigma*rho, which is zero for correct triples.
+// The parties commit to their shares of r before opening them, so that no
+// party can choose r.
+func (tcp *TripleCheckProtocol) sacrifice(ctx context.Context, triples []Triple) ([]Triple, error) {
+	n := len(triples) / 2
+	checked, sacrificed := triples[:n], triples[n:2*n]
+
+	coins, err := tcp.OpenCommitted(ctx, sampleUniformVector(1, tcp.t))
+	if err != nil {
+		return nil, err
+	}
+	var r uint64
+	for _, coin := range coins {
+		r = ring.CRed(r+coin[0], tcp.t)
+	}
+
+	masked := make([]uint64, 2*n)
+	for i := range checked {
+		masked[i] = ring.CRed(ring.BRed(r, checked[i].A, tcp.t, tcp.bredParam)+tcp.t-sacrificed[i].A, tcp.t)
+		masked[n+i] = ring.CRed(checked[i].B+tcp.t-sacrificed[i].B, tcp.t)
+	}
+	if masked, err = tcp.Open(ctx, masked); err != nil {
+		return nil, err
+	}
+	rho, sigma := masked[:n], masked[n:]
+
+	z := make([]uint64, n)
+	for i := range z {
+		x, y := checked[i], sacrificed[i]
+		z[i] = ring.BRed(r, x.C, tcp.t, tcp.bredParam)
+		z[i] = ring.CRed(z[i]+tcp.t-y.C, tcp.t)
+		z[i] = ring.CRed(z[i]+tcp.t-ring.BRed(sigma[i], y.A, tcp.t, tcp.bredParam), tcp.t)
+		z[i] = ring.CRed(z[i]+tcp.t-ring.BRed(rho[i], y.B, tcp.t, tcp.bredParam), tcp.t)
+		z[i] = ring.CRed(z[i]+tcp.t-tcp.publicShare(ring.BRed(sigma[i], rho[i], tcp.t, tcp.bredParam)), tcp.t)
+	}
+	if z, err = tcp.Open(ctx, z); err != nil {
+		return nil, err
+	}
+
+	var failed int
+	for i := range z {
+		if z[i] != 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("%w: %d of %d triples", ErrCheckFailed, failed, n)
+	}
+	return checked, nil
+}
+
+// sample opens CHECK_SAMPLE triples chosen at random from a common seed, and
+// checks that c = a*b. It returns the other triples, in the same order.
+func (tcp *TripleCheckProtocol) sample(ctx context.Context, triples []Triple) ([]Triple, error) {
+	seed, err := tcp.Open(ctx, sampleUniformVector(2, tcp.t))
+	if err != nil {
+		return nil, err
+	}
+	prng := mrand.New(mrand.NewSource(int64(seed[0]<<32 | seed[1])))
+	perm := prng.Perm(len(triples))
+	if len(perm) > CHECK_SAMPLE {
+		perm = perm[:CHECK_SAMPLE]
+	}
+
+	opened := make(map[int]bool, len(perm))
+	values := make([]uint64, 0, 3*len(perm))
+	for _, i := range perm {
+		opened[i] = true
+		values = append(values, triples[i].A, triples[i].B, triples[i].C)
+	}
+	if values, err = tcp.Open(ctx, values); err != nil {
+		return nil, err
+	}
+
+	var failed int
+	for k := range perm {
+		if ring.BRed(values[3*k], values[3*k+1], tcp.t, tcp.bredParam) != values[3*k+2] {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("%w: %d of %d opened triples", ErrCheckFailed, failed, len(perm))
+	}
+
+	remaining := make([]Triple, 0, len(triples)-len(perm))
+	for i, t := range triples {
+		if !opened[i] {
+			remaining = append(remaining, t)
+		}
+	}
+	return remaining, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// shareTriples returns the additive shares modulo t of n random triples for
+// each of the parties.
+func shareTriples(nParties int, n int, t uint64) [][]Triple {
+	shares := make([][]Triple, nParties)
+	for i := range shares {
+		shares[i] = make([]Triple, n)
+	}
+	for k := 0; k < n; k++ {
+		ab := sampleUniformVector(2, t)
+		a, b := ab[0], ab[1]
+		c := ring.BRed(a, b, t, ring.BRedParams(t))
+		for i := 0; i < nParties-1; i++ {
+			share := sampleUniformVector(3, t)
+			shares[i][k] = Triple{A: share[0], B: share[1], C: share[2]}
+			a, b, c = (a+t-share[0])%t, (b+t-share[1])%t, (c+t-share[2])%t
+		}
+		shares[nParties-1][k] = Triple{A: a, B: b, C: c}
+	}
+	return shares
+}
+
+func TestSacrifice(t *testing.T) {
+	const modulus, nParties, nTriples = 65537, 3, 8
+	for _, tc := range []struct {
+		name    string
+		corrupt func(shares [][]Triple)
+		err     error
+	}{
+		{"correct", func(shares [][]Triple) {}, nil},
+		{"checked c", func(shares [][]Triple) { shares[1][2].C = (shares[1][2].C + 1) % modulus }, ErrCheckFailed},
+		{"sacrificed c", func(shares [][]Triple) { shares[2][nTriples+5].C = (shares[2][nTriples+5].C + 3) % modulus }, ErrCheckFailed},
+		{"c of every party", func(shares [][]Triple) {
+			for i := range shares {
+				shares[i][0].C = (shares[i][0].C + 1) % modulus
+			}
+		}, ErrCheckFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shares := shareTriples(nParties, 2*nTriples, modulus)
+			tc.corrupt(shares)
+
+			topo := NewDockerTopology(nParties)
+			tree := NewTree(topo.Peers(), 2)
+			checked := make([][]Triple, nParties)
+			client := func(ctx context.Context, lp *LocalParty, netw Network) (*CommReport, error) {
+				if err := netw.Connect(ctx, lp, tree.Edges()); err != nil {
+					return nil, err
+				}
+				mux := NewMux(lp, netw)
+				defer mux.Close()
+				if _, err := lp.AgreeRunID(ctx, mux, modulus, tree); err != nil {
+					return nil, err
+				}
+				sess, err := mux.Session(ProtocolTripleCheck, 0)
+				if err != nil {
+					return nil, err
+				}
+				tcp := lp.NewTripleCheckProtocol(modulus, tree)
+				tcp.BindNetwork(sess)
+				checked[lp.ID], err = tcp.Run(ctx, CheckSacrifice, shares[lp.ID])
+				return nil, err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_, err := RunLocal(ctx, topo, client, modulus, "", "")
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			for i := range checked {
+				if len(checked[i]) != nTriples {
+					t.Fatalf("party %d kept %d triples instead of %d", i, len(checked[i]), nTriples)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// GateOp is the operation of a gate of an arithmetic circuit over Z_t.
+type GateOp string
+
+const (
+	// GateInput is an input of a party
+	GateInput GateOp = "input"
+	// GateConst is a public constant
+	GateConst GateOp = "const"
+	// GateAdd and GateSub add and subtract two wires
+	GateAdd GateOp = "add"
+	GateSub GateOp = "sub"
+	// GateMulConst multiplies a wire by a public constant
+	GateMulConst GateOp = "cmul"
+	// GateMul multiplies two wires, which consumes a triple in the online phase
+	GateMul GateOp = "mul"
+	// GateOutput opens a wire to all the parties, in circuit files
+	GateOutput GateOp = "output"
+)
+
+// arity returns the number of inputs of the gates of op, or -1 if op is unknown.
+func (op GateOp) arity() int {
+	switch op {
+	case GateInput, GateConst:
+		return 0
+	case GateMulConst, GateOutput:
+		return 1
+	case GateAdd, GateSub, GateMul:
+		return 2
+	}
+	return -1
+}
+
+// Gate is a gate of a circuit. Its inputs are the outputs of previous gates.
+type Gate struct {
+	Op    GateOp
+	In    []int
+	Party PartyID // of an input gate
+	Value uint64  // of a constant gate, or the constant of a cmul gate
+}
+
+// Circuit is an arithmetic circuit over Z_t, whose i-th gate computes the
+// wire i, and whose outputs are opened to all the parties.
+type Circuit struct {
+	Name    string
+	Gates   []Gate
+	Outputs []int
+}
+
+func (c *Circuit) add(g Gate) int {
+	c.Gates = append(c.Gates, g)
+	return len(c.Gates) - 1
+}
+
+func (c *Circuit) Input(party PartyID) int { return c.add(Gate{Op: GateInput, Party: party}) }
+func (c *Circuit) Const(v uint64) int      { return c.add(Gate{Op: GateConst, Value: v}) }
+func (c *Circuit) Add(x, y int) int        { return c.add(Gate{Op: GateAdd, In: []int{x, y}}) }
+func (c *Circuit) Sub(x, y int) int        { return c.add(Gate{Op: GateSub, In: []int{x, y}}) }
+func (c *Circuit) MulConst(x int, v uint64) int {
+	return c.add(Gate{Op: GateMulConst, In: []int{x}, Value: v})
+}
+func (c *Circuit) Mul(x, y int) int { return c.add(Gate{Op: GateMul, In: []int{x, y}}) }
+func (c *Circuit) Output(x int)     { c.Outputs = append(c.Outputs, x) }
+
+// Multiplications returns the number of multiplication gates of the circuit,
+// that is the number of triples its evaluation consumes.
+func (c *Circuit) Multiplications() (n uint64) {
+	for _, g := range c.Gates {
+		if g.Op == GateMul {
+			n++
+		}
+	}
+	return n
+}
+
+// Inputs returns the number of input gates of the circuit, which consume a
+// triple each when the triples are authenticated.
+func (c *Circuit) Inputs() (n uint64) {
+	for _, g := range c.Gates {
+		if g.Op == GateInput {
+			n++
+		}
+	}
+	return n
+}
+
+// Schedule is the order in which the online phase evaluates the gates of a
+// circuit: in each round d, the gates of Linear[d], which only depend on
+// multiplications of the previous rounds, and then the multiplications of
+// Mul[d] together, so that the values of a round are opened at once. The
+// multiplications consume the triples in the order of the schedule.
+type Schedule struct {
+	Linear [][]int
+	Mul    [][]int
+}
+
+// Schedule returns the schedule of the circuit, whose number of rounds is its
+// multiplicative depth.
+func (c *Circuit) Schedule() *Schedule {
+	depth := make([]int, len(c.Gates))
+	s := &Schedule{Linear: [][]int{nil}}
+	for w, g := range c.Gates {
+		for _, in := range g.In {
+			if depth[in] > depth[w] {
+				depth[w] = depth[in]
+			}
+		}
+		if g.Op != GateMul {
+			s.Linear[depth[w]] = append(s.Linear[depth[w]], w)
+			continue
+		}
+		if depth[w] == len(s.Mul) {
+			s.Mul = append(s.Mul, nil)
+			s.Linear = append(s.Linear, nil)
+		}
+		s.Mul[depth[w]] = append(s.Mul[depth[w]], w)
+		depth[w]++
+	}
+	return s
+}
+
+// Evaluate evaluates the circuit in the clear, modulo t, on the inputs given
+// by the wire of their input gate, and returns its outputs.
+func (c *Circuit) Evaluate(t uint64, inputs map[int]uint64) []uint64 {
+	bredParams := ring.BRedParams(t)
+	wires := make([]uint64, len(c.Gates))
+	for w, g := range c.Gates {
+		switch g.Op {
+		case GateInput:
+			wires[w] = inputs[w] % t
+		case GateConst:
+			wires[w] = g.Value % t
+		case GateAdd:
+			wires[w] = ring.CRed(wires[g.In[0]]+wires[g.In[1]], t)
+		case GateSub:
+			wires[w] = ring.CRed(wires[g.In[0]]+t-wires[g.In[1]], t)
+		case GateMulConst:
+			wires[w] = ring.BRed(wires[g.In[0]], g.Value%t, t, bredParams)
+		case GateMul:
+			wires[w] = ring.BRed(wires[g.In[0]], wires[g.In[1]], t, bredParams)
+		}
+	}
+	outputs := make([]uint64, len(c.Outputs))
+	for i, w := range c.Outputs {
+		outputs[i] = wires[w]
+	}
+	return outputs
+}
+
+// LoadCircuitSpec returns the test circuit numbered spec, from 1, or the
+// circuit of the JSON file spec, for nParties parties.
+func LoadCircuitSpec(spec string, nParties int) (*Circuit, error) {
+	n, err := strconv.Atoi(spec)
+	if err != nil {
+		return LoadCircuit(spec, nParties)
+	}
+	if n < 1 || n > len(TestCircuits) {
+		return nil, fmt.Errorf("the test circuit should be between 1 and %d", len(TestCircuits))
+	}
+	return TestCircuits[n-1](nParties), nil
+}
+
+// CircuitFile is the JSON format of a circuit. The gates are named by their
+// ID, by which the other gates refer to them as inputs, and can be given in
+// any order as long as they have no cycle. Output gates need no ID.
+//
+//	{
+//	  "name": "x*y + 3",
+//	  "gates": [
+//	    {"id": "x", "op": "input", "party": 0},
+//	    {"id": "y", "op": "input", "party": 1},
+//	    {"id": "xy", "op": "mul", "in": ["x", "y"]},
+//	    {"id": "three", "op": "const", "value": 3},
+//	    {"id": "z", "op": "add", "in": ["xy", "three"]},
+//	    {"op": "output", "in": ["z"]}
+//	  ]
+//	}
+type CircuitFile struct {
+	Name  string        `json:"name,omitempty"`
+	Gates []CircuitGate `json:"gates"`
+}
+
+type CircuitGate struct {
+	ID    string   `json:"id,omitempty"`
+	Op    GateOp   `json:"op"`
+	In    []string `json:"in,omitempty"`
+	Party PartyID  `json:"party,omitempty"`
+	Value uint64   `json:"value,omitempty"`
+}
+
+// LoadCircuit reads a circuit for nParties parties from a JSON file.
+func LoadCircuit(path string, nParties int) (*Circuit, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read circuit: %s", err)
+	}
+	cf := new(CircuitFile)
+	if err := json.Unmarshal(data, cf); err != nil {
+		return nil, fmt.Errorf("cannot parse circuit %s: %s", path, err)
+	}
+	c, err := cf.Circuit(nParties)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuit %s: %s", path, err)
+	}
+	return c, nil
+}
+
+// Circuit returns the circuit of the file for nParties parties, with its gates
+// sorted topologically, in the order of the file when possible.
+func (cf *CircuitFile) Circuit(nParties int) (*Circuit, error) {
+	index := make(map[string]int)
+	for i, g := range cf.Gates {
+		if arity := g.Op.arity(); arity < 0 {
+			return nil, fmt.Errorf("gate %d: unknown operation %q", i, g.Op)
+		} else if len(g.In) != arity {
+			return nil, fmt.Errorf("gate %d: %s takes %d inputs, not %d", i, g.Op, arity, len(g.In))
+		}
+		if g.Op == GateInput && int(g.Party) >= nParties {
+			return nil, fmt.Errorf("gate %d: input of party %d, out of %d parties", i, g.Party, nParties)
+		}
+		if g.Op == GateOutput {
+			continue
+		}
+		if g.ID == "" {
+			return nil, fmt.Errorf("gate %d: missing ID", i)
+		}
+		if _, exists := index[g.ID]; exists {
+			return nil, fmt.Errorf("gate %d: duplicate ID %q", i, g.ID)
+		}
+		index[g.ID] = i
+	}
+
+	// The gates are sorted by depth-first search from the gates of the file in order
+	c := &Circuit{Name: cf.Name}
+	wires := make(map[int]int, len(cf.Gates))
+	visiting := make(map[int]bool)
+	var visit func(i int) error
+	visit = func(i int) error {
+		if _, done := wires[i]; done {
+			return nil
+		}
+		if visiting[i] {
+			return fmt.Errorf("gate %q is in a cycle", cf.Gates[i].ID)
+		}
+		visiting[i] = true
+		g := cf.Gates[i]
+		in := make([]int, len(g.In))
+		for k, id := range g.In {
+			j, defined := index[id]
+			if !defined {
+				return fmt.Errorf("gate %d: undefined input %q", i, id)
+			}
+			if err := visit(j); err != nil {
+				return err
+			}
+			in[k] = wires[j]
+		}
+		if g.Op == GateOutput {
+			c.Output(in[0])
+		} else {
+			wires[i] = c.add(Gate{Op: g.Op, In: in, Party: g.Party, Value: g.Value})
+		}
+		return nil
+	}
+	for i := range cf.Gates {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Outputs) == 0 {
+		return nil, fmt.Errorf("no output")
+	}
+	return c, nil
+}
+
+// TestInputs returns inputs for all the input gates of the circuit, which
+// every party can compute, so that the outputs of a test run can be checked.
+func TestInputs(c *Circuit, t uint64) map[int]uint64 {
+	inputs := make(map[int]uint64)
+	for w, g := range c.Gates {
+		if g.Op == GateInput {
+			inputs[w] = (uint64(w+1) * 0x9E3779B97F4A7C15 >> 16) % t
+		}
+	}
+	return inputs
+}
+
+// TestCircuits are the circuits of the online phase experiment, for a given
+// number of parties.
+var TestCircuits = []func(nParties int) *Circuit{
+	ProductCircuit,
+	InnerProductCircuit,
+	PolynomialCircuit,
+}
+
+// ProductCircuit multiplies an input of each party.
+func ProductCircuit(nParties int) *Circuit {
+	c := &Circuit{Name: fmt.Sprintf("product of %d inputs", nParties)}
+	prod := c.Input(0)
+	for i := 1; i < nParties; i++ {
+		prod = c.Mul(prod, c.Input(PartyID(i)))
+	}
+	c.Output(prod)
+	return c
+}
+
+// InnerProductCircuit computes the inner product of a vector of 256 inputs of
+// party 0 with a vector of 256 inputs of the last party.
+func InnerProductCircuit(nParties int) *Circuit {
+	const n = 256
+	c := &Circuit{Name: fmt.Sprintf("inner product of %d inputs", n)}
+	sum := c.Const(0)
+	for i := 0; i < n; i++ {
+		sum = c.Add(sum, c.Mul(c.Input(0), c.Input(PartyID(nParties-1))))
+	}
+	c.Output(sum)
+	return c
+}
+
+// PolynomialCircuit evaluates 3x^16 - 5x + 7 on the sum x of an input of each
+// party.
+func PolynomialCircuit(nParties int) *Circuit {
+	c := &Circuit{Name: "3x^16 - 5x + 7"}
+	x := c.Input(0)
+	for i := 1; i < nParties; i++ {
+		x = c.Add(x, c.Input(PartyID(i)))
+	}
+	pow := x
+	for i := 0; i < 4; i++ {
+		pow = c.Mul(pow, pow)
+	}
+	c.Output(c.Add(c.Sub(c.MulConst(pow, 3), c.MulConst(x, 5)), c.Const(7)))
+	return c
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// SeedLen is the size of the seeds of the CRPs.
+const SeedLen = 32
+
+// MaxCRPIndex is the largest index of a CRP read from a seed: a seed is used
+// for at most two ciphertexts.
+const MaxCRPIndex = 1
+
+// SeededCiphertext is the compressed form of a ciphertext of degree 1
+// encrypted under a secret key from a common reference polynomial (CRP), when
+// this CRP is the Index-th polynomial read from a PRNG keyed with Seed. Only
+// c0 and the seed are sent, and the receiver re-derives c1 = InvNTT(CRP),
+// which halves the size of the ciphertext on the wire.
+type SeededCiphertext struct {
+	Seed  []byte
+	Index uint64
+	C0    *ring.Poly
+}
+
+// deriveSeed returns the seed of the CRPs identified by a label and values.
+func deriveSeed(label string, values ...uint64) []byte {
+	h := sha256.New()
+	h.Write([]byte(label))
+	for _, v := range values {
+		h.Write(appendUint64(nil, v))
+	}
+	return h.Sum(nil)
+}
+
+// deriveRunSeed returns the seed of the given label and values in the run,
+// so that the CRPs derived from it are not used by another run.
+func deriveRunSeed(label string, run RunID, values ...uint64) []byte {
+	return deriveSeed(label, append([]uint64{binary.BigEndian.Uint64(run[:8]), binary.BigEndian.Uint64(run[8:])}, values...)...)
+}
+
+// readCRP returns the index-th uniform polynomial of rq read from the PRNG keyed with seed.
+func readCRP(rq *ring.Ring, seed []byte, index uint64) (*ring.Poly, error) {
+	if len(seed) != SeedLen || index > MaxCRPIndex {
+		return nil, fmt.Errorf("invalid CRP of index %d from a seed of %d bytes", index, len(seed))
+	}
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return nil, err
+	}
+	crpGen := ring.NewUniformSampler(prng, rq)
+	crp := crpGen.ReadNew()
+	for i := uint64(0); i < index; i++ {
+		crpGen.Read(crp)
+	}
+	return crp, nil
+}
+
+// EncryptSeeded encrypts pt with the index-th CRP derived from seed, and
+// returns the ciphertext along with its compressed form.
+func EncryptSeeded(encryptor bfv.Encryptor, rq *ring.Ring, pt *bfv.Plaintext, seed []byte, index uint64) (*bfv.Ciphertext, *SeededCiphertext, error) {
+	crp, err := readCRP(rq, seed, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct := encryptor.EncryptFromCRPNew(pt, crp)
+	return ct, &SeededCiphertext{Seed: seed, Index: index, C0: ct.Value[0]}, nil
+}
+
+// Expand re-derives c1 and returns the full ciphertext.
+func (sct *SeededCiphertext) Expand(params bfv.Parameters) (*bfv.Ciphertext, error) {
+	rq := params.RingQ()
+	crp, err := readCRP(rq, sct.Seed, sct.Index)
+	if err != nil {
+		return nil, err
+	}
+	ct := bfv.NewCiphertext(params, 1)
+	rq.Copy(sct.C0, ct.Value[0])
+	rq.InvNTT(crp, ct.Value[1])
+	return ct, nil
+}
+
+// MarshalBinary encodes the seeded ciphertext as
+//
+//	seed (SeedLen) | index (8) | c0
+func (sct *SeededCiphertext) MarshalBinary() ([]byte, error) {
+	c0, err := sct.C0.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, len(sct.Seed)+8+len(c0))
+	data = append(data, sct.Seed...)
+	data = appendUint64(data, sct.Index)
+	return append(data, c0...), nil
+}
+
+// decodeSeededCiphertext decodes a seeded ciphertext of the ring rq from the
+// beginning of data, and returns the number of bytes read. The index of its
+// CRP should be at most MaxCRPIndex.
+func decodeSeededCiphertext(data []byte, rq *ring.Ring) (*SeededCiphertext, int, error) {
+	if len(data) < SeedLen+8 {
+		return nil, 0, fmt.Errorf("%w: invalid seed", ErrMalformedMessage)
+	}
+	sct := new(SeededCiphertext)
+	sct.Seed = append([]byte(nil), data[:SeedLen]...)
+	ptr := SeedLen
+	if sct.Index = binary.BigEndian.Uint64(data[ptr:]); sct.Index > MaxCRPIndex {
+		return nil, 0, fmt.Errorf("%w: CRP index %d", ErrMalformedMessage, sct.Index)
+	}
+	ptr += 8
+
+	n, err := checkPolyEncoding(data[ptr:], rq)
+	if err != nil {
+		return nil, 0, err
+	}
+	sct.C0 = new(ring.Poly)
+	if err := sct.C0.UnmarshalBinary(data[ptr : ptr+n]); err != nil {
+		return nil, 0, err
+	}
+	return sct, ptr + n, nil
+}
+
+// UnmarshalSeededCiphertexts decodes the concatenation of count seeded
+// ciphertexts of the ring rq.
+func UnmarshalSeededCiphertexts(data []byte, rq *ring.Ring, count int) ([]*SeededCiphertext, error) {
+	scts := make([]*SeededCiphertext, count)
+	for i := range scts {
+		var n int
+		var err error
+		if scts[i], n, err = decodeSeededCiphertext(data, rq); err != nil {
+			return nil, err
+		}
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(data))
+	}
+	return scts, nil
+}
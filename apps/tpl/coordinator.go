@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// CoordinatorPort is the default port of the coordinator.
+const CoordinatorPort = 50100
+
+// START_DELAY is the delay between the start signal of the coordinator and
+// the start of the experiment, so that all the parties start at the same time.
+const START_DELAY = time.Second
+
+// The parties and the coordinator exchange JSON messages over a single TCP
+// connection. A party sends its Registration, and receives its Assignment
+// once all the parties registered. It then sends a ready PartyStatus,
+// receives the StartSignal once all the parties are ready, and sends its
+// final PartyStatus at the end of the experiment.
+
+// Registration is sent by a party to the coordinator. Addr is the address
+// the other parties dial to reach the party, and defaults to the address of
+// the party as seen by the coordinator, with the port of Listen.
+type Registration struct {
+	Listen string `json:"listen"`
+	Addr   string `json:"addr,omitempty"`
+}
+
+// Assignment is the ID of a party and the experiment it takes part in, as
+// decided by the coordinator.
+type Assignment struct {
+	ID       PartyID        `json:"id"`
+	Topology *Topology      `json:"topology"`
+	Tree     Tree           `json:"tree"`
+	Protocol string         `json:"protocol"`
+	Params   bfv.Parameters `json:"params"`
+	Triples  uint64         `json:"triples"`
+	Sessions int            `json:"sessions"`
+
+	Authenticated bool        `json:"authenticated,omitempty"`
+	Check         TripleCheck `json:"check,omitempty"`
+	Threshold     int         `json:"threshold,omitempty"`
+	ZK            bool        `json:"zk,omitempty"`
+	Smudging      int         `json:"smudging,omitempty"`
+}
+
+// StartSignal tells the parties to start the experiment at time At.
+type StartSignal struct {
+	At time.Time `json:"at"`
+}
+
+// PartyStatus is sent by a party when it is ready to start the experiment,
+// and then with its communication report or its error once it stopped.
+type PartyStatus struct {
+	Ready  bool        `json:"ready,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Report *CommReport `json:"report,omitempty"`
+}
+
+// Coordinator assigns the IDs of the parties in the order they register,
+// sends them the address book and the experiment to run, and starts them.
+type Coordinator struct {
+	NParties int
+	Protocol string
+	Params   bfv.Parameters
+	Triples  uint64
+	Sessions int
+	WAN      *LinkProfile
+
+	Authenticated bool
+	Check         TripleCheck
+	Threshold     int
+	ZK            bool
+	Smudging      int
+}
+
+type coordinatedParty struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+	reg  Registration
+	addr string
+}
+
+// Run waits for the parties to register on listen, runs the experiment, and
+// returns the communication reports of the parties. It returns an error if
+// a party failed or disconnected.
+func (c *Coordinator) Run(ctx context.Context, listen string) ([]*CommReport, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create listening socket: %s", err)
+	}
+	fmt.Println("coordinator listening on", listener.Addr(), "for", c.NParties, "parties")
+
+	registered, full := make(chan *coordinatedParty), make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Println("coordinator failed to accept connection:", err)
+				continue
+			}
+			go func() {
+				cp, err := readRegistration(conn)
+				if err != nil {
+					fmt.Println("coordinator rejected registration from", conn.RemoteAddr(), ":", err)
+					conn.Close()
+					return
+				}
+				select {
+				case registered <- cp:
+				case <-full:
+					conn.Close()
+				case <-ctx.Done():
+					conn.Close()
+				}
+			}()
+		}
+	}()
+
+	parties := make([]*coordinatedParty, 0, c.NParties)
+	defer func() {
+		for _, cp := range parties {
+			cp.conn.Close()
+		}
+	}()
+	for len(parties) < c.NParties {
+		select {
+		case cp := <-registered:
+			fmt.Printf("party-%d registered from %s\n", len(parties), cp.conn.RemoteAddr())
+			parties = append(parties, cp)
+		case <-ctx.Done():
+			listener.Close()
+			return nil, ctx.Err()
+		}
+	}
+	// The registrations after the last party are not accepted
+	close(full)
+	listener.Close()
+
+	// The parties are stopped when the experiment is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, cp := range parties {
+				cp.conn.Close()
+			}
+		case <-stop:
+		}
+	}()
+
+	topo := new(Topology)
+	for i, cp := range parties {
+		topo.Parties = append(topo.Parties, PartyConfig{ID: PartyID(i), Listen: cp.reg.Listen, Addr: cp.addr, Role: RoleParty})
+	}
+	topo.WAN = c.WAN
+	if err := topo.Validate(); err != nil {
+		return nil, err
+	}
+	tree := NewTree(topo.Peers(), 2)
+
+	err = c.each(ctx, parties, func(id PartyID, cp *coordinatedParty) error {
+		assignment := &Assignment{
+			ID:       id,
+			Topology: topo,
+			Tree:     tree,
+			Protocol: c.Protocol,
+			Params:   c.Params,
+			Triples:  c.Triples,
+			Sessions: c.Sessions,
+
+			Authenticated: c.Authenticated,
+			Check:         c.Check,
+			Threshold:     c.Threshold,
+			ZK:            c.ZK,
+			Smudging:      c.Smudging,
+		}
+		if err := cp.enc.Encode(assignment); err != nil {
+			return err
+		}
+		var status PartyStatus
+		if err := cp.dec.Decode(&status); err != nil {
+			return err
+		}
+		if !status.Ready {
+			return fmt.Errorf("not ready: %s", status.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("starting", c.Protocol, "with", c.NParties, "parties")
+	start := &StartSignal{At: time.Now().Add(START_DELAY)}
+	reports := make([]*CommReport, len(parties))
+	err = c.each(ctx, parties, func(id PartyID, cp *coordinatedParty) error {
+		if err := cp.enc.Encode(start); err != nil {
+			return err
+		}
+		var status PartyStatus
+		if err := cp.dec.Decode(&status); err != nil {
+			return err
+		}
+		if status.Error != "" {
+			return errors.New(status.Error)
+		}
+		reports[id] = status.Report
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// each runs f for every party concurrently, and returns the first error.
+func (c *Coordinator) each(ctx context.Context, parties []*coordinatedParty, f func(id PartyID, cp *coordinatedParty) error) error {
+	errs := make([]error, len(parties))
+	wg := new(sync.WaitGroup)
+	for i, cp := range parties {
+		wg.Add(1)
+		go func(i int, cp *coordinatedParty) {
+			defer wg.Done()
+			errs[i] = f(PartyID(i), cp)
+		}(i, cp)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for i, err := range errs {
+		if err != nil {
+			return &PeerError{Peer: PartyID(i), Err: err}
+		}
+	}
+	return nil
+}
+
+func readRegistration(conn net.Conn) (*coordinatedParty, error) {
+	cp := &coordinatedParty{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	if err := conn.SetReadDeadline(time.Now().Add(CONNECT_ATTEMPTS * CONNECT_ATTEMPTS_DELAY * time.Millisecond)); err != nil {
+		return nil, err
+	}
+	if err := cp.dec.Decode(&cp.reg); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	_, port, err := net.SplitHostPort(cp.reg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %s", err)
+	}
+	cp.addr = cp.reg.Addr
+	if cp.addr == "" {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		cp.addr = net.JoinHostPort(host, port)
+	}
+	return cp, nil
+}
+
+// CoordinatorClient is the connection of a party with the coordinator.
+type CoordinatorClient struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// JoinCoordinator registers with the coordinator at addr, and returns the
+// assignment of the party once all the parties registered.
+func JoinCoordinator(ctx context.Context, addr string, reg Registration) (*CoordinatorClient, *Assignment, error) {
+	var conn net.Conn
+	var err error
+	for attempt := 0; conn == nil && attempt < CONNECT_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(CONNECT_ATTEMPTS_DELAY * time.Millisecond):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot connect to the coordinator: %w", err)
+	}
+
+	cc := &CoordinatorClient{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	stop := cc.closeOnDone(ctx)
+	defer close(stop)
+
+	if err := cc.enc.Encode(&reg); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	assignment := new(Assignment)
+	if err := cc.dec.Decode(assignment); err != nil {
+		conn.Close()
+		return nil, nil, cc.err(ctx, err)
+	}
+	if err := assignment.Topology.Validate(); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("invalid topology from the coordinator: %s", err)
+	}
+	return cc, assignment, nil
+}
+
+// WaitStart tells the coordinator that the party is ready, and waits for
+// the start of the experiment.
+func (cc *CoordinatorClient) WaitStart(ctx context.Context) error {
+	stop := cc.closeOnDone(ctx)
+	defer close(stop)
+
+	if err := cc.enc.Encode(&PartyStatus{Ready: true}); err != nil {
+		return cc.err(ctx, err)
+	}
+	start := new(StartSignal)
+	if err := cc.dec.Decode(start); err != nil {
+		return cc.err(ctx, err)
+	}
+	select {
+	case <-time.After(time.Until(start.At)):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Done sends the communication report of the party, or its error, to the
+// coordinator, and closes the connection.
+func (cc *CoordinatorClient) Done(report *CommReport, err error) error {
+	defer cc.conn.Close()
+	status := &PartyStatus{Report: report}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return cc.enc.Encode(status)
+}
+
+// closeOnDone closes the connection once ctx is cancelled, unless the
+// returned channel is closed first.
+func (cc *CoordinatorClient) closeOnDone(ctx context.Context) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cc.conn.Close()
+		case <-stop:
+		}
+	}()
+	return stop
+}
+
+// err returns the error of ctx if the connection failed because ctx was cancelled.
+func (cc *CoordinatorClient) err(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("lost connection with the coordinator: %w", err)
+}
+
+// defaultCoordinatorAddr returns addr, with the default port of the
+// coordinator if it has none.
+func defaultCoordinatorAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, strconv.Itoa(CoordinatorPort))
+	}
+	return addr
+}
+
+// RunCoordinator runs the coordinator of an experiment with nParties parties,
+// listening on addr, and returns the communication reports of the parties.
+func RunCoordinator(ctx context.Context, addr, protocol, nParties string, nTriples uint64, nSessions int, authenticated bool, tripleCheck TripleCheck, threshold int, zk bool, smudging int, wan *LinkProfile) ([]*CommReport, error) {
+	if protocol != "he" && protocol != "mhe" {
+		return nil, fmt.Errorf("unknown protocol %q", protocol)
+	}
+	if authenticated && protocol != "mhe" {
+		return nil, fmt.Errorf("authenticated triples are only generated by mhe")
+	}
+	if zk && protocol != "he" {
+		return nil, fmt.Errorf("the queries and responses are only proven by he")
+	}
+	if smudging < 1 {
+		return nil, fmt.Errorf("the statistical security of the smudging noise should be positive")
+	}
+	n, err := strconv.ParseUint(nParties, 10, 64)
+	if err != nil || n < 2 {
+		return nil, fmt.Errorf("n party should be an integer greater than 1")
+	}
+	if err := checkThreshold(threshold, int(n), protocol == "mhe", authenticated, tripleCheck); err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", CoordinatorPort)
+	}
+	c := &Coordinator{
+		NParties: int(n),
+		Protocol: protocol,
+		Params:   tplParameters(authenticated),
+		Triples:  nTriples,
+		Sessions: nSessions,
+		WAN:      wan,
+
+		Authenticated: authenticated,
+		Check:         tripleCheck,
+		Threshold:     threshold,
+		ZK:            zk,
+		Smudging:      smudging,
+	}
+	reports, err := c.Run(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var comm uint64
+	for _, report := range reports {
+		comm += report.Sent.Bytes + report.Received.Bytes
+	}
+	fmt.Println("Comm:", comm)
+	return reports, nil
+}
+
+// RunJoin registers the party with the coordinator, runs the experiment it
+// is assigned, and reports the result to the coordinator, whatever the
+// outcome. The parties connect over TLS with the CA and the certificates of
+// the parties of certs, if not nil.
+func RunJoin(ctx context.Context, coordinator string, reg Registration, certs *Topology, transcript, store string) (report *CommReport, err error) {
+	cc, assignment, err := JoinCoordinator(ctx, coordinator, reg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errDone := cc.Done(report, err); err == nil && errDone != nil {
+			err = fmt.Errorf("cannot report to the coordinator: %w", errDone)
+		}
+	}()
+	topo := assignment.Topology
+	fmt.Printf("joined as party %d of %d for %s\n", assignment.ID, topo.NumParties(), assignment.Protocol)
+
+	if certs != nil {
+		if err := topo.useCertificates(certs); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkThresholdTopology(assignment.Threshold, topo, false); err != nil {
+		return nil, err
+	}
+
+	client := func(ctx context.Context, lp *LocalParty, netw Network) (*CommReport, error) {
+		if err := cc.WaitStart(ctx); err != nil {
+			return nil, err
+		}
+		if assignment.Protocol == "mhe" {
+			return ClientMHETripleGen(ctx, lp, assignment.Tree, netw, assignment.Params, assignment.Triples, assignment.Sessions, assignment.Authenticated, assignment.Check, assignment.Threshold, assignment.Smudging, nil)
+		}
+		return ClientHETripleGen(ctx, lp, netw, assignment.Params, assignment.Triples, assignment.Sessions, assignment.Check, assignment.ZK, assignment.Smudging, nil)
+	}
+	return RunParty(ctx, topo, assignment.ID, client, assignment.Params.T(), transcript, store)
+}
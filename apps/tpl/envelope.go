@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// EnvelopeVersion is the version of the wire format of the envelopes.
+// Version 2 adds the receiver and the signature of the sender, and version 3
+// the batch of the message within its session, and version 4 the ID of the run.
+const EnvelopeVersion = 4
+
+// MaxEnvelopePayload bounds the size of the payloads accepted from the network.
+const MaxEnvelopePayload = 1 << 30
+
+// READ_TIMEOUT is the maximum time a protocol waits for the next message of a peer.
+const READ_TIMEOUT = 20 * time.Second
+
+// The header of an envelope is laid out as
+//
+//	version (1) | protocol (1) | run (16) | session (8) | batch (8) | round (8) | sender (8) | receiver (8) | length (8) | signature length (1) | checksum (4)
+//
+// in big endian, followed by length bytes of payload and by the signature, if
+// any. The signature is the Ed25519 signature by the sender of the header, up
+// to the length field, followed by the payload. The checksum is the CRC-32C
+// of the header, without the checksum field, followed by the payload and the
+// signature.
+const envelopeHeaderLen = 1 + 1 + RunIDLen + 8 + 8 + 8 + 8 + 8 + 8 + 1 + 4
+
+// envelopeSignedLen is the length of the signed part of the header.
+const envelopeSignedLen = envelopeHeaderLen - 1 - 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrEnvelopeVersion  = errors.New("unsupported envelope version")
+	ErrEnvelopeChecksum = errors.New("envelope checksum mismatch")
+	ErrEnvelopeTooLarge = errors.New("envelope payload too large")
+	ErrInvalidSignature = errors.New("invalid envelope signature")
+)
+
+// ProtocolID identifies the protocol an envelope belongs to.
+type ProtocolID uint8
+
+const (
+	ProtocolTripleGen ProtocolID = iota + 1
+	ProtocolMHETripleGen
+	ProtocolRkg
+	ProtocolMACKeyGen
+	ProtocolTripleCheck
+	ProtocolOnline
+	ProtocolThresholdKeyGen
+	ProtocolRefill
+	ProtocolRunID
+)
+
+func (p ProtocolID) String() string {
+	switch p {
+	case ProtocolTripleGen:
+		return "tripleGen"
+	case ProtocolMHETripleGen:
+		return "mheTripleGen"
+	case ProtocolRkg:
+		return "rkg"
+	case ProtocolMACKeyGen:
+		return "macKeyGen"
+	case ProtocolTripleCheck:
+		return "tripleCheck"
+	case ProtocolOnline:
+		return "online"
+	case ProtocolThresholdKeyGen:
+		return "thresholdKeyGen"
+	case ProtocolRefill:
+		return "refill"
+	case ProtocolRunID:
+		return "runID"
+	}
+	return fmt.Sprintf("protocol-%d", uint8(p))
+}
+
+// Envelope is the wire format shared by all the protocol messages.
+type Envelope struct {
+	Protocol  ProtocolID
+	Run       RunID
+	Session   uint64
+	Batch     uint64
+	Round     uint64
+	Sender    PartyID
+	Receiver  PartyID
+	Payload   []byte
+	Signature []byte
+}
+
+func (env *Envelope) String() string {
+	signed := ""
+	if len(env.Signature) > 0 {
+		signed = ", signed"
+	}
+	return fmt.Sprintf("{%s/%d | batch %d, round %d from %d to %d, %d bytes%s}", env.Protocol, env.Session, env.Batch, env.Round, env.Sender, env.Receiver, len(env.Payload), signed)
+}
+
+// Len returns the length of the wire format of env.
+func (env *Envelope) Len() int {
+	return envelopeHeaderLen + len(env.Payload) + len(env.Signature)
+}
+
+// header encodes the header of env, but for the checksum.
+func (env *Envelope) header() []byte {
+	header := make([]byte, envelopeHeaderLen)
+	header[0] = EnvelopeVersion
+	header[1] = byte(env.Protocol)
+	copy(header[2:], env.Run[:])
+	binary.BigEndian.PutUint64(header[18:], env.Session)
+	binary.BigEndian.PutUint64(header[26:], env.Batch)
+	binary.BigEndian.PutUint64(header[34:], env.Round)
+	binary.BigEndian.PutUint64(header[42:], uint64(env.Sender))
+	binary.BigEndian.PutUint64(header[50:], uint64(env.Receiver))
+	binary.BigEndian.PutUint64(header[58:], uint64(len(env.Payload)))
+	header[66] = byte(len(env.Signature))
+	return header
+}
+
+// signedData returns the data signed by the sender.
+func (env *Envelope) signedData() []byte {
+	return append(env.header()[:envelopeSignedLen], env.Payload...)
+}
+
+// Sign signs env with the signing key of its sender.
+func (env *Envelope) Sign(key ed25519.PrivateKey) {
+	env.Signature = ed25519.Sign(key, env.signedData())
+}
+
+// Verify checks that env is signed with the signing key of its sender.
+func (env *Envelope) Verify(key ed25519.PublicKey) error {
+	if len(env.Signature) == 0 {
+		return fmt.Errorf("%w: %s is not signed", ErrInvalidSignature, env)
+	}
+	if !ed25519.Verify(key, env.signedData(), env.Signature) {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, env)
+	}
+	return nil
+}
+
+// WriteEnvelope encodes env to w with a single call to Write.
+func WriteEnvelope(w io.Writer, env *Envelope) error {
+	_, err := w.Write(env.MarshalBinary())
+	return err
+}
+
+// MarshalBinary encodes env to its wire format.
+func (env *Envelope) MarshalBinary() []byte {
+	buff := append(env.header(), env.Payload...)
+	buff = append(buff, env.Signature...)
+
+	crc := crc32.Update(crc32.Checksum(buff[:envelopeHeaderLen-4], crcTable), crcTable, buff[envelopeHeaderLen:])
+	binary.BigEndian.PutUint32(buff[envelopeHeaderLen-4:], crc)
+	return buff
+}
+
+// ReadEnvelope decodes the next envelope from r.
+func ReadEnvelope(r io.Reader) (*Envelope, error) {
+	header := make([]byte, envelopeHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != EnvelopeVersion {
+		return nil, fmt.Errorf("%w: %d", ErrEnvelopeVersion, header[0])
+	}
+
+	env := new(Envelope)
+	env.Protocol = ProtocolID(header[1])
+	copy(env.Run[:], header[2:])
+	env.Session = binary.BigEndian.Uint64(header[18:])
+	env.Batch = binary.BigEndian.Uint64(header[26:])
+	env.Round = binary.BigEndian.Uint64(header[34:])
+	env.Sender = PartyID(binary.BigEndian.Uint64(header[42:]))
+	env.Receiver = PartyID(binary.BigEndian.Uint64(header[50:]))
+	length := binary.BigEndian.Uint64(header[58:])
+	if length > MaxEnvelopePayload {
+		return nil, fmt.Errorf("%w: %d bytes", ErrEnvelopeTooLarge, length)
+	}
+
+	body := make([]byte, length+uint64(header[66]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	env.Payload = body[:length]
+	if header[66] > 0 {
+		env.Signature = body[length:]
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[:envelopeHeaderLen-4], crcTable), crcTable, body)
+	if crc != binary.BigEndian.Uint32(header[envelopeHeaderLen-4:]) {
+		return nil, ErrEnvelopeChecksum
+	}
+	return env, nil
+}
+
+// DumpEnvelopes decodes a capture of envelopes from r and prints them to w.
+func DumpEnvelopes(r io.Reader, w io.Writer) error {
+	for {
+		env, err := ReadEnvelope(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, env); err != nil {
+			return err
+		}
+	}
+}
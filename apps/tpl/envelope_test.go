@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		env    *Envelope
+		signed bool
+	}{
+		{"empty", &Envelope{Protocol: ProtocolTripleGen}, false},
+		{"header", &Envelope{Protocol: ProtocolOnline, Run: RunID{1, 2, 3}, Session: 1 << 40, Batch: 7, Round: 3, Sender: 2, Receiver: 5}, false},
+		{"payload", &Envelope{Protocol: ProtocolRkg, Session: 3, Round: 1, Sender: 1, Payload: []byte("payload")}, false},
+		{"signed", &Envelope{Protocol: ProtocolMHETripleGen, Run: RunID{9}, Batch: 4, Sender: 3, Receiver: 1, Payload: []byte("signed payload")}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.signed {
+				tc.env.Sign(key)
+			}
+			data := tc.env.MarshalBinary()
+			if len(data) != tc.env.Len() {
+				t.Fatalf("encoded %d bytes, Len is %d", len(data), tc.env.Len())
+			}
+			env, err := ReadEnvelope(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(env.Payload) == 0 {
+				env.Payload = tc.env.Payload
+			}
+			if !reflect.DeepEqual(env, tc.env) {
+				t.Fatalf("decoded %s instead of %s", env, tc.env)
+			}
+			if tc.signed {
+				if err := env.Verify(key.Public().(ed25519.PublicKey)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadEnvelopeErrors(t *testing.T) {
+	env := &Envelope{Protocol: ProtocolTripleGen, Session: 1, Sender: 1, Payload: []byte("payload")}
+	for _, tc := range []struct {
+		name   string
+		tamper func(data []byte) []byte
+		err    error
+	}{
+		{"version", func(data []byte) []byte {
+			data[0] = EnvelopeVersion - 1
+			return data
+		}, ErrEnvelopeVersion},
+		{"checksum", func(data []byte) []byte {
+			data[len(data)-1] ^= 1
+			return data
+		}, ErrEnvelopeChecksum},
+		{"header checksum", func(data []byte) []byte {
+			data[18] ^= 1
+			return data
+		}, ErrEnvelopeChecksum},
+		{"too large", func(data []byte) []byte {
+			binary.BigEndian.PutUint64(data[58:], MaxEnvelopePayload+1)
+			return data
+		}, ErrEnvelopeTooLarge},
+		{"truncated header", func(data []byte) []byte {
+			return data[:envelopeHeaderLen-1]
+		}, io.ErrUnexpectedEOF},
+		{"truncated payload", func(data []byte) []byte {
+			return data[:len(data)-1]
+		}, io.ErrUnexpectedEOF},
+		{"end", func(data []byte) []byte {
+			return nil
+		}, io.EOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadEnvelope(bytes.NewReader(tc.tamper(env.MarshalBinary())))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestEnvelopeVerify(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		tamper func(env *Envelope)
+		key    ed25519.PublicKey
+		err    error
+	}{
+		{"valid", func(env *Envelope) {}, public, nil},
+		{"unsigned", func(env *Envelope) { env.Signature = nil }, public, ErrInvalidSignature},
+		{"other key", func(env *Envelope) {}, other, ErrInvalidSignature},
+		{"payload", func(env *Envelope) { env.Payload[0] ^= 1 }, public, ErrInvalidSignature},
+		{"run", func(env *Envelope) { env.Run[0] ^= 1 }, public, ErrInvalidSignature},
+		{"session", func(env *Envelope) { env.Session++ }, public, ErrInvalidSignature},
+		{"batch", func(env *Envelope) { env.Batch++ }, public, ErrInvalidSignature},
+		{"round", func(env *Envelope) { env.Round++ }, public, ErrInvalidSignature},
+		{"receiver", func(env *Envelope) { env.Receiver++ }, public, ErrInvalidSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := &Envelope{Protocol: ProtocolOnline, Run: RunID{4}, Session: 2, Batch: 1, Round: 3, Sender: 1, Receiver: 2, Payload: []byte("payload")}
+			env.Sign(key)
+			tc.tamper(env)
+			if err := env.Verify(tc.key); !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+		})
+	}
+}
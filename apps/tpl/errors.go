@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+var (
+	ErrPeerClosed        = errors.New("peer closed the connection")
+	ErrUnexpectedMessage = errors.New("unexpected message")
+	ErrMalformedMessage  = errors.New("malformed message")
+	ErrTimeout           = errors.New("timed out waiting for message")
+	ErrCheckFailed       = errors.New("triple check failed")
+)
+
+// PeerError reports that the connection with a peer failed for good, or was
+// closed by the peer, after which nothing more is received from it.
+type PeerError struct {
+	Peer PartyID
+	Err  error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("party %d: %s", e.Peer, e.Err)
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// ProtocolError reports the failure of a protocol session because of the
+// message of a peer in a given batch and round, or the absence thereof.
+type ProtocolError struct {
+	Session SessionKey
+	Peer    PartyID
+	Batch   uint64
+	Round   uint64
+	Err     error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: batch %d, round %d with party %d: %s", e.Session, e.Batch, e.Round, e.Peer, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// step is a round of a batch of a protocol session.
+type step struct {
+	Batch, Round uint64
+}
+
+func (s step) before(other step) bool {
+	return s.Batch < other.Batch || (s.Batch == other.Batch && s.Round < other.Round)
+}
+
+// awaited tracks the peers from which a party still expects a message, by
+// batch and round.
+type awaited map[step]map[PartyID]bool
+
+// expect adds the peers to the ones expected to send a message in the round
+// of the batch.
+func (a awaited) expect(batch, round uint64, peers ...PartyID) {
+	s := step{Batch: batch, Round: round}
+	if a[s] == nil {
+		a[s] = make(map[PartyID]bool)
+	}
+	for _, peer := range peers {
+		a[s][peer] = true
+	}
+}
+
+// receive marks the message of peer in the round of the batch as received,
+// and returns false if it was not expected.
+func (a awaited) receive(peer PartyID, batch, round uint64) bool {
+	s := step{Batch: batch, Round: round}
+	if !a[s][peer] {
+		return false
+	}
+	delete(a[s], peer)
+	if len(a[s]) == 0 {
+		delete(a, s)
+	}
+	return true
+}
+
+// from returns the first step in which a message of peer is expected.
+func (a awaited) from(peer PartyID) (first step, expected bool) {
+	for s, peers := range a {
+		if peers[peer] && (!expected || s.before(first)) {
+			first, expected = s, true
+		}
+	}
+	return
+}
+
+// drop stops expecting messages from peer, and returns the steps in which
+// they were expected.
+func (a awaited) drop(peer PartyID) (steps []step) {
+	for s, peers := range a {
+		if peers[peer] {
+			steps = append(steps, s)
+			delete(peers, peer)
+			if len(peers) == 0 {
+				delete(a, s)
+			}
+		}
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].before(steps[j]) })
+	return steps
+}
+
+// first returns the lowest expected step and the lowest peer expected in it.
+func (a awaited) first() (peer PartyID, first step, expected bool) {
+	for s := range a {
+		if !expected || s.before(first) {
+			first, expected = s, true
+		}
+	}
+	if !expected {
+		return
+	}
+	peers := make([]PartyID, 0, len(a[first]))
+	for p := range a[first] {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers[0], first, true
+}
+
+// failure turns the error received from a session into the error of the
+// protocol, or returns nil if err concerns a peer from which nothing is
+// expected anymore.
+func (a awaited) failure(key SessionKey, err error) error {
+	var peerErr *PeerError
+	if !errors.As(err, &peerErr) {
+		return err
+	}
+	s, expected := a.from(peerErr.Peer)
+	if !expected {
+		return nil
+	}
+	return &ProtocolError{Session: key, Peer: peerErr.Peer, Batch: s.Batch, Round: s.Round, Err: peerErr.Err}
+}
+
+// timeout returns the error of a protocol that received nothing for READ_TIMEOUT.
+func (a awaited) timeout(key SessionKey) error {
+	peer, s, _ := a.first()
+	return &ProtocolError{Session: key, Peer: peer, Batch: s.Batch, Round: s.Round, Err: ErrTimeout}
+}
+
+// reportSendError keeps the first error of the sending loops of a protocol in errs.
+func reportSendError(errs chan error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+// checkPolyEncoding checks that data starts with the encoding of a polynomial
+// of the ring r, and returns the length of this encoding. The decoders of
+// lattigo trust the dimensions found in their input.
+func checkPolyEncoding(data []byte, r *ring.Ring) (int, error) {
+	n := 2 + 8*int(r.N)*len(r.Modulus)
+	if len(data) < n || int(data[0]) != bits.Len64(r.N)-1 || int(data[1]) != len(r.Modulus) {
+		return 0, fmt.Errorf("%w: invalid polynomial encoding", ErrMalformedMessage)
+	}
+	return n, nil
+}
+
+// checkElementsEncoding checks that data is the encoding of a ciphertext or a
+// share, that is a count of elements followed by the encoding of count
+// polynomials of r per element.
+func checkElementsEncoding(data []byte, r *ring.Ring, count, polys int) error {
+	if len(data) < 1 || int(data[0]) != count {
+		return fmt.Errorf("%w: expected %d elements", ErrMalformedMessage, count)
+	}
+	ptr := 1
+	for i := 0; i < count*polys; i++ {
+		n, err := checkPolyEncoding(data[ptr:], r)
+		if err != nil {
+			return err
+		}
+		ptr += n
+	}
+	if ptr != len(data) {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(data)-ptr)
+	}
+	return nil
+}
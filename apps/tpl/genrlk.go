@@ -1,11 +1,9 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"net"
-	"syscall"
 	"time"
 
 	"github.com/ldsec/lattigo/v2/bfv"
@@ -32,12 +30,16 @@ type RkgProtocol struct {
 	Chan     chan RkgGenMessage
 	Parent   *RkgGenRemote
 	Children map[PartyID]*RkgGenRemote
+
+	binding
 }
 
 type RkgGenMessage struct {
 	PartyID
 	Data  []byte
 	Round int
+
+	err error // failure of the session, in place of a message
 }
 
 type RkgGenRemote struct {
@@ -72,49 +74,64 @@ func (lp *LocalParty) NewRkgProtocol(params bfv.Parameters, sk *rlwe.SecretKey,
 	return
 }
 
-func (rkg *RkgProtocol) Run() (evakey *rlwe.RelinearizationKey) {
+// Run generates the relinearization key, which is returned to the root of the
+// tree only. It stops with an error if ctx is cancelled, if a peer fails, or
+// if nothing is received from the peers for READ_TIMEOUT.
+func (rkg *RkgProtocol) Run(ctx context.Context) (evakey *rlwe.RelinearizationKey, err error) {
 
 	rkg.RKGProtocol = dbfv.NewRKGProtocol(rkg.params)
 	rkg.u, rkg.share1, rkg.share2 = rkg.RKGProtocol.AllocateShares()
 
+	err = rkg.listen(ctx)
+	if errUnbind := rkg.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rkg.rlk, nil
+}
+
+func (rkg *RkgProtocol) listen(ctx context.Context) error {
+
 	var state int
 
+	waiting := make(awaited)
+
 	// Root
 	if rkg.Parent == nil {
 
-		// First generates a seed, computes the CRP and sends it to its Children
-		seed := []byte{'b', 'e', 'a', 'v', 'e', 'r', 's'}
-
-		prng, err := utils.NewKeyedPRNG(seed)
+		// First derives the seed, computes the CRP and sends it to its Children
+		seed := rkgSeed(rkg.session.mux.Run(), rkg.session.Session)
+		crp, err := rkg.genCRP(seed)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		crpGen := ring.NewUniformSampler(prng, rkg.params.RingQP())
-		crp := make([]*ring.Poly, rkg.params.Beta())
-
-		for i := uint64(0); i < rkg.params.Beta(); i++ {
-			crp[i] = crpGen.ReadNew()
-		}
-
 		rkg.crp = crp
 
 		// Sends the seed to the Children
 		for i := range rkg.Children {
 			rkg.Children[i].Chan <- RkgGenMessage{PartyID: rkg.ID, Data: seed, Round: 0}
-
+			waiting.expect(0, 1, rkg.Children[i].ID)
 		}
 
 		// And generates its Round1 share
 		rkg.GenShareRoundOne(rkg.SecretKey, crp, rkg.u, rkg.share1)
 
 		// Then listen
-		for m := range rkg.Chan {
+		for {
+			m, err := rkg.next(ctx, waiting)
+			if err != nil {
+				return err
+			}
 
 			// Recieves a Round1 share
 			if m.Round == 1 {
 				// We receive the Round1 share from the Children, and aggregate it with our own
 				//fmt.Println("Aggregate Share Round 1 from :", rkg.ID)
-				rkg.aggregateShareRound1(m.Data)
+				if err := rkg.aggregateShareRound1(m.Data); err != nil {
+					return rkg.messageError(m, err)
+				}
 				state++
 
 				// If we recieved from all the Children, then we compute our Round2 share and
@@ -125,6 +142,7 @@ func (rkg *RkgProtocol) Run() (evakey *rlwe.RelinearizationKey) {
 
 					for i := range rkg.Children {
 						rkg.Children[i].Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 2}
+						waiting.expect(0, 3, rkg.Children[i].ID)
 					}
 
 					//fmt.Println("Gen Share Round 2 from :", rkg.ID)
@@ -137,7 +155,9 @@ func (rkg *RkgProtocol) Run() (evakey *rlwe.RelinearizationKey) {
 
 			if m.Round == 3 {
 
-				rkg.aggregateShareRound2(m.Data)
+				if err := rkg.aggregateShareRound2(m.Data); err != nil {
+					return rkg.messageError(m, err)
+				}
 				state++
 
 				if state == len(rkg.Children) {
@@ -145,203 +165,247 @@ func (rkg *RkgProtocol) Run() (evakey *rlwe.RelinearizationKey) {
 					rkg.rlk = bfv.NewRelinearizationKey(rkg.params, 1)
 					rkg.GenRelinearizationKey(rkg.share1, rkg.share2, rkg.rlk)
 					fmt.Println("\t\tround 2 ok")
-					break
+					return nil
 				}
 			}
 		}
+	}
 
-		// Everyone else
-	} else {
+	// Everyone else
+	waiting.expect(0, 0, rkg.Parent.ID)
 
-		// Then listen on the Channel
-		for m := range rkg.Chan {
-			// Awaits the CRP seed
-			if m.Round == 0 {
+	// Then listen on the Channel
+	for {
+		m, err := rkg.next(ctx, waiting)
+		if err != nil {
+			return err
+		}
 
-				// Forwards the seed to the Children
-				for i := range rkg.Children {
-					rkg.Children[i].Chan <- m
-				}
+		// Awaits the CRP seed
+		if m.Round == 0 {
 
-				// Generates the CRP from the seed
-				prng, err := utils.NewKeyedPRNG(m.Data)
-				if err != nil {
-					panic(err)
-				}
-				crpGen := ring.NewUniformSampler(prng, rkg.params.RingQP())
+			// Forwards the seed to the Children
+			for i := range rkg.Children {
+				rkg.Children[i].Chan <- m
+				waiting.expect(0, 1, rkg.Children[i].ID)
+			}
 
-				crp := make([]*ring.Poly, rkg.params.Beta())
+			// Generates the CRP from the seed, which must be the one of the run
+			if len(m.Data) != SeedLen {
+				return rkg.messageError(m, fmt.Errorf("%w: seed of %d bytes", ErrMalformedMessage, len(m.Data)))
+			}
+			if !bytes.Equal(m.Data, rkgSeed(rkg.session.mux.Run(), rkg.session.Session)) {
+				return rkg.messageError(m, fmt.Errorf("%w: seed not derived from the run", ErrUnexpectedMessage))
+			}
+			crp, err := rkg.genCRP(m.Data)
+			if err != nil {
+				return rkg.messageError(m, err)
+			}
+			rkg.crp = crp
 
-				for i := uint64(0); i < rkg.params.Beta(); i++ {
-					crp[i] = crpGen.ReadNew()
-				}
+			// Generates the Round1 share
+			//fmt.Println("Gen Share Round 1 from :", rkg.ID)
+			rkg.GenShareRoundOne(rkg.SecretKey, crp, rkg.u, rkg.share1)
 
-				rkg.crp = crp
+			// If leaf, then directly broadcast Round1 share to the Parent
+			if len(rkg.Children) == 0 {
+				data, _ := rkg.share1.MarshalBinary()
+				rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 1}
+				waiting.expect(0, 2, rkg.Parent.ID)
+			}
+		}
 
-				// Generates the Round1 share
-				//fmt.Println("Gen Share Round 1 from :", rkg.ID)
-				rkg.GenShareRoundOne(rkg.SecretKey, crp, rkg.u, rkg.share1)
+		// Recieves a Round1 share
+		if m.Round == 1 {
 
-				// If leaf, then directly broadcast Round1 share to the Parent
-				if len(rkg.Children) == 0 {
-					data, _ := rkg.share1.MarshalBinary()
-					rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 1}
-				}
+			// We receive the Round1 share from the Children, and aggregate it with our own
+			//fmt.Println("Gen Share Round 1 from :", rkg.ID)
+			if err := rkg.aggregateShareRound1(m.Data); err != nil {
+				return rkg.messageError(m, err)
 			}
+			state++
+
+			// If we received from all the Children, then we send it to our Parent
+			if state == len(rkg.Children) {
+				data, _ := rkg.share1.MarshalBinary()
+				rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 1}
+				waiting.expect(0, 2, rkg.Parent.ID)
+				state = 0
+				fmt.Println("\t\tround 1 ok")
+			}
+		}
 
-			// Recieves a Round1 share
-			if m.Round == 1 {
+		// Recieves the aggregation of the Round1 shares
+		if m.Round == 2 {
 
-				// We receive the Round1 share from the Children, and aggregate it with our own
-				//fmt.Println("Gen Share Round 1 from :", rkg.ID)
-				rkg.aggregateShareRound1(m.Data)
-				state++
-
-				// If we received from all the Children, then we send it to our Parent
-				if state == len(rkg.Children) {
-					data, _ := rkg.share1.MarshalBinary()
-					rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 1}
-					state = 0
-					fmt.Println("\t\tround 1 ok")
-				}
+			// We update the share1 with the aggregated one
+			if err := rkg.checkShare(m.Data); err != nil {
+				return rkg.messageError(m, err)
+			}
+			if err := rkg.share1.UnmarshalBinary(m.Data); err != nil {
+				return rkg.messageError(m, err)
 			}
 
-			// Recieves the aggregation of the Round1 shares
-			if m.Round == 2 {
+			// Forwards the aggretated Round1 shares to the Children
+			for i := range rkg.Children {
+				rkg.Children[i].Chan <- m
+				waiting.expect(0, 3, rkg.Children[i].ID)
+			}
 
-				// Forwards the aggretated Round1 shares to the Children
-				for i := range rkg.Children {
-					rkg.Children[i].Chan <- m
-				}
+			// Computes Round2 share
+			//fmt.Println("Gen Share Round 1 from :", rkg.ID)
+			rkg.GenShareRoundTwo(rkg.u, rkg.SecretKey, rkg.share1, rkg.crp, rkg.share2)
 
-				// We update the share1 with the aggregated one
-				if err := rkg.share1.UnmarshalBinary(m.Data); err != nil {
-					panic(err)
-				}
+			// If leaf, then send directly Round2 share to the parent
+			if len(rkg.Children) == 0 {
+				data, _ := rkg.share2.MarshalBinary()
+				rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 3}
+				fmt.Println("\t\tround 2 ok")
+				return nil
+			}
+		}
 
-				// Computes Round2 share
-				//fmt.Println("Gen Share Round 1 from :", rkg.ID)
-				rkg.GenShareRoundTwo(rkg.u, rkg.SecretKey, rkg.share1, rkg.crp, rkg.share2)
+		// Recieves a Round2 share from a Children
+		if m.Round == 3 {
 
-				// If leaf, then send directly Round2 share to the parent
-				if len(rkg.Children) == 0 {
-					data, _ := rkg.share2.MarshalBinary()
-					rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 3}
-					fmt.Println("\t\tround 2 ok")
-					break
-				}
+			//fmt.Println("Aggregate Share Round 2 from :", rkg.ID)
+			if err := rkg.aggregateShareRound2(m.Data); err != nil {
+				return rkg.messageError(m, err)
 			}
+			state++
+
+			// If we received from all the Children, then we send it to our Parent
+			if state == len(rkg.Children) {
+				data, _ := rkg.share2.MarshalBinary()
+				rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 3}
+				state = 0
+				fmt.Println("\t\tround 2 ok")
+				return nil
+			}
+		}
+	}
+}
 
-			// Recieves a Round2 share from a Children
-			if m.Round == 3 {
+// rkgSeed returns the common seed of the CRP of the relinearization key
+// generated in a session of the run, so that it is not used with the secret
+// keys of another run.
+func rkgSeed(run RunID, session uint64) []byte {
+	return deriveRunSeed("relinearization key", run, session)
+}
 
-				//fmt.Println("Aggregate Share Round 2 from :", rkg.ID)
-				rkg.aggregateShareRound2(m.Data)
-				state++
+// genCRP returns the CRP read from the PRNG keyed with seed.
+func (rkg *RkgProtocol) genCRP(seed []byte) ([]*ring.Poly, error) {
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return nil, err
+	}
+	crpGen := ring.NewUniformSampler(prng, rkg.params.RingQP())
+	crp := make([]*ring.Poly, rkg.params.Beta())
+	for i := range crp {
+		crp[i] = crpGen.ReadNew()
+	}
+	return crp, nil
+}
 
-				// If we received from all the Children, then we send it to our Parent
-				if state == len(rkg.Children) {
-					data, _ := rkg.share2.MarshalBinary()
-					rkg.Parent.Chan <- RkgGenMessage{PartyID: rkg.ID, Data: data, Round: 3}
-					state = 0
-					fmt.Println("\t\tround 2 ok")
-					break
+// next returns the next expected message of the session, or the error that stops the protocol.
+func (rkg *RkgProtocol) next(ctx context.Context, waiting awaited) (RkgGenMessage, error) {
+	timer := time.NewTimer(READ_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-rkg.Chan:
+			if m.err != nil {
+				if err := waiting.failure(rkg.session.SessionKey, m.err); err != nil {
+					return m, err
 				}
+				continue
+			}
+			if !waiting.receive(m.PartyID, 0, uint64(m.Round)) {
+				return m, rkg.messageError(m, ErrUnexpectedMessage)
 			}
+			return m, nil
+		case err := <-rkg.sendErrs:
+			return RkgGenMessage{}, err
+		case <-timer.C:
+			return RkgGenMessage{}, waiting.timeout(rkg.session.SessionKey)
+		case <-ctx.Done():
+			return RkgGenMessage{}, ctx.Err()
 		}
 	}
-	return nil
 }
 
-func (rkg *RkgProtocol) aggregateShareRound1(data []byte) {
+func (rkg *RkgProtocol) messageError(m RkgGenMessage, err error) error {
+	return &ProtocolError{Session: rkg.session.SessionKey, Peer: m.PartyID, Round: uint64(m.Round), Err: err}
+}
+
+// checkShare checks that data is the encoding of a share of the protocol.
+func (rkg *RkgProtocol) checkShare(data []byte) error {
+	return checkElementsEncoding(data, rkg.params.RingQP(), int(rkg.params.Beta()), 2)
+}
+
+func (rkg *RkgProtocol) aggregateShareRound1(data []byte) error {
+	if err := rkg.checkShare(data); err != nil {
+		return err
+	}
 	share := new(drlwe.RKGShare)
 	if err := share.UnmarshalBinary(data); err != nil {
-		panic(err)
+		return err
 	}
 	rkg.RKGProtocol.AggregateShares(rkg.share1, share, rkg.share1)
+	return nil
 }
 
-func (rkg *RkgProtocol) aggregateShareRound2(data []byte) {
+func (rkg *RkgProtocol) aggregateShareRound2(data []byte) error {
+	if err := rkg.checkShare(data); err != nil {
+		return err
+	}
 	share := new(drlwe.RKGShare)
 	if err := share.UnmarshalBinary(data); err != nil {
-		panic(err)
+		return err
 	}
 	rkg.RKGProtocol.AggregateShares(rkg.share2, share, rkg.share2)
+	return nil
 }
 
-func (rkg *RkgProtocol) BindNetwork(nw *TCPNetworkStruct) {
-
-	var binds []*RkgGenRemote
+func (rkg *RkgProtocol) BindNetwork(sess *Session) {
+	rkg.bind(sess, func(env *Envelope, err error) bool {
+		var msg RkgGenMessage
+		if err == nil && env.Batch != 0 {
+			// The key is generated in a single batch
+			err = &ProtocolError{Session: sess.SessionKey, Peer: env.Sender, Batch: env.Batch, Round: env.Round, Err: ErrUnexpectedMessage}
+		}
+		if err != nil {
+			msg.err = err
+		} else {
+			msg = RkgGenMessage{
+				PartyID: env.Sender,
+				Data:    env.Payload,
+				Round:   int(env.Round),
+			}
+		}
+		select {
+		case rkg.Chan <- msg:
+			return true
+		case <-rkg.done:
+			return false
+		}
+	})
 
+	var remotes []*RkgGenRemote
 	if rkg.Parent != nil {
-		binds = append(binds, rkg.Parent)
+		remotes = append(remotes, rkg.Parent)
 	}
-
-	for _, i := range rkg.Children {
-		binds = append(binds, i)
+	for _, rp := range rkg.Children {
+		remotes = append(remotes, rp)
 	}
-
-	for _, rp := range binds {
-		conn := nw.Conns[rp.ID]
-
-		// Receiving loop from remote
-		go func(conn net.Conn, rp *RkgGenRemote) {
-
-			if conn == nil {
-				panic(fmt.Errorf("conn is nil for %s", rp.ID))
-			}
-
-			for {
-				var id uint64
-				var round uint64
-				var err error
-				var datalen uint64
-
-				err = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
-				if err != nil {
-					panic(fmt.Errorf("SetReadDeadline failed:", err))
+	for _, rp := range remotes {
+		rp := rp
+		rkg.startSending(func() { close(rp.Chan) }, func() {
+			for m := range rp.Chan {
+				if err := sess.Send(rp.ID, 0, uint64(m.Round), m.Data); err != nil {
+					reportSendError(rkg.sendErrs, &ProtocolError{Session: sess.SessionKey, Peer: rp.ID, Round: uint64(m.Round), Err: err})
 				}
-
-				err = binary.Read(conn, binary.BigEndian, &id)
-				if err != nil {
-					if err == io.EOF || err.Error() == syscall.ECONNRESET.Error() {
-						return
-					}
-					panic(err)
-				}
-				check(binary.Read(conn, binary.BigEndian, &datalen))
-
-				ctBuff := make([]byte, datalen, datalen)
-				_, err = io.ReadFull(conn, ctBuff)
-				check(err)
-				//check(ct.UnmarshalBinary(ctBuff))
-				check(binary.Read(conn, binary.BigEndian, &round))
-				msg := RkgGenMessage{
-					PartyID: PartyID(id),
-					Data:    ctBuff,
-					Round:   int(round),
-				}
-
-				//fmt.Println(rkg, "receiving", msg.Round, "from", rp.ID)
-
-				rkg.Chan <- msg
-			}
-		}(conn, rp)
-
-		// Sending loop of remote
-		go func(conn net.Conn, rp *RkgGenRemote) {
-			var m RkgGenMessage
-			var open = true
-			for open {
-				m, open = <-rp.Chan
-
-				//fmt.Println(rkg, "sending m round", m.Round, "to", rp.ID)
-				check(binary.Write(conn, binary.BigEndian, m.PartyID))
-				check(binary.Write(conn, binary.BigEndian, uint64(len(m.Data))))
-				_, err := conn.Write(m.Data)
-				check(err)
-				check(binary.Write(conn, binary.BigEndian, uint64(m.Round)))
 			}
-		}(conn, rp)
+		})
 	}
 }
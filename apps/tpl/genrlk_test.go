@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// TestRkgSeed checks that a party only generates its share of the
+// relinearization key from the CRP seed derived from the run and the session.
+func TestRkgSeed(t *testing.T) {
+	params := tplParameters(false)
+	sk := bfv.NewKeyGenerator(params).GenSecretKey()
+	peers := map[PartyID]string{0: "", 1: ""}
+	run := RunID{1}
+	for _, tc := range []struct {
+		name string
+		seed []byte
+		err  error
+	}{
+		{"run seed", rkgSeed(run, 0), context.DeadlineExceeded},
+		{"short seed", []byte("beavers"), ErrMalformedMessage},
+		{"other session", rkgSeed(run, 1), ErrUnexpectedMessage},
+		{"other run", rkgSeed(RunID{2}, 0), ErrUnexpectedMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp, err := NewLocalParty(1, peers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := newMux(lp, nil)
+			mux.SetRun(run)
+			sent := make(chan *Envelope, 1)
+			mux.outbox = func(to PartyID, env *Envelope) error {
+				sent <- env
+				return nil
+			}
+			sess := openSession(t, mux, ProtocolRkg, 0)
+			rkg := lp.NewRkgProtocol(params, sk, NewTree(peers, 2))
+			rkg.BindNetwork(sess)
+			sess.deliver(&Envelope{Protocol: ProtocolRkg, Run: run, Round: 0, Sender: 0, Receiver: 1, Payload: tc.seed})
+
+			// With the seed of the run, the leaf sends its share and waits
+			// for the aggregated one
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if _, err := rkg.Run(ctx); !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+			if shared := len(sent) > 0; shared != (tc.err == context.DeadlineExceeded) {
+				t.Fatalf("share sent: %v", shared)
+			}
+		})
+	}
+}
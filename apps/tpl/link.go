@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame types of the links. A data frame carries an envelope and its sequence
+// number, an ack frame the sequence number of the next data frame expected by
+// its sender, and a fin frame announces that its sender closes the link.
+const (
+	frameData byte = 'D'
+	frameAck  byte = 'A'
+	frameFin  byte = 'F'
+)
+
+// CLOSE_TIMEOUT is the maximum time a link waits for its last messages to be
+// acknowledged when closing.
+const CLOSE_TIMEOUT = 10 * time.Second
+
+type frame struct {
+	seq  uint64
+	data []byte
+}
+
+// link reliably delivers the envelopes exchanged with a peer, despite the
+// failures of the underlying connection. Each data frame is numbered and kept
+// until the peer acknowledges it. When the connection fails, the link asks
+// the network to reconnect and retransmits the unacknowledged frames, which
+// the peer deduplicates by their sequence number.
+type link struct {
+	mux  *Mux
+	peer PartyID
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	conn       net.Conn
+	gen        uint64 // generation of conn, incremented by each reconnection
+	readerDone chan struct{}
+
+	nextSeq uint64   // sequence number of the next frame to send
+	sentSeq uint64   // sequence number of the next frame to write to conn
+	highSeq uint64   // sequence number following the last frame written to any conn
+	unacked []*frame // frames not acknowledged yet, by increasing sequence number
+	recvSeq uint64   // sequence number of the next frame expected from the peer
+	ackDue  bool
+
+	broken     bool
+	closing    bool
+	closed     bool
+	peerClosed bool
+	err        error // set when the link failed for good
+
+	done chan struct{}
+}
+
+func newLink(mux *Mux, peer PartyID, conn net.Conn) *link {
+	l := &link{mux: mux, peer: peer, conn: conn, done: make(chan struct{})}
+	l.cond = sync.NewCond(&l.lock)
+	l.readerDone = make(chan struct{})
+	go l.receive(conn, l.gen, l.readerDone)
+	go l.write()
+	return l
+}
+
+// send queues env for delivery to the peer.
+func (l *link) send(env *Envelope) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err != nil {
+		return &PeerError{Peer: l.peer, Err: l.err}
+	}
+	if l.closing || l.closed {
+		return fmt.Errorf("link with party %d is closed", l.peer)
+	}
+	if l.peerClosed {
+		return fmt.Errorf("party %d closed the connection", l.peer)
+	}
+	l.unacked = append(l.unacked, &frame{seq: l.nextSeq, data: env.MarshalBinary()})
+	l.nextSeq++
+	l.cond.Broadcast()
+	return nil
+}
+
+// close sends the fin frame once all the frames are acknowledged, and
+// closes the connection.
+func (l *link) close() {
+	l.lock.Lock()
+	l.closing = true
+	l.cond.Broadcast()
+	l.lock.Unlock()
+
+	select {
+	case <-l.done:
+	case <-time.After(CLOSE_TIMEOUT):
+		l.lock.Lock()
+		l.closed = true
+		l.cond.Broadcast()
+		l.lock.Unlock()
+		fmt.Println(l.mux.LocalParty, "closing link with party", l.peer, "with", len(l.unacked), "unacknowledged messages")
+	}
+	l.conn.Close()
+}
+
+// fail marks the link as broken if the connection of generation gen is
+// still in use.
+func (l *link) fail(gen uint64, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if gen != l.gen || l.closed || l.peerClosed || l.broken {
+		return
+	}
+	fmt.Println(l.mux.LocalParty, "lost connection with party", l.peer, ":", err)
+	l.broken = true
+	l.cond.Broadcast()
+}
+
+// abort closes the link for good after an unrecoverable error, and reports
+// it to the sessions.
+func (l *link) abort(err error) {
+	l.lock.Lock()
+	if l.err == nil && !l.closed {
+		l.err = err
+		l.closed = true
+		l.cond.Broadcast()
+	}
+	l.lock.Unlock()
+	l.mux.peerFailed(l.peer, err)
+}
+
+// reject aborts the link after the peer broke the protocol, and closes its
+// connection.
+func (l *link) reject(err error) {
+	l.abort(err)
+	l.lock.Lock()
+	conn := l.conn
+	l.lock.Unlock()
+	conn.Close()
+}
+
+func (l *link) receive(conn net.Conn, gen uint64, done chan struct{}) {
+	defer close(done)
+	r := bufio.NewReader(conn)
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			l.fail(gen, err)
+			return
+		}
+
+		switch typ {
+		case frameData:
+			var seq uint64
+			if err := binary.Read(r, binary.BigEndian, &seq); err != nil {
+				l.fail(gen, err)
+				return
+			}
+			env, err := ReadEnvelope(r)
+			if err != nil {
+				l.fail(gen, err)
+				return
+			}
+
+			l.lock.Lock()
+			if seq != l.recvSeq {
+				l.ackDue = true
+				l.cond.Broadcast()
+				l.lock.Unlock()
+				if seq > l.recvSeq {
+					l.fail(gen, fmt.Errorf("expected message %d, got %d", l.recvSeq, seq))
+					return
+				}
+				continue // retransmission of a frame already delivered
+			}
+			l.recvSeq++
+			l.ackDue = true
+			l.cond.Broadcast()
+			l.lock.Unlock()
+
+			if err := l.mux.dispatch(l.peer, env); err != nil {
+				l.abort(err)
+				conn.Close()
+				return
+			}
+
+		case frameAck:
+			var ack uint64
+			if err := binary.Read(r, binary.BigEndian, &ack); err != nil {
+				l.fail(gen, err)
+				return
+			}
+			l.lock.Lock()
+			// A peer cannot acknowledge a frame that was never written, and
+			// may acknowledge the frames that a reconnection rewound
+			if ack > l.highSeq {
+				high := l.highSeq
+				l.lock.Unlock()
+				l.abort(fmt.Errorf("%w: party %d acknowledged message %d, only %d sent", ErrUnexpectedMessage, l.peer, ack, high))
+				conn.Close()
+				return
+			}
+			for len(l.unacked) > 0 && l.unacked[0].seq < ack {
+				l.unacked = l.unacked[1:]
+			}
+			if ack > l.sentSeq {
+				l.sentSeq = ack
+			}
+			l.cond.Broadcast()
+			l.lock.Unlock()
+
+		case frameFin:
+			l.lock.Lock()
+			l.peerClosed = true
+			l.cond.Broadcast()
+			l.lock.Unlock()
+			l.mux.peerFailed(l.peer, ErrPeerClosed)
+			return
+
+		default:
+			l.fail(gen, fmt.Errorf("unknown frame type %d", typ))
+			return
+		}
+	}
+}
+
+// ready returns whether the writer has something to do.
+func (l *link) ready() bool {
+	if l.closed || l.broken {
+		return true
+	}
+	if l.peerClosed {
+		return l.closing
+	}
+	return l.ackDue || l.sentSeq < l.nextSeq || (l.closing && len(l.unacked) == 0)
+}
+
+func (l *link) write() {
+	defer close(l.done)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for {
+		for !l.ready() {
+			l.cond.Wait()
+		}
+
+		if l.closed {
+			return
+		}
+
+		if l.peerClosed {
+			l.closed = true
+			return
+		}
+
+		if l.broken {
+			if !l.reconnect() {
+				return
+			}
+			continue
+		}
+
+		var buff []byte
+		if l.ackDue {
+			buff = append(buff, frameAck)
+			buff = appendUint64(buff, l.recvSeq)
+			l.ackDue = false
+		}
+		for ; l.sentSeq < l.nextSeq; l.sentSeq++ {
+			f := l.unacked[l.sentSeq-l.unacked[0].seq]
+			buff = append(buff, frameData)
+			buff = appendUint64(buff, f.seq)
+			buff = append(buff, f.data...)
+		}
+		if l.sentSeq > l.highSeq {
+			l.highSeq = l.sentSeq
+		}
+		fin := l.closing && len(l.unacked) == 0
+		if fin {
+			buff = append(buff, frameFin)
+		}
+
+		conn, gen := l.conn, l.gen
+		l.lock.Unlock()
+		_, err := conn.Write(buff)
+		l.lock.Lock()
+
+		if err != nil {
+			l.lock.Unlock()
+			l.fail(gen, err)
+			l.lock.Lock()
+			continue
+		}
+
+		if fin {
+			l.closed = true
+			return
+		}
+	}
+}
+
+// reconnect replaces the broken connection, and rewinds the link to the first
+// unacknowledged frame. It is called with the lock held.
+func (l *link) reconnect() bool {
+	oldConn, readerDone := l.conn, l.readerDone
+	l.lock.Unlock()
+	oldConn.Close()
+	<-readerDone
+	conn, err := l.mux.nw.Reconnect(l.peer)
+	l.lock.Lock()
+
+	if l.closed {
+		if conn != nil {
+			conn.Close()
+		}
+		return false
+	}
+	if err != nil {
+		l.err = fmt.Errorf("cannot reconnect: %w", err)
+		l.closed = true
+		l.cond.Broadcast()
+		l.lock.Unlock()
+		l.mux.peerFailed(l.peer, l.err)
+		l.lock.Lock()
+		return false
+	}
+
+	l.conn = conn
+	l.gen++
+	l.broken = false
+	l.ackDue = true
+	if len(l.unacked) > 0 {
+		l.sentSeq = l.unacked[0].seq
+	}
+	l.readerDone = make(chan struct{})
+	go l.receive(conn, l.gen, l.readerDone)
+
+	fmt.Printf("%s reconnected with party %d, resending %d messages\n", l.mux.LocalParty, l.peer, l.nextSeq-l.sentSeq)
+	return true
+}
+
+func appendUint64(buff []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buff, b[:]...)
+}
+
+// DumpFrames decodes a capture of the frames sent on a link from r and
+// prints them to w.
+func DumpFrames(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	for {
+		typ, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var seq uint64
+		switch typ {
+		case frameData:
+			if err := binary.Read(br, binary.BigEndian, &seq); err != nil {
+				return err
+			}
+			env, err := ReadEnvelope(br)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, "data", seq, env)
+		case frameAck:
+			if err := binary.Read(br, binary.BigEndian, &seq); err != nil {
+				return err
+			}
+			fmt.Fprintln(w, "ack", seq)
+		case frameFin:
+			fmt.Fprintln(w, "fin")
+		default:
+			return fmt.Errorf("unknown frame type %d", typ)
+		}
+	}
+}
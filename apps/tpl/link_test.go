@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// noReconnect is a network whose connections cannot be replaced.
+type noReconnect struct{ Network }
+
+func (noReconnect) Reconnect(id PartyID) (net.Conn, error) {
+	return nil, errors.New("no reconnection")
+}
+
+// TestLinkBogusAck checks that a peer that acknowledges frames not sent yet
+// fails the link, instead of pruning frames that the link would then write.
+func TestLinkBogusAck(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ack  uint64
+		err  error
+	}{
+		{"sent", 1, nil},
+		{"not sent", 5, ErrUnexpectedMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp, err := NewLocalParty(0, map[PartyID]string{0: "", 1: ""})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := newMux(lp, noReconnect{})
+			sess := openSession(t, mux, ProtocolRunID, 0)
+			local, remote := net.Pipe()
+			defer remote.Close()
+			mux.links[1] = newLink(mux, 1, local)
+			defer local.Close()
+
+			if err := sess.Send(1, 0, 0, []byte("payload")); err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(remote)
+			if typ, err := r.ReadByte(); err != nil || typ != frameData {
+				t.Fatalf("read frame %q, error %v", typ, err)
+			}
+			var seq uint64
+			if err := binary.Read(r, binary.BigEndian, &seq); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ReadEnvelope(r); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := remote.Write(appendUint64([]byte{frameAck}, tc.ack)); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.err == nil {
+				// The link writes the next frames
+				if err := sess.Send(1, 0, 1, []byte("payload")); err != nil {
+					t.Fatal(err)
+				}
+				if typ, err := r.ReadByte(); err != nil || typ != frameData {
+					t.Fatalf("read frame %q, error %v", typ, err)
+				}
+				return
+			}
+			var peerErr *PeerError
+			if _, err := sess.Recv(); !errors.As(err, &peerErr) || !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+			if err := sess.Send(1, 0, 1, []byte("payload")); !errors.Is(err, tc.err) {
+				t.Fatalf("sent after the failure of the link, error %v", err)
+			}
+		})
+	}
+}
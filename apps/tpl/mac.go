@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// macKeySeed returns the common seed of the CRP of the encryptions of the
+// shares of the MAC key generated in a session of the run. The secret key of
+// a party is the same for all the sessions of a run, so the seed is derived
+// with the run and the session, so that its CRP is not used twice with it.
+func macKeySeed(run RunID, session uint64) []byte {
+	return deriveRunSeed("mac key", run, session)
+}
+
+// MACKey is the share of a party of the global MAC key alpha, which is the
+// sum of the shares of all the parties. An authenticated value x is shared
+// along with a share of its MAC alpha*x. Enc is the encryption of alpha under
+// the collective secret key, which only the root of the tree holds.
+type MACKey struct {
+	Share uint64
+	Enc   *bfv.Ciphertext
+}
+
+// MACKeyGenProtocol generates the shares of the MAC key of the parties, and
+// aggregates their encryptions up the tree to the root, as the MHE triple
+// generation does for enc(a) and enc(b).
+type MACKeyGenProtocol struct {
+	*LocalParty
+	bfv.Encoder
+	bfv.Encryptor
+
+	Chan     chan MHETripleGenMessage
+	Parent   *MHETripleGenRemote
+	Children map[PartyID]*MHETripleGenRemote
+
+	binding
+
+	rq     *ring.Ring
+	params bfv.Parameters
+}
+
+func (lp *LocalParty) NewMACKeyGenProtocol(params bfv.Parameters, sk *rlwe.SecretKey, tree Tree) *MACKeyGenProtocol {
+	mkg := new(MACKeyGenProtocol)
+	mkg.LocalParty = lp
+	mkg.Encoder = bfv.NewEncoder(params)
+	mkg.Encryptor = bfv.NewEncryptorFromSk(params, sk)
+	mkg.rq = params.RingQ()
+	mkg.params = params
+
+	mkg.Chan = make(chan MHETripleGenMessage, 32)
+
+	if lp.ID != tree[lp.ID].Parent {
+		mkg.Parent = &MHETripleGenRemote{
+			ID:   tree[lp.ID].Parent,
+			Chan: make(chan MHETripleGenMessage, 32),
+		}
+	}
+
+	mkg.Children = make(map[PartyID]*MHETripleGenRemote)
+	for _, child := range tree[lp.ID].Children {
+		mkg.Children[child] = &MHETripleGenRemote{
+			ID:   child,
+			Chan: make(chan MHETripleGenMessage, 32),
+		}
+	}
+	return mkg
+}
+
+// Run samples the share of the MAC key of the party, and returns it, along
+// with the encryption of the MAC key at the root of the tree. It stops with an
+// error if ctx is cancelled, if a peer fails, or if nothing is received from
+// the peers for READ_TIMEOUT.
+func (mkg *MACKeyGenProtocol) Run(ctx context.Context) (*MACKey, error) {
+	key, err := mkg.listen(ctx)
+	if errUnbind := mkg.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (mkg *MACKeyGenProtocol) listen(ctx context.Context) (*MACKey, error) {
+
+	// Each party encrypts its share in every slot, with the CRP derived from the common seed
+	key := &MACKey{Share: sampleUniformVector(1, mkg.params.T())[0]}
+	shares := make([]uint64, mkg.params.N())
+	for i := range shares {
+		shares[i] = key.Share
+	}
+	plain := bfv.NewPlaintext(mkg.params)
+	mkg.EncodeUint(shares, plain)
+	seed := macKeySeed(mkg.session.mux.Run(), mkg.session.Session)
+	enc, seeded, err := EncryptSeeded(mkg.Encryptor, mkg.rq, plain, seed, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Then aggregates the encryptions of its Children with its own
+	waiting := make(awaited)
+	for _, child := range mkg.Children {
+		waiting.expect(0, 0, child.ID)
+	}
+	for range mkg.Children {
+		m, err := mkg.next(ctx, waiting)
+		if err != nil {
+			return nil, err
+		}
+		scts, err := UnmarshalSeededCiphertexts(m.Data, mkg.rq, 1)
+		if err == nil && (!bytes.Equal(scts[0].Seed, seed) || scts[0].Index != 0) {
+			err = fmt.Errorf("%w: ciphertext not derived from the common seed", ErrMalformedMessage)
+		}
+		if err != nil {
+			return nil, mkg.messageError(m, err)
+		}
+		mkg.rq.Add(enc.Value[0], scts[0].C0, enc.Value[0])
+	}
+
+	// And relays the aggregation to its Parent, unless it is the root
+	if mkg.Parent != nil {
+		data, _ := seeded.MarshalBinary()
+		mkg.Parent.Chan <- MHETripleGenMessage{PartyID: mkg.ID, Data: data}
+	} else {
+		key.Enc = enc
+	}
+	return key, nil
+}
+
+// next returns the next expected message of the session, or the error that stops the protocol.
+func (mkg *MACKeyGenProtocol) next(ctx context.Context, waiting awaited) (MHETripleGenMessage, error) {
+	timer := time.NewTimer(READ_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-mkg.Chan:
+			if m.err != nil {
+				if err := waiting.failure(mkg.session.SessionKey, m.err); err != nil {
+					return m, err
+				}
+				continue
+			}
+			if !waiting.receive(m.PartyID, m.Batch, uint64(m.Round)) {
+				return m, mkg.messageError(m, ErrUnexpectedMessage)
+			}
+			return m, nil
+		case err := <-mkg.sendErrs:
+			return MHETripleGenMessage{}, err
+		case <-timer.C:
+			return MHETripleGenMessage{}, waiting.timeout(mkg.session.SessionKey)
+		case <-ctx.Done():
+			return MHETripleGenMessage{}, ctx.Err()
+		}
+	}
+}
+
+func (mkg *MACKeyGenProtocol) messageError(m MHETripleGenMessage, err error) error {
+	return &ProtocolError{Session: mkg.session.SessionKey, Peer: m.PartyID, Batch: m.Batch, Round: uint64(m.Round), Err: err}
+}
+
+func (mkg *MACKeyGenProtocol) BindNetwork(sess *Session) {
+	var remotes []*MHETripleGenRemote
+	if mkg.Parent != nil {
+		remotes = append(remotes, mkg.Parent)
+	}
+	for _, rp := range mkg.Children {
+		remotes = append(remotes, rp)
+	}
+	mkg.bindMessages(sess, mkg.Chan, remotes, nil)
+}
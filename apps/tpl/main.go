@@ -1,161 +1,541 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/ldsec/lattigo/v2/bfv"
 )
 
 func main() {
-	prog := os.Args[0]
-	args := os.Args[1:]
+	topologyFile := flag.String("topology", "", "JSON file listing the parties with their listen and dial addresses")
+	local := flag.Bool("local", false, "run all the parties in this process over an in-process network")
+	nSessions := flag.Int("sessions", 1, "number of triple generation sessions to run concurrently over the same connections")
+	statsFile := flag.String("stats", "", "JSON file to write the communication breakdown by session, round, peer and direction to")
+	wan := flag.String("wan", "", "emulated profile of all the links, as latency=10ms,bandwidth=100Mbps[,jitter=1ms][,loss=0.001]")
+	coordinatorAddr := flag.String("coordinator", "", "address of the coordinator to join, or to listen on with coordinate")
+	listen := flag.String("listen", fmt.Sprintf(":%d", BasePort), "address to listen on for the other parties, with join")
+	advertise := flag.String("addr", "", "address the other parties dial to reach this party, with join (default: as seen by the coordinator)")
+	nTriple := flag.Uint64("triples", 8192, "number of triples to generate in each session, by batches of the ring degree")
+	mac := flag.Bool("mac", false, "generate triples authenticated by MACs under a collectively generated MAC key (mhe only)")
+	threshold := flag.Int("threshold", 0, "generate the triples with any threshold of the parties, excluding the ones that fail or straggle (mhe only, default all the parties)")
+	zk := flag.Bool("zk", false, "prove the queries and responses of the triple generation in zero knowledge, and verify the ones of the peers (he only)")
+	smudging := flag.Int("smudging", SMUDGING_SECURITY, "statistical security, in bits, of the smudging noise that floods the noise of the responses of he and of the decryption shares of mhe")
+	checkMode := flag.String("check", "", "check the generated triples by sacrificing half of them (sacrifice) or by opening a random sample of them (sample)")
+	circuitSpec := flag.String("circuit", "", fmt.Sprintf("circuit evaluated by the online phase, or to generate the triples of, as a JSON file or a test circuit from 1 to %d (default 1 with online)", len(TestCircuits)))
+	storeFile := flag.String("store", "", "file of the triple store to append the generated triples to (suffixed by _p[party ID] with -local)")
+	produceMarks := flag.String("produce", "", "produce triples in the background until interrupted, refilling the inventory of each party once below low up to high triples given as low,high, while taking -triples triples at a time from it (he and mhe)")
+	transcriptFile := flag.String("transcript", "", "file to record the messages sent and received by the party to (suffixed by _p[party ID] with -local)")
+	flag.Usage = func() {
+		fmt.Println("Usage:", os.Args[0], "[-topology file] [he|mhe] [party ID] [n party]")
+		fmt.Println("      ", os.Args[0], "-local [-topology file] [he|mhe] [n party]")
+		fmt.Println("      ", os.Args[0], "[-local] [-topology file] -store file [-circuit file|n] online [party ID] [n party]")
+		fmt.Println("      ", os.Args[0], "-topology file gencerts [dir]")
+		fmt.Println("      ", os.Args[0], "-topology file genkeys [dir]")
+		fmt.Println("      ", os.Args[0], "-topology file relay")
+		fmt.Println("      ", os.Args[0], "[-coordinator addr] coordinate [proto] [n party]")
+		fmt.Println("      ", os.Args[0], "-coordinator addr [-listen addr] [-addr addr] [-topology file] join")
+		fmt.Println("      ", os.Args[0], "dump [capture file]")
+		fmt.Println("      ", os.Args[0], "replay [transcript file] [session]")
+		fmt.Println("      ", os.Args[0], "store [store file]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) == 2 && args[0] == "gencerts" && *topologyFile != "" {
+		topo, err := LoadTopology(*topologyFile)
+		if err == nil {
+			err = GenerateCertificates(topo, args[1])
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	if len(args) < 3 {
-		fmt.Println("Usage:", prog, "[proto] [party ID] [n party]")
-		os.Exit(1)
+	if len(args) == 2 && args[0] == "genkeys" && *topologyFile != "" {
+		topo, err := LoadTopology(*topologyFile)
+		if err == nil {
+			err = GenerateSigningKeys(topo, args[1])
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	mhe := args[0] == "mhe"
+	if len(args) == 1 && args[0] == "relay" && *topologyFile != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		topo, err := LoadTopology(*topologyFile)
+		if err == nil {
+			err = RunRelay(ctx, topo)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var wanProfile *LinkProfile
+	if *wan != "" {
+		var err error
+		if wanProfile, err = ParseLinkProfile(*wan); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 
-	partyID, errPartyID := strconv.ParseUint(args[1], 10, 64)
-	if errPartyID != nil {
-		fmt.Println("Party ID should be an unsigned integer")
+	tripleCheck, err := ParseTripleCheck(*checkMode)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	nParties, errNParty := strconv.ParseUint(args[2], 10, 64)
-	if errNParty != nil {
-		fmt.Println("n party should be an unsigned integer")
+	if *nSessions < 1 || *nTriple < 1 {
+		fmt.Println("the numbers of sessions and triples should be positive")
 		os.Exit(1)
 	}
 
-	nTriple := uint64(8192)
+	// The protocols are cancelled on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if (len(args) == 2 || len(args) == 3) && args[0] == "replay" {
+		t, err := LoadTranscript(args[1])
+		if err == nil && len(args) == 2 {
+			err = ListTranscript(t, os.Stdout)
+		} else if err == nil {
+			var key SessionKey
+			if key, err = ParseSessionKey(args[2]); err == nil {
+				err = ReplayTranscript(ctx, t, key, tplParameters(t.authenticated()))
+			}
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	if mhe {
-		ClientMHETripleGen(PartyID(partyID), nParties, nTriple)
+	if len(args) == 3 && args[0] == "coordinate" || len(args) == 1 && args[0] == "join" {
+		var reports []*CommReport
+		if args[0] == "coordinate" {
+			reports, err = RunCoordinator(ctx, *coordinatorAddr, args[1], args[2], *nTriple, *nSessions, *mac, tripleCheck, *threshold, *zk, *smudging, wanProfile)
+		} else if *coordinatorAddr == "" {
+			err = fmt.Errorf("the -coordinator option is required to join")
+		} else {
+			var certs *Topology
+			if *topologyFile != "" {
+				certs, err = LoadTopology(*topologyFile)
+			}
+			if err == nil {
+				var report *CommReport
+				report, err = RunJoin(ctx, defaultCoordinatorAddr(*coordinatorAddr), Registration{Listen: *listen, Addr: *advertise}, certs, *transcriptFile, *storeFile)
+				reports = append(reports, report)
+			}
+		}
+		if err == nil && *statsFile != "" {
+			err = WriteCommReports(*statsFile, reports)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
 		return
 	}
-	ClientHETripleGen(PartyID(partyID), nParties, nTriple)
-	//Client(PartyID(partyID), TestCircuits[circuitNum-1])
-}
 
-const BasePort = 50000
+	if len(args) == 2 && args[0] == "store" {
+		ts, err := LoadTripleStore(args[1])
+		if err == nil {
+			err = PrintTripleStore(ts, os.Stdout)
+			ts.Close()
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 
-func ClientHETripleGen(partyID PartyID, nParties, nTriples uint64) {
+	if len(args) == 2 && args[0] == "dump" {
+		f, err := os.Open(args[1])
+		if err == nil {
+			err = DumpFrames(f, os.Stdout)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	fmt.Println("> Init")
+	// In local mode, there is no party ID on the command line
+	nArgs := 3
+	if *local {
+		nArgs = 2
+	}
+	if len(args) < nArgs-1 || (len(args) < nArgs && *topologyFile == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	mhe := args[0] == "mhe"
+	if *mac && !mhe {
+		fmt.Println("authenticated triples are only generated by mhe")
+		os.Exit(1)
+	}
+	if *zk && args[0] != "he" {
+		fmt.Println("the queries and responses are only proven by he")
+		os.Exit(1)
+	}
+	if *smudging < 1 {
+		fmt.Println("the statistical security of the smudging noise should be positive")
+		os.Exit(1)
+	}
 
-	peers := make(map[PartyID]string)
-	for i := uint64(0); i < nParties; i++ {
-		peers[PartyID(i)] = fmt.Sprintf("mpc-party-%d:50000", i)
+	var produce *WaterMarks
+	if *produceMarks != "" {
+		if args[0] != "he" && args[0] != "mhe" {
+			fmt.Println("the triples are only produced in the background by he and mhe")
+			os.Exit(1)
+		}
+		if *storeFile != "" {
+			fmt.Println("the triples produced in the background are not stored")
+			os.Exit(1)
+		}
+		if produce, err = ParseWaterMarks(*produceMarks); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *nTriple > produce.Low {
+			fmt.Println("the triples taken at once should not exceed the low-water mark")
+			os.Exit(1)
+		}
 	}
 
-	lp, err := NewLocalParty(PartyID(partyID), peers)
-	check(err)
-	netTripleGen, err := NewTCPNetwork(lp)
-	check(err)
+	var partyID uint64
+	if !*local {
+		var errPartyID error
+		partyID, errPartyID = strconv.ParseUint(args[1], 10, 64)
+		if errPartyID != nil {
+			fmt.Println("Party ID should be an unsigned integer")
+			os.Exit(1)
+		}
+	}
 
-	fmt.Print("\testablishing connections...")
-	err = netTripleGen.Connect(lp)
-	check(err)
-	fmt.Println(" done")
+	var topo *Topology
+	if *topologyFile != "" {
+		if topo, err = LoadTopology(*topologyFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if len(args) >= nArgs {
+		nParties, errNParty := strconv.ParseUint(args[nArgs-1], 10, 64)
+		if errNParty != nil {
+			fmt.Println("n party should be an unsigned integer")
+			os.Exit(1)
+		}
+		if topo == nil {
+			topo = NewDockerTopology(nParties)
+		} else if nParties != uint64(topo.NumParties()) {
+			fmt.Println("n party does not match the number of parties in the topology")
+			os.Exit(1)
+		}
+	}
+
+	if wanProfile != nil {
+		topo.WAN = wanProfile
+	}
+
+	if err := checkThreshold(*threshold, topo.NumParties(), mhe, *mac, tripleCheck); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := checkThresholdTopology(*threshold, topo, *local); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var circuit *Circuit
+	if *circuitSpec == "" && args[0] == "online" {
+		*circuitSpec = "1"
+	}
+	if *circuitSpec != "" {
+		if circuit, err = LoadCircuitSpec(*circuitSpec, topo.NumParties()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	// The triples generated for a circuit are its triple demand, unless -triples is set
+	tripleFlag := false
+	flag.Visit(func(f *flag.Flag) { tripleFlag = tripleFlag || f.Name == "triples" })
+	if circuit != nil && args[0] != "online" && !tripleFlag {
+		demand := circuit.Multiplications()
+		if *mac {
+			demand += circuit.Inputs()
+		}
+		if demand == 0 {
+			fmt.Println("the circuit has no multiplication to generate triples for")
+			os.Exit(1)
+		}
+		*nTriple = (demand + uint64(*nSessions) - 1) / uint64(*nSessions)
+		fmt.Printf("generating %d triples in each of %d sessions for %s\n", *nTriple, *nSessions, circuit.Name)
+	}
+
+	params := tplParameters(*mac)
+	tree := NewTree(topo.Peers(), 2)
+	var client PartyClient
+	switch args[0] {
+	case "mhe":
+		client = func(ctx context.Context, lp *LocalParty, netw Network) (*CommReport, error) {
+			return ClientMHETripleGen(ctx, lp, tree, netw, params, *nTriple, *nSessions, *mac, tripleCheck, *threshold, *smudging, produce)
+		}
+	case "online":
+		client = func(ctx context.Context, lp *LocalParty, netw Network) (*CommReport, error) {
+			return ClientOnline(ctx, lp, tree, netw, params.T(), circuit)
+		}
+	default:
+		client = func(ctx context.Context, lp *LocalParty, netw Network) (*CommReport, error) {
+			return ClientHETripleGen(ctx, lp, netw, params, *nTriple, *nSessions, tripleCheck, *zk, *smudging, produce)
+		}
+	}
+
+	var reports []*CommReport
+	if *local {
+		reports, err = RunLocal(ctx, topo, client, params.T(), *transcriptFile, *storeFile)
+	} else {
+		var report *CommReport
+		report, err = RunParty(ctx, topo, PartyID(partyID), client, params.T(), *transcriptFile, *storeFile)
+		reports = append(reports, report)
+	}
+
+	if err == nil && *statsFile != "" {
+		err = WriteCommReports(*statsFile, reports)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
 
+const BasePort = 50000
+
+// SMUDGING_SECURITY is the default statistical security, in bits, of the
+// smudging noise that floods the noise of the ciphertexts a party reveals.
+const SMUDGING_SECURITY = 40
+
+// tplParameters returns the parameters of the triple generation. The MACs of
+// the authenticated triples are products of depth 2, alpha*a*b, for which
+// PN13QP218 has no noise budget left.
+func tplParameters(authenticated bool) bfv.Parameters {
 	paramsDef := bfv.PN13QP218
+	if authenticated {
+		paramsDef = bfv.PN14QP438
+	}
 	paramsDef.T = uint64(4294475777)
 	params, err := bfv.NewParametersFromLiteral(paramsDef)
 	if err != nil {
 		panic(err)
 	}
+	return params
+}
+
+// ClientHETripleGen runs nSessions concurrent sessions of the triple generation
+// protocol over the network of lp, with proofs of the queries and responses if
+// zk is set and smudging bits of statistical security for the smudging noise,
+// followed by the check of their triples if any, and returns its communication
+// report. If produce is set, it instead produces triples in the background
+// between these water marks, with runProducer.
+func ClientHETripleGen(ctx context.Context, lp *LocalParty, netw Network, params bfv.Parameters, nTriples uint64, nSessions int, tripleCheck TripleCheck, zk bool, smudging int, produce *WaterMarks) (*CommReport, error) {
+
+	fmt.Println("> Init")
+
+	// Every party sends its queries to every other party
+	edges := FullMesh(lp.Peers)
+	fmt.Print("\testablishing connections...")
+	if err := netw.Connect(ctx, lp, edges); err != nil {
+		return nil, err
+	}
+	fmt.Println(" done")
+	mux := NewMux(lp, netw)
+
+	// The triples are checked, and the run agreed, along a tree whose edges
+	// are in the full mesh
+	peers := make(map[PartyID]string, len(lp.Peers))
+	for id := range lp.Peers {
+		peers[id] = ""
+	}
+	tree := NewTree(peers, 2)
+	if err := agreeRun(ctx, lp, mux, params.T(), tree); err != nil {
+		return nil, err
+	}
+
 	sk := bfv.NewKeyGenerator(params).GenSecretKey()
-	tripleGenProtocol := lp.NewTripleGenProtocol(params, sk)
-	tripleGenProtocol.BindNetwork(netTripleGen)
 
-	fmt.Println("> Triple Generation Phase")
-	tripleGenStart := time.Now()
-	tripleGenProtocol.Run(nTriples)
-	tripleGenTime := time.Since(tripleGenStart)
+	g := &tripleGeneration{lp: lp, mux: mux, tree: tree, t: params.T(), protocol: ProtocolTripleGen, check: tripleCheck,
+		newGenerator: func() tripleGenerator {
+			tripleGenProtocol := lp.NewTripleGenProtocol(params, sk)
+			tripleGenProtocol.ZK = zk
+			tripleGenProtocol.SmudgingSecurity = smudging
+			return tripleGenProtocol
+		},
+	}
 
-	triples := make([]Triple, 0, nTriples)
-	for t := range tripleGenProtocol.Triples {
-		triples = append(triples, t)
+	if produce != nil {
+		fmt.Println("> Triple Production")
+		return runProducer(ctx, g, netw, *produce, nTriples, nSessions, nil)
 	}
 
-	sent, received := netTripleGen.Sum()
+	fmt.Println("> Triple Generation Phase")
+	sessions, checkSessions, triples, elapsed, err := g.run(ctx, nSessions, nTriples)
+	if err == nil && lp.Store != nil {
+		err = storeTriples(lp.Store, sessions, triples, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Printf("\tdone\n")
-	fmt.Println("Time:", tripleGenTime.Nanoseconds())
-	fmt.Println("Comm:", sent+received)
+	printGeneration(sessions, checkSessions, elapsed)
+	return NewCommReport(lp, netw, append(sessions, checkSessions...)), nil
 }
 
-func ClientMHETripleGen(partyID PartyID, nParties, nTriples uint64) {
+// ClientMHETripleGen runs the relinearization key generation, the MAC key
+// generation if the triples are authenticated, the threshold key generation
+// if threshold is set, and then nSessions concurrent sessions of the MHE
+// triple generation protocol over the network of lp, with smudging bits of
+// statistical security for the smudging noise, and returns its communication
+// report. The triples of the sessions are then checked, if tripleCheck is set. If
+// produce is set, the setup is followed by the production of triples in the
+// background between these water marks, with runProducer.
+func ClientMHETripleGen(ctx context.Context, lp *LocalParty, tree Tree, netw Network, params bfv.Parameters, nTriples uint64, nSessions int, authenticated bool, tripleCheck TripleCheck, threshold int, smudging int, produce *WaterMarks) (*CommReport, error) {
 
 	fmt.Println("> Init")
-	peers := make(map[PartyID]string)
-	for i := uint64(0); i < nParties; i++ {
-		peers[PartyID(i)] = fmt.Sprintf("mpc-party-%d:50000", i)
-	}
-
-	tree := NewTree(peers, 2)
-
-	lp, err := NewLocalParty(PartyID(partyID), peers)
-	check(err)
-	netRLKGen, err := NewTCPNetwork(lp)
-	check(err)
-	netTripleGen, err := NewTCPNetwork(lp)
-	check(err)
 
+	// The parties only communicate with their parent and children in the tree,
+	// except for the sharing of the threshold key
+	edges := tree.Edges()
+	if threshold > 0 {
+		edges = FullMesh(lp.Peers)
+	}
 	fmt.Print("\testablishing connections...")
-	err = netRLKGen.Connect(lp)
-	check(err)
+	if err := netw.Connect(ctx, lp, edges); err != nil {
+		return nil, err
+	}
 	fmt.Println(" done")
+	mux := NewMux(lp, netw)
+	if err := agreeRun(ctx, lp, mux, params.T(), tree); err != nil {
+		return nil, err
+	}
 
 	fmt.Println("> MHE Setup")
-	paramsDef := bfv.PN13QP218
-	paramsDef.T = uint64(4294475777)
-	params, err := bfv.NewParametersFromLiteral(paramsDef)
-	if err != nil {
-		panic(err)
-	}
 
 	sk := bfv.NewKeyGenerator(params).GenSecretKey()
 
 	fmt.Println("\tgenerating the relinearization key...")
+	rlkGenSession, err := mux.Session(ProtocolRkg, 0)
+	if err != nil {
+		mux.Close()
+		return nil, err
+	}
 	rlkGenProtocol := lp.NewRkgProtocol(params, sk, tree)
-	rlkGenProtocol.BindNetwork(netRLKGen)
+	rlkGenProtocol.BindNetwork(rlkGenSession)
 	rlkGenStart := time.Now()
-	rlkGenProtocol.Run()
-	rlkGenTime := time.Since(rlkGenStart)
-	rlk := rlkGenProtocol.rlk
+	rlk, err := rlkGenProtocol.Run(ctx)
+	if err != nil {
+		mux.Close()
+		return nil, err
+	}
 	fmt.Println("\tdone")
+	setupSessions := []*Session{rlkGenSession}
+
+	var macKey *MACKey
+	if authenticated {
+		fmt.Println("\tgenerating the MAC key...")
+		macKeyGenSession, err := mux.Session(ProtocolMACKeyGen, 0)
+		if err != nil {
+			mux.Close()
+			return nil, err
+		}
+		macKeyGenProtocol := lp.NewMACKeyGenProtocol(params, sk, tree)
+		macKeyGenProtocol.BindNetwork(macKeyGenSession)
+		if macKey, err = macKeyGenProtocol.Run(ctx); err != nil {
+			mux.Close()
+			return nil, err
+		}
+		fmt.Println("\tdone")
+		setupSessions = append(setupSessions, macKeyGenSession)
+	}
 
-	fmt.Println("> Triple Generation Phase")
+	var thresholdKey *ThresholdKey
+	if threshold > 0 {
+		fmt.Printf("\tgenerating the %d-out-of-%d threshold key...\n", threshold, len(lp.Peers))
+		thresholdKeyGenSession, err := mux.Session(ProtocolThresholdKeyGen, 0)
+		if err != nil {
+			mux.Close()
+			return nil, err
+		}
+		thresholdKeyGenProtocol := lp.NewThresholdKeyGenProtocol(params, sk, threshold, tree)
+		thresholdKeyGenProtocol.BindNetwork(thresholdKeyGenSession)
+		if thresholdKey, err = thresholdKeyGenProtocol.Run(ctx); err != nil {
+			mux.Close()
+			return nil, err
+		}
+		fmt.Println("\tdone")
+		setupSessions = append(setupSessions, thresholdKeyGenSession)
+	}
+	setupTime := time.Since(rlkGenStart)
+
+	g := &tripleGeneration{lp: lp, mux: mux, tree: tree, t: params.T(), protocol: ProtocolMHETripleGen, check: tripleCheck,
+		newGenerator: func() tripleGenerator {
+			tripleGenProtocol := lp.NewMHETripleGenProtocol(params, sk, rlk, tree)
+			tripleGenProtocol.MACKey = macKey
+			tripleGenProtocol.ThresholdKey = thresholdKey
+			tripleGenProtocol.SmudgingSecurity = smudging
+			return tripleGenProtocol
+		},
+	}
 
-	fmt.Print("\testablishing connections...")
-	err = netTripleGen.Connect(lp)
-	check(err)
-	fmt.Println(" done")
+	if produce != nil {
+		fmt.Println("Setup Time:", setupTime.Nanoseconds())
+		fmt.Println("> Triple Production")
+		return runProducer(ctx, g, netw, *produce, nTriples, nSessions, setupSessions)
+	}
+
+	fmt.Println("> Triple Generation Phase")
 
 	fmt.Println("\tgenerating the triples...")
-	tripleGenProtocol := lp.NewMHETripleGenProtocol(params, sk, rlk, tree)
-	tripleGenProtocol.BindNetwork(netTripleGen)
-	triples := make([]Triple, 0, nTriples)
-	tripleGenStart := time.Now()
-	tripleGenProtocol.Run(nTriples)
-	tripleGenTime := time.Since(tripleGenStart)
-	for t := range tripleGenProtocol.Triples {
-		triples = append(triples, t)
+	sessions, checkSessions, triples, elapsed, err := g.run(ctx, nSessions, nTriples)
+	if err == nil && lp.Store != nil {
+		err = storeTriples(lp.Store, sessions, triples, macKey)
+	}
+	if err != nil {
+		return nil, err
 	}
 	fmt.Println("\tdone")
 
-	fmt.Println("Setup Time:", rlkGenTime.Nanoseconds())
-	sent, received := netRLKGen.Sum()
-	fmt.Println("Setup Comm:", sent+received)
-	fmt.Println("Time:", tripleGenTime.Nanoseconds())
-	sent, received = netTripleGen.Sum()
-	fmt.Println("Comm:", sent+received)
-
-	<-time.After(1 * time.Second)
+	fmt.Println("Setup Time:", setupTime.Nanoseconds())
+	var setupComm uint64
+	for _, sess := range setupSessions {
+		sent, received := sess.Sum()
+		setupComm += sent + received
+	}
+	fmt.Println("Setup Comm:", setupComm)
+	printGeneration(sessions, checkSessions, elapsed)
+	return NewCommReport(lp, netw, append(append(setupSessions, sessions...), checkSessions...)), nil
 }
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// SessionKey identifies a logical session multiplexed over a Network.
+type SessionKey struct {
+	Protocol ProtocolID
+	Session  uint64
+}
+
+func (sk SessionKey) String() string {
+	return fmt.Sprintf("%s/%d", sk.Protocol, sk.Session)
+}
+
+// MAX_PENDING_SESSIONS bounds the number of sessions that the peers open
+// before the local party does.
+const MAX_PENDING_SESSIONS = 256
+
+// MAX_PENDING_BYTES bounds the size of the envelopes that a peer sends in the
+// sessions the local party has not opened yet.
+const MAX_PENDING_BYTES = 1 << 30
+
+var ErrPendingOverflow = errors.New("too many envelopes for sessions not opened")
+
+// ErrSessionReused is returned when opening a session on the key of a session
+// that was closed before, whose seeds a protocol would use again.
+var ErrSessionReused = errors.New("session already run")
+
+// ErrSessionClosed fails a peer that sends an envelope of a closed session.
+var ErrSessionClosed = errors.New("envelope of a closed session")
+
+// Mux carries several protocol sessions at once over the connections of a
+// single Network. It receives the envelopes of every peer over a link and
+// dispatches them to their session, which buffers them until the protocol
+// consumes them. The envelopes received before the local party agreed on the
+// run with AgreeRunID are queued until it does. A peer that sends more than
+// MAX_PENDING_BYTES in sessions that the local party has not opened yet, or
+// before it agreed on the run, or that opens more than MAX_PENDING_SESSIONS
+// sessions, fails, as does a peer that sends an envelope of another run than
+// the one agreed.
+type Mux struct {
+	*LocalParty
+	nw Network
+
+	lock         sync.Mutex
+	sessions     map[SessionKey]*Session
+	closed       map[SessionKey]bool // whether the late envelopes are dropped
+	peerErrs     map[PartyID]error
+	pending      int // sessions not opened by the local party
+	pendingBytes map[PartyID]int
+
+	links map[PartyID]*link
+
+	run      RunID
+	agreed   chan struct{}   // closed once the run is set
+	early    []earlyEnvelope // received before the run was set
+	draining bool            // whether SetRun delivers the early envelopes
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// outbox, when set, receives the envelopes sent in place of the links
+	outbox func(to PartyID, env *Envelope) error
+}
+
+// NewMux starts dispatching the envelopes received on the connections of nw,
+// which should already be connected.
+func NewMux(lp *LocalParty, nw Network) *Mux {
+	mux := newMux(lp, nw)
+	for id := range lp.Peers {
+		if id == lp.ID {
+			continue
+		}
+		if conn := nw.Conn(id); conn != nil {
+			mux.links[id] = newLink(mux, id, conn)
+		}
+	}
+	return mux
+}
+
+func newMux(lp *LocalParty, nw Network) *Mux {
+	return &Mux{
+		LocalParty: lp,
+		nw:         nw,
+		sessions:   make(map[SessionKey]*Session),
+		closed:     make(map[SessionKey]bool),
+		peerErrs:   make(map[PartyID]error),
+		links:      make(map[PartyID]*link),
+		agreed:     make(chan struct{}),
+
+		pendingBytes: make(map[PartyID]int),
+	}
+}
+
+// Close closes the links once the peers acknowledged all the messages sent
+// to them, and then closes the network. It returns the error of the first
+// call on the next ones.
+func (mux *Mux) Close() error {
+	mux.closeOnce.Do(func() {
+		wg := new(sync.WaitGroup)
+		for _, l := range mux.links {
+			wg.Add(1)
+			go func(l *link) {
+				l.close()
+				wg.Done()
+			}(l)
+		}
+		wg.Wait()
+		mux.closeErr = mux.nw.Close()
+	})
+	return mux.closeErr
+}
+
+type earlyEnvelope struct {
+	peer PartyID
+	env  *Envelope
+}
+
+func (mux *Mux) dispatch(peer PartyID, env *Envelope) error {
+	if env.Sender != peer {
+		return fmt.Errorf("%w: party %d sent %s on behalf of party %d", ErrUnexpectedMessage, peer, env, env.Sender)
+	}
+	if env.Receiver != mux.ID {
+		return fmt.Errorf("%w: party %d sent %s to party %d", ErrUnexpectedMessage, peer, env, mux.ID)
+	}
+	// The envelopes of the peers with a verification key must be signed
+	if rp, known := mux.Peers[peer]; known && rp.VerifyKey != nil {
+		if err := env.Verify(rp.VerifyKey); err != nil {
+			return err
+		}
+	}
+	// The envelopes of the other protocols belong to the run agreed by the
+	// parties, and those of a peer that agreed first are queued until the
+	// local party does
+	if env.Protocol != ProtocolRunID {
+		mux.lock.Lock()
+		early := mux.draining
+		select {
+		case <-mux.agreed:
+		default:
+			early = true
+		}
+		if early {
+			defer mux.lock.Unlock()
+			if mux.pendingBytes[peer]+env.Len() > MAX_PENDING_BYTES {
+				return fmt.Errorf("%w: party %d sent more than %d bytes before the run was agreed", ErrPendingOverflow, peer, MAX_PENDING_BYTES)
+			}
+			mux.pendingBytes[peer] += env.Len()
+			mux.early = append(mux.early, earlyEnvelope{peer: peer, env: env})
+			return nil
+		}
+		mux.lock.Unlock()
+	}
+	return mux.deliver(peer, env)
+}
+
+// deliver delivers the envelope received from peer to its session.
+func (mux *Mux) deliver(peer PartyID, env *Envelope) error {
+	if env.Protocol != ProtocolRunID && env.Run != mux.run {
+		return fmt.Errorf("%w: party %d sent %s of run %s instead of %s", ErrUnexpectedMessage, peer, env, env.Run, mux.run)
+	}
+
+	key := SessionKey{Protocol: env.Protocol, Session: env.Session}
+	mux.lock.Lock()
+	if dropLate, closed := mux.closed[key]; closed {
+		mux.lock.Unlock()
+		if dropLate {
+			return nil
+		}
+		return fmt.Errorf("%w: party %d sent %s", ErrSessionClosed, peer, env)
+	}
+	sess, exists := mux.sessions[key]
+	if !exists && mux.pending >= MAX_PENDING_SESSIONS {
+		mux.lock.Unlock()
+		return fmt.Errorf("%w: party %d opened %s beyond %d sessions", ErrPendingOverflow, peer, key, MAX_PENDING_SESSIONS)
+	}
+	if !exists {
+		sess = mux.session(key)
+		mux.pending++
+	}
+	if !sess.opened {
+		if mux.pendingBytes[peer]+env.Len() > MAX_PENDING_BYTES {
+			mux.lock.Unlock()
+			return fmt.Errorf("%w: party %d sent more than %d bytes", ErrPendingOverflow, peer, MAX_PENDING_BYTES)
+		}
+		mux.pendingBytes[peer] += env.Len()
+		sess.pendingBytes[peer] += env.Len()
+	}
+	mux.lock.Unlock()
+
+	sess.deliver(env)
+	return nil
+}
+
+// SetRun sets the run of the envelopes sent and received by mux, once the
+// parties agreed on it, and delivers the envelopes received before, in order.
+// A peer that sent envelopes of another run fails.
+func (mux *Mux) SetRun(id RunID) {
+	mux.lock.Lock()
+	mux.run = id
+	close(mux.agreed)
+	mux.draining = true
+	mux.lock.Unlock()
+
+	failed := make(map[PartyID]bool)
+	for {
+		mux.lock.Lock()
+		if len(mux.early) == 0 {
+			mux.draining = false
+			mux.lock.Unlock()
+			return
+		}
+		e := mux.early[0]
+		mux.early = mux.early[1:]
+		mux.pendingBytes[e.peer] -= e.env.Len()
+		mux.lock.Unlock()
+
+		if failed[e.peer] {
+			continue
+		}
+		if err := mux.deliver(e.peer, e.env); err != nil {
+			failed[e.peer] = true
+			if l, known := mux.links[e.peer]; known {
+				l.reject(err)
+			} else {
+				mux.peerFailed(e.peer, err)
+			}
+		}
+	}
+}
+
+// Run returns the run of the envelopes, or the zero ID before the parties
+// agreed on it.
+func (mux *Mux) Run() RunID {
+	select {
+	case <-mux.agreed:
+		return mux.run
+	default:
+		return RunID{}
+	}
+}
+
+// peerFailed reports to the current and future sessions that nothing more
+// will be received from peer.
+func (mux *Mux) peerFailed(peer PartyID, err error) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	peerErr := &PeerError{Peer: peer, Err: err}
+	mux.peerErrs[peer] = peerErr
+	for _, sess := range mux.sessions {
+		sess.fail(peerErr)
+	}
+}
+
+// Session returns the session identified by protocol and id, creating it
+// if needed. The envelopes received before the session was opened are
+// delivered to it. It returns ErrSessionReused if a session of the same key
+// was closed.
+func (mux *Mux) Session(protocol ProtocolID, id uint64) (*Session, error) {
+	key := SessionKey{Protocol: protocol, Session: id}
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	if _, closed := mux.closed[key]; closed {
+		return nil, fmt.Errorf("%w: %s", ErrSessionReused, key)
+	}
+	sess, exists := mux.sessions[key]
+	if !exists {
+		sess = mux.session(key)
+	} else if !sess.opened {
+		// The envelopes of the peers no longer count as pending
+		mux.pending--
+		for peer, n := range sess.pendingBytes {
+			mux.pendingBytes[peer] -= n
+		}
+		sess.pendingBytes = nil
+	}
+	sess.opened = true
+	return sess, nil
+}
+
+func (mux *Mux) session(key SessionKey) *Session {
+	sess, exists := mux.sessions[key]
+	if !exists {
+		sess = &Session{
+			SessionKey: key,
+			mux:        mux,
+			sent:       make(map[commKey]*CommStats),
+			received:   make(map[commKey]*CommStats),
+
+			pendingBytes: make(map[PartyID]int),
+		}
+		sess.cond = sync.NewCond(&sess.lock)
+		for _, err := range mux.peerErrs {
+			sess.failures = append(sess.failures, err)
+		}
+		mux.sessions[key] = sess
+	}
+	return sess
+}
+
+// Sessions returns the sessions opened so far.
+func (mux *Mux) Sessions() (sessions []*Session) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	for _, sess := range mux.sessions {
+		sessions = append(sessions, sess)
+	}
+	return
+}
+
+func (mux *Mux) send(to PartyID, env *Envelope) error {
+	if mux.outbox != nil {
+		return mux.outbox(to, env)
+	}
+	l, known := mux.links[to]
+	if !known {
+		return fmt.Errorf("%s: no connection with party %d", mux.LocalParty, to)
+	}
+	return l.send(env)
+}
+
+func (mux *Mux) closeSession(key SessionKey, dropLate bool) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+	mux.closed[key] = dropLate
+	delete(mux.sessions, key)
+}
+
+// Session is a logical stream of envelopes of a protocol instance.
+type Session struct {
+	SessionKey
+	mux *Mux
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []*Envelope
+	failures []error
+	closed   bool
+
+	opened       bool            // whether the local party opened the session
+	dropLate     bool            // whether the envelopes received once closed are dropped
+	pendingBytes map[PartyID]int // received from each peer before it was opened
+
+	sent, received map[commKey]*CommStats
+}
+
+// Send sends the payload to party to, as the given round of a batch of the session.
+func (sess *Session) Send(to PartyID, batch, round uint64, payload []byte) error {
+	env := &Envelope{
+		Protocol: sess.Protocol,
+		Run:      sess.mux.Run(),
+		Session:  sess.Session,
+		Batch:    batch,
+		Round:    round,
+		Sender:   sess.mux.ID,
+		Receiver: to,
+		Payload:  payload,
+	}
+	if sess.mux.SigningKey != nil {
+		env.Sign(sess.mux.SigningKey)
+	}
+	if err := sess.mux.send(to, env); err != nil {
+		return err
+	}
+	sess.lock.Lock()
+	sess.stats(sess.sent, to, round).add(env.Len())
+	if sess.mux.Transcript != nil {
+		sess.mux.Transcript.Record(env)
+	}
+	sess.lock.Unlock()
+	return nil
+}
+
+// stats returns the entry of the peer and round in stats, creating it if
+// needed. It is called with the lock held.
+func (sess *Session) stats(stats map[commKey]*CommStats, peer PartyID, round uint64) *CommStats {
+	key := commKey{Peer: peer, Round: round}
+	cs, exists := stats[key]
+	if !exists {
+		cs = new(CommStats)
+		stats[key] = cs
+	}
+	return cs
+}
+
+func (sess *Session) deliver(env *Envelope) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	sess.stats(sess.received, env.Sender, env.Round).add(env.Len())
+	if sess.mux.Transcript != nil {
+		sess.mux.Transcript.Record(env)
+	}
+	sess.queue = append(sess.queue, env)
+	sess.cond.Signal()
+}
+
+func (sess *Session) fail(err *PeerError) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	sess.failures = append(sess.failures, err)
+	sess.cond.Signal()
+}
+
+// Recv returns the next envelope received in the session. Once the envelopes
+// received from a peer are consumed, it returns a *PeerError if the connection
+// with this peer failed or was closed. It returns io.EOF once the session is
+// closed.
+func (sess *Session) Recv() (*Envelope, error) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	for len(sess.queue) == 0 && len(sess.failures) == 0 && !sess.closed {
+		sess.cond.Wait()
+	}
+	if sess.closed {
+		return nil, io.EOF
+	}
+	if len(sess.queue) == 0 {
+		err := sess.failures[0]
+		sess.failures = sess.failures[1:]
+		return nil, err
+	}
+	env := sess.queue[0]
+	sess.queue = sess.queue[1:]
+	return env, nil
+}
+
+// DropLate drops the envelopes that the peers send once the session is
+// closed, for the protocols that do not wait for all of them, instead of
+// failing these peers.
+func (sess *Session) DropLate() {
+	sess.lock.Lock()
+	sess.dropLate = true
+	sess.lock.Unlock()
+}
+
+// Close stops the delivery of envelopes to the session.
+func (sess *Session) Close() {
+	sess.lock.Lock()
+	dropLate := sess.dropLate
+	sess.lock.Unlock()
+	sess.mux.closeSession(sess.SessionKey, dropLate)
+	sess.lock.Lock()
+	sess.closed = true
+	sess.queue = nil
+	sess.cond.Broadcast()
+	sess.lock.Unlock()
+}
+
+// Sum returns the bytes sent and received in the session.
+func (sess *Session) Sum() (sent, received uint64) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	for _, cs := range sess.sent {
+		sent += cs.Bytes
+	}
+	for _, cs := range sess.received {
+		received += cs.Bytes
+	}
+	return
+}
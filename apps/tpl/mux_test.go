@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func openSession(t *testing.T, mux *Mux, protocol ProtocolID, id uint64) *Session {
+	sess, err := mux.Session(protocol, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// closeCounter is a network that counts its closings.
+type closeCounter struct {
+	Network
+	closes int
+}
+
+func (nw *closeCounter) Close() error {
+	nw.closes++
+	return errors.New("closed")
+}
+
+func TestMuxCloseTwice(t *testing.T) {
+	lp, err := NewLocalParty(0, map[PartyID]string{0: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nw := new(closeCounter)
+	mux := newMux(lp, nw)
+	first := mux.Close()
+	if err := mux.Close(); err != first {
+		t.Fatalf("got error %v instead of %v", err, first)
+	}
+	if nw.closes != 1 {
+		t.Fatalf("network closed %d times", nw.closes)
+	}
+}
+
+// TestMuxEarlyEnvelopes checks that the envelopes received before the local
+// party agreed on the run are queued without blocking, and delivered in order
+// once it does, unless they belong to another run.
+func TestMuxEarlyEnvelopes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		run  RunID
+		err  error
+	}{
+		{"agreed run", RunID{1}, nil},
+		{"other run", RunID{2}, ErrUnexpectedMessage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp, err := NewLocalParty(0, map[PartyID]string{0: "", 1: ""})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := newMux(lp, nil)
+			for round := uint64(0); round < 3; round++ {
+				env := &Envelope{Protocol: ProtocolTripleCheck, Run: tc.run, Round: round, Sender: 1, Receiver: 0}
+				if err := mux.dispatch(1, env); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sess := openSession(t, mux, ProtocolTripleCheck, 0)
+			mux.SetRun(RunID{1})
+
+			if tc.err != nil {
+				if _, err := sess.Recv(); !errors.Is(err, tc.err) {
+					t.Fatalf("got error %v instead of %v", err, tc.err)
+				}
+				return
+			}
+			for round := uint64(0); round < 3; round++ {
+				env, err := sess.Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if env.Round != round {
+					t.Fatalf("got round %d instead of %d", env.Round, round)
+				}
+			}
+			if n := mux.pendingBytes[1]; n != 0 {
+				t.Fatalf("%d bytes still pending", n)
+			}
+		})
+	}
+}
+
+// TestMuxSessionReused checks that no protocol can open a session on the key
+// of a closed session, whose seeds it would use again, and that a peer that
+// sends an envelope of a closed session fails, unless its late envelopes are
+// dropped.
+func TestMuxSessionReused(t *testing.T) {
+	lp, err := NewLocalParty(0, map[PartyID]string{0: "", 1: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newMux(lp, nil)
+	mux.SetRun(RunID{1})
+	for _, protocol := range []ProtocolID{ProtocolTripleGen, ProtocolMHETripleGen, ProtocolTripleCheck, ProtocolOnline} {
+		openSession(t, mux, protocol, 0).Close()
+		if _, err := mux.Session(protocol, 0); !errors.Is(err, ErrSessionReused) {
+			t.Errorf("%s: got error %v instead of %v", protocol, err, ErrSessionReused)
+		}
+		openSession(t, mux, protocol, 1)
+	}
+
+	env := &Envelope{Protocol: ProtocolOnline, Run: RunID{1}, Sender: 1, Receiver: 0}
+	if err := mux.dispatch(1, env); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("got error %v instead of %v", err, ErrSessionClosed)
+	}
+	sess := openSession(t, mux, ProtocolOnline, 2)
+	sess.DropLate()
+	sess.Close()
+	env.Session = 2
+	if err := mux.dispatch(1, env); err != nil {
+		t.Fatal(err)
+	}
+}
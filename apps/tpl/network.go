@@ -1,46 +1,117 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const CONNECT_ATTEMPTS = 5
 const CONNECT_ATTEMPTS_DELAY = 1000
 
+// Reconnections are attempted RECONNECT_ATTEMPTS times, with a delay starting
+// at RECONNECT_BACKOFF and doubling after each attempt.
+const RECONNECT_ATTEMPTS = 8
+const RECONNECT_BACKOFF = 100 * time.Millisecond
+
 type Network interface {
-	Connect(party *LocalParty) error
+	// Connect establishes the connections of party with its peers in edges,
+	// or returns an error once ctx is cancelled.
+	Connect(ctx context.Context, party *LocalParty, edges Edges) error
+	Conn(id PartyID) net.Conn
+	// Reconnect replaces the connection with party id after it failed.
+	Reconnect(id PartyID) (net.Conn, error)
+	Sum() (sent, received uint64)
+	Close() error
+}
+
+// Edges is the set of connections used by a protocol, as the peers of
+// each party.
+type Edges map[PartyID]map[PartyID]bool
+
+// FullMesh returns the edges between all the pairs of parties.
+func FullMesh(parties map[PartyID]*RemoteParty) Edges {
+	edges := make(Edges)
+	for i := range parties {
+		for j := range parties {
+			if i != j {
+				edges.Add(i, j)
+			}
+		}
+	}
+	return edges
+}
+
+// Add adds the edge between parties i and j.
+func (e Edges) Add(i, j PartyID) {
+	if e[i] == nil {
+		e[i] = make(map[PartyID]bool)
+	}
+	if e[j] == nil {
+		e[j] = make(map[PartyID]bool)
+	}
+	e[i][j] = true
+	e[j][i] = true
 }
 
 type Triple struct {
 	A, B, C uint64
+
+	// MacA, MacB and MacC are the shares of the MACs of A, B and C under the
+	// MAC key, for authenticated triples
+	MacA, MacB, MacC uint64
 }
 
+// MonitoredConn counts the bytes read and written on a connection. The
+// counters are updated atomically, so that they can be read while the links
+// use the connection.
 type MonitoredConn struct {
+	// The counters come first for their 64-bit alignment
+	received uint64
+	sent     uint64
 	net.Conn
-	received int
-	sent     int
 }
 
 func (mc *MonitoredConn) Read(b []byte) (n int, err error) {
 	n, err = mc.Conn.Read(b)
-	mc.received += n
+	atomic.AddUint64(&mc.received, uint64(n))
 	return
 }
 
 func (mc *MonitoredConn) Write(b []byte) (n int, err error) {
 	n, err = mc.Conn.Write(b)
-	mc.sent += n
+	atomic.AddUint64(&mc.sent, uint64(n))
 	return
 }
 
+// Sent returns the bytes written so far.
+func (mc *MonitoredConn) Sent() uint64 {
+	return atomic.LoadUint64(&mc.sent)
+}
+
+// Received returns the bytes read so far.
+func (mc *MonitoredConn) Received() uint64 {
+	return atomic.LoadUint64(&mc.received)
+}
+
 type TCPNetworkStruct struct {
 	Conns    map[PartyID]net.Conn
 	connLock sync.RWMutex
 
+	// TLS, when set, secures the connections and authenticates the parties
+	// with their certificates. The monitored byte counts exclude the TLS overhead.
+	TLS *tls.Config
+
+	lp       *LocalParty
+	listener net.Listener
+	redialed map[PartyID]chan net.Conn
+
 	ready sync.WaitGroup
 }
 
@@ -50,11 +121,14 @@ func NewTCPNetwork(party *LocalParty) (*TCPNetworkStruct, error) {
 	return netw, nil
 }
 
-func (tnw *TCPNetworkStruct) Connect(lp *LocalParty) error {
+func (tnw *TCPNetworkStruct) Connect(ctx context.Context, lp *LocalParty, edges Edges) error {
 	//var err error
 	waitFor, dialFor := make(map[PartyID]*RemoteParty), make(map[PartyID]*RemoteParty)
 
 	for _, rp := range lp.Peers {
+		if !edges[lp.ID][rp.ID] {
+			continue
+		}
 		if lp.ID > rp.ID {
 			waitFor[rp.ID] = rp
 		}
@@ -65,88 +139,333 @@ func (tnw *TCPNetworkStruct) Connect(lp *LocalParty) error {
 
 	//fmt.Println(lp, "dialFor:", dialFor, "waitFor", waitFor)
 
+	tnw.lp = lp
+	tnw.redialed = make(map[PartyID]chan net.Conn, len(waitFor))
+	for id := range waitFor {
+		tnw.redialed[id] = make(chan net.Conn, 1)
+	}
+
 	tnw.ready.Add(len(waitFor) + len(dialFor))
 
-	go func() {
-		listener, err := net.Listen("tcp", ":50000")
+	listenAddr := lp.Listen
+	if listenAddr == "" {
+		listenAddr = fmt.Sprintf(":%d", BasePort)
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("cannot create listening socket: %s", err)
+	}
+	tnw.listener = listener
+	//fmt.Println(lp, "now listening on", listener.Addr())
+
+	// The listener stays open after the initial connections, to accept the
+	// reconnections of the parties. Each connection is accepted in its own
+	// goroutine, so that a party slow to identify itself does not hold back
+	// the others.
+	var acceptLock sync.Mutex
+	accept := func(conn net.Conn) {
+		partyID, conn, err := acceptParty(conn, tnw.TLS)
 		if err != nil {
-			panic(fmt.Errorf("cannot create listening socket: %s", err))
+			fmt.Println(lp, "rejected connection from", conn.RemoteAddr(), ":", err)
+			conn.Close()
+			return
 		}
-		//fmt.Println(lp, "now listening on", listener.Addr())
+		acceptLock.Lock()
+		defer acceptLock.Unlock()
+		if rp, known := waitFor[partyID]; known {
+			fmt.Println(lp, "now connected with", rp)
+
+			tnw.connLock.Lock()
+			tnw.Conns[partyID] = &MonitoredConn{Conn: conn}
+			tnw.connLock.Unlock()
 
-		for range waitFor {
+			delete(waitFor, partyID)
+			tnw.ready.Done()
+		} else if redialed, known := tnw.redialed[partyID]; known {
+			// Only the latest reconnection is kept
+			select {
+			case stale := <-redialed:
+				stale.Close()
+			default:
+			}
+			redialed <- conn
+		} else {
+			fmt.Println(lp, "rejected connection from", conn.RemoteAddr(), ": unexpected party ID", partyID)
+			conn.Close()
+		}
+	}
+	go func() {
+		for {
 			conn, err := listener.Accept()
-			check(err)
-			var partyID PartyID
-			check(binary.Read(conn, binary.BigEndian, &partyID))
-			if rp, known := waitFor[partyID]; known {
-				fmt.Println(lp, "now connected with", rp)
-
-				tnw.connLock.Lock()
-				tnw.Conns[partyID] = &MonitoredConn{Conn: conn}
-				tnw.connLock.Unlock()
-
-				tnw.ready.Done()
-			} else {
-				panic(fmt.Sprintf("%s: unexpected party ID: %d", lp, partyID))
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Println(lp, "failed to accept connection:", err)
+				continue
 			}
+			go accept(conn)
 		}
-		check(listener.Close())
 	}()
 
 	//<- time.After(time.Second)
 
+	var dialErr error
+	var dialErrLock sync.Mutex
 	for _, p := range dialFor {
 		go func(rp *RemoteParty) {
+			defer tnw.ready.Done()
 			var conn net.Conn
 			var err error
 			for attempt := 0; conn == nil && attempt < CONNECT_ATTEMPTS; attempt++ {
 				if attempt > 0 {
 					//fmt.Println("retrying:", err)
-					<-time.After(CONNECT_ATTEMPTS_DELAY * time.Millisecond)
+					select {
+					case <-time.After(CONNECT_ATTEMPTS_DELAY * time.Millisecond):
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					err = ctx.Err()
+					break
 				}
-				conn, err = net.Dial("tcp", rp.Addr)
+				conn, err = dialParty(rp, tnw.TLS)
 			}
-			if conn == nil {
-				fmt.Println(lp, "couldn't connect to", rp, ":", err)
+			if conn != nil {
+				if err = binary.Write(conn, binary.BigEndian, lp.ID); err != nil {
+					conn.Close()
+				}
+			}
+			if conn == nil || err != nil {
+				dialErrLock.Lock()
+				if dialErr == nil {
+					dialErr = &PeerError{Peer: rp.ID, Err: fmt.Errorf("cannot connect: %w", err)}
+				}
+				dialErrLock.Unlock()
+				return
 			}
 			tnw.connLock.Lock()
 			tnw.Conns[rp.ID] = &MonitoredConn{Conn: conn}
 			tnw.connLock.Unlock()
-			check(binary.Write(conn, binary.BigEndian, lp.ID))
-			tnw.ready.Done()
 		}(p)
 	}
 
-	tnw.ready.Wait()
-	return nil
+	ready := make(chan struct{})
+	go func() {
+		tnw.ready.Wait()
+		close(ready)
+	}()
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		tnw.Close()
+		return ctx.Err()
+	}
+	if dialErr != nil {
+		tnw.Close()
+	}
+	return dialErr
 }
 
-func (tnw *TCPNetworkStruct) Sum() (sent, received uint64) {
-	for _, conn := range tnw.Conns {
-		sent += uint64(conn.(*MonitoredConn).sent)
-		received += uint64(conn.(*MonitoredConn).received)
+// dialParty connects to rp and, if config is set, checks that its TLS
+// certificate is bound to rp.ID.
+func dialParty(rp *RemoteParty, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		return net.Dial("tcp", rp.Addr)
 	}
-	return
+	config = config.Clone()
+	config.ServerName = fmt.Sprintf(identityFormat, rp.ID)
+	conn, err := tls.Dial("tcp", rp.Addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
 }
 
-func GetTestingTCPNetwork(P []*LocalParty) []*TCPNetworkStruct {
+// Reconnect replaces the connection with party id after it failed. The party
+// that dialed the initial connection dials again, with an exponential backoff,
+// and the other one waits for the new connection.
+func (tnw *TCPNetworkStruct) Reconnect(id PartyID) (net.Conn, error) {
+	rp, known := tnw.lp.Peers[id]
+	if !known || id == tnw.lp.ID {
+		return nil, fmt.Errorf("party %d is not a peer", id)
+	}
+
+	var conn net.Conn
 	var err error
-	netws := make([]*TCPNetworkStruct, len(P), len(P))
-	for i, lp := range P {
-		netws[i], err = NewTCPNetwork(lp)
-		check(err)
+	if tnw.lp.ID < id {
+		delay := RECONNECT_BACKOFF
+		for attempt := 0; conn == nil; attempt++ {
+			if attempt == RECONNECT_ATTEMPTS {
+				return nil, err
+			}
+			if attempt > 0 {
+				<-time.After(delay)
+				delay *= 2
+			}
+			if conn, err = dialParty(rp, tnw.TLS); err == nil {
+				if err = binary.Write(conn, binary.BigEndian, tnw.lp.ID); err != nil {
+					conn.Close()
+					conn = nil
+				}
+			}
+		}
+	} else {
+		select {
+		case conn = <-tnw.redialed[id]:
+		case <-time.After(2 * RECONNECT_BACKOFF << RECONNECT_ATTEMPTS):
+			return nil, fmt.Errorf("party %d did not reconnect", id)
+		}
+	}
+
+	tnw.connLock.Lock()
+	defer tnw.connLock.Unlock()
+	mc := &MonitoredConn{Conn: conn}
+	if old, isMonitored := tnw.Conns[id].(*MonitoredConn); isMonitored {
+		mc.sent, mc.received = old.Sent(), old.Received()
+	}
+	tnw.Conns[id] = mc
+	return mc, nil
+}
+
+// acceptParty reads the ID of the party that opened conn. If config is set,
+// the claimed ID must match the one bound to the TLS certificate of the party.
+func acceptParty(conn net.Conn, config *tls.Config) (PartyID, net.Conn, error) {
+	var partyID PartyID
+	if err := conn.SetDeadline(time.Now().Add(CONNECT_ATTEMPTS * CONNECT_ATTEMPTS_DELAY * time.Millisecond)); err != nil {
+		return partyID, conn, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	if config == nil {
+		err := binary.Read(conn, binary.BigEndian, &partyID)
+		return partyID, conn, err
+	}
+
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return partyID, conn, err
+	}
+	certID, err := peerIdentity(tlsConn)
+	if err != nil {
+		return partyID, tlsConn, err
+	}
+	if err := binary.Read(tlsConn, binary.BigEndian, &partyID); err != nil {
+		return partyID, tlsConn, err
+	}
+	if partyID != certID {
+		return partyID, tlsConn, fmt.Errorf("party %d claims to be party %d", certID, partyID)
+	}
+	return partyID, tlsConn, nil
+}
+
+func (tnw *TCPNetworkStruct) Conn(id PartyID) net.Conn {
+	tnw.connLock.RLock()
+	defer tnw.connLock.RUnlock()
+	return tnw.Conns[id]
+}
+
+func (tnw *TCPNetworkStruct) Sum() (sent, received uint64) {
+	tnw.connLock.RLock()
+	defer tnw.connLock.RUnlock()
+	return sumConns(tnw.Conns)
+}
+
+func (tnw *TCPNetworkStruct) Close() error {
+	if tnw.listener != nil {
+		tnw.listener.Close()
 	}
+	tnw.connLock.Lock()
+	defer tnw.connLock.Unlock()
+	return closeConns(tnw.Conns)
+}
+
+// LocalNetworkStruct is a Network between parties of the same process,
+// connected pairwise by in-memory pipes.
+type LocalNetworkStruct struct {
+	Conns map[PartyID]net.Conn
+}
 
-	wgc := &sync.WaitGroup{}
+// NewLocalNetworks connects the parties P with each other and returns the
+// network of each party, in the order of P.
+func NewLocalNetworks(P []*LocalParty) []*LocalNetworkStruct {
+	netws := make([]*LocalNetworkStruct, len(P))
 	for i, lp := range P {
-		wgc.Add(1)
-		go func(netw *TCPNetworkStruct, lp *LocalParty) {
-			err = netw.Connect(lp)
-			check(err)
-			wgc.Done()
-		}(netws[i], lp)
-	}
-	wgc.Wait()
+		netws[i] = &LocalNetworkStruct{Conns: make(map[PartyID]net.Conn, len(lp.Peers))}
+	}
+	for i := range P {
+		for j := i + 1; j < len(P); j++ {
+			ci, cj := net.Pipe()
+			netws[i].Conns[P[j].ID] = &MonitoredConn{Conn: ci}
+			netws[j].Conns[P[i].ID] = &MonitoredConn{Conn: cj}
+		}
+	}
 	return netws
 }
+
+// Connect closes the connections that are not in edges, as the connections
+// are created with the network.
+func (lnw *LocalNetworkStruct) Connect(ctx context.Context, lp *LocalParty, edges Edges) error {
+	for id, conn := range lnw.Conns {
+		if !edges[lp.ID][id] {
+			conn.Close()
+			delete(lnw.Conns, id)
+		}
+	}
+	return nil
+}
+
+func (lnw *LocalNetworkStruct) Conn(id PartyID) net.Conn {
+	return lnw.Conns[id]
+}
+
+// Reconnect always fails, as the in-process connections do not fail.
+func (lnw *LocalNetworkStruct) Reconnect(id PartyID) (net.Conn, error) {
+	return nil, fmt.Errorf("in-process connections cannot be re-established")
+}
+
+func (lnw *LocalNetworkStruct) Sum() (sent, received uint64) {
+	return sumConns(lnw.Conns)
+}
+
+func (lnw *LocalNetworkStruct) Close() error {
+	return closeConns(lnw.Conns)
+}
+
+func sumConns(conns map[PartyID]net.Conn) (sent, received uint64) {
+	for _, conn := range conns {
+		sent += conn.(*MonitoredConn).Sent()
+		received += conn.(*MonitoredConn).Received()
+	}
+	return
+}
+
+func closeConns(conns map[PartyID]net.Conn) (err error) {
+	for _, conn := range conns {
+		if errClose := conn.Close(); errClose != nil && !errors.Is(errClose, net.ErrClosed) && err == nil {
+			err = errClose
+		}
+	}
+	return
+}
+
+// NewNetworkFromTopology creates the network of lp, secured with TLS if the
+// topology enables it. The parties connect to the relay of the topology if
+// there is one, and with each other otherwise.
+func NewNetworkFromTopology(topo *Topology, lp *LocalParty) (Network, error) {
+	tlsConfig, err := topo.TLSConfig(lp.ID)
+	if err != nil {
+		return nil, err
+	}
+	if pc, isRelayed := topo.Relay(); isRelayed {
+		netw := NewRelayNetwork(&RemoteParty{Party: Party{ID: pc.ID, Addr: pc.Addr}})
+		netw.TLS = tlsConfig
+		return netw, nil
+	}
+	netw, err := NewTCPNetwork(lp)
+	if err != nil {
+		return nil, err
+	}
+	netw.TLS = tlsConfig
+	return netw, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address with a port free for listening.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestTCPNetworkSlowClient checks that a client that connects without
+// identifying itself does not hold back the connection of the parties.
+func TestTCPNetworkSlowClient(t *testing.T) {
+	peers := map[PartyID]string{0: freeAddr(t), 1: freeAddr(t)}
+	parties := make([]*LocalParty, 2)
+	networks := make([]*TCPNetworkStruct, 2)
+	for i := range parties {
+		lp, err := NewLocalParty(PartyID(i), peers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lp.Listen = peers[PartyID(i)]
+		if networks[i], err = NewTCPNetwork(lp); err != nil {
+			t.Fatal(err)
+		}
+		defer networks[i].Close()
+		parties[i] = lp
+	}
+	edges := FullMesh(parties[0].Peers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_ATTEMPTS*CONNECT_ATTEMPTS_DELAY*time.Millisecond/2)
+	defer cancel()
+	connected := make(chan error, 1)
+	go func() {
+		connected <- networks[1].Connect(ctx, parties[1], edges)
+	}()
+	var slow net.Conn
+	for slow == nil {
+		var err error
+		if slow, err = net.Dial("tcp", peers[1]); err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer slow.Close()
+
+	if err := networks[0].Connect(ctx, parties[0], edges); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+}
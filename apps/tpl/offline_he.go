@@ -1,39 +1,90 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
-	"encoding/binary"
+	"crypto/rand"
 	"fmt"
-	"io"
-	"net"
+	"math/big"
 	"time"
 
+	"github.com/ldsec/lattigo-pets21/apps/pir/smudging"
 	"github.com/ldsec/lattigo/v2/bfv"
 	"github.com/ldsec/lattigo/v2/ring"
 	"github.com/ldsec/lattigo/v2/rlwe"
 	"github.com/ldsec/lattigo/v2/utils"
 )
 
+// Rounds of the envelopes of the triple generation protocol
+const (
+	tripleGenRoundQuery = iota
+	tripleGenRoundResponse
+)
+
 type TripleGenMessage struct {
 	PartyID
+	Batch uint64
 	bfv.Ciphertext
 	Query bool
+
+	// Seeded is the compressed form of the ciphertext of a query, sent in its place
+	Seeded *SeededCiphertext
+
+	// EncB and SeededB are the encryption of b that comes with a query, and
+	// its compressed form, when the queries and responses are proven
+	EncB    *bfv.Ciphertext
+	SeededB *SeededCiphertext
+
+	// Proof is the proof of the query or response sent before, in place of a ciphertext
+	Proof []byte
+
+	err error // failure of the session, in place of a message
+}
+
+// round returns the round of the envelope of the message.
+func (m *TripleGenMessage) round() uint64 {
+	switch {
+	case m.Query && m.Proof != nil:
+		return tripleGenRoundQueryProof
+	case m.Proof != nil:
+		return tripleGenRoundResponseProof
+	case m.Query:
+		return tripleGenRoundQuery
+	}
+	return tripleGenRoundResponse
 }
 
 func (m *TripleGenMessage) String() string {
-	ctBytes, _ := m.Ciphertext.MarshalBinary()
+	ctBytes := m.Proof
+	if m.Proof == nil {
+		ctBytes, _ = m.Ciphertext.MarshalBinary()
+	}
 	mType := "response"
 	if m.Query {
 		mType = "query"
 	}
-	return fmt.Sprintf("{%s | %d, %v}", mType, m.PartyID, md5.Sum(ctBytes))
+	if m.Proof != nil {
+		mType += " proof"
+	}
+	return fmt.Sprintf("{%s | %d, batch %d, %v}", mType, m.PartyID, m.Batch, md5.Sum(ctBytes))
 }
 
 type TripleGenRound struct {
-	a, b, c        []uint64
-	plainA, plainB *bfv.Plaintext
-	plainM         map[PartyID]*bfv.Plaintext
-	encA, encAggr  *bfv.Ciphertext
+	batch               uint64
+	a, b, c             []uint64
+	ringA, ringB        *bfv.PlaintextRingT
+	ringM               map[PartyID]*bfv.PlaintextRingT
+	plainA, plainB      *bfv.Plaintext
+	mulB                *bfv.PlaintextMul
+	plainM              map[PartyID]*bfv.Plaintext
+	encA, encB, encAggr *bfv.Ciphertext
+	seededA, seededB    *SeededCiphertext
+	noise               map[PartyID]responseNoise
+
+	// The queries and responses of the peers wait for their proof, and the
+	// enc(b) of the proven queries for the proof of the responses
+	queries, responses map[PartyID]TripleGenMessage
+	peerEncB           map[PartyID]*bfv.Ciphertext
 
 	hasQueried   map[PartyID]struct{}
 	hasResponded map[PartyID]struct{}
@@ -47,12 +98,25 @@ type TripleGenProtocol struct {
 	bfv.Decryptor
 
 	gaussianSampler *ring.GaussianSampler
+	smudgingSampler *smudging.Sampler
+
+	// SmudgingSecurity is the statistical security, in bits, of the smudging
+	// noise of the responses. It is set before Run.
+	SmudgingSecurity int
+
+	// ZK makes the party prove its queries and responses in zero knowledge,
+	// and verify the ones of its peers. It is set before BindNetwork.
+	ZK bool
+	zk *tripleGenProofs
+	sk *rlwe.SecretKey
 
 	Triples chan Triple
 
 	Chan  chan TripleGenMessage
 	Peers map[PartyID]*TripleGenRemote
 
+	binding
+
 	rq     *ring.Ring
 	n      uint64 // number of beaver triples per ciphertext
 	q      uint64 // ring of the beaver triples
@@ -72,12 +136,14 @@ func (lp *LocalParty) NewTripleGenProtocol(params bfv.Parameters, sk *rlwe.Secre
 	tgp.Encoder = bfv.NewEncoder(params)
 	tgp.Encryptor = bfv.NewEncryptorFromSk(params, sk)
 	tgp.Decryptor = bfv.NewDecryptor(params, sk)
+	tgp.sk = sk
 
 	prng, err := utils.NewPRNG()
 	if err != nil {
 		panic(err)
 	}
-	tgp.gaussianSampler = ring.NewGaussianSampler(prng, tgp.rq, 3.19, 19)
+	tgp.gaussianSampler = ring.NewGaussianSampler(prng, tgp.rq, params.Sigma(), uint64(6*params.Sigma()))
+	tgp.SmudgingSecurity = SMUDGING_SECURITY
 
 	tgp.params = params
 	// Number of Beaver triplets elements (has to comply with the BFV parameters)
@@ -100,49 +166,221 @@ func (lp *LocalParty) NewTripleGenProtocol(params bfv.Parameters, sk *rlwe.Secre
 	return tgp
 }
 
-func (tgp *TripleGenProtocol) Run(nTriple uint64) {
+// Run generates nTriple triples to the Triples channel, which is closed when
+// Run returns. The triples are generated by batches of n, up to BATCH_WINDOW
+// of which are started ahead, and the Triples channel should be consumed
+// while Run runs. It stops with an error if ctx is cancelled, if a peer fails,
+// or if nothing is received from the peers for READ_TIMEOUT.
+func (tgp *TripleGenProtocol) Run(ctx context.Context, nTriple uint64) error {
+
+	defer close(tgp.Triples)
+
+	tgp.smudgingSampler = smudging.NewSampler(tgp.rq, tgp.SmudgingSecurity, tgp.responseNoise())
+	err := smudging.CheckNoiseBudget(tgp.params, tgp.decryptionNoise(), tgp.SmudgingSecurity)
+
+	if tgp.ZK && err == nil {
+		// The proofs are over the ring of the ciphertexts
+		sk := tgp.rq.NewPoly()
+		for i := range tgp.rq.Modulus {
+			copy(sk.Coeffs[i], tgp.sk.Value.Coeffs[i])
+		}
+		tgp.zk, err = newTripleGenProofs(tgp.params, sk, tgp.smudgingSampler)
+	}
+
+	nBatches := numBatches(nTriple, tgp.n)
+	if err == nil {
+		err = tgp.listen(ctx, nTriple, nBatches)
+	}
+	if errUnbind := tgp.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\t%d batches ok\n", nBatches)
+	return nil
+}
+
+func (tgp *TripleGenProtocol) listen(ctx context.Context, nTriple, nBatches uint64) error {
 
-	round := tgp.genInput()
+	output := newTripleOutput(tgp.Triples, nTriple)
+	rounds := make(map[uint64]*TripleGenRound)
+	waiting := make(awaited)
 
-	// Send input
+	// The queries of a batch can arrive before the party started it
+	for batch := uint64(0); batch < nBatches; batch++ {
+		for _, rp := range tgp.Peers {
+			if rp.ID != tgp.ID {
+				waiting.expect(batch, tripleGenRoundQuery, rp.ID)
+				if tgp.ZK {
+					waiting.expect(batch, tripleGenRoundQueryProof, rp.ID)
+				}
+			}
+		}
+	}
 
-	for _, rp := range tgp.Peers {
-		if rp.ID != tgp.ID {
-			m := TripleGenMessage{PartyID: tgp.ID, Ciphertext: *round.encA, Query: true}
-			rp.Chan <- m
-			//fmt.Println(tgp, "sent to", rp, &m,)
+	// Starting a batch sends its input, and its proof
+	var started, completed uint64
+	start := func() error {
+		round, err := tgp.genInput(started)
+		if err != nil {
+			return err
+		}
+		var proof []byte
+		if tgp.ZK {
+			context := proofContext(tgp.session.SessionKey, round.batch, tripleGenRoundQueryProof, tgp.ID)
+			if proof, err = tgp.zk.prove(tgp.zk.queryRelation(round.encA, round.encB), tgp.zk.queryWitness(round), context); err != nil {
+				return tgp.localError(round.batch, tripleGenRoundQueryProof, err)
+			}
+		}
+		for _, rp := range tgp.Peers {
+			if rp.ID != tgp.ID {
+				m := TripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Ciphertext: *round.encA, Query: true, Seeded: round.seededA, EncB: round.encB, SeededB: round.seededB}
+				rp.Chan <- m
+				waiting.expect(round.batch, tripleGenRoundResponse, rp.ID)
+				if tgp.ZK {
+					rp.Chan <- TripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Query: true, Proof: proof}
+					waiting.expect(round.batch, tripleGenRoundResponseProof, rp.ID)
+				}
+				//fmt.Println(tgp, "sent to", rp, &m,)
+			}
+		}
+		rounds[round.batch] = round
+		started++
+		return nil
+	}
+	for started < nBatches && started < BATCH_WINDOW {
+		if err := start(); err != nil {
+			return err
 		}
 	}
 
 	// Listen for Messages
-	for m := range tgp.Chan {
+	for completed < nBatches {
+		m, err := tgp.next(ctx, waiting)
+		if err != nil {
+			return err
+		}
 		//fmt.Println(tgp, "got from", m.PartyID , &m)
+
+		for m.Batch >= started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		round := rounds[m.Batch]
+
+		if tgp.ZK {
+			proven, err := tgp.verify(m, round)
+			if err != nil {
+				return err
+			}
+			if proven == nil {
+				continue
+			}
+			m = *proven
+		}
+
 		if m.Query {
+			var query *bfv.Ciphertext
+			if tgp.ZK {
+				query = m.Ciphertext.CopyNew()
+			}
 			response := tgp.processQuery(m.PartyID, &m.Ciphertext, round)
-			tgp.Peers[m.PartyID].Chan <- TripleGenMessage{PartyID: tgp.ID, Ciphertext: *response, Query: false}
+			tgp.Peers[m.PartyID].Chan <- TripleGenMessage{PartyID: tgp.ID, Batch: m.Batch, Ciphertext: *response, Query: false}
+			if tgp.ZK {
+				context := proofContext(tgp.session.SessionKey, m.Batch, tripleGenRoundResponseProof, tgp.ID, m.PartyID)
+				proof, err := tgp.zk.prove(tgp.zk.responseRelation(round.encB, query, response), tgp.zk.responseWitness(round, m.PartyID), context)
+				if err != nil {
+					return tgp.localError(m.Batch, tripleGenRoundResponseProof, err)
+				}
+				tgp.Peers[m.PartyID].Chan <- TripleGenMessage{PartyID: tgp.ID, Batch: m.Batch, Proof: proof}
+			}
+		} else {
+			tgp.processResponse(m.PartyID, &m.Ciphertext, round)
+			//fmt.Println(tgp, "got response from", m.PartyID)
+		}
+
+		if !tgp.IsComplete(round) {
 			continue
 		}
+		delete(rounds, m.Batch)
+		completed++
+		if err := output.add(ctx, round.batch, tgp.decryptTriples(round)); err != nil {
+			return err
+		}
+		if started < nBatches {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-		tgp.processResponse(m.PartyID, &m.Ciphertext, round)
-		//fmt.Println(tgp, "got response from", m.PartyID)
+// verify keeps a query or response of a peer until its proof, and returns it
+// once its proof is received and valid, or nil while it waits for its proof.
+// The query of a peer comes before its responses, whose proof involves the
+// enc(b) of the query.
+func (tgp *TripleGenProtocol) verify(m TripleGenMessage, round *TripleGenRound) (*TripleGenMessage, error) {
+	pending := round.responses
+	if m.Query {
+		pending = round.queries
+	}
+	if m.Proof == nil {
+		pending[m.PartyID] = m
+		return nil, nil
+	}
 
-		if tgp.IsComplete(round) {
-			break
-		}
+	proven, received := pending[m.PartyID]
+	encB, queried := round.peerEncB[m.PartyID]
+	if !received || (!m.Query && !queried) {
+		return nil, &ProtocolError{Session: tgp.session.SessionKey, Peer: m.PartyID, Batch: m.Batch, Round: m.round(), Err: ErrUnexpectedMessage}
 	}
+	delete(pending, m.PartyID)
 
-	fmt.Println("\tround 1 ok")
+	var err error
+	if m.Query {
+		context := proofContext(tgp.session.SessionKey, m.Batch, tripleGenRoundQueryProof, m.PartyID)
+		err = tgp.zk.verify(tgp.zk.queryRelation(&proven.Ciphertext, proven.EncB), m.Proof, context)
+		round.peerEncB[m.PartyID] = proven.EncB
+	} else {
+		context := proofContext(tgp.session.SessionKey, m.Batch, tripleGenRoundResponseProof, m.PartyID, tgp.ID)
+		err = tgp.zk.verify(tgp.zk.responseRelation(encB, round.encA, &proven.Ciphertext), m.Proof, context)
+	}
+	if err != nil {
+		return nil, &ProtocolError{Session: tgp.session.SessionKey, Peer: m.PartyID, Batch: m.Batch, Round: m.round(), Err: err}
+	}
+	return &proven, nil
+}
 
-	needed := nTriple
-	for _, t := range tgp.decryptTriples(round) {
-		tgp.Triples <- t
-		needed--
-		if needed == 0 {
-			break
+// next returns the next expected message of the session, or the error that stops the protocol.
+func (tgp *TripleGenProtocol) next(ctx context.Context, waiting awaited) (TripleGenMessage, error) {
+	timer := time.NewTimer(READ_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-tgp.Chan:
+			if m.err != nil {
+				if err := waiting.failure(tgp.session.SessionKey, m.err); err != nil {
+					return m, err
+				}
+				continue
+			}
+			round := m.round()
+			if !waiting.receive(m.PartyID, m.Batch, round) {
+				return m, &ProtocolError{Session: tgp.session.SessionKey, Peer: m.PartyID, Batch: m.Batch, Round: round, Err: ErrUnexpectedMessage}
+			}
+			return m, nil
+		case err := <-tgp.sendErrs:
+			return TripleGenMessage{}, err
+		case <-timer.C:
+			return TripleGenMessage{}, waiting.timeout(tgp.session.SessionKey)
+		case <-ctx.Done():
+			return TripleGenMessage{}, ctx.Err()
 		}
 	}
-
-	close(tgp.Triples)
 }
 
 func (tgp *TripleGenProtocol) IsComplete(round *TripleGenRound) bool {
@@ -155,23 +393,33 @@ func (tgp *TripleGenProtocol) IsComplete(round *TripleGenRound) bool {
 	return complete
 }
 
-func (tgp *TripleGenProtocol) genInput() (round *TripleGenRound) {
-	round = new(TripleGenRound)
+// genInput starts the batch, and returns its round. It fails with a
+// ProtocolError of the party if its randomness or its encryption fails.
+func (tgp *TripleGenProtocol) genInput(batch uint64) (*TripleGenRound, error) {
+	round := new(TripleGenRound)
+	round.batch = batch
 
 	// Each party samples its [a] and [b] and computes c' = [a_self] * [b_self]
 	round.a = sampleUniformVector(tgp.n, tgp.q)
 	round.b = sampleUniformVector(tgp.n, tgp.q)
 	round.c = mulVec(round.a, round.b, tgp.q)
 
-	// Those [a_self] and [b_self] are encode to a BFV plaintext
+	// Those [a_self] and [b_self] are encoded to BFV plaintexts, [b_self] for
+	// the multiplication of the queries, whose product is then linear in the
+	// coefficients of the plaintext
+	round.ringA = bfv.NewPlaintextRingT(tgp.params)
+	round.ringB = bfv.NewPlaintextRingT(tgp.params)
+	tgp.EncodeUintRingT(round.a, round.ringA)
+	tgp.EncodeUintRingT(round.b, round.ringB)
 	round.plainA = bfv.NewPlaintext(tgp.params)
-	round.plainB = bfv.NewPlaintext(tgp.params)
-	tgp.EncodeUint(round.a, round.plainA)
-	tgp.EncodeUint(round.b, round.plainB)
+	round.mulB = bfv.NewPlaintextMul(tgp.params)
+	tgp.ScaleUp(round.ringA, round.plainA)
+	tgp.RingTToMul(round.ringB, round.mulB)
 
 	// Each party samples a uniform mask to be assigned to each other party to the protocol.
 	m := make(map[PartyID][]uint64, len(tgp.Peers))
 	round.plainM = make(map[PartyID]*bfv.Plaintext, len(tgp.Peers))
+	round.ringM = make(map[PartyID]*bfv.PlaintextRingT, len(tgp.Peers))
 
 	for peerID := range tgp.Peers {
 
@@ -185,19 +433,47 @@ func (tgp *TripleGenProtocol) genInput() (round *TripleGenRound) {
 			round.c = subVec(round.c, m[peerID], tgp.q)
 
 			// Encodes the m_i_self to a BFV plaintext
+			round.ringM[peerID] = bfv.NewPlaintextRingT(tgp.params)
 			round.plainM[peerID] = bfv.NewPlaintext(tgp.params)
-			tgp.EncodeUint(m[peerID], round.plainM[peerID])
+			tgp.EncodeUintRingT(m[peerID], round.ringM[peerID])
+			tgp.ScaleUp(round.ringM[peerID], round.plainM[peerID])
 		}
 	}
 
-	// Each party encrypts [a_self] to a BFV ciphertext : enc([a_self]).
-	round.encA = tgp.EncryptNew(round.plainA)
+	// Each party encrypts [a_self] to a BFV ciphertext : enc([a_self]), whose
+	// uniform part is derived from a fresh seed so that it can be sent compressed.
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, tgp.localError(batch, tripleGenRoundQuery, err)
+	}
+	var err error
+	if round.encA, round.seededA, err = EncryptSeeded(tgp.Encryptor, tgp.rq, round.plainA, seed, 0); err != nil {
+		return nil, tgp.localError(batch, tripleGenRoundQuery, err)
+	}
+
+	// The proofs of the responses refer to an encryption of [b_self] as well
+	if tgp.ZK {
+		round.plainB = bfv.NewPlaintext(tgp.params)
+		tgp.ScaleUp(round.ringB, round.plainB)
+		if round.encB, round.seededB, err = EncryptSeeded(tgp.Encryptor, tgp.rq, round.plainB, seed, 1); err != nil {
+			return nil, tgp.localError(batch, tripleGenRoundQuery, err)
+		}
+		round.queries = make(map[PartyID]TripleGenMessage, len(tgp.Peers))
+		round.responses = make(map[PartyID]TripleGenMessage, len(tgp.Peers))
+		round.peerEncB = make(map[PartyID]*bfv.Ciphertext, len(tgp.Peers))
+	}
+	round.noise = make(map[PartyID]responseNoise, len(tgp.Peers))
 
 	round.encAggr = bfv.NewCiphertext(tgp.params, 1)
 
 	round.hasQueried = make(map[PartyID]struct{}, len(tgp.Peers))
 	round.hasResponded = make(map[PartyID]struct{}, len(tgp.Peers))
-	return
+	return round, nil
+}
+
+// localError reports the failure of the party itself in a round of a batch.
+func (tgp *TripleGenProtocol) localError(batch, round uint64, err error) error {
+	return &ProtocolError{Session: tgp.session.SessionKey, Peer: tgp.ID, Batch: batch, Round: round, Err: err}
 }
 
 func (tgp *TripleGenProtocol) processQuery(fromPeer PartyID, encA *bfv.Ciphertext, round *TripleGenRound) (encResponse *bfv.Ciphertext) {
@@ -205,16 +481,43 @@ func (tgp *TripleGenProtocol) processQuery(fromPeer PartyID, encA *bfv.Ciphertex
 	round.hasQueried[fromPeer] = struct{}{}
 
 	// Computes enc([a_i]) * [b_self] + m_i_self
-	tgp.Mul(encA, round.plainB, encA)
+	tgp.Mul(encA, round.mulB, encA)
 	tgp.Add(encA, round.plainM[fromPeer], encA)
 
-	// Adds smudgning error to the ciphertext
-	tgp.rq.Add(encA.Value[0], tgp.gaussianSampler.ReadNew(), encA.Value[0])
-	tgp.rq.Add(encA.Value[1], tgp.gaussianSampler.ReadNew(), encA.Value[1])
+	// Adds the smudging noise, which floods the noise of enc([a_i]) * [b_self]
+	// that depends on [b_self], and a fresh noise to the ciphertext
+	noise := responseNoise{smudging: tgp.smudgingSampler.Read(), fresh: tgp.gaussianSampler.ReadNew()}
+	tgp.rq.Add(encA.Value[0], tgp.smudgingSampler.Poly(noise.smudging), encA.Value[0])
+	tgp.rq.Add(encA.Value[1], noise.fresh, encA.Value[1])
+	round.noise[fromPeer] = noise
 
 	return encA
 }
 
+// responseNoise is the noise added to a response: the smudging noise, by
+// digits, to its c0 and a fresh noise to its c1.
+type responseNoise struct {
+	smudging [][]int64
+	fresh    *ring.Poly
+}
+
+// responseNoise returns the bound of the noise of enc(a) * b for a fresh
+// enc(a) and b in [0, t).
+func (tgp *TripleGenProtocol) responseNoise() *big.Int {
+	return smudging.PlainMulNoise(tgp.params, smudging.FreshNoise(tgp.params))
+}
+
+// decryptionNoise returns the bound of the noise of the aggregation of the
+// responses of the peers: for each, that of enc(a) * b, the smudging noise, s
+// times the fresh noise and the wraps of the addition of the plaintexts.
+func (tgp *TripleGenProtocol) decryptionNoise() *big.Int {
+	noise := new(big.Int).Add(tgp.responseNoise(), tgp.smudgingSampler.Bound)
+	fresh := new(big.Int).Mul(smudging.FreshNoise(tgp.params), new(big.Int).SetUint64(tgp.params.N()))
+	noise.Add(noise, fresh)
+	noise.Add(noise, new(big.Int).Lsh(smudging.WrapNoise(tgp.params), 1))
+	return noise.Mul(noise, big.NewInt(int64(len(tgp.Peers))))
+}
+
 func (tgp *TripleGenProtocol) processResponse(fromPeer PartyID, encResponse *bfv.Ciphertext, round *TripleGenRound) {
 
 	round.hasResponded[fromPeer] = struct{}{}
@@ -234,64 +537,109 @@ func (tgp *TripleGenProtocol) decryptTriples(round *TripleGenRound) (triples []T
 	return triples
 }
 
-func (tgp *TripleGenProtocol) BindNetwork(nw *TCPNetworkStruct) {
-	for partyID, conn := range nw.Conns {
+// tripleChannel returns the Triples channel, for tripleGenerator.
+func (tgp *TripleGenProtocol) tripleChannel() <-chan Triple {
+	return tgp.Triples
+}
 
-		if partyID == tgp.ID {
-			continue
+func (tgp *TripleGenProtocol) BindNetwork(sess *Session) {
+	tgp.bind(sess, func(env *Envelope, err error) bool {
+		var ct bfv.Ciphertext
+		var encB *bfv.Ciphertext
+		var proof []byte
+		var msg TripleGenMessage
+
+		if err == nil && env.Round == tripleGenRoundQuery {
+			// Queries are sent compressed, with enc(b) when they are proven
+			count := 1
+			if tgp.ZK {
+				count = 2
+			}
+			var scts []*SeededCiphertext
+			var expanded *bfv.Ciphertext
+			if scts, err = UnmarshalSeededCiphertexts(env.Payload, tgp.rq, count); err == nil {
+				if expanded, err = scts[0].Expand(tgp.params); err == nil {
+					ct = *expanded
+				}
+			}
+			if err == nil && tgp.ZK {
+				encB, err = scts[1].Expand(tgp.params)
+			}
+			// enc(a) and enc(b) are encrypted with the first and second CRPs of their seed
+			for i := range scts {
+				if err == nil && scts[i].Index != uint64(i) {
+					err = fmt.Errorf("%w: CRP index %d", ErrMalformedMessage, scts[i].Index)
+				}
+			}
+			if err != nil {
+				err = &ProtocolError{Session: sess.SessionKey, Peer: env.Sender, Batch: env.Batch, Round: env.Round, Err: err}
+			}
+		} else if err == nil && (env.Round == tripleGenRoundQueryProof || env.Round == tripleGenRoundResponseProof) {
+			// The proofs are checked by the protocol
+			proof = append([]byte{}, env.Payload...)
+		} else if err == nil {
+			// A ciphertext of degree 1 has two elements of one polynomial
+			if err = checkElementsEncoding(env.Payload, tgp.rq, 2, 1); err == nil {
+				err = ct.UnmarshalBinary(env.Payload)
+			}
+			if err != nil {
+				err = &ProtocolError{Session: sess.SessionKey, Peer: env.Sender, Batch: env.Batch, Round: env.Round, Err: err}
+			}
+		}
+		if err != nil {
+			msg.err = err
+		} else {
+			msg = TripleGenMessage{
+				PartyID:    env.Sender,
+				Batch:      env.Batch,
+				Ciphertext: ct,
+				Query:      env.Round == tripleGenRoundQuery || env.Round == tripleGenRoundQueryProof,
+				EncB:       encB,
+				Proof:      proof,
+			}
+		}
+		select {
+		case tgp.Chan <- msg:
+			return true
+		case <-tgp.done:
+			return false
 		}
+	})
 
-		rp := tgp.Peers[partyID]
+	for partyID, rp := range tgp.Peers {
 
-		// Receiving loop from remote
-		go func(conn net.Conn, rp *TripleGenRemote) {
-			wireLen := bfv.NewCiphertext(tgp.params, 1).GetDataLen(true)
+		if partyID == tgp.ID {
+			continue
+		}
 
-			for {
-				var id uint64
-				var ct bfv.Ciphertext
-				var query bool
+		rp := rp
+		tgp.startSending(func() { close(rp.Chan) }, func() {
+			for m := range rp.Chan {
+				round := m.round()
+				var data []byte
 				var err error
-
-				err = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
-				if err != nil {
-					panic(fmt.Errorf("SetReadDeadline failed:", err))
+				if m.Proof != nil {
+					data = m.Proof
+				} else if m.Seeded != nil {
+					data, err = m.Seeded.MarshalBinary()
+					if m.SeededB != nil && err == nil {
+						var dataB []byte
+						dataB, err = m.SeededB.MarshalBinary()
+						data = append(data, dataB...)
+					}
+				} else {
+					data, err = m.Ciphertext.MarshalBinary()
 				}
-
-				ctBuff := make([]byte, wireLen, wireLen)
-				err = binary.Read(conn, binary.BigEndian, &id)
-				if err == io.EOF {
-					return
+				if err == nil {
+					err = sess.Send(rp.ID, m.Batch, round, data)
 				}
-				check(err)
-				_, err = io.ReadFull(conn, ctBuff)
-				check(err)
-				check(ct.UnmarshalBinary(ctBuff))
-				check(binary.Read(conn, binary.BigEndian, &query))
-				msg := TripleGenMessage{
-					PartyID:    PartyID(id),
-					Ciphertext: ct,
-					Query:      query,
+				if err != nil {
+					reportSendError(tgp.sendErrs, &ProtocolError{Session: sess.SessionKey, Peer: rp.ID, Batch: m.Batch, Round: round, Err: err})
 				}
-				//fmt.Println(tgp, "receiving", &msg, "from", rp)
-				tgp.Chan <- msg
-			}
-		}(conn, rp)
-
-		// Sending loop of remote
-		go func(conn net.Conn, rp *TripleGenRemote) {
-			var m TripleGenMessage
-			var open = true
-			for open {
-				m, open = <-rp.Chan
-				//fmt.Println(tgp, "sending", &m, "to", rp)
-				check(binary.Write(conn, binary.BigEndian, m.PartyID))
-				data, err := m.Ciphertext.MarshalBinary()
-				check(err)
-				_, err = conn.Write(data)
-				check(err)
-				check(binary.Write(conn, binary.BigEndian, m.Query))
 			}
-		}(conn, rp)
+		})
 	}
 }
+
+// unbindNetwork flushes the messages to the remotes, closes the session and
+// returns the first error of the sending loops.
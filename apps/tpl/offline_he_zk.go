@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math/big"
+	"math/bits"
+
+	"github.com/ldsec/lattigo-pets21/apps/pir/smudging"
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// Rounds of the proofs of the triple generation protocol, each sent in its own
+// envelope after the query or response it proves
+const (
+	tripleGenRoundQueryProof = iota + tripleGenRoundResponse + 1
+	tripleGenRoundResponseProof
+)
+
+// zkDigitBits is the size of the digits of the plaintexts in the proofs, whose
+// masks then fit in 64 bits.
+const zkDigitBits = 16
+
+// tripleGenProofs holds what a party needs to prove its queries and responses,
+// and to verify the ones of its peers.
+//
+// A query is enc(a) and enc(b) under the secret key s of the party, of which
+// the party proves that they are of the form (-c1*s + Δ*m + e, c1), with s
+// ternary, a plaintext m in [0, t) and a noise e of the encryption. A response
+// to the query enc(a') of a peer is enc(a')*b + (Δ*m + e0, e1), with the mask
+// m, the smudging noise e0 and the fresh noise e1, and the party proves that it
+// has this form for the b of its own enc(b). The plaintexts are decomposed in
+// digits of zkDigitBits, and the smudging noise in its digits.
+type tripleGenProofs struct {
+	*proofSystem
+
+	sk    *ring.Poly // secret key in the NTT and Montgomery domains
+	s     []int64
+	one   *ring.Poly
+	delta []*ring.Poly // Δ for each digit
+	digit *big.Int
+	noise uint64 // bound of the encryption noise
+
+	smudging *smudging.Sampler
+	scales   []*ring.Poly // scale of each digit of the smudging noise
+}
+
+func newTripleGenProofs(params bfv.Parameters, sk *ring.Poly, ss *smudging.Sampler) (*tripleGenProofs, error) {
+	rq := params.RingQ()
+	ps, err := newProofSystem(rq)
+	if err != nil {
+		return nil, err
+	}
+	zk := &tripleGenProofs{proofSystem: ps, sk: sk, smudging: ss}
+	zk.noise = smudging.FreshNoise(params).Uint64()
+	for _, scale := range ss.Scales {
+		zk.scales = append(zk.scales, constantNTT(rq, scale))
+	}
+
+	s := rq.NewPoly()
+	rq.InvMForm(sk, s)
+	rq.InvNTT(s, s)
+	zk.s = centered(rq, s)
+
+	zk.one = constantNTT(rq, big.NewInt(1))
+	zk.digit = new(big.Int).Lsh(big.NewInt(1), zkDigitBits)
+	delta := new(big.Int).Quo(rq.ModulusBigint, new(big.Int).SetUint64(params.T()))
+	for d := uint64(0); d < zk.digits(params.T()); d++ {
+		zk.delta = append(zk.delta, constantNTT(rq, delta))
+		delta = new(big.Int).Mul(delta, zk.digit)
+	}
+	return zk, nil
+}
+
+// digits returns the number of digits of the plaintexts modulo t.
+func (zk *tripleGenProofs) digits(t uint64) uint64 {
+	return (uint64(bits.Len64(t-1)) + zkDigitBits - 1) / zkDigitBits
+}
+
+// digitBounds returns the bounds of the witnesses of the digits of a plaintext.
+func (zk *tripleGenProofs) digitBounds() []uint64 {
+	bounds := make([]uint64, len(zk.delta))
+	for d := range bounds {
+		bounds[d] = 1<<zkDigitBits - 1
+	}
+	return bounds
+}
+
+// plaintextDigits returns the witnesses of the digits of the plaintext in R_t.
+func (zk *tripleGenProofs) plaintextDigits(pt *bfv.PlaintextRingT) [][]int64 {
+	digits := make([][]int64, len(zk.delta))
+	for d := range digits {
+		digits[d] = make([]int64, zk.rq.N)
+		for i, c := range pt.Value.Coeffs[0] {
+			digits[d][i] = int64((c >> (zkDigitBits * uint(d))) & (1<<zkDigitBits - 1))
+		}
+	}
+	return digits
+}
+
+// ntt returns p in the NTT domain, and in the Montgomery form as well if mform.
+func (zk *tripleGenProofs) ntt(p *ring.Poly, mform bool) *ring.Poly {
+	out := zk.rq.NewPoly()
+	zk.rq.NTT(p, out)
+	if mform {
+		zk.rq.MForm(out, out)
+	}
+	return out
+}
+
+// encryptionEquation returns the row of A and U of the equation
+// c0 = -c1*s + Δ*m + e of the encryption ct, for the witnesses s, the digits
+// of m and e, in this order.
+func (zk *tripleGenProofs) encryptionEquation(ct *bfv.Ciphertext) ([]*ring.Poly, *ring.Poly) {
+	c1 := zk.ntt(ct.Value[1], true)
+	zk.rq.Neg(c1, c1)
+	row := append([]*ring.Poly{c1}, zk.delta...)
+	return append(row, zk.one), zk.ntt(ct.Value[0], false)
+}
+
+// encryptionNoise returns the noise e = c0 + c1*s - Δ*m of the encryption ct of pt.
+func (zk *tripleGenProofs) encryptionNoise(ct *bfv.Ciphertext, pt *bfv.Plaintext) []int64 {
+	e := zk.ntt(ct.Value[1], false)
+	zk.rq.MulCoeffsMontgomery(e, zk.sk, e)
+	zk.rq.InvNTT(e, e)
+	zk.rq.Add(e, ct.Value[0], e)
+	zk.rq.Sub(e, pt.Value, e)
+	return centered(zk.rq, e)
+}
+
+// queryRelation returns the statement of the proof of the query encA and encB,
+// on the witnesses s, the digits of a, e_a, the digits of b and e_b.
+func (zk *tripleGenProofs) queryRelation(encA, encB *bfv.Ciphertext) *linearRelation {
+	nDigits := len(zk.delta)
+	rel := &linearRelation{A: make([][]*ring.Poly, 2), U: make([]*ring.Poly, 2)}
+	rowA, uA := zk.encryptionEquation(encA)
+	rowB, uB := zk.encryptionEquation(encB)
+	rel.A[0] = append(rowA, make([]*ring.Poly, nDigits+1)...)
+	rel.A[1] = append([]*ring.Poly{rowB[0]}, make([]*ring.Poly, nDigits+1)...)
+	rel.A[1] = append(rel.A[1], rowB[1:]...)
+	rel.U[0], rel.U[1] = uA, uB
+
+	rel.Bounds = append([]uint64{1}, zk.digitBounds()...)
+	rel.Bounds = append(rel.Bounds, zk.noise)
+	rel.Bounds = append(rel.Bounds, rel.Bounds[1:]...)
+	return rel
+}
+
+// queryWitness returns the witness of the proof of the query of the round.
+func (zk *tripleGenProofs) queryWitness(round *TripleGenRound) [][]int64 {
+	w := append([][]int64{zk.s}, zk.plaintextDigits(round.ringA)...)
+	w = append(w, zk.encryptionNoise(round.encA, round.plainA))
+	w = append(w, zk.plaintextDigits(round.ringB)...)
+	return append(w, zk.encryptionNoise(round.encB, round.plainB))
+}
+
+// responseRelation returns the statement of the proof of the response to the
+// query encA, for the b of the query encB of the responder, on the witnesses
+// s, the digits of b, e_b, the digits of m, the digits of e0 and e1.
+func (zk *tripleGenProofs) responseRelation(encB, encA, response *bfv.Ciphertext) *linearRelation {
+	nDigits, nSmudging := len(zk.delta), len(zk.scales)
+	rel := &linearRelation{A: make([][]*ring.Poly, 3), U: make([]*ring.Poly, 3)}
+	rowB, uB := zk.encryptionEquation(encB)
+	rel.A[0] = append(rowB, make([]*ring.Poly, nDigits+nSmudging+1)...)
+	rel.U[0] = uB
+
+	// enc(a)*b is the sum of the products of enc(a) by the digits of b, scaled
+	for i := 0; i < 2; i++ {
+		rel.A[i+1] = make([]*ring.Poly, 2*nDigits+nSmudging+3)
+		c := zk.ntt(encA.Value[i], true)
+		for d := 0; d < nDigits; d++ {
+			rel.A[i+1][1+d] = c
+			c = c.CopyNew()
+			zk.rq.MulScalarBigint(c, zk.digit, c)
+		}
+		rel.U[i+1] = zk.ntt(response.Value[i], false)
+	}
+	for d, delta := range zk.delta {
+		rel.A[1][nDigits+2+d] = delta
+	}
+	for d, scale := range zk.scales {
+		rel.A[1][2*nDigits+2+d] = scale
+	}
+	rel.A[2][2*nDigits+nSmudging+2] = zk.one
+
+	rel.Bounds = append([]uint64{1}, zk.digitBounds()...)
+	rel.Bounds = append(rel.Bounds, zk.noise)
+	rel.Bounds = append(rel.Bounds, zk.digitBounds()...)
+	rel.Bounds = append(rel.Bounds, zk.smudging.DigitBounds()...)
+	rel.Bounds = append(rel.Bounds, zk.noise)
+	return rel
+}
+
+// responseWitness returns the witness of the proof of the response of the
+// round to the query of peer.
+func (zk *tripleGenProofs) responseWitness(round *TripleGenRound, peer PartyID) [][]int64 {
+	w := append([][]int64{zk.s}, zk.plaintextDigits(round.ringB)...)
+	w = append(w, zk.encryptionNoise(round.encB, round.plainB))
+	w = append(w, zk.plaintextDigits(round.ringM[peer])...)
+	noise := round.noise[peer]
+	w = append(w, noise.smudging...)
+	return append(w, centered(zk.rq, noise.fresh))
+}
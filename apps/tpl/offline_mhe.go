@@ -1,16 +1,16 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"net"
+	"math/big"
 	"time"
 
+	"github.com/ldsec/lattigo-pets21/apps/pir/smudging"
 	"github.com/ldsec/lattigo/v2/bfv"
 	"github.com/ldsec/lattigo/v2/ring"
 	"github.com/ldsec/lattigo/v2/rlwe"
-	"github.com/ldsec/lattigo/v2/utils"
 )
 
 type Node struct {
@@ -54,17 +54,46 @@ func NewTree(peers map[PartyID]string, branching uint64) (tree Tree) {
 	return
 }
 
+// Edges returns the edges between the parties and their parent in the tree.
+func (tree Tree) Edges() Edges {
+	edges := make(Edges)
+	for id, node := range tree {
+		if node.Parent != id {
+			edges.Add(id, node.Parent)
+		}
+	}
+	return edges
+}
+
 type MHETripleGenMessage struct {
 	PartyID
+	Batch uint64
 	Data  []byte
 	Round int
+
+	err error // failure of the session, in place of a message
 }
 
 type MHETripleGenRound struct {
+	batch                 uint64
+	state                 uint64 // number of Children whose message of the current round was aggregated
 	seed                  []byte
 	a, b, c               []uint64
+	macA, macB, macC      []uint64
 	encA, encB, encC, tmp *bfv.Ciphertext
-	decryptionShare       *ring.Poly
+	seededA, seededB      *SeededCiphertext
+
+	// products are the ciphertexts decrypted collectively, that is enc(c)
+	// followed, for authenticated triples, by the encryptions of the MACs
+	products         []*bfv.Ciphertext
+	decryptionShares []*ring.Poly
+
+	// In the threshold variant, the parties whose inputs are aggregated in
+	// the batch, the children whose inputs were received in time, and whether
+	// a child failed to send its decryption share
+	parties  []PartyID
+	included []PartyID
+	failed   bool
 }
 
 type MHETripleGenProtocol struct {
@@ -76,7 +105,18 @@ type MHETripleGenProtocol struct {
 	bfv.Encryptor
 	bfv.Decryptor
 
-	gaussianSampler *ring.GaussianSampler
+	smudgingSampler *smudging.Sampler
+
+	// SmudgingSecurity is the statistical security, in bits, of the smudging
+	// noise of the decryption shares. It is set before Run.
+	SmudgingSecurity int
+
+	// MACKey, when set, authenticates the triples
+	MACKey *MACKey
+
+	// ThresholdKey, when set, generates the triples with the parties that do
+	// not straggle, with the threshold key instead of the secret key
+	ThresholdKey *ThresholdKey
 
 	Triples chan Triple
 
@@ -84,10 +124,13 @@ type MHETripleGenProtocol struct {
 	Parent   *MHETripleGenRemote
 	Children map[PartyID]*MHETripleGenRemote
 
+	binding
+
 	rq     *ring.Ring
 	n      uint64 // number of beaver triples per ciphertext
 	q      uint64 // ring of the beaver triples
 	params bfv.Parameters
+	tree   Tree
 }
 
 type MHETripleGenRemote struct {
@@ -104,13 +147,10 @@ func (lp *LocalParty) NewMHETripleGenProtocol(params bfv.Parameters, sk *rlwe.Se
 	tgp.Encoder = bfv.NewEncoder(params)
 	tgp.Encryptor = bfv.NewEncryptorFromSk(params, sk)
 
-	prng, err := utils.NewPRNG()
-	if err != nil {
-		panic(err)
-	}
-	tgp.gaussianSampler = ring.NewGaussianSampler(prng, tgp.rq, 3.19, 19)
+	tgp.SmudgingSecurity = SMUDGING_SECURITY
 
 	tgp.params = params
+	tgp.tree = tree
 	// Number of Beaver triplets elements (has to comply with the BFV parameters)
 	tgp.n = params.N()
 
@@ -141,141 +181,285 @@ func (lp *LocalParty) NewMHETripleGenProtocol(params bfv.Parameters, sk *rlwe.Se
 	return tgp
 }
 
-func (tgp *MHETripleGenProtocol) Run(nTriple uint64) {
+// Run generates nTriple triples to the Triples channel, which is closed when
+// Run returns. The triples are generated by batches of n, up to BATCH_WINDOW
+// of which are started ahead, all with the relinearization key of the
+// protocol, and the Triples channel should be consumed while Run runs. It
+// stops with an error if ctx is cancelled, if a peer fails, or if nothing is
+// received from the peers for READ_TIMEOUT. With a threshold key, the
+// children that fail or straggle are excluded instead (see listenThreshold).
+func (tgp *MHETripleGenProtocol) Run(ctx context.Context, nTriple uint64) error {
+
+	defer close(tgp.Triples)
+
+	tgp.smudgingSampler = smudging.NewSampler(tgp.rq, tgp.SmudgingSecurity, tgp.productNoise())
+	err := smudging.CheckNoiseBudget(tgp.params, tgp.decryptionNoise(), tgp.SmudgingSecurity)
+
+	nBatches := numBatches(nTriple, tgp.n)
+	switch {
+	case err != nil:
+	case tgp.ThresholdKey != nil:
+		tgp.Encryptor = bfv.NewEncryptorFromPk(tgp.params, tgp.ThresholdKey.PublicKey)
+		// The children excluded may still send their late messages
+		tgp.session.DropLate()
+		err = tgp.listenThreshold(ctx, nTriple)
+	default:
+		err = tgp.listen(ctx, nTriple, nBatches)
+	}
+	if errUnbind := tgp.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\t\t%d batches ok\n", nBatches)
+	return nil
+}
+
+func (tgp *MHETripleGenProtocol) listen(ctx context.Context, nTriple, nBatches uint64) error {
 
-	round := tgp.genInput()
+	output := newTripleOutput(tgp.Triples, nTriple)
+	rounds := make(map[uint64]*MHETripleGenRound)
+	waiting := make(awaited)
 
-	var state uint64
+	// The enc(a), enc(b) of the Children for a batch can arrive before the party started it
+	for batch := uint64(0); batch < nBatches; batch++ {
+		for i := range tgp.Children {
+			waiting.expect(batch, 0, tgp.Children[i].ID)
+		}
+	}
 
-	// We are at round zero -> If we are a leaf, we end enc(a), enc(b) to our Parent
-	if len(tgp.Children) == 0 {
+	var started, completed uint64
+	start := func() error {
+		round, err := tgp.genInput(started)
+		if err != nil {
+			return err
+		}
 
-		data0, _ := round.encA.MarshalBinary()
-		data1, _ := round.encB.MarshalBinary()
+		// We are at round zero -> If we are a leaf, we end enc(a), enc(b) to our Parent
+		if len(tgp.Children) == 0 {
+			m := MHETripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Data: tgp.marshalEncAEncB(round), Round: 0}
+			tgp.Parent.Chan <- m
+			waiting.expect(round.batch, 1, tgp.Parent.ID)
+		}
+		//fmt.Println(tgp, "sent to", rp, &m,)
 
-		m := MHETripleGenMessage{PartyID: tgp.ID, Data: append(data0, data1...), Round: 0}
-		tgp.Parent.Chan <- m
+		rounds[round.batch] = round
+		started++
+		return nil
+	}
+	for started < nBatches && started < BATCH_WINDOW {
+		if err := start(); err != nil {
+			return err
+		}
 	}
-	//fmt.Println(tgp, "sent to", rp, &m,)
 
 	// Then we listen to our Parent and Children
-	for m := range tgp.Chan {
+	for completed < nBatches {
+		m, err := tgp.next(ctx, waiting)
+		if err != nil {
+			return err
+		}
 		//fmt.Println(tgp, "got from", m.PartyID , &m)
 
-		// If the message is enc(a), enc(b), we aggregate it with our own
-		// Once we get enc(a), enc(b) from all our Children, we relay it to our Parent
-		if m.Round == 0 {
+		for m.Batch >= started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		round := rounds[m.Batch]
 
-			// We aggregate enc(a), enc(b) from our Children with our own enc(a), enc(b)
-			tgp.aggregateEncAEncB(m.Data, round)
+		complete, err := tgp.handle(m, round, waiting)
+		if err != nil {
+			return err
+		}
+		if !complete {
+			continue
+		}
+		delete(rounds, m.Batch)
+		completed++
+		if err := output.add(ctx, round.batch, tgp.decryptTriples(round)); err != nil {
+			return err
+		}
+		if started < nBatches {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-			state++
+// handle processes a message of the batch of round, and returns true once the
+// party is done with this batch.
+func (tgp *MHETripleGenProtocol) handle(m MHETripleGenMessage, round *MHETripleGenRound, waiting awaited) (bool, error) {
 
-			// If we have recieved enc(a), enc(b) from both our Children, we relay the aggregation to our Parent
-			// unless we are the root, in which case we compute sum(enc(a)) * sum(enc(b))
-			if state == uint64(len(tgp.Children)) {
+	// If the message is enc(a), enc(b), we aggregate it with our own
+	// Once we get enc(a), enc(b) from all our Children, we relay it to our Parent
+	if m.Round == 0 {
 
-				if tgp.Parent != nil {
-					data0, _ := round.encA.MarshalBinary()
-					data1, _ := round.encB.MarshalBinary()
+		// We aggregate enc(a), enc(b) from our Children with our own enc(a), enc(b)
+		if err := tgp.aggregateEncAEncB(m.Data, round); err != nil {
+			return false, tgp.messageError(m, err)
+		}
+
+		round.state++
 
-					tgp.Parent.Chan <- MHETripleGenMessage{PartyID: tgp.ID, Data: append(data0, data1...), Round: 0}
+		// If we have recieved enc(a), enc(b) from both our Children, we relay the aggregation to our Parent
+		// unless we are the root, in which case we compute sum(enc(a)) * sum(enc(b))
+		if round.state == uint64(len(tgp.Children)) {
 
-				} else {
+			if tgp.Parent != nil {
+				tgp.Parent.Chan <- MHETripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Data: tgp.marshalEncAEncB(round), Round: 0}
+				waiting.expect(round.batch, 1, tgp.Parent.ID)
 
-					//tgp.Evaluator.Add(round.encC, round.encA, round.encC)
-					//tgp.Evaluator.Add(round.encC, round.encB, round.encC)
-					tgp.Evaluator.Mul(round.encA, round.encB, round.tmp)
-					tgp.Evaluator.Relinearize(round.tmp, round.encC)
+			} else {
 
-					// And we relay it to our children
-					NTTA := round.encC.Value[1].CopyNew()
-					tgp.rq.NTT(NTTA, NTTA)
-					data, _ := NTTA.MarshalBinary()
+				//tgp.Evaluator.Add(round.encC, round.encA, round.encC)
+				//tgp.Evaluator.Add(round.encC, round.encB, round.encC)
+				tgp.Evaluator.Mul(round.encA, round.encB, round.tmp)
+				tgp.Evaluator.Relinearize(round.tmp, round.encC)
+				round.products = []*bfv.Ciphertext{round.encC}
 
-					for i := range tgp.Children {
-						tgp.Children[i].Chan <- MHETripleGenMessage{PartyID: tgp.ID, Data: data, Round: 1}
+				// The MACs are the products of enc(alpha) with enc(a), enc(b) and enc(c)
+				// (enc(a) being round.encB, and enc(b) round.encA)
+				if tgp.MACKey != nil {
+					for _, ct := range []*bfv.Ciphertext{round.encB, round.encA, round.encC} {
+						mac := bfv.NewCiphertext(tgp.params, 1)
+						tgp.Evaluator.Mul(tgp.MACKey.Enc, ct, round.tmp)
+						tgp.Evaluator.Relinearize(round.tmp, mac)
+						round.products = append(round.products, mac)
 					}
+				}
 
-					tgp.genDecryptionShare(data, round)
+				// And we relay their c1 to our children
+				polys := make([]*ring.Poly, len(round.products))
+				for k, ct := range round.products {
+					polys[k] = ct.Value[1].CopyNew()
+					tgp.rq.NTT(polys[k], polys[k])
 				}
+				data := marshalPolys(polys)
 
-				state = 0
+				for i := range tgp.Children {
+					tgp.Children[i].Chan <- MHETripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Data: data, Round: 1}
+					waiting.expect(round.batch, 2, tgp.Children[i].ID)
+				}
+
+				if err := tgp.genDecryptionShare(data, round); err != nil {
+					return false, err
+				}
 			}
 
+			round.state = 0
 		}
 
-		// Now we wait for a message of the encryption of enc(a)*enc(b)
-		if m.Round == 1 {
+	}
 
-			// First we try to relay the enc(a)*enc(b) to our Children
-			for i := range tgp.Children {
-				tgp.Children[i].Chan <- MHETripleGenMessage{PartyID: tgp.ID, Data: m.Data, Round: 1}
-			}
+	// Now we wait for a message of the encryption of enc(a)*enc(b)
+	if m.Round == 1 {
 
-			// Then we compute our decryption share
-			tgp.genDecryptionShare(m.Data, round)
+		// First we compute our decryption share, which checks the message
+		if err := tgp.genDecryptionShare(m.Data, round); err != nil {
+			return false, tgp.messageError(m, err)
+		}
 
-			// If we are a leaf (no children), we directly relay it to our Parent and close the connection.
-			if len(tgp.Children) == 0 {
-				data, _ := round.decryptionShare.MarshalBinary()
-				tgp.Parent.Chan <- MHETripleGenMessage{PartyID: tgp.ID, Data: data, Round: 2}
-				break
-			}
+		// Then we relay the enc(a)*enc(b) to our Children
+		for i := range tgp.Children {
+			tgp.Children[i].Chan <- MHETripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Data: m.Data, Round: 1}
+			waiting.expect(round.batch, 2, tgp.Children[i].ID)
 		}
 
-		// If we are not a leaf we wait for the decryption share of our Children
-		if m.Round == 2 {
+		// If we are a leaf (no children), we directly relay it to our Parent and are done with the batch.
+		if len(tgp.Children) == 0 {
+			data := marshalPolys(round.decryptionShares)
+			tgp.Parent.Chan <- MHETripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Data: data, Round: 2}
+			return true, nil
+		}
+	}
 
-			tgp.aggregateDecryptionShare(m.Data, round)
+	// If we are not a leaf we wait for the decryption share of our Children
+	if m.Round == 2 {
 
-			state++
+		if err := tgp.aggregateDecryptionShare(m.Data, round); err != nil {
+			return false, tgp.messageError(m, err)
+		}
 
-			// Once we received all the decryption share of all our Children
-			// we relay it to our Parent and close the connection
-			if state == uint64(len(tgp.Children)) {
+		round.state++
 
-				if tgp.Parent != nil {
-					data, _ := round.decryptionShare.MarshalBinary()
-					tgp.Parent.Chan <- MHETripleGenMessage{PartyID: tgp.ID, Data: data, Round: 2}
-					state = 0
-				} else {
-					tgp.rootFinalize(round)
-				}
-				break
-			}
+		// Once we received all the decryption share of all our Children
+		// we relay it to our Parent and are done with the batch
+		if round.state == uint64(len(tgp.Children)) {
 
-			fmt.Println("\t\tround 1 ok")
+			if tgp.Parent != nil {
+				data := marshalPolys(round.decryptionShares)
+				tgp.Parent.Chan <- MHETripleGenMessage{PartyID: tgp.ID, Batch: round.batch, Data: data, Round: 2}
+				round.state = 0
+			} else {
+				tgp.rootFinalize(round)
+			}
+			return true, nil
 		}
 	}
+	return false, nil
+}
 
-	needed := nTriple
-	for _, t := range tgp.decryptTriples(round) {
-		tgp.Triples <- t
-		needed--
-		if needed == 0 {
-			break
+// next returns the next expected message of the session, or the error that stops the protocol.
+func (tgp *MHETripleGenProtocol) next(ctx context.Context, waiting awaited) (MHETripleGenMessage, error) {
+	timer := time.NewTimer(READ_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-tgp.Chan:
+			if m.err != nil {
+				if err := waiting.failure(tgp.session.SessionKey, m.err); err != nil {
+					return m, err
+				}
+				continue
+			}
+			if !waiting.receive(m.PartyID, m.Batch, uint64(m.Round)) {
+				return m, tgp.messageError(m, ErrUnexpectedMessage)
+			}
+			return m, nil
+		case err := <-tgp.sendErrs:
+			return MHETripleGenMessage{}, err
+		case <-timer.C:
+			return MHETripleGenMessage{}, waiting.timeout(tgp.session.SessionKey)
+		case <-ctx.Done():
+			return MHETripleGenMessage{}, ctx.Err()
 		}
 	}
+}
 
-	close(tgp.Triples)
+func (tgp *MHETripleGenProtocol) messageError(m MHETripleGenMessage, err error) error {
+	return &ProtocolError{Session: tgp.session.SessionKey, Peer: m.PartyID, Batch: m.Batch, Round: uint64(m.Round), Err: err}
 }
 
-func (tgp *MHETripleGenProtocol) genInput() (round *MHETripleGenRound) {
-	round = new(MHETripleGenRound)
+// mheTripleGenSeed returns the common seed of the CRPs of enc(a) and enc(b)
+// in a batch of a session. The secret key of a party is the same for all the
+// sessions of a run, so the seed is derived with the run, the session and the
+// batch, so that no CRP is used twice with this key.
+func mheTripleGenSeed(run RunID, session, batch uint64) []byte {
+	return deriveRunSeed("mhe triple generation", run, session, batch)
+}
 
-	round.seed = []byte{0x49, 0x0a, 0x42, 0x3d, 0x97, 0x9d, 0xc1, 0x07, 0xa1, 0xd7, 0xe9, 0x7b, 0x3b, 0xce, 0xa1, 0xdb}
+// genInput starts the batch, and returns its round. It fails with a
+// ProtocolError of the party if its encryption fails.
+func (tgp *MHETripleGenProtocol) genInput(batch uint64) (*MHETripleGenRound, error) {
+	round := new(MHETripleGenRound)
+	round.batch = batch
 
-	prng, err := utils.NewKeyedPRNG(round.seed)
-	if err != nil {
-		panic(err)
-	}
-	crpGen := ring.NewUniformSampler(prng, tgp.rq)
+	round.seed = mheTripleGenSeed(tgp.session.mux.Run(), tgp.session.Session, batch)
 
 	// Each party samples its [a] and [b] and computes c' = [a_self] * [b_self]
 	round.a = sampleUniformVector(tgp.n, tgp.q)
 	round.b = sampleUniformVector(tgp.n, tgp.q)
 	round.c = sampleUniformVector(tgp.n, tgp.q)
+	if tgp.MACKey != nil {
+		round.macA = sampleUniformVector(tgp.n, tgp.q)
+		round.macB = sampleUniformVector(tgp.n, tgp.q)
+		round.macC = sampleUniformVector(tgp.n, tgp.q)
+	}
 
 	// Those [a_self] and [b_self] are encode to a BFV plaintext
 	plainA := bfv.NewPlaintext(tgp.params)
@@ -285,72 +469,203 @@ func (tgp *MHETripleGenProtocol) genInput() (round *MHETripleGenRound) {
 	tgp.EncodeUint(round.b, plainB)
 
 	// Each party encrypts [a_self] to a BFV ciphertext : enc([a_self]).
-	round.encB = tgp.EncryptFromCRPNew(plainA, crpGen.ReadNew())
-	round.encA = tgp.EncryptFromCRPNew(plainB, crpGen.ReadNew())
+	// The CRPs are the first two polynomials read from the common seed.
+	// In the threshold variant, the parties whose inputs are aggregated are
+	// only known afterwards, and the inputs are encrypted under the
+	// collective public key instead.
+	if tgp.ThresholdKey != nil {
+		round.encB = tgp.EncryptNew(plainA)
+		round.encA = tgp.EncryptNew(plainB)
+	} else {
+		var err error
+		if round.encB, round.seededB, err = EncryptSeeded(tgp.Encryptor, tgp.rq, plainA, round.seed, 0); err == nil {
+			round.encA, round.seededA, err = EncryptSeeded(tgp.Encryptor, tgp.rq, plainB, round.seed, 1)
+		}
+		if err != nil {
+			return nil, tgp.messageError(MHETripleGenMessage{PartyID: tgp.ID, Batch: batch}, err)
+		}
+	}
 
 	round.tmp = bfv.NewCiphertext(tgp.params, 2)
 	round.encC = bfv.NewCiphertext(tgp.params, 1)
 
-	round.decryptionShare = ring.NewPoly(tgp.n, uint64(len(tgp.params.Q())))
+	return round, nil
+}
 
-	return
+// nOutputs returns the number of values decrypted collectively in a batch:
+// c and, for authenticated triples, the MACs of a, b and c.
+func (tgp *MHETripleGenProtocol) nOutputs() int {
+	if tgp.MACKey != nil {
+		return 4
+	}
+	return 1
 }
 
-func (tgp *MHETripleGenProtocol) aggregateEncAEncB(data []byte, round *MHETripleGenRound) {
+// outputs returns the shares of the values decrypted collectively in round.
+func (tgp *MHETripleGenProtocol) outputs(round *MHETripleGenRound) []*[]uint64 {
+	return []*[]uint64{&round.c, &round.macA, &round.macB, &round.macC}[:tgp.nOutputs()]
+}
+
+// marshalEncAEncB encodes enc(a), enc(b) in their compressed form, since their
+// c1 is derived from the common seed.
+func (tgp *MHETripleGenProtocol) marshalEncAEncB(round *MHETripleGenRound) []byte {
+	data0, _ := round.seededA.MarshalBinary()
+	data1, _ := round.seededB.MarshalBinary()
+	return append(data0, data1...)
+}
 
-	encA := new(bfv.Ciphertext)
-	encB := new(bfv.Ciphertext)
+func (tgp *MHETripleGenProtocol) aggregateEncAEncB(data []byte, round *MHETripleGenRound) error {
 
-	encA.UnmarshalBinary(data[:len(data)>>1])
-	encB.UnmarshalBinary(data[len(data)>>1:])
+	scts, err := UnmarshalSeededCiphertexts(data, tgp.rq, 2)
+	if err != nil {
+		return err
+	}
+	encA, encB := scts[0], scts[1]
+
+	// The ciphertexts can only be aggregated if they share the same c1
+	if !bytes.Equal(encA.Seed, round.seed) || encA.Index != round.seededA.Index ||
+		!bytes.Equal(encB.Seed, round.seed) || encB.Index != round.seededB.Index {
+		return fmt.Errorf("%w: ciphertexts not derived from the common seed", ErrMalformedMessage)
+	}
 
-	tgp.rq.Add(round.encA.Value[0], encA.Value[0], round.encA.Value[0])
-	tgp.rq.Add(round.encB.Value[0], encB.Value[0], round.encB.Value[0])
+	tgp.rq.Add(round.encA.Value[0], encA.C0, round.encA.Value[0])
+	tgp.rq.Add(round.encB.Value[0], encB.C0, round.encB.Value[0])
 
 	//tgp.Evaluator.Add(round.encA, encA, round.encA)
 	//tgp.Evaluator.Add(round.encB, encB, round.encB)
+	return nil
 }
 
-func (tgp *MHETripleGenProtocol) aggregateDecryptionShare(data []byte, round *MHETripleGenRound) {
+func (tgp *MHETripleGenProtocol) aggregateDecryptionShare(data []byte, round *MHETripleGenRound) error {
 
-	share := new(ring.Poly)
-	share.UnmarshalBinary(data)
+	shares, err := tgp.unmarshalPolys(data, tgp.nOutputs())
+	if err != nil {
+		return err
+	}
 
-	tgp.rq.Add(round.decryptionShare, share, round.decryptionShare)
+	for k, share := range shares {
+		tgp.rq.Add(round.decryptionShares[k], share, round.decryptionShares[k])
+	}
 
+	return nil
 }
 
-func (tgp *MHETripleGenProtocol) genDecryptionShare(data []byte, round *MHETripleGenRound) {
+// unmarshalPolys decodes count polynomials of the ring, encoded one after the other.
+func (tgp *MHETripleGenProtocol) unmarshalPolys(data []byte, count int) ([]*ring.Poly, error) {
+	polys := make([]*ring.Poly, count)
+	for k := range polys {
+		n, err := checkPolyEncoding(data, tgp.rq)
+		if err != nil {
+			return nil, err
+		}
+		polys[k] = new(ring.Poly)
+		if err := polys[k].UnmarshalBinary(data[:n]); err != nil {
+			return nil, err
+		}
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(data))
+	}
+	return polys, nil
+}
 
-	a := new(ring.Poly)
-	a.UnmarshalBinary(data)
+// marshalPolys encodes the polynomials one after the other.
+func marshalPolys(polys []*ring.Poly) (data []byte) {
+	for _, p := range polys {
+		b, _ := p.MarshalBinary()
+		data = append(data, b...)
+	}
+	return
+}
 
-	share := tgp.rq.NewPoly()
+func (tgp *MHETripleGenProtocol) genDecryptionShare(data []byte, round *MHETripleGenRound) error {
 
-	// a*s
-	tgp.rq.MulCoeffsMontgomeryAndAdd(a, tgp.SecretKey.Value, share)
-	tgp.rq.InvNTT(share, share)
+	polys, err := tgp.unmarshalPolys(data, tgp.nOutputs())
+	if err != nil {
+		return err
+	}
+	tgp.decryptionShares(polys, tgp.SecretKey.Value, round)
+	return nil
+}
 
-	if tgp.Parent != nil {
-		// a*s + e
-		tgp.rq.Add(share, tgp.gaussianSampler.ReadNew(), share)
+// decryptionShares computes the decryption shares of the party for the c1 of
+// the products, with its share sk of the secret key.
+func (tgp *MHETripleGenProtocol) decryptionShares(polys []*ring.Poly, sk *ring.Poly, round *MHETripleGenRound) {
 
-		c_plain := bfv.NewPlaintext(tgp.params)
-		tgp.Encoder.EncodeUint(round.c, c_plain)
+	outputs := tgp.outputs(round)
+	round.decryptionShares = make([]*ring.Poly, len(polys))
+	for k, a := range polys {
 
-		// a*s - c + e
-		tgp.rq.Sub(share, c_plain.Value, share)
+		share := tgp.rq.NewPoly()
+
+		// a*s
+		tgp.rq.MulCoeffsMontgomeryAndAdd(a, sk, share)
+		tgp.rq.InvNTT(share, share)
+
+		if tgp.Parent != nil {
+			// a*s + e, with e the smudging noise that floods the noise of the products
+			tgp.rq.Add(share, tgp.smudgingSampler.ReadNew(), share)
+
+			plain := bfv.NewPlaintext(tgp.params)
+			tgp.Encoder.EncodeUint(*outputs[k], plain)
+
+			// a*s - c + e
+			tgp.rq.Sub(share, plain.Value, share)
+		}
+
+		round.decryptionShares[k] = share
 	}
+}
 
-	round.decryptionShare = share
+// inputNoise returns the bound of the noise of the aggregated encryptions of
+// the inputs, of n encryptions under the secret keys, or under the public key
+// of the threshold key.
+func (tgp *MHETripleGenProtocol) inputNoise() *big.Int {
+	noise := smudging.FreshNoise(tgp.params)
+	if tgp.ThresholdKey != nil {
+		noise = smudging.PublicKeyNoise(tgp.params, len(tgp.tree))
+	}
+	return noise.Mul(noise, big.NewInt(int64(len(tgp.tree))))
+}
+
+// mulNoise returns the heuristic bound of the noise of the relinearized product
+// of ciphertexts of noise e1 and e2, under the collective key of the parties.
+func (tgp *MHETripleGenProtocol) mulNoise(e1, e2 *big.Int) *big.Int {
+	return smudging.MulNoise(tgp.params, len(tgp.tree), e1, e2)
+}
 
+// productNoise returns the bound of the noise of the products decrypted
+// collectively: enc(a)*enc(b), and enc(alpha) times enc(a), enc(b) and
+// enc(a)*enc(b) for authenticated triples, enc(alpha) being aggregated as the
+// inputs.
+func (tgp *MHETripleGenProtocol) productNoise() *big.Int {
+	input := tgp.inputNoise()
+	noise := tgp.mulNoise(input, input)
+	if tgp.MACKey != nil {
+		noise = tgp.mulNoise(input, noise)
+	}
+	return noise
+}
+
+// decryptionNoise returns the bound of the noise of the collective decryption
+// of the products: theirs, and the smudging noise of the decryption shares of
+// the parties but the root, along with the wraps of the subtraction of their
+// shares of the outputs.
+func (tgp *MHETripleGenProtocol) decryptionNoise() *big.Int {
+	noise := new(big.Int).Add(tgp.smudgingSampler.Bound, smudging.WrapNoise(tgp.params))
+	noise.Mul(noise, big.NewInt(int64(len(tgp.tree)-1)))
+	return noise.Add(noise, tgp.productNoise())
 }
 
 func (tgp *MHETripleGenProtocol) rootFinalize(round *MHETripleGenRound) {
 
-	tgp.rq.Add(round.encC.Value[0], round.decryptionShare, round.encC.Value[0])
-	pt := &bfv.Plaintext{&rlwe.Plaintext{Value: round.encC.Value[0]}}
-	round.c = tgp.Encoder.DecodeUintNew(pt)
+	outputs := tgp.outputs(round)
+	for k, ct := range round.products {
+		tgp.rq.Add(ct.Value[0], round.decryptionShares[k], ct.Value[0])
+		pt := &bfv.Plaintext{Plaintext: &rlwe.Plaintext{Value: ct.Value[0]}}
+		*outputs[k] = tgp.Encoder.DecodeUintNew(pt)
+	}
 }
 
 func (tgp *MHETripleGenProtocol) decryptTriples(round *MHETripleGenRound) (triples []Triple) {
@@ -360,75 +675,37 @@ func (tgp *MHETripleGenProtocol) decryptTriples(round *MHETripleGenRound) (tripl
 		triples[i].A = round.a[i]
 		triples[i].B = round.b[i]
 		triples[i].C = round.c[i]
+		if tgp.MACKey != nil {
+			triples[i].MacA = round.macA[i]
+			triples[i].MacB = round.macB[i]
+			triples[i].MacC = round.macC[i]
+		}
 	}
 
 	return triples
 }
 
-func (tgp *MHETripleGenProtocol) BindNetwork(nw *TCPNetworkStruct) {
+// tripleChannel returns the Triples channel, for tripleGenerator.
+func (tgp *MHETripleGenProtocol) tripleChannel() <-chan Triple {
+	return tgp.Triples
+}
 
-	var binds []*MHETripleGenRemote
+func (tgp *MHETripleGenProtocol) BindNetwork(sess *Session) {
+	var remotes []*MHETripleGenRemote
 	if tgp.Parent != nil {
-		binds = append(binds, tgp.Parent)
+		remotes = append(remotes, tgp.Parent)
 	}
-
-	for _, i := range tgp.Children {
-		binds = append(binds, i)
+	for _, rp := range tgp.Children {
+		remotes = append(remotes, rp)
 	}
 
-	for _, rp := range binds {
-
-		conn := nw.Conns[rp.ID]
-
-		// Receiving loop from remote
-		go func(conn net.Conn, rp *MHETripleGenRemote) {
-
-			for {
-				var id uint64
-				var err error
-				var datalen uint64
-				var round uint64
-
-				err = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
-				if err != nil {
-					panic(fmt.Errorf("SetReadDeadline failed:", err))
-				}
-
-				err = binary.Read(conn, binary.BigEndian, &id)
-				if err == io.EOF {
-					return
-				}
-				check(err)
-				check(binary.Read(conn, binary.BigEndian, &datalen))
-
-				ctBuff := make([]byte, datalen, datalen)
-				_, err = io.ReadFull(conn, ctBuff)
-				check(err)
-				//check(ct.UnmarshalBinary(ctBuff))
-				check(binary.Read(conn, binary.BigEndian, &round))
-				msg := MHETripleGenMessage{
-					PartyID: PartyID(id),
-					Data:    ctBuff,
-					Round:   int(round),
-				}
-				//fmt.Println(tgp, "receiving", &msg, "from", rp)
-				tgp.Chan <- msg
-			}
-		}(conn, rp)
-
-		// Sending loop of remote
-		go func(conn net.Conn, rp *MHETripleGenRemote) {
-			var m MHETripleGenMessage
-			var open = true
-			for open {
-				m, open = <-rp.Chan
-				//fmt.Println(tgp, "sending", &m, "to", rp)
-				check(binary.Write(conn, binary.BigEndian, m.PartyID))
-				check(binary.Write(conn, binary.BigEndian, uint64(len(m.Data))))
-				_, err := conn.Write(m.Data)
-				check(err)
-				check(binary.Write(conn, binary.BigEndian, uint64(m.Round)))
-			}
-		}(conn, rp)
+	// In the threshold variant, the failure of a child is also reported by
+	// the session, and excludes it
+	var tolerated func(PartyID) bool
+	if tgp.ThresholdKey != nil {
+		tolerated = func(peer PartyID) bool {
+			return tgp.Parent == nil || peer != tgp.Parent.ID
+		}
 	}
+	tgp.bindMessages(sess, tgp.Chan, remotes, tolerated)
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// TestMHETripleGenSeedsUnique checks that the CRPs of enc(a) and enc(b),
+// identified by their seed and index, are not used twice by the sessions of
+// a run, nor by two runs, nor by the encryption of the MAC key.
+func TestMHETripleGenSeedsUnique(t *testing.T) {
+	params := tplParameters(false)
+	sk := bfv.NewKeyGenerator(params).GenSecretKey()
+	rlk := bfv.NewKeyGenerator(params).GenRelinearizationKey(sk, 1)
+	peers := map[PartyID]string{0: "", 1: ""}
+	tree := NewTree(peers, 2)
+
+	seen := make(map[string]string)
+	for _, run := range []RunID{{1}, {2}} {
+		lp, err := NewLocalParty(0, peers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := newMux(lp, nil)
+		mux.SetRun(run)
+		seen[fmt.Sprintf("%x/0", macKeySeed(run, 0))] = fmt.Sprintf("run %s, MAC key", run)
+		for session := uint64(0); session < 3; session++ {
+			tgp := lp.NewMHETripleGenProtocol(params, sk, rlk, tree)
+			tgp.BindNetwork(openSession(t, mux, ProtocolMHETripleGen, session))
+			for batch := uint64(0); batch < 3; batch++ {
+				round, err := tgp.genInput(batch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, sct := range []*SeededCiphertext{round.seededA, round.seededB} {
+					key := fmt.Sprintf("%x/%d", sct.Seed, sct.Index)
+					at := fmt.Sprintf("run %s, session %d, batch %d", run, session, batch)
+					if previous, used := seen[key]; used {
+						t.Fatalf("CRP %s of %s already used in %s", key, at, previous)
+					}
+					seen[key] = at
+				}
+			}
+			if err := tgp.unbindNetwork(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// STRAGGLER_TIMEOUT is the time a party waits for the messages of a round of
+// a batch from each level of its subtree, in the threshold variant of the MHE
+// triple generation, before it excludes the children that did not send theirs.
+const STRAGGLER_TIMEOUT = 5 * time.Second
+
+var ErrBelowThreshold = errors.New("fewer parties than the threshold")
+
+// thresholdSession is the state of a session of the threshold variant of the
+// MHE triple generation.
+//
+// Each node of the tree waits for the enc(a), enc(b) of its children for at
+// most STRAGGLER_TIMEOUT per level of its subtree, and then relays the
+// aggregation of the ones it received along with the set of parties whose
+// inputs they aggregate. The root decrypts enc(c) with the parties of the
+// batch, whose shares of the threshold key are weighted by their Lagrange
+// coefficients, so that the parties excluded from the batch are not needed.
+// The children that straggle, or whose connection fails, are excluded for the
+// rest of the session.
+//
+// A batch is lost if a party fails after its inputs were aggregated, since
+// the other parties miss its shares of a and b. The root then discards the
+// batch, and sends the outcome of each batch down the tree in a last round.
+// The triples of a batch are only valid among the parties of the batch: the
+// session generates batches until enough of them have the parties common to
+// all the batches, and only outputs these ones, once it is done.
+type thresholdSession struct {
+	*MHETripleGenProtocol
+
+	nBatches  uint64
+	rounds    map[uint64]*MHETripleGenRound
+	completed map[uint64]*thresholdBatch
+	waiting   awaited
+	deadlines map[step]time.Time
+	excluded  map[PartyID]bool
+	timeout   time.Duration
+
+	parties                   []PartyID // common to all the batches so far
+	started, decided, horizon uint64
+}
+
+// thresholdBatch is a batch that completed, with the parties among which its
+// triples are shared.
+type thresholdBatch struct {
+	parties []PartyID
+	triples []Triple
+}
+
+func (tgp *MHETripleGenProtocol) listenThreshold(ctx context.Context, nTriple uint64) error {
+	ts := &thresholdSession{
+		MHETripleGenProtocol: tgp,
+		nBatches:             numBatches(nTriple, tgp.n),
+		rounds:               make(map[uint64]*MHETripleGenRound),
+		completed:            make(map[uint64]*thresholdBatch),
+		waiting:              make(awaited),
+		deadlines:            make(map[step]time.Time),
+		excluded:             make(map[PartyID]bool),
+		timeout:              time.Duration(tgp.tree.height(tgp.ID)) * STRAGGLER_TIMEOUT,
+	}
+
+	if err := ts.fill(); err != nil {
+		return err
+	}
+	for ts.valid() < ts.nBatches {
+		m, err := ts.next(ctx)
+		if err != nil {
+			return err
+		}
+		if m.err != nil {
+			err = ts.exclude(m)
+		} else {
+			for m.Batch >= ts.started {
+				if err := ts.start(); err != nil {
+					return err
+				}
+			}
+			err = ts.handle(m, ts.rounds[m.Batch])
+		}
+		if err == nil {
+			err = ts.fill()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The batches are output in order, whatever the batches discarded in between
+	var batches []uint64
+	for batch, tb := range ts.completed {
+		if sameParties(tb.parties, ts.parties) {
+			batches = append(batches, batch)
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i] < batches[j] })
+	output := newTripleOutput(tgp.Triples, nTriple)
+	for i, batch := range batches {
+		if err := output.add(ctx, uint64(i), ts.completed[batch].triples); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("\t\t%d batches of %d discarded, with parties %v\n", ts.decided-uint64(len(batches)), ts.decided, ts.parties)
+	return nil
+}
+
+// valid returns the number of completed batches with the parties common to
+// all the batches.
+func (ts *thresholdSession) valid() (n uint64) {
+	for _, tb := range ts.completed {
+		if sameParties(tb.parties, ts.parties) {
+			n++
+		}
+	}
+	return n
+}
+
+// fill starts batches up to BATCH_WINDOW ahead, as long as they may be
+// needed. The enc(a), enc(b) of the children for a batch can arrive before
+// the party started it, but not before it decided BATCH_WINDOW batches less.
+func (ts *thresholdSession) fill() error {
+	for ; ts.horizon < ts.decided+BATCH_WINDOW; ts.horizon++ {
+		for id := range ts.Children {
+			if !ts.excluded[id] {
+				ts.waiting.expect(ts.horizon, 0, id)
+			}
+		}
+	}
+	for ts.started-ts.decided < BATCH_WINDOW && ts.valid()+ts.started-ts.decided < ts.nBatches {
+		if err := ts.start(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *thresholdSession) start() error {
+	round, err := ts.genInput(ts.started)
+	if err != nil {
+		return err
+	}
+	round.parties = []PartyID{ts.ID}
+	ts.rounds[round.batch] = round
+	ts.started++
+	return ts.collected(round, 0)
+}
+
+// collected moves the batch of round to the next round once the messages of
+// round r of all the children it waits for are received, or they are
+// excluded. Until then, it sets the deadline of the round.
+func (ts *thresholdSession) collected(round *MHETripleGenRound, r uint64) error {
+	s := step{Batch: round.batch, Round: r}
+	if ts.waiting[s] != nil {
+		if _, exists := ts.deadlines[s]; !exists {
+			ts.deadlines[s] = time.Now().Add(ts.timeout)
+		}
+		return nil
+	}
+	delete(ts.deadlines, s)
+	if r == 0 {
+		return ts.relayInputs(round)
+	}
+	return ts.relayDecryptionShares(round)
+}
+
+// handle processes a message of the batch of round.
+func (ts *thresholdSession) handle(m MHETripleGenMessage, round *MHETripleGenRound) error {
+	switch m.Round {
+	case 0:
+		// The enc(a), enc(b) of the parties of the subtree of the child
+		parties, data, err := unmarshalParties(m.Data, len(ts.Peers))
+		if err == nil && len(parties) == 0 {
+			err = fmt.Errorf("%w: no party", ErrMalformedMessage)
+		}
+		for _, id := range parties {
+			if err == nil && !ts.tree.inSubtree(id, m.PartyID) {
+				err = fmt.Errorf("%w: party %d is not in the subtree of the sender", ErrMalformedMessage, id)
+			}
+		}
+		var polys []*ring.Poly
+		if err == nil {
+			polys, err = ts.unmarshalPolys(data, 4)
+		}
+		if err != nil {
+			return ts.messageError(m, err)
+		}
+		ts.rq.Add(round.encB.Value[0], polys[0], round.encB.Value[0])
+		ts.rq.Add(round.encB.Value[1], polys[1], round.encB.Value[1])
+		ts.rq.Add(round.encA.Value[0], polys[2], round.encA.Value[0])
+		ts.rq.Add(round.encA.Value[1], polys[3], round.encA.Value[1])
+		round.parties = append(round.parties, parties...)
+		sort.Slice(round.parties, func(i, j int) bool { return round.parties[i] < round.parties[j] })
+		round.included = append(round.included, m.PartyID)
+		return ts.collected(round, 0)
+
+	case 1:
+		// The parties of the batch and the c1 of the products
+		parties, data, err := unmarshalParties(m.Data, len(ts.Peers))
+		if err == nil && (len(parties) < ts.ThresholdKey.Threshold || !includesParties(parties, round.parties)) {
+			err = fmt.Errorf("%w: invalid parties %v for the batch", ErrMalformedMessage, parties)
+		}
+		var polys []*ring.Poly
+		if err == nil {
+			polys, err = ts.unmarshalPolys(data, ts.nOutputs())
+		}
+		if err != nil {
+			return ts.messageError(m, err)
+		}
+		return ts.decrypt(round, parties, polys, m.Data)
+
+	case 2:
+		// The decryption shares of the subtree of the child, or nothing if it failed
+		if len(m.Data) == 0 {
+			round.failed = true
+		} else if err := ts.aggregateDecryptionShare(m.Data, round); err != nil {
+			return ts.messageError(m, err)
+		}
+		return ts.collected(round, 2)
+
+	case 3:
+		if len(m.Data) != 1 || m.Data[0] > 1 {
+			return ts.messageError(m, fmt.Errorf("%w: invalid outcome", ErrMalformedMessage))
+		}
+		ts.decide(round, m.Data[0] == 1)
+	}
+	return nil
+}
+
+// relayInputs relays the aggregation of enc(a), enc(b) to the parent, or,
+// at the root, computes the products and starts their decryption.
+func (ts *thresholdSession) relayInputs(round *MHETripleGenRound) error {
+	if ts.Parent != nil {
+		data := marshalParties(round.parties)
+		data = append(data, marshalPolys([]*ring.Poly{round.encB.Value[0], round.encB.Value[1], round.encA.Value[0], round.encA.Value[1]})...)
+		ts.Parent.Chan <- MHETripleGenMessage{PartyID: ts.ID, Batch: round.batch, Data: data, Round: 0}
+		ts.waiting.expect(round.batch, 1, ts.Parent.ID)
+		return nil
+	}
+
+	if len(round.parties) < ts.ThresholdKey.Threshold {
+		return fmt.Errorf("%w: batch %d with parties %v", ErrBelowThreshold, round.batch, round.parties)
+	}
+	ts.Evaluator.Mul(round.encA, round.encB, round.tmp)
+	ts.Evaluator.Relinearize(round.tmp, round.encC)
+	round.products = []*bfv.Ciphertext{round.encC}
+	polys := []*ring.Poly{round.encC.Value[1].CopyNew()}
+	ts.rq.NTT(polys[0], polys[0])
+	data := append(marshalParties(round.parties), marshalPolys(polys)...)
+	return ts.decrypt(round, round.parties, polys, data)
+}
+
+// decrypt computes the decryption shares of the party for the parties of the
+// batch, and relays the c1 of the products to the children included in the
+// batch. The batch fails if one of them was excluded since.
+func (ts *thresholdSession) decrypt(round *MHETripleGenRound, parties []PartyID, polys []*ring.Poly, data []byte) error {
+	round.parties = parties
+	if ts.parties == nil {
+		ts.parties = parties
+	} else {
+		ts.parties = intersectParties(ts.parties, parties)
+	}
+
+	// The share of the secret key of the party among the parties of the batch
+	lambda := lagrangeCoefficient(ts.ID, parties, ts.rq.ModulusBigint)
+	sk := ts.rq.NewPoly()
+	ts.rq.MulScalarBigint(ts.ThresholdKey.Share, lambda, sk)
+	ts.decryptionShares(polys, sk, round)
+
+	for _, child := range round.included {
+		if ts.excluded[child] {
+			round.failed = true
+			continue
+		}
+		ts.Children[child].Chan <- MHETripleGenMessage{PartyID: ts.ID, Batch: round.batch, Data: data, Round: 1}
+		ts.waiting.expect(round.batch, 2, child)
+	}
+	return ts.collected(round, 2)
+}
+
+// relayDecryptionShares relays the aggregation of the decryption shares to
+// the parent, or nothing if the batch failed, or, at the root, decrypts the
+// products and decides the outcome of the batch.
+func (ts *thresholdSession) relayDecryptionShares(round *MHETripleGenRound) error {
+	if ts.Parent != nil {
+		var data []byte
+		if !round.failed {
+			data = marshalPolys(round.decryptionShares)
+		}
+		ts.Parent.Chan <- MHETripleGenMessage{PartyID: ts.ID, Batch: round.batch, Data: data, Round: 2}
+		ts.waiting.expect(round.batch, 3, ts.Parent.ID)
+		return nil
+	}
+	if !round.failed {
+		ts.rootFinalize(round)
+	}
+	ts.decide(round, !round.failed)
+	return nil
+}
+
+// decide relays the outcome of the batch to the children included in it, and
+// keeps its triples if it completed.
+func (ts *thresholdSession) decide(round *MHETripleGenRound, ok bool) {
+	outcome := []byte{0}
+	if ok {
+		outcome[0] = 1
+	}
+	for _, child := range round.included {
+		if !ts.excluded[child] {
+			ts.Children[child].Chan <- MHETripleGenMessage{PartyID: ts.ID, Batch: round.batch, Data: outcome, Round: 3}
+		}
+	}
+	if ok {
+		ts.completed[round.batch] = &thresholdBatch{parties: round.parties, triples: ts.decryptTriples(round)}
+	}
+	delete(ts.rounds, round.batch)
+	ts.decided++
+}
+
+// exclude excludes for good the child that failed, or the children that
+// straggled in the round of the batch of m, and moves on the batches that
+// waited for them. The batches whose decryption shares they did not send
+// fail.
+func (ts *thresholdSession) exclude(m MHETripleGenMessage) error {
+	stragglers := []PartyID{m.PartyID}
+	if errors.Is(m.err, ErrTimeout) {
+		stragglers = stragglers[:0]
+		for id := range ts.waiting[step{Batch: m.Batch, Round: uint64(m.Round)}] {
+			stragglers = append(stragglers, id)
+		}
+	}
+	for _, id := range stragglers {
+		fmt.Printf("\t\t%s excluding party %d: %s\n", ts.LocalParty, id, m.err)
+		ts.excluded[id] = true
+		for _, s := range ts.waiting.drop(id) {
+			round, started := ts.rounds[s.Batch]
+			if !started {
+				continue
+			}
+			if s.Round == 2 {
+				round.failed = true
+			}
+			if err := ts.collected(round, s.Round); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// next returns the next expected message of the session, the failure of a
+// child or the deadline of a round as a message with an error, or the error
+// that stops the protocol.
+func (ts *thresholdSession) next(ctx context.Context) (MHETripleGenMessage, error) {
+	for {
+		// The deadlines of the rounds that are not waiting anymore are dropped
+		var deadline time.Time
+		var expiring step
+		for s, d := range ts.deadlines {
+			if ts.waiting[s] == nil {
+				delete(ts.deadlines, s)
+			} else if deadline.IsZero() || d.Before(deadline) {
+				deadline, expiring = d, s
+			}
+		}
+		wait := READ_TIMEOUT
+		if !deadline.IsZero() {
+			wait = time.Until(deadline)
+		}
+		timer := time.NewTimer(wait)
+
+		select {
+		case m := <-ts.Chan:
+			timer.Stop()
+			if m.err != nil {
+				var peerErr *PeerError
+				if errors.As(m.err, &peerErr) && ts.Children[peerErr.Peer] != nil {
+					if ts.excluded[peerErr.Peer] {
+						continue
+					}
+					return MHETripleGenMessage{PartyID: peerErr.Peer, err: m.err}, nil
+				}
+				if err := ts.waiting.failure(ts.session.SessionKey, m.err); err != nil {
+					return m, err
+				}
+				continue
+			}
+			// The late messages of the excluded children are dropped
+			if ts.excluded[m.PartyID] {
+				continue
+			}
+			if !ts.waiting.receive(m.PartyID, m.Batch, uint64(m.Round)) {
+				return m, ts.messageError(m, ErrUnexpectedMessage)
+			}
+			return m, nil
+		case err := <-ts.sendErrs:
+			timer.Stop()
+			return MHETripleGenMessage{}, err
+		case <-timer.C:
+			if deadline.IsZero() {
+				return MHETripleGenMessage{}, ts.waiting.timeout(ts.session.SessionKey)
+			}
+			return MHETripleGenMessage{Batch: expiring.Batch, Round: int(expiring.Round), err: ErrTimeout}, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return MHETripleGenMessage{}, ctx.Err()
+		}
+	}
+}
+
+// sameParties reports whether the sorted sets of parties a and b are equal.
+func sameParties(a, b []PartyID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// includesParties reports whether the set of parties a includes b.
+func includesParties(a, b []PartyID) bool {
+	return len(intersectParties(a, b)) == len(b)
+}
+
+// intersectParties returns the parties of the sorted set a that are in b.
+func intersectParties(a, b []PartyID) []PartyID {
+	in := make(map[PartyID]bool, len(b))
+	for _, id := range b {
+		in[id] = true
+	}
+	var parties []PartyID
+	for _, id := range a {
+		if in[id] {
+			parties = append(parties, id)
+		}
+	}
+	return parties
+}
+
+// checkThreshold checks that the threshold of the parties needed to generate
+// the triples, if any, is valid for the experiment. The MAC key and the checks
+// of the triples are shared among all the parties, and need them all.
+func checkThreshold(threshold, nParties int, mhe, authenticated bool, tripleCheck TripleCheck) error {
+	switch {
+	case threshold == 0:
+		return nil
+	case !mhe:
+		return fmt.Errorf("the triples are only generated with a threshold of the parties by mhe")
+	case threshold < 2 || threshold > nParties:
+		return fmt.Errorf("the threshold should be between 2 and the number of parties")
+	case authenticated || tripleCheck != CheckNone:
+		return fmt.Errorf("the triples generated with a threshold of the parties can be neither authenticated nor checked")
+	}
+	return nil
+}
+
+// checkThresholdTopology checks, if threshold is set, that the parties of the
+// topology connect directly to each other over TLS, which authenticates the
+// ephemeral keys that encrypt the shares of the secret keys, unless they run
+// in this process. A relay is rejected even with TLS, which only covers the
+// hop to the relay.
+func checkThresholdTopology(threshold int, topo *Topology, local bool) error {
+	if threshold == 0 {
+		return nil
+	}
+	if _, isRelayed := topo.Relay(); isRelayed {
+		return fmt.Errorf("the threshold key generation cannot run through a relay")
+	}
+	if !local && topo.CA == "" {
+		return fmt.Errorf("the threshold key generation requires TLS between the parties")
+	}
+	return nil
+}
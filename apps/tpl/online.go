@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+var (
+	ErrTriplesMismatch = errors.New("parties reserved different triples")
+	ErrOutputMismatch  = errors.New("output does not match the evaluation in the clear")
+	ErrMACCheckFailed  = errors.New("opened values do not match their MACs")
+)
+
+// TripleSource provides the triples consumed by the online phase, as does a
+// TripleStore. Plan returns the next reservation of n triples without
+// consuming them, so that the parties agree on it before Reserve consumes the
+// triples of this reservation. MACKeyShare returns the share of the party of
+// the MAC key of the authenticated triples of a run.
+type TripleSource interface {
+	Plan(n uint64) (*Reservation, error)
+	Reserve(r *Reservation) ([]Triple, error)
+	MACKeyShare(run RunID) (uint64, bool)
+}
+
+// TripleSlice is a TripleSource over the triples generated by a run, which
+// belong to Batches, with the MAC key share of the party if they are
+// authenticated.
+type TripleSlice struct {
+	Triples      []Triple
+	Batches      []*StoredBatch
+	MACKey       *MACKey
+	reservations uint64
+	cursor       uint64
+}
+
+func (ts *TripleSlice) Plan(n uint64) (*Reservation, error) {
+	if n > uint64(len(ts.Triples))-ts.cursor {
+		return nil, fmt.Errorf("%w: %d requested, %d available", ErrTripleStoreExhausted, n, uint64(len(ts.Triples))-ts.cursor)
+	}
+	return &Reservation{ID: ts.reservations, First: ts.cursor, Count: n, Batches: batchesOf(ts.Batches, ts.cursor, n)}, nil
+}
+
+func (ts *TripleSlice) Reserve(r *Reservation) ([]Triple, error) {
+	if r.ID != ts.reservations || r.First != ts.cursor || r.Count > uint64(len(ts.Triples))-ts.cursor {
+		return nil, fmt.Errorf("%s is not the next reservation of the slice", r)
+	}
+	ts.reservations++
+	ts.cursor += r.Count
+	return ts.Triples[r.First : r.First+r.Count], nil
+}
+
+func (ts *TripleSlice) MACKeyShare(run RunID) (uint64, bool) {
+	if ts.MACKey == nil || len(ts.Batches) == 0 || ts.Batches[0].Run != run {
+		return 0, false
+	}
+	return ts.MACKey.Share, true
+}
+
+// OnlineProtocol evaluates an arithmetic circuit over Z_t on inputs shared
+// additively among the parties, with the Beaver multiplication: a
+// multiplication gate consumes a triple (a, b, c), and opens d = x - a and
+// e = y - b to compute the shares of x*y = c + d*b + e*a + d*e. The other
+// gates are evaluated locally, and the multiplications are evaluated by
+// rounds of the schedule of the circuit, one opening per round.
+//
+// An input of a party is shared as the input itself for the party and 0 for
+// the others, which hides it since the only values opened are masked by the
+// triples, or are outputs.
+//
+// If the reserved triples are authenticated under the same MAC key, the
+// parties also evaluate the circuit on the shares of the MACs of the wires,
+// and check the MACs of the opened values with the MAC check of SPDZ, before
+// and after opening the outputs. The inputs are then authenticated with the
+// first triples: the parties open d = x - a for the input x and the triple
+// (a, b, c), and share x as d + a, with the MAC alpha*d + alpha*a.
+type OnlineProtocol struct {
+	*OpenProtocol
+}
+
+func (lp *LocalParty) NewOnlineProtocol(t uint64, tree Tree) *OnlineProtocol {
+	return &OnlineProtocol{OpenProtocol: lp.NewOpenProtocol(t, tree)}
+}
+
+// Run evaluates the circuit on the inputs of the party, given by the wire of
+// their input gate, with the triples reserved from source, and returns the
+// outputs of the circuit. It first checks that all the parties plan to
+// reserve the same triples, of the same batches, before reserving them. It
+// stops with ErrMACCheckFailed if authenticated triples reveal that a value
+// was not opened correctly, and with an error if ctx is cancelled, if a peer
+// fails, or if nothing is received from the peers for READ_TIMEOUT.
+func (op *OnlineProtocol) Run(ctx context.Context, c *Circuit, inputs map[int]uint64, source TripleSource) ([]uint64, error) {
+	outputs, err := op.evaluate(ctx, c, inputs, source)
+	if errUnbind := op.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+func (op *OnlineProtocol) evaluate(ctx context.Context, c *Circuit, inputs map[int]uint64, source TripleSource) ([]uint64, error) {
+	reservation, err := source.Plan(c.Multiplications())
+	if err != nil {
+		return nil, err
+	}
+	var auth *macCheck
+	if _, ok := macKeyShare(reservation, source); ok {
+		if reservation, err = source.Plan(c.Multiplications() + c.Inputs()); err != nil {
+			return nil, err
+		}
+		key, ok := macKeyShare(reservation, source)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s of triples not authenticated under the same MAC key", ErrTriplesMismatch, reservation)
+		}
+		auth = &macCheck{key: key}
+	}
+	if err := op.agree(ctx, reservation); err != nil {
+		return nil, err
+	}
+	triples, err := source.Reserve(reservation)
+	if err != nil {
+		return nil, err
+	}
+
+	wires := make([]uint64, len(c.Gates))
+	var macs []uint64
+	if auth != nil {
+		macs = make([]uint64, len(c.Gates))
+	}
+	if triples, err = op.shareInputs(ctx, c, inputs, triples, wires, macs, auth); err != nil {
+		return nil, err
+	}
+
+	// The values masked by the triples of the multiplications of a round are opened together
+	schedule := c.Schedule()
+	for d, linear := range schedule.Linear {
+		for _, w := range linear {
+			g := c.Gates[w]
+			if err := op.evaluateLinear(g, w, wires, op.publicShare(g.Value%op.t)); err != nil {
+				return nil, err
+			}
+			if auth != nil {
+				op.evaluateLinear(g, w, macs, auth.mul(g.Value%op.t, op.bredParam, op.t))
+			}
+		}
+		if d == len(schedule.Mul) {
+			break
+		}
+
+		muls := schedule.Mul[d]
+		masked := make([]uint64, 2*len(muls))
+		for k, w := range muls {
+			g, t := c.Gates[w], triples[k]
+			masked[2*k] = ring.CRed(wires[g.In[0]]+op.t-t.A, op.t)
+			masked[2*k+1] = ring.CRed(wires[g.In[1]]+op.t-t.B, op.t)
+		}
+		opened, err := op.Open(ctx, masked)
+		if err != nil {
+			return nil, err
+		}
+		for k, w := range muls {
+			g, t := c.Gates[w], triples[k]
+			de := ring.BRed(opened[2*k], opened[2*k+1], op.t, op.bredParam)
+			wires[w] = op.beaver(t.A, t.B, t.C, op.publicShare(de), opened[2*k], opened[2*k+1])
+			if auth != nil {
+				auth.add(opened[2*k], ring.CRed(macs[g.In[0]]+op.t-t.MacA, op.t))
+				auth.add(opened[2*k+1], ring.CRed(macs[g.In[1]]+op.t-t.MacB, op.t))
+				macs[w] = op.beaver(t.MacA, t.MacB, t.MacC, auth.mul(de, op.bredParam, op.t), opened[2*k], opened[2*k+1])
+			}
+		}
+		triples = triples[len(muls):]
+	}
+
+	// The openings are checked before the outputs are opened, so that a
+	// cheating party learns nothing from them
+	if auth != nil {
+		if err := op.checkMACs(ctx, auth); err != nil {
+			return nil, err
+		}
+	}
+	shares := make([]uint64, len(c.Outputs))
+	for i, w := range c.Outputs {
+		shares[i] = wires[w]
+	}
+	outputs, err := op.Open(ctx, shares)
+	if err != nil || auth == nil {
+		return outputs, err
+	}
+	for i, w := range c.Outputs {
+		auth.add(outputs[i], macs[w])
+	}
+	if err := op.checkMACs(ctx, auth); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// macKeyShare returns the share of the party of the MAC key of the triples of
+// the reservation, if they are all authenticated under the MAC key of the
+// same run.
+func macKeyShare(r *Reservation, source TripleSource) (uint64, bool) {
+	if len(r.Batches) == 0 {
+		return 0, false
+	}
+	for _, b := range r.Batches {
+		if !b.MAC || b.Run != r.Batches[0].Run {
+			return 0, false
+		}
+	}
+	return source.MACKeyShare(r.Batches[0].Run)
+}
+
+// shareInputs sets the shares of the input wires of the party, and of their
+// MACs if auth is set, with the first triples, and returns the other triples.
+func (op *OnlineProtocol) shareInputs(ctx context.Context, c *Circuit, inputs map[int]uint64, triples []Triple, wires, macs []uint64, auth *macCheck) ([]Triple, error) {
+	var ws []int
+	for w, g := range c.Gates {
+		if g.Op != GateInput {
+			continue
+		}
+		ws = append(ws, w)
+		if g.Party == op.ID {
+			wires[w] = inputs[w] % op.t
+		}
+	}
+	if auth == nil || len(ws) == 0 {
+		return triples, nil
+	}
+
+	masked := make([]uint64, len(ws))
+	for k, w := range ws {
+		masked[k] = ring.CRed(wires[w]+op.t-triples[k].A, op.t)
+	}
+	opened, err := op.Open(ctx, masked)
+	if err != nil {
+		return nil, err
+	}
+	for k, w := range ws {
+		wires[w] = ring.CRed(triples[k].A+op.publicShare(opened[k]), op.t)
+		macs[w] = ring.CRed(triples[k].MacA+auth.mul(opened[k], op.bredParam, op.t), op.t)
+	}
+	return triples[len(ws):], nil
+}
+
+// evaluateLinear computes the share of the wire w of the gate g, which is not
+// a multiplication, given the share of the party of its constant, if any. The
+// shares of the inputs are set beforehand.
+func (op *OnlineProtocol) evaluateLinear(g Gate, w int, shares []uint64, constant uint64) error {
+	switch g.Op {
+	case GateInput:
+	case GateConst:
+		shares[w] = constant
+	case GateAdd:
+		shares[w] = ring.CRed(shares[g.In[0]]+shares[g.In[1]], op.t)
+	case GateSub:
+		shares[w] = ring.CRed(shares[g.In[0]]+op.t-shares[g.In[1]], op.t)
+	case GateMulConst:
+		shares[w] = ring.BRed(shares[g.In[0]], g.Value%op.t, op.t, op.bredParam)
+	default:
+		return fmt.Errorf("unknown gate %q", g.Op)
+	}
+	return nil
+}
+
+// beaver returns the share of x*y from the shares of a triple (a, b, c) and
+// of d*e, and the opened d = x - a and e = y - b. It computes the share of
+// the MAC of x*y from the shares of the MACs of the triple, and of alpha*d*e.
+func (op *OnlineProtocol) beaver(a, b, c, de, d, e uint64) uint64 {
+	z := ring.CRed(c+ring.BRed(d, b, op.t, op.bredParam), op.t)
+	z = ring.CRed(z+ring.BRed(e, a, op.t, op.bredParam), op.t)
+	return ring.CRed(z+de, op.t)
+}
+
+// macCheck holds the values opened since the last MAC check, with the shares
+// of the party of their MACs, under its share of the MAC key.
+type macCheck struct {
+	key    uint64
+	values []uint64
+	macs   []uint64
+}
+
+func (auth *macCheck) add(value, mac uint64) {
+	auth.values = append(auth.values, value)
+	auth.macs = append(auth.macs, mac)
+}
+
+// mul returns the share of the party of the MAC of the public value v.
+func (auth *macCheck) mul(v uint64, bredParam []uint64, t uint64) uint64 {
+	return ring.BRed(auth.key, v, t, bredParam)
+}
+
+// checkMACs checks the values of auth against their MACs, with the MAC check
+// of SPDZ: the parties open random coefficients r_j, and each party commits
+// to sigma_i = sum_j r_j*mac_ij - alpha_i*sum_j r_j*y_j, which sum to zero if
+// the values y_j were opened correctly. A party that lies in the openings
+// passes the check with a probability of about 2/t. The coefficients and the
+// sigma_i are opened with OpenCommitted, so that no party chooses its share
+// after seeing the others.
+func (op *OnlineProtocol) checkMACs(ctx context.Context, auth *macCheck) error {
+	coins, err := op.OpenCommitted(ctx, sampleUniformVector(uint64(runNonceLen(op.t)), op.t))
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write([]byte("mac check"))
+	for _, c := range coins {
+		h.Write(marshalUint64s(c))
+	}
+	prng, err := utils.NewKeyedPRNG(h.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	var y, sigma uint64
+	buf := make([]byte, 8)
+	for j := range auth.values {
+		prng.Clock(buf)
+		r := binary.BigEndian.Uint64(buf) % op.t
+		y = ring.CRed(y+ring.BRed(r, auth.values[j], op.t, op.bredParam), op.t)
+		sigma = ring.CRed(sigma+ring.BRed(r, auth.macs[j], op.t, op.bredParam), op.t)
+	}
+	sigma = ring.CRed(sigma+op.t-auth.mul(y, op.bredParam, op.t), op.t)
+	auth.values, auth.macs = nil, nil
+
+	sigmas, err := op.OpenCommitted(ctx, []uint64{sigma})
+	if err != nil {
+		return err
+	}
+	var sum uint64
+	for _, s := range sigmas {
+		sum = ring.CRed(sum+s[0], op.t)
+	}
+	if sum != 0 {
+		return ErrMACCheckFailed
+	}
+	return nil
+}
+
+// agree opens the planned reservations of all the parties, each in its own
+// slots of the opened vector, and checks that they are the same. The slots of
+// a party hold its reservation, followed by the digest of the batches of the
+// triples, on as many values as the nonce of a run.
+func (op *OnlineProtocol) agree(ctx context.Context, r *Reservation) error {
+	digest := digestValues(r.digest(), op.t)
+	n := 3 + len(digest)
+	slots := make([]uint64, n*len(op.Peers))
+	own := slots[n*int(op.ID) : n*int(op.ID)+n]
+	own[0], own[1], own[2] = r.ID%op.t, r.First%op.t, r.Count%op.t
+	copy(own[3:], digest)
+	opened, err := op.Open(ctx, slots)
+	if err != nil {
+		return err
+	}
+	for id := 0; id < len(op.Peers); id++ {
+		other := opened[n*id : n*id+n]
+		if other[0] != own[0] || other[1] != own[1] || other[2] != own[2] {
+			return fmt.Errorf("%w: %s, and party %d reservation %d of triples [%d, %d)", ErrTriplesMismatch, r, id, other[0], other[1], other[1]+other[2])
+		}
+		for i := range digest {
+			if other[3+i] != own[3+i] {
+				return fmt.Errorf("%w: %s of other batches than party %d", ErrTriplesMismatch, r, id)
+			}
+		}
+	}
+	return nil
+}
+
+// digest returns the hash of the reservation and of the batches of its
+// triples: their IDs, runs, sessions, ranges and MACs.
+func (r *Reservation) digest() []byte {
+	h := sha256.New()
+	for _, v := range []uint64{r.ID, r.First, r.Count, uint64(len(r.Batches))} {
+		h.Write(appendUint64(nil, v))
+	}
+	for _, b := range r.Batches {
+		h.Write(appendUint64(nil, b.ID))
+		h.Write(b.Run[:])
+		h.Write([]byte{byte(b.Session.Protocol), boolByte(b.MAC)})
+		for _, v := range []uint64{b.Session.Session, b.First, b.Count} {
+			h.Write(appendUint64(nil, v))
+		}
+	}
+	return h.Sum(nil)
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// digestValues returns the first RUN_NONCE_BITS bits of digest as values
+// modulo t, of runNonceLen(t) values.
+func digestValues(digest []byte, t uint64) []uint64 {
+	x := new(big.Int).SetBytes(digest[:RUN_NONCE_BITS/8])
+	width := uint(bits.Len64(t) - 1)
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), width), big.NewInt(1))
+	values := make([]uint64, runNonceLen(t))
+	for i := range values {
+		values[i] = new(big.Int).And(x, mask).Uint64()
+		x.Rsh(x, width)
+	}
+	return values
+}
+
+// ClientOnline evaluates the circuit over the network of lp, with the test
+// inputs and the triples of the store of the party, and checks its outputs
+// against the evaluation of the circuit in the clear. It returns the
+// communication report of the party.
+func ClientOnline(ctx context.Context, lp *LocalParty, tree Tree, netw Network, t uint64, c *Circuit) (*CommReport, error) {
+	if lp.Store == nil {
+		return nil, fmt.Errorf("the online phase needs a triple store")
+	}
+
+	fmt.Println("> Init")
+
+	// The values are opened along the tree
+	fmt.Print("\testablishing connections...")
+	if err := netw.Connect(ctx, lp, tree.Edges()); err != nil {
+		return nil, err
+	}
+	fmt.Println(" done")
+	mux := NewMux(lp, netw)
+	if err := agreeRun(ctx, lp, mux, t, tree); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("> Online Phase")
+	fmt.Printf("\tevaluating %s, of %d multiplications, in %d rounds...\n", c.Name, c.Multiplications(), len(c.Schedule().Mul))
+	inputs := TestInputs(c, t)
+	session, err := mux.Session(ProtocolOnline, 0)
+	if err != nil {
+		mux.Close()
+		return nil, err
+	}
+	onlineProtocol := lp.NewOnlineProtocol(t, tree)
+	onlineProtocol.BindNetwork(session)
+	start := time.Now()
+	outputs, err := onlineProtocol.Run(ctx, c, inputs, lp.Store)
+	elapsed := time.Since(start)
+	if errClose := mux.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, want := range c.Evaluate(t, inputs) {
+		if outputs[i] != want {
+			return nil, fmt.Errorf("%w: output %d is %d instead of %d", ErrOutputMismatch, i, outputs[i], want)
+		}
+	}
+	fmt.Println("\toutputs ok:", outputs)
+
+	sent, received := session.Sum()
+	fmt.Println("Time:", elapsed.Nanoseconds())
+	fmt.Println("Comm:", sent+received)
+	return NewCommReport(lp, netw, []*Session{session}), nil
+}
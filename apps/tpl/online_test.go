@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// shareMACs sets the shares of the MACs of the triples of the parties under
+// the MAC key whose shares it returns.
+func shareMACs(shares [][]Triple, t uint64) []uint64 {
+	bredParams := ring.BRedParams(t)
+	keys := sampleUniformVector(uint64(len(shares)), t)
+	var alpha uint64
+	for _, k := range keys {
+		alpha = ring.CRed(alpha+k, t)
+	}
+	for k := range shares[0] {
+		var a, b, c uint64
+		for i := range shares {
+			a, b, c = ring.CRed(a+shares[i][k].A, t), ring.CRed(b+shares[i][k].B, t), ring.CRed(c+shares[i][k].C, t)
+		}
+		macs := []uint64{ring.BRed(alpha, a, t, bredParams), ring.BRed(alpha, b, t, bredParams), ring.BRed(alpha, c, t, bredParams)}
+		for i := 0; i < len(shares)-1; i++ {
+			share := sampleUniformVector(3, t)
+			shares[i][k].MacA, shares[i][k].MacB, shares[i][k].MacC = share[0], share[1], share[2]
+			for j := range macs {
+				macs[j] = (macs[j] + t - share[j]) % t
+			}
+		}
+		last := &shares[len(shares)-1][k]
+		last.MacA, last.MacB, last.MacC = macs[0], macs[1], macs[2]
+	}
+	return keys
+}
+
+// TestOnlineMACCheck checks that the online phase evaluates a circuit with
+// authenticated triples, and that it catches a party whose shares do not
+// match their MACs.
+func TestOnlineMACCheck(t *testing.T) {
+	const modulus, nParties = 65537, 3
+	c := PolynomialCircuit(nParties)
+	inputs := TestInputs(c, modulus)
+	nTriples := int(c.Multiplications() + c.Inputs())
+	for _, tc := range []struct {
+		name    string
+		corrupt func(shares [][]Triple, keys []uint64)
+		err     error
+	}{
+		{"correct", func(shares [][]Triple, keys []uint64) {}, nil},
+		{"a of an input triple", func(shares [][]Triple, keys []uint64) { shares[1][0].A = (shares[1][0].A + 1) % modulus }, ErrMACCheckFailed},
+		{"b of a multiplication triple", func(shares [][]Triple, keys []uint64) {
+			shares[2][nTriples-1].B = (shares[2][nTriples-1].B + 5) % modulus
+		}, ErrMACCheckFailed},
+		{"c of a multiplication triple", func(shares [][]Triple, keys []uint64) {
+			shares[0][nTriples-1].C = (shares[0][nTriples-1].C + 1) % modulus
+		}, ErrMACCheckFailed},
+		{"MAC key share", func(shares [][]Triple, keys []uint64) { keys[1] = (keys[1] + 1) % modulus }, ErrMACCheckFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shares := shareTriples(nParties, nTriples, modulus)
+			keys := shareMACs(shares, modulus)
+			tc.corrupt(shares, keys)
+
+			topo := NewDockerTopology(nParties)
+			tree := NewTree(topo.Peers(), 2)
+			outputs := make([][]uint64, nParties)
+			client := func(ctx context.Context, lp *LocalParty, netw Network) (*CommReport, error) {
+				if err := netw.Connect(ctx, lp, tree.Edges()); err != nil {
+					return nil, err
+				}
+				mux := NewMux(lp, netw)
+				defer mux.Close()
+				if _, err := lp.AgreeRunID(ctx, mux, modulus, tree); err != nil {
+					return nil, err
+				}
+				sess, err := mux.Session(ProtocolOnline, 0)
+				if err != nil {
+					return nil, err
+				}
+				source := &TripleSlice{
+					Triples: shares[lp.ID],
+					Batches: []*StoredBatch{{Run: mux.Run(), Count: uint64(nTriples), MAC: true}},
+					MACKey:  &MACKey{Share: keys[lp.ID]},
+				}
+				op := lp.NewOnlineProtocol(modulus, tree)
+				op.BindNetwork(sess)
+				outputs[lp.ID], err = op.Run(ctx, c, inputs, source)
+				return nil, err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_, err := RunLocal(ctx, topo, client, modulus, "", "")
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			for i := range outputs {
+				if want := c.Evaluate(modulus, inputs); !reflect.DeepEqual(outputs[i], want) {
+					t.Fatalf("party %d got outputs %v instead of %v", i, outputs[i], want)
+				}
+			}
+		})
+	}
+}
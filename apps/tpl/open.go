@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// OpenProtocol opens values shared additively modulo t among the parties, by
+// summing their shares up a tree, whose root sends the sum back down. A
+// session can open values several times.
+type OpenProtocol struct {
+	*LocalParty
+
+	Chan     chan MHETripleGenMessage
+	Parent   *MHETripleGenRemote
+	Children map[PartyID]*MHETripleGenRemote
+
+	binding
+
+	t         uint64
+	bredParam []uint64
+	openings  uint64
+	timeout   time.Duration // 0 to wait for the peers indefinitely
+}
+
+func (lp *LocalParty) NewOpenProtocol(t uint64, tree Tree) *OpenProtocol {
+	op := new(OpenProtocol)
+	op.LocalParty = lp
+	op.t = t
+	op.bredParam = ring.BRedParams(t)
+	op.timeout = READ_TIMEOUT
+
+	op.Chan = make(chan MHETripleGenMessage, 32)
+
+	if lp.ID != tree[lp.ID].Parent {
+		op.Parent = &MHETripleGenRemote{
+			ID:   tree[lp.ID].Parent,
+			Chan: make(chan MHETripleGenMessage, 32),
+		}
+	}
+
+	op.Children = make(map[PartyID]*MHETripleGenRemote)
+	for _, child := range tree[lp.ID].Children {
+		op.Children[child] = &MHETripleGenRemote{
+			ID:   child,
+			Chan: make(chan MHETripleGenMessage, 32),
+		}
+	}
+	return op
+}
+
+// Open returns the sum of the shares of the parties. The k-th opening of the
+// session sends the sums of the subtrees up the tree in round 2k, and the
+// total down the tree in round 2k+1.
+func (op *OpenProtocol) Open(ctx context.Context, shares []uint64) ([]uint64, error) {
+	up, down := 2*op.openings, 2*op.openings+1
+	op.openings++
+
+	sum := append([]uint64(nil), shares...)
+	waiting := make(awaited)
+	for _, child := range op.Children {
+		waiting.expect(0, up, child.ID)
+	}
+	for range op.Children {
+		m, err := op.next(ctx, waiting)
+		if err != nil {
+			return nil, err
+		}
+		values, err := unmarshalUint64s(m.Data, len(shares), op.t)
+		if err != nil {
+			return nil, op.messageError(m, err)
+		}
+		sum = addVec(sum, values, op.t)
+	}
+
+	if op.Parent != nil {
+		op.Parent.Chan <- MHETripleGenMessage{PartyID: op.ID, Data: marshalUint64s(sum), Round: int(up)}
+		waiting.expect(0, down, op.Parent.ID)
+		m, err := op.next(ctx, waiting)
+		if err != nil {
+			return nil, err
+		}
+		if sum, err = unmarshalUint64s(m.Data, len(shares), op.t); err != nil {
+			return nil, op.messageError(m, err)
+		}
+	}
+
+	data := marshalUint64s(sum)
+	for _, child := range op.Children {
+		child.Chan <- MHETripleGenMessage{PartyID: op.ID, Data: data, Round: int(down)}
+	}
+	return sum, nil
+}
+
+var ErrCommitment = errors.New("opened values do not match the commitment")
+
+// OpenCommitted opens the values of each party, to which it commits first:
+// the parties open the hashes of their values and of a nonce, each in its own
+// slots of a vector of zeros, and then the values and the nonces in the same
+// way, and check them against the hashes. No party can thus choose its values
+// after seeing those of the others, as the root of the tree, which sums the
+// shares last, can with Open. It returns the values of the parties, by ID.
+func (op *OpenProtocol) OpenCommitted(ctx context.Context, values []uint64) ([][]uint64, error) {
+	k := runNonceLen(op.t)
+	n := len(values) + k
+	own := append(append([]uint64(nil), values...), sampleUniformVector(uint64(k), op.t)...)
+
+	committed := commitment(op.ID, own, op.t)
+	slots := make([]uint64, k*len(op.Peers))
+	copy(slots[k*int(op.ID):], committed)
+	commitments, err := op.Open(ctx, slots)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range committed {
+		if commitments[k*int(op.ID)+i] != v {
+			return nil, fmt.Errorf("%w: the commitment of the party was not opened", ErrCommitment)
+		}
+	}
+
+	slots = make([]uint64, n*len(op.Peers))
+	copy(slots[n*int(op.ID):], own)
+	opened, err := op.Open(ctx, slots)
+	if err != nil {
+		return nil, err
+	}
+	parties := make([][]uint64, len(op.Peers))
+	for id := range parties {
+		party := opened[n*id : n*id+n]
+		for i, v := range commitment(PartyID(id), party, op.t) {
+			if commitments[k*id+i] != v {
+				return nil, fmt.Errorf("%w of party %d", ErrCommitment, id)
+			}
+		}
+		parties[id] = party[:len(values)]
+	}
+	return parties, nil
+}
+
+// commitment returns the hash of the values of the party, as values modulo t.
+func commitment(id PartyID, values []uint64, t uint64) []uint64 {
+	digest := sha256.Sum256(append(appendUint64([]byte("commitment"), uint64(id)), marshalUint64s(values)...))
+	return digestValues(digest[:], t)
+}
+
+// publicShare returns the share of the party of the public value v, which is
+// v for the root of the tree and 0 for the others.
+func (op *OpenProtocol) publicShare(v uint64) uint64 {
+	if op.Parent == nil {
+		return v
+	}
+	return 0
+}
+
+func marshalUint64s(values []uint64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint64(data[8*i:], v)
+	}
+	return data
+}
+
+// unmarshalUint64s decodes count values, which should be reduced modulo t.
+func unmarshalUint64s(data []byte, count int, t uint64) ([]uint64, error) {
+	if len(data) != 8*count {
+		return nil, fmt.Errorf("%w: %d bytes for %d values", ErrMalformedMessage, len(data), count)
+	}
+	values := make([]uint64, count)
+	for i := range values {
+		if values[i] = binary.BigEndian.Uint64(data[8*i:]); values[i] >= t {
+			return nil, fmt.Errorf("%w: value not reduced modulo %d", ErrMalformedMessage, t)
+		}
+	}
+	return values, nil
+}
+
+// next returns the next expected message of the session, or the error that stops the protocol.
+func (op *OpenProtocol) next(ctx context.Context, waiting awaited) (MHETripleGenMessage, error) {
+	var timeout <-chan time.Time
+	if op.timeout > 0 {
+		timer := time.NewTimer(op.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case m := <-op.Chan:
+			if m.err != nil {
+				if err := waiting.failure(op.session.SessionKey, m.err); err != nil {
+					return m, err
+				}
+				continue
+			}
+			if !waiting.receive(m.PartyID, m.Batch, uint64(m.Round)) {
+				return m, op.messageError(m, ErrUnexpectedMessage)
+			}
+			return m, nil
+		case err := <-op.sendErrs:
+			return MHETripleGenMessage{}, err
+		case <-timeout:
+			return MHETripleGenMessage{}, waiting.timeout(op.session.SessionKey)
+		case <-ctx.Done():
+			return MHETripleGenMessage{}, ctx.Err()
+		}
+	}
+}
+
+func (op *OpenProtocol) messageError(m MHETripleGenMessage, err error) error {
+	return &ProtocolError{Session: op.session.SessionKey, Peer: m.PartyID, Batch: m.Batch, Round: uint64(m.Round), Err: err}
+}
+
+func (op *OpenProtocol) BindNetwork(sess *Session) {
+	var remotes []*MHETripleGenRemote
+	if op.Parent != nil {
+		remotes = append(remotes, op.Parent)
+	}
+	for _, rp := range op.Children {
+		remotes = append(remotes, rp)
+	}
+	op.bindMessages(sess, op.Chan, remotes, nil)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"sync"
 )
@@ -15,7 +16,17 @@ type Party struct {
 type LocalParty struct {
 	Party
 	*sync.WaitGroup
-	Peers map[PartyID]*RemoteParty
+	Peers  map[PartyID]*RemoteParty
+	Listen string
+
+	// SigningKey, when set, signs the envelopes sent by the party
+	SigningKey ed25519.PrivateKey
+
+	// Transcript, when set, records the envelopes sent and received by the party
+	Transcript *TranscriptWriter
+
+	// Store, when set, persists the triples generated by the party
+	Store *TripleStore
 }
 
 func check(err error) {
@@ -48,6 +59,9 @@ func (lp *LocalParty) String() string {
 
 type RemoteParty struct {
 	Party
+
+	// VerifyKey, when set, is required to verify the envelopes of the party
+	VerifyKey ed25519.PublicKey
 }
 
 func (rp *RemoteParty) String() string {
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TripleProducer keeps an inventory of triples, which the parties refill in
+// the background as a consumer takes triples from it.
+//
+// The parties refill their inventories together. Once the inventory of a
+// party drops below LowWater, the party reaches a barrier up and down the
+// tree, and once all the parties reached it, they generate HighWater-LowWater
+// triples. A party joins the barrier with fewer than LowWater triples, and its
+// inventory only decreases until the refill, so that it never holds more than
+// HighWater triples.
+//
+// The parties should take the same numbers of triples in the same order, so
+// that the i-th triples they take are shares of the same triple.
+type TripleProducer struct {
+	LowWater, HighWater uint64
+
+	barrier  *OpenProtocol
+	generate func(ctx context.Context, refill, nTriple uint64) ([]Triple, error)
+
+	lock      sync.Mutex
+	inventory []Triple
+	batches   []*StoredBatch // the refills of the triples of the inventory
+	produced  uint64
+	refilled  chan struct{} // closed when the inventory is refilled or the production stops
+	drained   chan struct{} // signaled when the inventory drops below LowWater
+	refills   uint64
+	taken     uint64
+	reserved  uint64
+	err       error
+}
+
+// WaterMarks are the bounds of the inventory of a TripleProducer.
+type WaterMarks struct {
+	Low, High uint64
+}
+
+// ParseWaterMarks parses water marks given as low,high, with 0 < low < high.
+func ParseWaterMarks(s string) (*WaterMarks, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) == 2 {
+		low, errLow := strconv.ParseUint(fields[0], 10, 64)
+		high, errHigh := strconv.ParseUint(fields[1], 10, 64)
+		if errLow == nil && errHigh == nil && 0 < low && low < high {
+			return &WaterMarks{Low: low, High: high}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid water marks %q, expected low,high with 0 < low < high", s)
+}
+
+// NewTripleProducer returns a producer whose k-th refill generates nTriple
+// triples with generate(ctx, k, nTriple), and whose barrier runs along tree.
+func (lp *LocalParty) NewTripleProducer(t uint64, tree Tree, marks WaterMarks, generate func(ctx context.Context, refill, nTriple uint64) ([]Triple, error)) *TripleProducer {
+	tp := &TripleProducer{
+		LowWater:  marks.Low,
+		HighWater: marks.High,
+		barrier:   lp.NewOpenProtocol(t, tree),
+		generate:  generate,
+		refilled:  make(chan struct{}),
+		drained:   make(chan struct{}, 1),
+	}
+	// The parties wait for each other to consume their triples, for as long
+	// as they need
+	tp.barrier.timeout = 0
+	tp.drained <- struct{}{}
+	return tp
+}
+
+func (tp *TripleProducer) BindNetwork(sess *Session) {
+	tp.barrier.BindNetwork(sess)
+}
+
+// Run refills the inventory until ctx is cancelled, a refill fails, or a peer
+// fails, and returns the error that stopped it. The consumers waiting for
+// triples then get this error.
+func (tp *TripleProducer) Run(ctx context.Context) error {
+	err := tp.produce(ctx)
+	if errUnbind := tp.barrier.unbindNetwork(); errUnbind != nil {
+		err = errUnbind
+	}
+	tp.lock.Lock()
+	tp.err = err
+	close(tp.refilled)
+	tp.lock.Unlock()
+	return err
+}
+
+// produce runs the refills, one at a time. The k-th refill is the k-th
+// opening of the barrier, of no value.
+func (tp *TripleProducer) produce(ctx context.Context) error {
+	for {
+		select {
+		case <-tp.drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if _, err := tp.barrier.Open(ctx, nil); err != nil {
+			return err
+		}
+		triples, err := tp.generate(ctx, tp.Refills(), tp.HighWater-tp.LowWater)
+		if err != nil {
+			return err
+		}
+		tp.lock.Lock()
+		tp.batches = append(tp.batches, &StoredBatch{
+			ID:      tp.refills,
+			Run:     tp.barrier.session.mux.Run(),
+			Session: SessionKey{Protocol: ProtocolRefill, Session: tp.refills},
+			First:   tp.produced,
+			Count:   uint64(len(triples)),
+		})
+		tp.refills++
+		tp.produced += uint64(len(triples))
+		tp.inventory = append(tp.inventory, triples...)
+		if uint64(len(tp.inventory)) < tp.LowWater {
+			tp.drain()
+		}
+		close(tp.refilled)
+		tp.refilled = make(chan struct{})
+		tp.lock.Unlock()
+	}
+}
+
+// drain signals that the inventory dropped below LowWater. It is called with
+// the lock held.
+func (tp *TripleProducer) drain() {
+	select {
+	case tp.drained <- struct{}{}:
+	default:
+	}
+}
+
+// Take removes n triples from the inventory and returns them, once the
+// inventory holds them. It returns an error if n exceeds LowWater, since the
+// parties do not refill an inventory of LowWater triples or more, if ctx is
+// cancelled, or if the production stopped.
+func (tp *TripleProducer) Take(ctx context.Context, n uint64) ([]Triple, error) {
+	_, triples, err := tp.take(ctx, n)
+	return triples, err
+}
+
+// Plan waits, without a deadline, until the inventory holds n triples, and
+// returns their reservation, so that the online phase can consume the
+// triples of a producer. The refills of the triples are their batches.
+func (tp *TripleProducer) Plan(n uint64) (*Reservation, error) {
+	return tp.plan(context.Background(), n)
+}
+
+// Reserve removes the triples of r, the last planned reservation, from the
+// inventory and returns them.
+func (tp *TripleProducer) Reserve(r *Reservation) ([]Triple, error) {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if r.ID != tp.reserved || r.First != tp.taken || r.Count > uint64(len(tp.inventory)) {
+		return nil, fmt.Errorf("%s is not the next reservation of the producer", r)
+	}
+	triples := tp.inventory[:r.Count:r.Count]
+	tp.inventory = tp.inventory[r.Count:]
+	if uint64(len(tp.inventory)) < tp.LowWater {
+		tp.drain()
+	}
+	tp.reserved++
+	tp.taken += r.Count
+	for len(tp.batches) > 0 && tp.batches[0].First+tp.batches[0].Count <= tp.taken {
+		tp.batches = tp.batches[1:]
+	}
+	return triples, nil
+}
+
+// MACKeyShare returns no key: the refills are not recorded as authenticated,
+// so the online phase does not check the MACs of the triples of a producer.
+func (tp *TripleProducer) MACKeyShare(run RunID) (uint64, bool) {
+	return 0, false
+}
+
+func (tp *TripleProducer) take(ctx context.Context, n uint64) (*Reservation, []Triple, error) {
+	r, err := tp.plan(ctx, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	triples, err := tp.Reserve(r)
+	return r, triples, err
+}
+
+func (tp *TripleProducer) plan(ctx context.Context, n uint64) (*Reservation, error) {
+	if n > tp.LowWater {
+		return nil, fmt.Errorf("cannot take %d triples at once, more than the low-water mark of %d", n, tp.LowWater)
+	}
+	for {
+		tp.lock.Lock()
+		if n <= uint64(len(tp.inventory)) {
+			r := &Reservation{ID: tp.reserved, First: tp.taken, Count: n, Batches: batchesOf(tp.batches, tp.taken, n)}
+			tp.lock.Unlock()
+			return r, nil
+		}
+		refilled, err := tp.refilled, tp.err
+		tp.lock.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("the triple production stopped: %w", err)
+		}
+
+		select {
+		case <-refilled:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Available returns the number of triples in the inventory.
+func (tp *TripleProducer) Available() uint64 {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return uint64(len(tp.inventory))
+}
+
+// Refills returns the number of refills completed.
+func (tp *TripleProducer) Refills() uint64 {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.refills
+}
+
+// runProducer produces triples in the background with a TripleProducer of the
+// given water marks, whose refills split their triples among nSessions
+// concurrent sessions of g, and takes nTriple triples at a time from it until
+// ctx is cancelled, as a consumer would, for nTriple up to the low-water mark.
+// It returns the communication report of the party, with the setup sessions.
+func runProducer(ctx context.Context, g *tripleGeneration, netw Network, marks WaterMarks, nTriple uint64, nSessions int, setup []*Session) (*CommReport, error) {
+	lp, mux := g.lp, g.mux
+
+	var lock sync.Mutex
+	var sessions []*Session
+	producer := lp.NewTripleProducer(g.t, g.tree, marks, func(ctx context.Context, refill, nRefill uint64) ([]Triple, error) {
+		triples := make([][]Triple, nSessions)
+		err := runSessions(ctx, nSessions, func(ctx context.Context, i int) error {
+			n := nRefill / uint64(nSessions)
+			if uint64(i) < nRefill%uint64(nSessions) {
+				n++
+			}
+			if n == 0 {
+				return nil
+			}
+			// Each session of each refill has its own ID, from which the
+			// MHE triple generation derives its CRPs
+			sess, checkSess, ts, err := g.generate(ctx, refill*uint64(nSessions)+uint64(i), n)
+			lock.Lock()
+			if sess != nil {
+				sessions = append(sessions, sess)
+			}
+			if checkSess != nil {
+				sessions = append(sessions, checkSess)
+			}
+			lock.Unlock()
+			triples[i] = ts
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// The triples of the sessions are added in the order of the sessions
+		var refilled []Triple
+		for _, ts := range triples {
+			refilled = append(refilled, ts...)
+		}
+		fmt.Printf("\trefill %d: %d triples\n", refill, len(refilled))
+		return refilled, nil
+	})
+	refillSession, err := mux.Session(ProtocolRefill, 0)
+	if err != nil {
+		return nil, err
+	}
+	producer.BindNetwork(refillSession)
+
+	fmt.Printf("\ttaking %d triples at a time, refilled below %d triples up to %d...\n", nTriple, marks.Low, marks.High)
+	produced := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		produced <- producer.Run(ctx)
+	}()
+	var taken uint64
+	for {
+		if _, err := producer.Take(ctx, nTriple); err != nil {
+			break
+		}
+		taken += nTriple
+	}
+	err = <-produced
+	elapsed := time.Since(start)
+	if errClose := mux.Close(); err == nil {
+		err = errClose
+	}
+
+	// The production stops once interrupted
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	fmt.Println("\tdone")
+
+	lock.Lock()
+	sessions = append(sessions, refillSession)
+	var comm uint64
+	for _, sess := range sessions {
+		sent, received := sess.Sum()
+		comm += sent + received
+	}
+	fmt.Println("Refills:", producer.Refills())
+	fmt.Println("Triples:", taken)
+	fmt.Println("Time:", elapsed.Nanoseconds())
+	fmt.Println("Comm:", comm)
+	fmt.Printf("Throughput: %.0f triples/s\n", float64(taken)/elapsed.Seconds())
+	return NewCommReport(lp, netw, append(setup, sessions...)), nil
+}
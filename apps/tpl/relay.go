@@ -0,0 +1,805 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Frame types exchanged between the parties and the relay. A data frame
+// carries a chunk of the stream of a party with a peer, and is addressed to
+// the peer when sent to the relay, and from the peer when sent by the relay.
+// The relay announces with up and down frames that a peer connected or
+// disconnected.
+const (
+	relayData byte = 'D'
+	relayUp   byte = 'U'
+	relayDown byte = 'X'
+)
+
+// relayHeaderLen is the length of the header of the relay frames: the frame
+// type, the party ID of the destination or source, and the payload length.
+const relayHeaderLen = 1 + 8 + 4
+
+// RELAY_CHUNK_SIZE is the maximum payload of a relay data frame.
+const RELAY_CHUNK_SIZE = 64 << 10
+
+// RELAY_QUEUE_LEN bounds the number of frames that the relay queues for a
+// party that does not read them fast enough, before closing its connection.
+const RELAY_QUEUE_LEN = 256
+
+var ErrRelayOverflow = errors.New("too many frames queued")
+
+func relayFrame(typ byte, peer PartyID, payload []byte) []byte {
+	buff := make([]byte, relayHeaderLen, relayHeaderLen+len(payload))
+	buff[0] = typ
+	binary.BigEndian.PutUint64(buff[1:], uint64(peer))
+	binary.BigEndian.PutUint32(buff[9:], uint32(len(payload)))
+	return append(buff, payload...)
+}
+
+func writeRelayFrame(w io.Writer, typ byte, peer PartyID, payload []byte) error {
+	_, err := w.Write(relayFrame(typ, peer, payload))
+	return err
+}
+
+func readRelayFrame(r io.Reader) (typ byte, peer PartyID, payload []byte, err error) {
+	var header [relayHeaderLen]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	typ, peer = header[0], PartyID(binary.BigEndian.Uint64(header[1:]))
+	length := binary.BigEndian.Uint32(header[9:])
+	if length > RELAY_CHUNK_SIZE || (typ != relayData && length != 0) {
+		err = fmt.Errorf("%w: invalid relay frame", ErrMalformedMessage)
+		return
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+// Relay forwards the streams of the parties of a relay network to their
+// destination, so that each party holds a single connection. The relay is
+// not trusted with the content of the streams, which are forwarded as is.
+type Relay struct {
+	ID  PartyID
+	TLS *tls.Config
+
+	lock      sync.Mutex
+	parties   map[PartyID]bool // parties that connected at least once, or not yet
+	clients   map[PartyID]*relayClient
+	forwarded map[PartyID]*CommStats
+	dropped   CommStats
+	done      chan struct{}
+}
+
+// relayClient is the connection of a party with the relay. The frames to the
+// party are queued and written by their own goroutine, so that a party that
+// stops reading does not stall the streams of the parties that send to it.
+type relayClient struct {
+	id    PartyID
+	conn  net.Conn
+	queue chan []byte
+	done  chan struct{}
+}
+
+func newRelayClient(id PartyID, conn net.Conn) *relayClient {
+	rc := &relayClient{id: id, conn: conn, queue: make(chan []byte, RELAY_QUEUE_LEN), done: make(chan struct{})}
+	go rc.run()
+	return rc
+}
+
+// write queues the frame for the party, or returns ErrRelayOverflow if
+// RELAY_QUEUE_LEN frames are already queued.
+func (rc *relayClient) write(typ byte, peer PartyID, payload []byte) error {
+	select {
+	case rc.queue <- relayFrame(typ, peer, payload):
+		return nil
+	default:
+		return fmt.Errorf("%w for party %d", ErrRelayOverflow, rc.id)
+	}
+}
+
+func (rc *relayClient) run() {
+	for {
+		select {
+		case frame := <-rc.queue:
+			if _, err := rc.conn.Write(frame); err != nil {
+				rc.conn.Close()
+				return
+			}
+		case <-rc.done:
+			return
+		}
+	}
+}
+
+// NewRelay creates the relay id between the given parties.
+func NewRelay(id PartyID, parties []PartyID) *Relay {
+	r := &Relay{
+		ID:        id,
+		parties:   make(map[PartyID]bool, len(parties)),
+		clients:   make(map[PartyID]*relayClient, len(parties)),
+		forwarded: make(map[PartyID]*CommStats, len(parties)),
+		done:      make(chan struct{}),
+	}
+	for _, p := range parties {
+		r.parties[p] = false
+		r.forwarded[p] = new(CommStats)
+	}
+	return r
+}
+
+// ListenAndServe accepts the connections of the parties on addr, until all
+// the parties connected and left, or until ctx is cancelled.
+func (r *Relay) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot create listening socket: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Println(r, "failed to accept connection:", err)
+				continue
+			}
+			go r.Serve(conn)
+		}
+	}()
+
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	listener.Close()
+	r.lock.Lock()
+	for _, rc := range r.clients {
+		rc.conn.Close()
+	}
+	r.lock.Unlock()
+	return err
+}
+
+// Serve forwards the frames sent by the party that opened conn, until conn
+// fails or the party connects again.
+func (r *Relay) Serve(conn net.Conn) {
+	id, conn, err := acceptParty(conn, r.TLS)
+	if err == nil {
+		r.lock.Lock()
+		if _, known := r.parties[id]; !known {
+			err = fmt.Errorf("unexpected party ID %d", id)
+		}
+		r.lock.Unlock()
+	}
+	if err != nil {
+		fmt.Println(r, "rejected connection from", conn.RemoteAddr(), ":", err)
+		conn.Close()
+		return
+	}
+
+	rc := r.register(id, conn)
+	defer r.unregister(rc)
+
+	for {
+		typ, dst, payload, err := readRelayFrame(conn)
+		if err == nil && typ != relayData {
+			err = fmt.Errorf("%w: unexpected relay frame %d", ErrUnexpectedMessage, typ)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				fmt.Println(r, "lost connection with party", id, ":", err)
+			}
+			return
+		}
+
+		r.lock.Lock()
+		drc := r.clients[dst]
+		if drc == nil {
+			r.dropped.add(len(payload))
+		} else {
+			r.forwarded[id].add(len(payload))
+		}
+		r.lock.Unlock()
+
+		// Frames to parties that are not connected are dropped, and sent again
+		// by the source once it learns that the destination reconnected. A
+		// destination that does not keep up is disconnected, and the frames
+		// queued for it are sent again once it reconnects.
+		if drc != nil {
+			if err := drc.write(relayData, id, payload); err != nil {
+				fmt.Println(r, "closing the connection of party", dst, ":", err)
+				drc.conn.Close()
+			}
+		}
+	}
+}
+
+// register makes rc the connection of party id, replacing the previous one,
+// and announces it to the other parties.
+func (r *Relay) register(id PartyID, conn net.Conn) *relayClient {
+	rc := newRelayClient(id, conn)
+	r.lock.Lock()
+	if old, exists := r.clients[id]; exists {
+		old.conn.Close()
+	}
+	r.clients[id] = rc
+	r.parties[id] = true
+	others := r.others(id)
+	r.lock.Unlock()
+
+	fmt.Println(r, "now connected with party", id)
+	for _, orc := range others {
+		rc.write(relayUp, orc.id, nil)
+		orc.write(relayUp, id, nil)
+	}
+	return rc
+}
+
+// unregister removes rc if it is still the connection of its party, and
+// announces it to the other parties.
+func (r *Relay) unregister(rc *relayClient) {
+	rc.conn.Close()
+	close(rc.done)
+	r.lock.Lock()
+	if r.clients[rc.id] != rc {
+		r.lock.Unlock()
+		return
+	}
+	delete(r.clients, rc.id)
+	others := r.others(rc.id)
+	if len(r.clients) == 0 && r.allJoined() {
+		select {
+		case <-r.done:
+		default:
+			close(r.done)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, orc := range others {
+		orc.write(relayDown, rc.id, nil)
+	}
+}
+
+// others returns the connections of the parties other than id. It is called
+// with the lock held.
+func (r *Relay) others(id PartyID) (others []*relayClient) {
+	for pid, rc := range r.clients {
+		if pid != id {
+			others = append(others, rc)
+		}
+	}
+	return
+}
+
+func (r *Relay) allJoined() bool {
+	for _, joined := range r.parties {
+		if !joined {
+			return false
+		}
+	}
+	return true
+}
+
+// Forwarded returns the bytes forwarded from each party, and the bytes
+// dropped because their destination was not connected.
+func (r *Relay) Forwarded() (forwarded map[PartyID]uint64, dropped uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	forwarded = make(map[PartyID]uint64, len(r.forwarded))
+	for id, cs := range r.forwarded {
+		forwarded[id] = cs.Bytes
+	}
+	return forwarded, r.dropped.Bytes
+}
+
+func (r *Relay) String() string {
+	return fmt.Sprintf("relay-%d", r.ID)
+}
+
+// RelayNetwork is a Network in which a party holds a single connection, to
+// the relay, over which the streams with all of its peers are routed. The
+// connection with a peer is reset when the peer disconnects from the relay,
+// and Reconnect waits for the peer to connect again.
+type RelayNetwork struct {
+	TLS   *tls.Config
+	relay *RemoteParty
+	// Dial opens a connection to the relay, and defaults to TCP.
+	Dial func() (net.Conn, error)
+
+	lp        *LocalParty
+	lock      sync.Mutex
+	conn      *MonitoredConn // nil while the connection with the relay is broken
+	gen       uint64
+	redialing bool
+	closed    bool
+	up        map[PartyID]bool
+	conns     map[PartyID]*relayConn
+	changed   chan struct{} // closed and replaced on each change of the state
+
+	writeLock      sync.Mutex
+	sent, received uint64 // on the previous connections with the relay
+}
+
+// NewRelayNetwork creates the network of a party connected to the relay.
+func NewRelayNetwork(relay *RemoteParty) *RelayNetwork {
+	rnw := &RelayNetwork{relay: relay, changed: make(chan struct{})}
+	rnw.Dial = func() (net.Conn, error) {
+		return dialParty(rnw.relay, rnw.TLS)
+	}
+	return rnw
+}
+
+// NewLocalRelayNetworks connects the parties P to an in-process relay, and
+// returns the network of each party, in the order of P.
+func NewLocalRelayNetworks(P []*LocalParty, relayID PartyID) []*RelayNetwork {
+	ids := make([]PartyID, len(P))
+	for i, lp := range P {
+		ids[i] = lp.ID
+	}
+	relay := NewRelay(relayID, ids)
+	netws := make([]*RelayNetwork, len(P))
+	for i := range P {
+		netws[i] = NewRelayNetwork(&RemoteParty{Party: Party{ID: relayID}})
+		netws[i].Dial = func() (net.Conn, error) {
+			conn, relayConn := net.Pipe()
+			go relay.Serve(relayConn)
+			return conn, nil
+		}
+	}
+	return netws
+}
+
+// Connect connects to the relay, and waits for the peers of lp in edges to
+// connect as well.
+func (rnw *RelayNetwork) Connect(ctx context.Context, lp *LocalParty, edges Edges) error {
+	rnw.lp = lp
+	rnw.up = make(map[PartyID]bool, len(lp.Peers))
+	rnw.conns = make(map[PartyID]*relayConn, len(edges[lp.ID]))
+	for id := range edges[lp.ID] {
+		rnw.conns[id] = newRelayConn(rnw, id)
+	}
+
+	var conn net.Conn
+	var err error
+	for attempt := 0; conn == nil && attempt < CONNECT_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(CONNECT_ATTEMPTS_DELAY * time.Millisecond):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		conn, err = rnw.dial()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot connect to the relay: %w", err)
+	}
+	rnw.lock.Lock()
+	rnw.setConn(conn)
+	rnw.lock.Unlock()
+	fmt.Println(lp, "now connected with the relay")
+
+	// The connections with the peers are used once they all joined the relay
+	for {
+		rnw.lock.Lock()
+		ready := rnw.conn != nil && rnw.allUp()
+		broken, changed := rnw.conn == nil, rnw.changed
+		rnw.lock.Unlock()
+		if ready {
+			return nil
+		}
+		if broken {
+			return fmt.Errorf("lost connection with the relay")
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			rnw.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+// allUp returns whether all the peers joined the relay. It is called with
+// the lock held.
+func (rnw *RelayNetwork) allUp() bool {
+	for id := range rnw.conns {
+		if !rnw.up[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// dial connects to the relay and identifies the party.
+func (rnw *RelayNetwork) dial() (net.Conn, error) {
+	conn, err := rnw.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := binary.Write(conn, binary.BigEndian, rnw.lp.ID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setConn starts using conn as the connection with the relay. It is called
+// with the lock held.
+func (rnw *RelayNetwork) setConn(conn net.Conn) {
+	rnw.conn = &MonitoredConn{Conn: conn}
+	rnw.gen++
+	go rnw.receive(rnw.conn, rnw.gen)
+	rnw.notify()
+}
+
+// notify wakes up the goroutines waiting for a change of the state. It is
+// called with the lock held.
+func (rnw *RelayNetwork) notify() {
+	close(rnw.changed)
+	rnw.changed = make(chan struct{})
+}
+
+// reset ends the stream with peer with err, and replaces it with a new one
+// for the next connection of the link. It is called with the lock held.
+func (rnw *RelayNetwork) reset(peer PartyID, err error) {
+	if rc, exists := rnw.conns[peer]; exists {
+		rc.end(err)
+		rnw.conns[peer] = newRelayConn(rnw, peer)
+	}
+}
+
+func (rnw *RelayNetwork) receive(conn *MonitoredConn, gen uint64) {
+	for {
+		typ, peer, payload, err := readRelayFrame(conn)
+		if err != nil {
+			rnw.fail(gen, err)
+			return
+		}
+
+		rnw.lock.Lock()
+		switch typ {
+		case relayData:
+			if rc, exists := rnw.conns[peer]; exists {
+				rc.deliver(payload)
+			}
+		case relayUp:
+			// A peer that connects again may have missed the end of the stream
+			if rnw.up[peer] {
+				rnw.reset(peer, fmt.Errorf("party %d reconnected to the relay", peer))
+			}
+			rnw.up[peer] = true
+		case relayDown:
+			if rnw.up[peer] {
+				rnw.reset(peer, io.EOF)
+			}
+			delete(rnw.up, peer)
+		default:
+			rnw.lock.Unlock()
+			rnw.fail(gen, fmt.Errorf("unknown relay frame type %d", typ))
+			return
+		}
+		rnw.notify()
+		rnw.lock.Unlock()
+	}
+}
+
+// fail resets the streams with all the peers if the connection of
+// generation gen with the relay is still in use.
+func (rnw *RelayNetwork) fail(gen uint64, err error) {
+	rnw.lock.Lock()
+	defer rnw.lock.Unlock()
+	if gen != rnw.gen || rnw.conn == nil || rnw.closed {
+		return
+	}
+	fmt.Println(rnw.lp, "lost connection with the relay:", err)
+	rnw.conn.Close()
+	rnw.sent += rnw.conn.Sent()
+	rnw.received += rnw.conn.Received()
+	rnw.conn = nil
+	rnw.up = make(map[PartyID]bool, len(rnw.conns))
+	for peer := range rnw.conns {
+		rnw.reset(peer, err)
+	}
+	rnw.notify()
+}
+
+// send routes the data to peer through the relay.
+func (rnw *RelayNetwork) send(peer PartyID, data []byte) error {
+	rnw.writeLock.Lock()
+	defer rnw.writeLock.Unlock()
+	rnw.lock.Lock()
+	conn, gen := rnw.conn, rnw.gen
+	rnw.lock.Unlock()
+	if conn == nil {
+		return fmt.Errorf("no connection with the relay")
+	}
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > RELAY_CHUNK_SIZE {
+			chunk = chunk[:RELAY_CHUNK_SIZE]
+		}
+		if err := writeRelayFrame(conn, relayData, peer, chunk); err != nil {
+			rnw.fail(gen, err)
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+func (rnw *RelayNetwork) Conn(id PartyID) net.Conn {
+	rnw.lock.Lock()
+	defer rnw.lock.Unlock()
+	if rc, exists := rnw.conns[id]; exists {
+		return rc
+	}
+	return nil
+}
+
+// Reconnect returns a new stream with party id once both the party and its
+// peer are connected to the relay. The party connects again to the relay,
+// with an exponential backoff, if its own connection failed.
+func (rnw *RelayNetwork) Reconnect(id PartyID) (net.Conn, error) {
+	timeout := time.After(2 * RECONNECT_BACKOFF << RECONNECT_ATTEMPTS)
+	rnw.lock.Lock()
+	defer rnw.lock.Unlock()
+	if _, known := rnw.conns[id]; !known {
+		return nil, fmt.Errorf("party %d is not a peer", id)
+	}
+	for {
+		if rnw.closed {
+			return nil, fmt.Errorf("network is closed")
+		}
+		if rnw.conn == nil && !rnw.redialing {
+			if err := rnw.redial(); err != nil {
+				return nil, fmt.Errorf("cannot reconnect to the relay: %w", err)
+			}
+			continue
+		}
+		if rnw.conn != nil && rnw.up[id] {
+			break
+		}
+		changed := rnw.changed
+		rnw.lock.Unlock()
+		select {
+		case <-changed:
+			rnw.lock.Lock()
+		case <-timeout:
+			rnw.lock.Lock()
+			return nil, fmt.Errorf("party %d did not reconnect", id)
+		}
+	}
+
+	if rnw.conns[id].isClosed() {
+		rnw.conns[id] = newRelayConn(rnw, id)
+	}
+	return rnw.conns[id], nil
+}
+
+// redial connects again to the relay. It is called with the lock held, which
+// it releases while dialing.
+func (rnw *RelayNetwork) redial() error {
+	rnw.redialing = true
+	rnw.lock.Unlock()
+	var conn net.Conn
+	var err error
+	delay := RECONNECT_BACKOFF
+	for attempt := 0; conn == nil && attempt < RECONNECT_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			<-time.After(delay)
+			delay *= 2
+		}
+		conn, err = rnw.dial()
+	}
+	rnw.lock.Lock()
+	rnw.redialing = false
+	if conn == nil {
+		rnw.notify()
+		return err
+	}
+	if rnw.closed {
+		conn.Close()
+		return fmt.Errorf("network is closed")
+	}
+	rnw.setConn(conn)
+	fmt.Println(rnw.lp, "reconnected with the relay")
+	return nil
+}
+
+// Sum returns the bytes sent and received on the connections with the relay.
+func (rnw *RelayNetwork) Sum() (sent, received uint64) {
+	rnw.lock.Lock()
+	defer rnw.lock.Unlock()
+	sent, received = rnw.sent, rnw.received
+	if rnw.conn != nil {
+		sent += rnw.conn.Sent()
+		received += rnw.conn.Received()
+	}
+	return
+}
+
+func (rnw *RelayNetwork) Close() error {
+	rnw.lock.Lock()
+	defer rnw.lock.Unlock()
+	rnw.closed = true
+	for _, rc := range rnw.conns {
+		rc.Close()
+	}
+	rnw.notify()
+	if rnw.conn == nil {
+		return nil
+	}
+	if err := rnw.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// relayConn is the stream of a party with a peer, routed through the relay.
+// The data received from the peer is buffered until read, so that a slow
+// reader does not block the streams with the other peers.
+type relayConn struct {
+	nw   *RelayNetwork
+	peer PartyID
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buff   []byte
+	err    error // returned once the buffered data is read
+	closed bool
+}
+
+func newRelayConn(nw *RelayNetwork, peer PartyID) *relayConn {
+	rc := &relayConn{nw: nw, peer: peer}
+	rc.cond = sync.NewCond(&rc.lock)
+	return rc
+}
+
+func (rc *relayConn) deliver(data []byte) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.closed || rc.err != nil {
+		return
+	}
+	rc.buff = append(rc.buff, data...)
+	rc.cond.Broadcast()
+}
+
+// end makes the reads fail with err once the buffered data is read.
+func (rc *relayConn) end(err error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.err == nil {
+		rc.err = err
+	}
+	rc.cond.Broadcast()
+}
+
+func (rc *relayConn) isClosed() bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.closed || rc.err != nil
+}
+
+func (rc *relayConn) Read(b []byte) (n int, err error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for len(rc.buff) == 0 && rc.err == nil && !rc.closed {
+		rc.cond.Wait()
+	}
+	if rc.closed {
+		return 0, net.ErrClosed
+	}
+	if len(rc.buff) == 0 {
+		return 0, rc.err
+	}
+	n = copy(b, rc.buff)
+	rc.buff = rc.buff[n:]
+	return n, nil
+}
+
+func (rc *relayConn) Write(b []byte) (n int, err error) {
+	rc.lock.Lock()
+	closed, rcErr := rc.closed, rc.err
+	rc.lock.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if rcErr != nil {
+		return 0, rcErr
+	}
+	if err := rc.nw.send(rc.peer, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (rc *relayConn) Close() error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.closed = true
+	rc.buff = nil
+	rc.cond.Broadcast()
+	return nil
+}
+
+// relayAddr is the address of a peer reached through the relay.
+type relayAddr PartyID
+
+func (ra relayAddr) Network() string {
+	return "relay"
+}
+
+func (ra relayAddr) String() string {
+	return fmt.Sprintf(identityFormat, PartyID(ra))
+}
+
+func (rc *relayConn) LocalAddr() net.Addr {
+	return relayAddr(rc.nw.lp.ID)
+}
+
+func (rc *relayConn) RemoteAddr() net.Addr {
+	return relayAddr(rc.peer)
+}
+
+// The deadlines are not supported by the streams routed through the relay.
+func (rc *relayConn) SetDeadline(t time.Time) error      { return nil }
+func (rc *relayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rc *relayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// sortedParties returns the party IDs of the map in increasing order.
+func sortedParties(m map[PartyID]uint64) []PartyID {
+	ids := make([]PartyID, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// RunRelay runs the relay of the topology until all the parties connected and
+// left, and prints the bytes it forwarded from each party.
+func RunRelay(ctx context.Context, topo *Topology) error {
+	pc, isRelayed := topo.Relay()
+	if !isRelayed {
+		return fmt.Errorf("the topology has no relay")
+	}
+	if err := topo.checkRelay(); err != nil {
+		return err
+	}
+	var parties []PartyID
+	for id := range topo.Peers() {
+		parties = append(parties, id)
+	}
+	relay := NewRelay(pc.ID, parties)
+	var err error
+	if relay.TLS, err = topo.TLSConfig(pc.ID); err != nil {
+		return err
+	}
+	fmt.Println(relay, "listening on", pc.Listen)
+	err = relay.ListenAndServe(ctx, pc.Listen)
+
+	forwarded, dropped := relay.Forwarded()
+	for _, id := range sortedParties(forwarded) {
+		fmt.Printf("\tparty-%d forwarded: %d\n", id, forwarded[id])
+	}
+	fmt.Println("Dropped:", dropped)
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRelaySlowDestination checks that a party that stops reading does not
+// stall the stream of the parties that send to it, and is disconnected once
+// too many frames are queued for it.
+func TestRelaySlowDestination(t *testing.T) {
+	r := NewRelay(2, []PartyID{0, 1})
+	connect := func(id PartyID) net.Conn {
+		conn, relayConn := net.Pipe()
+		go r.Serve(relayConn)
+		if err := binary.Write(conn, binary.BigEndian, id); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// Party 1 reads nothing, not even the announcement of party 0
+	slow := connect(1)
+	defer slow.Close()
+	src := connect(0)
+	defer src.Close()
+	go func() {
+		for {
+			if _, _, _, err := readRelayFrame(src); err != nil {
+				return
+			}
+		}
+	}()
+
+	sent := make(chan error, 1)
+	go func() {
+		payload := make([]byte, 1024)
+		for i := 0; i < 2*RELAY_QUEUE_LEN; i++ {
+			if err := writeRelayFrame(src, relayData, 1, payload); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the stream of party 0 stalled")
+	}
+
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, _, err := readRelayFrame(slow); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				t.Fatal("party 1 still connected")
+			}
+			break
+		}
+	}
+}
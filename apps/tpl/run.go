@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// PartyClient runs the experiment of a party over its network, and returns its
+// communication report.
+type PartyClient func(ctx context.Context, lp *LocalParty, netw Network) (*CommReport, error)
+
+// RunLocal runs the client of all the parties of the topology within the
+// current process, connected by an in-process network, through an in-process
+// relay if the topology has one, and returns their communication reports. The
+// parties record their transcript to transcriptPath(transcript, id), if
+// transcript is not empty, and use the triple store modulo t at
+// transcriptPath(store, id), if store is not empty. It returns the first
+// error of the parties, after they all stopped.
+func RunLocal(ctx context.Context, topo *Topology, client PartyClient, t uint64, transcript, store string) ([]*CommReport, error) {
+	P := make([]*LocalParty, topo.NumParties())
+	for i := range P {
+		var err error
+		if P[i], err = topo.NewLocalParty(PartyID(i)); err != nil {
+			return nil, err
+		}
+		if transcript != "" {
+			if P[i].Transcript, err = CreateTranscript(transcriptPath(transcript, P[i].ID), P[i]); err != nil {
+				return nil, err
+			}
+			defer P[i].Transcript.Close()
+		}
+	}
+
+	if store != "" {
+		for _, lp := range P {
+			var err error
+			if lp.Store, err = OpenTripleStore(transcriptPath(store, lp.ID), lp, t); err != nil {
+				return nil, err
+			}
+			defer lp.Store.Close()
+		}
+	}
+	netws := make([]Network, len(P))
+	if pc, isRelayed := topo.Relay(); isRelayed {
+		for i, netw := range NewLocalRelayNetworks(P, pc.ID) {
+			netws[i] = netw
+		}
+	} else {
+		for i, netw := range NewLocalNetworks(P) {
+			netws[i] = netw
+		}
+	}
+
+	reports := make([]*CommReport, len(P))
+	errs := make([]error, len(P))
+	wg := new(sync.WaitGroup)
+	for i, lp := range P {
+		wg.Add(1)
+		go func(i int, lp *LocalParty) {
+			reports[i], errs[i] = client(ctx, lp, emulateWAN(topo, lp.ID, netws[i]))
+			if errs[i] != nil {
+				fmt.Println(lp, "failed:", errs[i])
+			}
+			wg.Done()
+		}(i, lp)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+// RunParty runs the client of party id of the topology, over its network to
+// the other parties. The party records its transcript to transcript, if not
+// empty, and uses the triple store modulo t at store, if not empty.
+func RunParty(ctx context.Context, topo *Topology, id PartyID, client PartyClient, t uint64, transcript, store string) (report *CommReport, err error) {
+	lp, err := topo.NewLocalParty(id)
+	if err != nil {
+		return nil, err
+	}
+	netw, err := NewNetworkFromTopology(topo, lp)
+	if err != nil {
+		return nil, err
+	}
+	if transcript != "" {
+		if lp.Transcript, err = CreateTranscript(transcript, lp); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if errClose := lp.Transcript.Close(); err == nil {
+				err = errClose
+			}
+		}()
+	}
+	if store != "" {
+		if lp.Store, err = OpenTripleStore(store, lp, t); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if errClose := lp.Store.Close(); err == nil {
+				err = errClose
+			}
+		}()
+	}
+	return client(ctx, lp, emulateWAN(topo, lp.ID, netw))
+}
+
+// emulateWAN wraps the network of party id with the link profiles of the
+// topology, if any.
+func emulateWAN(topo *Topology, id PartyID, netw Network) Network {
+	profiles := topo.LinkProfiles(id)
+	if len(profiles) == 0 {
+		return netw
+	}
+	return NewEmulatedNetwork(netw, profiles)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// RunIDLen is the length of the ID of a run.
+const RunIDLen = 16
+
+// RUN_NONCE_BITS is the minimum entropy of the nonce of each party in the ID
+// of a run.
+const RUN_NONCE_BITS = 128
+
+var ErrRunID = errors.New("the nonce of the party is missing from the run ID")
+
+// RunID identifies a run of the parties. It is in the signed header of the
+// envelopes, so that the envelopes of a run cannot be replayed in another.
+type RunID [RunIDLen]byte
+
+func (id RunID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// runNonceLen returns the number of values modulo t of the nonce of a party.
+func runNonceLen(t uint64) int {
+	perValue := bits.Len64(t) - 1
+	return (RUN_NONCE_BITS + perValue - 1) / perValue
+}
+
+// AgreeRunID agrees with the peers on the ID of the run, and sets it as the
+// run of the envelopes of mux. Each party samples a nonce and places it in
+// its own slot of a vector of zeros, and the parties open the sum of their
+// vectors along tree. Each party then checks that its slot holds its own
+// nonce, so that the run ID, the hash of the opened vector, is fresh to
+// every honest party whatever the others send. Parties that open different
+// vectors get different run IDs, and reject each other's envelopes.
+func (lp *LocalParty) AgreeRunID(ctx context.Context, mux *Mux, t uint64, tree Tree) (RunID, error) {
+	sess, err := mux.Session(ProtocolRunID, 0)
+	if err != nil {
+		return RunID{}, err
+	}
+	op := lp.NewOpenProtocol(t, tree)
+	op.BindNetwork(sess)
+
+	k := runNonceLen(t)
+	nonce := sampleUniformVector(uint64(k), t)
+	shares := make([]uint64, k*len(lp.Peers))
+	copy(shares[k*int(lp.ID):], nonce)
+	opened, err := op.Open(ctx, shares)
+	if errUnbind := op.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return RunID{}, err
+	}
+	for i, v := range nonce {
+		if opened[k*int(lp.ID)+i] != v {
+			return RunID{}, ErrRunID
+		}
+	}
+
+	var id RunID
+	digest := sha256.Sum256(append([]byte("run id"), marshalUint64s(opened)...))
+	copy(id[:], digest[:])
+	mux.SetRun(id)
+	return id, nil
+}
+
+// agreeRun runs AgreeRunID at the start of a client, and closes mux if it fails.
+func agreeRun(ctx context.Context, lp *LocalParty, mux *Mux, t uint64, tree Tree) error {
+	fmt.Print("\tagreeing on the run...")
+	id, err := lp.AgreeRunID(ctx, mux, t, tree)
+	if err != nil {
+		mux.Close()
+		return err
+	}
+	fmt.Println(" done:", id)
+	return nil
+}
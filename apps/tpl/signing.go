@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The signing keys of the parties are Ed25519 keys. The private key of a
+// party is stored in a PKCS #8 PEM file given by the signing_key field of its
+// topology entry, and its public key is listed, in base64, in the verify_key
+// field of its entry, so that every party knows the keys of its peers.
+
+// parseVerifyKey decodes the base64 encoding of an Ed25519 public key.
+func parseVerifyKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// loadSigningKey reads an Ed25519 private key from a PKCS #8 PEM file.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, isEd25519 := key.(ed25519.PrivateKey)
+	if !isEd25519 {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// SigningKeys loads the signing key of party id and the verification keys of
+// all the parties. It returns nil keys if the topology does not list any.
+func (topo *Topology) SigningKeys(id PartyID) (ed25519.PrivateKey, map[PartyID]ed25519.PublicKey, error) {
+	verifyKeys := make(map[PartyID]ed25519.PublicKey)
+	for _, pc := range topo.Parties {
+		if pc.Role != RoleRelay && pc.VerifyKey != "" {
+			key, err := parseVerifyKey(pc.VerifyKey)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid verification key of party %d: %s", pc.ID, err)
+			}
+			verifyKeys[pc.ID] = key
+		}
+	}
+	if len(verifyKeys) == 0 {
+		return nil, nil, nil
+	}
+
+	pc, known := topo.Party(id)
+	if !known {
+		return nil, nil, fmt.Errorf("party %d is not in the topology", id)
+	}
+	if pc.SigningKey == "" {
+		return nil, nil, fmt.Errorf("party %d has no signing key", id)
+	}
+	key, err := loadSigningKey(topo.path(pc.SigningKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load the signing key of party %d: %s", id, err)
+	}
+	if !bytes.Equal(key.Public().(ed25519.PublicKey), verifyKeys[id]) {
+		return nil, nil, fmt.Errorf("the signing key of party %d does not match its verification key", id)
+	}
+	return key, verifyKeys, nil
+}
+
+// GenerateSigningKeys creates, in dir, a signing key for each party of the
+// topology, and writes to dir/topology.json a copy of the topology listing
+// those keys.
+func GenerateSigningKeys(topo *Topology, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	topo.rebase(dir)
+
+	for i := range topo.Parties {
+		pc := &topo.Parties[i]
+		if pc.Role == RoleRelay {
+			continue
+		}
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return err
+		}
+		pc.SigningKey = fmt.Sprintf(identityFormat, pc.ID) + "-signing.pem"
+		pc.VerifyKey = base64.StdEncoding.EncodeToString(public)
+		if err := writePEM(filepath.Join(dir, pc.SigningKey), "PRIVATE KEY", der); err != nil {
+			return err
+		}
+	}
+	return topo.Save(filepath.Join(dir, "topology.json"))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// Directions of the communication records.
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+)
+
+// CommStats counts the messages exchanged in one direction, and their bytes
+// including the envelope headers.
+type CommStats struct {
+	Messages uint64 `json:"messages"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+func (cs *CommStats) add(bytes int) {
+	cs.Messages++
+	cs.Bytes += uint64(bytes)
+}
+
+// commKey indexes the communication of a session by peer and round.
+type commKey struct {
+	Peer  PartyID
+	Round uint64
+}
+
+// CommRecord is the communication of a session with a peer, in a given round
+// and direction.
+type CommRecord struct {
+	Protocol  string  `json:"protocol"`
+	Session   uint64  `json:"session"`
+	Round     uint64  `json:"round"`
+	Peer      PartyID `json:"peer"`
+	Direction string  `json:"direction"`
+	CommStats
+}
+
+// CommReport is the communication breakdown of a party at the end of a run.
+// Sent and Received are the totals of the records, while WireSent and
+// WireReceived are the bytes counted by the network, which include the
+// framing, acknowledgements and retransmissions of the links.
+type CommReport struct {
+	Party        PartyID      `json:"party"`
+	Sent         CommStats    `json:"sent"`
+	Received     CommStats    `json:"received"`
+	WireSent     uint64       `json:"wire_sent"`
+	WireReceived uint64       `json:"wire_received"`
+	Records      []CommRecord `json:"records"`
+}
+
+// Stats returns the communication records of the session, by round, peer
+// and direction.
+func (sess *Session) Stats() (records []CommRecord) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	for _, dir := range []struct {
+		name  string
+		stats map[commKey]*CommStats
+	}{{DirectionSent, sess.sent}, {DirectionReceived, sess.received}} {
+		for key, stats := range dir.stats {
+			records = append(records, CommRecord{
+				Protocol:  sess.Protocol.String(),
+				Session:   sess.Session,
+				Round:     key.Round,
+				Peer:      key.Peer,
+				Direction: dir.name,
+				CommStats: *stats,
+			})
+		}
+	}
+	return
+}
+
+// NewCommReport gathers the communication records of the sessions of lp
+// over the network nw.
+func NewCommReport(lp *LocalParty, nw Network, sessions []*Session) *CommReport {
+	report := &CommReport{Party: lp.ID, Records: []CommRecord{}}
+	for _, sess := range sessions {
+		report.Records = append(report.Records, sess.Stats()...)
+	}
+	sort.Slice(report.Records, func(i, j int) bool {
+		ri, rj := report.Records[i], report.Records[j]
+		if ri.Protocol != rj.Protocol {
+			return ri.Protocol < rj.Protocol
+		}
+		if ri.Session != rj.Session {
+			return ri.Session < rj.Session
+		}
+		if ri.Round != rj.Round {
+			return ri.Round < rj.Round
+		}
+		if ri.Peer != rj.Peer {
+			return ri.Peer < rj.Peer
+		}
+		return ri.Direction > rj.Direction
+	})
+	for _, r := range report.Records {
+		total := &report.Sent
+		if r.Direction == DirectionReceived {
+			total = &report.Received
+		}
+		total.Messages += r.Messages
+		total.Bytes += r.Bytes
+	}
+	report.WireSent, report.WireReceived = nw.Sum()
+	return report
+}
+
+// WriteCommReports writes the reports of the parties run by this process to
+// a JSON file.
+func WriteCommReports(path string, reports []*CommReport) error {
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Party < reports[j].Party })
+	data, err := json.MarshalIndent(struct {
+		Parties []*CommReport `json:"parties"`
+	}{reports}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
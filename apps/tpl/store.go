@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+// TripleStoreVersion is the version of the format of the triple stores.
+// Version 2 adds the run of the batches, and version 3 the key records.
+const TripleStoreVersion = 3
+
+// A triple store starts with the header
+//
+//	"TPLS" | version (1) | party ID (8) | number of parties (8) | plaintext modulus (8)
+//
+// in big endian, followed by records, each ending with the CRC-32C of the
+// record. A batch record holds the shares of the party of a batch of triples:
+//
+//	'B' | batch ID (8) | run (16) | protocol (1) | session (8) | count (8) | MACs (1) | triples | CRC-32C (4)
+//
+// where each value of the triples (a, b, c, and their MACs if any) takes the
+// number of bytes of the plaintext modulus. A key record holds the share of
+// the party of the MAC key of a run, in as many bytes, and precedes the
+// authenticated batches of the run:
+//
+//	'K' | run (16) | MAC key share | CRC-32C (4)
+//
+// A reservation record consumes the next triples of the store:
+//
+//	'R' | reservation ID (8) | first triple (8) | count (8) | CRC-32C (4)
+//
+// The records are only appended, and synced to disk before an append or a
+// reservation returns, so that a crash can only cut the last record short,
+// which is discarded when the store is opened again.
+const tripleStoreMagic = "TPLS"
+
+const (
+	tripleStoreHeaderLen = len(tripleStoreMagic) + 1 + 8 + 8 + 8
+	batchRecordLen       = 1 + 8 + RunIDLen + 1 + 8 + 8 + 1
+	reservationRecordLen = 1 + 8 + 8 + 8
+	keyRecordLen         = 1 + RunIDLen
+)
+
+var (
+	ErrTripleStoreFormat    = errors.New("not a triple store")
+	ErrTripleStoreMismatch  = errors.New("triple store of another party")
+	ErrTripleStoreExhausted = errors.New("not enough triples in the store")
+	ErrMACKeyMissing        = errors.New("no share of the MAC key of the run")
+)
+
+// StoredBatch is a batch of triples of a triple store. The batches get their
+// IDs in the order they are appended, and the parties append the batches of a
+// run in the order of their sessions, so that the batches with the same ID in
+// the stores of the parties hold their shares of the same triples, as long as
+// their stores started in the same state. A batch is identified across the
+// parties by its ID, and the run and session that generated it.
+type StoredBatch struct {
+	ID      uint64
+	Run     RunID
+	Session SessionKey
+	First   uint64
+	Count   uint64
+	MAC     bool
+
+	offset int64
+}
+
+// Reservation is a range of triples consumed from a triple store, with the
+// batches they belong to. The parties use the same triples if they make the
+// same reservations on stores with the same batches.
+type Reservation struct {
+	ID      uint64
+	First   uint64
+	Count   uint64
+	Batches []StoredBatch
+}
+
+func (r *Reservation) String() string {
+	return fmt.Sprintf("reservation %d of triples [%d, %d)", r.ID, r.First, r.First+r.Count)
+}
+
+// TripleStore persists the shares of the triples of a party, and tracks the
+// ones that were consumed.
+type TripleStore struct {
+	ID       PartyID
+	NParties int
+	T        uint64
+
+	// Recovered is the number of bytes of a record cut short that were
+	// discarded when the store was opened
+	Recovered int64
+
+	lock         sync.Mutex
+	f            *os.File
+	size         int64
+	width        int
+	batches      []*StoredBatch
+	keys         map[RunID]uint64
+	triples      uint64
+	cursor       uint64
+	reservations uint64
+}
+
+// OpenTripleStore opens the triple store of lp at path, for triples modulo t,
+// and creates it if it does not exist. A last record cut short by a crash is
+// truncated.
+func OpenTripleStore(path string, lp *LocalParty, t uint64) (*TripleStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ts := &TripleStore{ID: lp.ID, NParties: len(lp.Peers), T: t, f: f, keys: make(map[RunID]uint64)}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		err = ts.writeHeader()
+	} else if err == nil {
+		err = ts.load(info.Size())
+		if err == nil && (ts.ID != lp.ID || ts.NParties != len(lp.Peers) || ts.T != t) {
+			err = fmt.Errorf("%w: party-%d of %d parties, modulo %d", ErrTripleStoreMismatch, ts.ID, ts.NParties, ts.T)
+		}
+		if err == nil && ts.Recovered > 0 {
+			if err = f.Truncate(ts.size); err == nil {
+				err = f.Sync()
+			}
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ts, nil
+}
+
+// LoadTripleStore opens the triple store at path for reading only.
+func LoadTripleStore(path string) (*TripleStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ts := &TripleStore{f: f, keys: make(map[RunID]uint64)}
+	info, err := f.Stat()
+	if err == nil {
+		err = ts.load(info.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (ts *TripleStore) writeHeader() error {
+	header := make([]byte, tripleStoreHeaderLen)
+	copy(header, tripleStoreMagic)
+	header[4] = TripleStoreVersion
+	binary.BigEndian.PutUint64(header[5:], uint64(ts.ID))
+	binary.BigEndian.PutUint64(header[13:], uint64(ts.NParties))
+	binary.BigEndian.PutUint64(header[21:], ts.T)
+	ts.width = (bits.Len64(ts.T-1) + 7) / 8
+	if _, err := ts.f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	ts.size = int64(len(header))
+	return ts.f.Sync()
+}
+
+// load reads the header and the records of the store. A last record cut
+// short is not loaded, and its length is set in Recovered.
+func (ts *TripleStore) load(size int64) error {
+	header := make([]byte, tripleStoreHeaderLen)
+	if _, err := ts.f.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("%w: %s", ErrTripleStoreFormat, err)
+	}
+	if string(header[:4]) != tripleStoreMagic || header[4] != TripleStoreVersion {
+		return ErrTripleStoreFormat
+	}
+	ts.ID = PartyID(binary.BigEndian.Uint64(header[5:]))
+	ts.NParties = int(binary.BigEndian.Uint64(header[13:]))
+	ts.T = binary.BigEndian.Uint64(header[21:])
+	if ts.T < 2 {
+		return fmt.Errorf("%w: invalid modulus %d", ErrTripleStoreFormat, ts.T)
+	}
+	ts.width = (bits.Len64(ts.T-1) + 7) / 8
+
+	ts.size = int64(len(header))
+	for ts.size < size {
+		n, err := ts.readRecord(size)
+		if err == io.ErrUnexpectedEOF {
+			ts.Recovered = size - ts.size
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ts.size += n
+	}
+	return nil
+}
+
+// readRecord reads the record at the end of the loaded ones, and returns its
+// length. It returns io.ErrUnexpectedEOF if the record is cut short, or if it
+// is the last one and does not match its checksum.
+func (ts *TripleStore) readRecord(size int64) (int64, error) {
+	var length int64
+	var kind [1]byte
+	if _, err := ts.f.ReadAt(kind[:], ts.size); err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	switch kind[0] {
+	case 'B':
+		if size-ts.size < int64(batchRecordLen) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		header := make([]byte, batchRecordLen)
+		if _, err := ts.f.ReadAt(header, ts.size); err != nil {
+			return 0, err
+		}
+		b := &StoredBatch{
+			ID:      binary.BigEndian.Uint64(header[1:]),
+			Session: SessionKey{Protocol: ProtocolID(header[25]), Session: binary.BigEndian.Uint64(header[26:])},
+			First:   ts.triples,
+			Count:   binary.BigEndian.Uint64(header[34:]),
+			MAC:     header[42] == 1,
+			offset:  ts.size + int64(batchRecordLen),
+		}
+		copy(b.Run[:], header[9:])
+		if b.ID != uint64(len(ts.batches)) || b.Count > uint64(size) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		length = int64(batchRecordLen) + int64(b.Count)*int64(ts.tripleLen(b.MAC)) + 4
+		if length > size-ts.size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err := ts.checkRecord(length, size); err != nil {
+			return 0, err
+		}
+		if _, ok := ts.keys[b.Run]; b.MAC && !ok {
+			return 0, fmt.Errorf("%w: authenticated batch %d without the MAC key of run %s", ErrTripleStoreFormat, b.ID, b.Run)
+		}
+		ts.batches = append(ts.batches, b)
+		ts.triples += b.Count
+	case 'R':
+		length = int64(reservationRecordLen) + 4
+		if length > size-ts.size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err := ts.checkRecord(length, size); err != nil {
+			return 0, err
+		}
+		record := make([]byte, reservationRecordLen)
+		if _, err := ts.f.ReadAt(record, ts.size); err != nil {
+			return 0, err
+		}
+		id, first, count := binary.BigEndian.Uint64(record[1:]), binary.BigEndian.Uint64(record[9:]), binary.BigEndian.Uint64(record[17:])
+		if id != ts.reservations || first != ts.cursor || count > ts.triples-ts.cursor {
+			return 0, fmt.Errorf("%w: inconsistent reservation %d of triples [%d, %d)", ErrTripleStoreFormat, id, first, first+count)
+		}
+		ts.reservations++
+		ts.cursor += count
+	case 'K':
+		length = int64(keyRecordLen+ts.width) + 4
+		if length > size-ts.size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err := ts.checkRecord(length, size); err != nil {
+			return 0, err
+		}
+		record := make([]byte, keyRecordLen+ts.width)
+		if _, err := ts.f.ReadAt(record, ts.size); err != nil {
+			return 0, err
+		}
+		var run RunID
+		copy(run[:], record[1:])
+		share := ts.readValue(record[keyRecordLen:])
+		if _, ok := ts.keys[run]; ok || share >= ts.T {
+			return 0, fmt.Errorf("%w: inconsistent MAC key of run %s", ErrTripleStoreFormat, run)
+		}
+		ts.keys[run] = share
+	default:
+		return 0, io.ErrUnexpectedEOF
+	}
+	return length, nil
+}
+
+// checkRecord checks the checksum of the record of the given length at the
+// end of the loaded ones. A mismatch is only expected for the last record of
+// the store, if it was not fully written, and any other is an error.
+func (ts *TripleStore) checkRecord(length, size int64) error {
+	record := make([]byte, length)
+	if _, err := ts.f.ReadAt(record, ts.size); err != nil {
+		return err
+	}
+	crc := crc32.Checksum(record[:length-4], crc32.MakeTable(crc32.Castagnoli))
+	if crc == binary.BigEndian.Uint32(record[length-4:]) {
+		return nil
+	}
+	if ts.size+length == size {
+		return io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: corrupted record at offset %d", ErrTripleStoreFormat, ts.size)
+}
+
+// appendRecord writes the record at the end of the store, with its checksum,
+// and syncs it to disk.
+func (ts *TripleStore) appendRecord(record []byte) error {
+	crc := crc32.Checksum(record, crc32.MakeTable(crc32.Castagnoli))
+	record = append(record, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(record[len(record)-4:], crc)
+	if _, err := ts.f.WriteAt(record, ts.size); err != nil {
+		return err
+	}
+	if err := ts.f.Sync(); err != nil {
+		return err
+	}
+	ts.size += int64(len(record))
+	return nil
+}
+
+func (ts *TripleStore) tripleLen(mac bool) int {
+	if mac {
+		return 6 * ts.width
+	}
+	return 3 * ts.width
+}
+
+// AppendMACKey stores the share of the party of the MAC key of the run, which
+// authenticates the batches of the run appended with MACs. It does nothing if
+// the store already holds this share.
+func (ts *TripleStore) AppendMACKey(run RunID, share uint64) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if stored, ok := ts.keys[run]; ok {
+		if stored != share {
+			return fmt.Errorf("the store holds another MAC key for run %s", run)
+		}
+		return nil
+	}
+	record := make([]byte, keyRecordLen, keyRecordLen+ts.width+4)
+	record[0] = 'K'
+	copy(record[1:], run[:])
+	record = ts.appendValue(record, share)
+	if err := ts.appendRecord(record); err != nil {
+		return err
+	}
+	ts.keys[run] = share
+	return nil
+}
+
+// MACKeyShare returns the share of the party of the MAC key of the run, if
+// the store holds it.
+func (ts *TripleStore) MACKeyShare(run RunID) (uint64, bool) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	share, ok := ts.keys[run]
+	return share, ok
+}
+
+// Append stores the triples generated by the session key of the run as a new
+// batch, with their MACs if mac is set, and returns the batch. The MAC key of
+// the run should be stored first.
+func (ts *TripleStore) Append(run RunID, key SessionKey, triples []Triple, mac bool) (*StoredBatch, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if _, ok := ts.keys[run]; mac && !ok {
+		return nil, fmt.Errorf("%w %s", ErrMACKeyMissing, run)
+	}
+
+	b := &StoredBatch{ID: uint64(len(ts.batches)), Run: run, Session: key, First: ts.triples, Count: uint64(len(triples)), MAC: mac}
+	record := make([]byte, batchRecordLen, batchRecordLen+len(triples)*ts.tripleLen(mac)+4)
+	record[0] = 'B'
+	binary.BigEndian.PutUint64(record[1:], b.ID)
+	copy(record[9:], run[:])
+	record[25] = byte(key.Protocol)
+	binary.BigEndian.PutUint64(record[26:], key.Session)
+	binary.BigEndian.PutUint64(record[34:], b.Count)
+	if mac {
+		record[42] = 1
+	}
+	for _, t := range triples {
+		values := []uint64{t.A, t.B, t.C, t.MacA, t.MacB, t.MacC}
+		for _, v := range values[:ts.tripleLen(mac)/ts.width] {
+			record = ts.appendValue(record, v)
+		}
+	}
+	b.offset = ts.size + int64(batchRecordLen)
+	if err := ts.appendRecord(record); err != nil {
+		return nil, err
+	}
+	ts.batches = append(ts.batches, b)
+	ts.triples += b.Count
+	return b, nil
+}
+
+func (ts *TripleStore) appendValue(record []byte, v uint64) []byte {
+	for i := ts.width - 1; i >= 0; i-- {
+		record = append(record, byte(v>>(8*uint(i))))
+	}
+	return record
+}
+
+func (ts *TripleStore) readValue(data []byte) (v uint64) {
+	for _, b := range data[:ts.width] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// Plan returns the reservation of the next n triples of the store, without
+// consuming them. It returns ErrTripleStoreExhausted if the store has less
+// than n unconsumed triples.
+func (ts *TripleStore) Plan(n uint64) (*Reservation, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if n > ts.triples-ts.cursor {
+		return nil, fmt.Errorf("%w: %d requested, %d available", ErrTripleStoreExhausted, n, ts.triples-ts.cursor)
+	}
+	return &Reservation{ID: ts.reservations, First: ts.cursor, Count: n, Batches: batchesOf(ts.batches, ts.cursor, n)}, nil
+}
+
+// Reserve consumes the triples of r, which should be the next reservation of
+// the store, and returns them. The reservation is synced to disk before the
+// triples are returned, so that they are never used twice.
+func (ts *TripleStore) Reserve(r *Reservation) ([]Triple, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if r.ID != ts.reservations || r.First != ts.cursor || r.Count > ts.triples-ts.cursor {
+		return nil, fmt.Errorf("%s is not the next reservation of the store", r)
+	}
+	triples, err := ts.read(r.First, r.Count)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, reservationRecordLen, reservationRecordLen+4)
+	record[0] = 'R'
+	binary.BigEndian.PutUint64(record[1:], r.ID)
+	binary.BigEndian.PutUint64(record[9:], r.First)
+	binary.BigEndian.PutUint64(record[17:], r.Count)
+	if err := ts.appendRecord(record); err != nil {
+		return nil, err
+	}
+	ts.reservations++
+	ts.cursor += r.Count
+	return triples, nil
+}
+
+// batchesOf returns the batches of the count triples from first.
+func batchesOf(batches []*StoredBatch, first, count uint64) (covered []StoredBatch) {
+	for _, b := range batches {
+		if b.First < first+count && first < b.First+b.Count {
+			covered = append(covered, *b)
+		}
+	}
+	return
+}
+
+// read returns the count triples of the store from first.
+func (ts *TripleStore) read(first, count uint64) ([]Triple, error) {
+	triples := make([]Triple, 0, count)
+	for _, b := range ts.batches {
+		if count == 0 {
+			break
+		}
+		if first >= b.First+b.Count {
+			continue
+		}
+		start := first - b.First
+		n := b.Count - start
+		if n > count {
+			n = count
+		}
+		tripleLen := ts.tripleLen(b.MAC)
+		data := make([]byte, int(n)*tripleLen)
+		if _, err := ts.f.ReadAt(data, b.offset+int64(start)*int64(tripleLen)); err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(n); i++ {
+			values := make([]uint64, tripleLen/ts.width)
+			for k := range values {
+				values[k] = ts.readValue(data[i*tripleLen+k*ts.width:])
+			}
+			t := Triple{A: values[0], B: values[1], C: values[2]}
+			if b.MAC {
+				t.MacA, t.MacB, t.MacC = values[3], values[4], values[5]
+			}
+			triples = append(triples, t)
+		}
+		first += n
+		count -= n
+	}
+	return triples, nil
+}
+
+// Batches returns the batches of the store, in the order of their IDs.
+func (ts *TripleStore) Batches() []StoredBatch {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	batches := make([]StoredBatch, len(ts.batches))
+	for i, b := range ts.batches {
+		batches[i] = *b
+	}
+	return batches
+}
+
+// Len returns the number of triples of the store, and the number of them
+// that were consumed.
+func (ts *TripleStore) Len() (triples, consumed uint64) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.triples, ts.cursor
+}
+
+// Available returns the number of unconsumed triples of the store.
+func (ts *TripleStore) Available() uint64 {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.triples - ts.cursor
+}
+
+func (ts *TripleStore) Close() error {
+	return ts.f.Close()
+}
+
+// storeTriples appends the triples of each session to the store, in the order
+// of the sessions, with the MAC key share of the party if they are
+// authenticated by macKey.
+func storeTriples(ts *TripleStore, sessions []*Session, triples [][]Triple, macKey *MACKey) error {
+	for i, sess := range sessions {
+		if macKey != nil {
+			if err := ts.AppendMACKey(sess.mux.Run(), macKey.Share); err != nil {
+				return err
+			}
+		}
+		b, err := ts.Append(sess.mux.Run(), sess.SessionKey, triples[i], macKey != nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\tstored %d triples of %s as batch %d\n", b.Count, sess.SessionKey, b.ID)
+	}
+	return nil
+}
+
+// PrintTripleStore prints the batches and the consumption of the store to w.
+func PrintTripleStore(ts *TripleStore, w io.Writer) error {
+	triples, consumed := ts.Len()
+	recovered := ""
+	if ts.Recovered > 0 {
+		recovered = fmt.Sprintf(", %d bytes of a record cut short discarded", ts.Recovered)
+	}
+	if _, err := fmt.Fprintf(w, "party-%d of %d parties: %d triples, %d consumed%s\n", ts.ID, ts.NParties, triples, consumed, recovered); err != nil {
+		return err
+	}
+	for _, b := range ts.Batches() {
+		mac := ""
+		if b.MAC {
+			mac = ", authenticated"
+		}
+		if _, err := fmt.Fprintf(w, "\tbatch %d from %s of run %s: triples [%d, %d)%s\n", b.ID, b.Session, b.Run, b.First, b.First+b.Count, mac); err != nil {
+			return err
+		}
+	}
+	return nil
+}
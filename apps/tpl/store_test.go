@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// reserve plans and makes the reservation of the next n triples of ts.
+func reserve(ts *TripleStore, n uint64) ([]Triple, error) {
+	r, err := ts.Plan(n)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Reserve(r)
+}
+
+// TestTripleStoreRecovery checks that a last record cut short, as by a crash,
+// is discarded when the store is opened again, and that a corrupted record
+// before the last one is an error.
+func TestTripleStoreRecovery(t *testing.T) {
+	const modulus = 65537
+	lp, err := NewLocalParty(1, map[PartyID]string{0: "", 1: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch0 := []Triple{{1, 2, 2, 0, 0, 0}, {3, 4, 12, 0, 0, 0}, {5, 6, 30, 0, 0, 0}, {7, 8, 56, 0, 0, 0}}
+	batch1 := []Triple{{9, 10, 90, 0, 0, 0}, {11, 12, 132, 0, 0, 0}}
+
+	// The store holds batch 0, a reservation of 3 triples and batch 1
+	batch0Len := int64(batchRecordLen + len(batch0)*9 + 4)
+	reservationLen := int64(reservationRecordLen + 4)
+	batch1Len := int64(batchRecordLen + len(batch1)*9 + 4)
+	size := int64(tripleStoreHeaderLen) + batch0Len + reservationLen + batch1Len
+
+	truncate := func(n int64) func(f *os.File) error {
+		return func(f *os.File) error { return f.Truncate(size - n) }
+	}
+	flip := func(offset int64) func(f *os.File) error {
+		return func(f *os.File) error {
+			b := make([]byte, 1)
+			if _, err := f.ReadAt(b, offset); err != nil {
+				return err
+			}
+			b[0] ^= 1
+			_, err := f.WriteAt(b, offset)
+			return err
+		}
+	}
+	for _, tc := range []struct {
+		name              string
+		damage            func(f *os.File) error
+		triples, consumed uint64
+		recovered         int64
+		err               error
+	}{
+		{"intact", func(f *os.File) error { return nil }, 6, 3, 0, nil},
+		{"last byte", truncate(1), 4, 3, batch1Len - 1, nil},
+		{"batch header", truncate(batch1Len - 5), 4, 3, 5, nil},
+		{"kind only", truncate(batch1Len - 1), 4, 3, 1, nil},
+		{"checksum of the last record", flip(size - 1), 4, 3, batch1Len, nil},
+		{"triple of the last record", flip(size - 10), 4, 3, batch1Len, nil},
+		{"reservation", truncate(batch1Len + 1), 4, 0, reservationLen - 1, nil},
+		{"first batch", flip(int64(tripleStoreHeaderLen) + batchRecordLen), 0, 0, 0, ErrTripleStoreFormat},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "store")
+			ts, err := OpenTripleStore(path, lp, modulus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ts.Append(RunID{1}, SessionKey{ProtocolTripleGen, 0}, batch0, false); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := reserve(ts, 3); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ts.Append(RunID{1}, SessionKey{ProtocolTripleGen, 1}, batch1, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.damage(ts.f); err != nil {
+				t.Fatal(err)
+			}
+			ts.Close()
+
+			ts, err = OpenTripleStore(path, lp, modulus)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if triples, consumed := ts.Len(); triples != tc.triples || consumed != tc.consumed || ts.Recovered != tc.recovered {
+				t.Fatalf("recovered %d triples, %d consumed, %d bytes discarded, instead of %d, %d and %d", triples, consumed, ts.Recovered, tc.triples, tc.consumed, tc.recovered)
+			}
+
+			// The store goes on from the recovered records, which are kept
+			if _, err := ts.Append(RunID{2}, SessionKey{ProtocolTripleGen, 0}, batch1, false); err != nil {
+				t.Fatal(err)
+			}
+			ts.Close()
+			if ts, err = OpenTripleStore(path, lp, modulus); err != nil {
+				t.Fatal(err)
+			}
+			defer ts.Close()
+			if ts.Recovered != 0 {
+				t.Fatalf("%d bytes discarded again", ts.Recovered)
+			}
+			all := append(append([]Triple(nil), batch0...), batch1...)[:tc.triples]
+			all = append(all, batch1...)
+			triples, err := reserve(ts, ts.Available())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := all[tc.consumed:]; !reflect.DeepEqual(triples, want) {
+				t.Fatalf("reserved %v instead of %v", triples, want)
+			}
+		})
+	}
+}
+
+// TestTripleStorePlan checks that a planned reservation consumes nothing
+// until it is made, and lists the batches of its triples.
+func TestTripleStorePlan(t *testing.T) {
+	lp, err := NewLocalParty(0, map[PartyID]string{0: "", 1: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "store")
+	ts, err := OpenTripleStore(path, lp, 65537)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for session := uint64(0); session < 3; session++ {
+		if _, err := ts.Append(RunID{7}, SessionKey{ProtocolMHETripleGen, session}, make([]Triple, 4), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reserve(ts, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ts.Plan(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Batches) != 2 || r.Batches[0].ID != 0 || r.Batches[1].ID != 1 || r.Batches[1].Session.Session != 1 || r.Batches[1].Run != (RunID{7}) {
+		t.Fatalf("%s of batches %v", r, r.Batches)
+	}
+	if _, err := ts.Plan(10); !errors.Is(err, ErrTripleStoreExhausted) {
+		t.Fatalf("got error %v instead of %v", err, ErrTripleStoreExhausted)
+	}
+
+	// The planned reservation is not recorded
+	ts.Close()
+	if ts, err = OpenTripleStore(path, lp, 65537); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	if _, consumed := ts.Len(); consumed != 3 {
+		t.Fatalf("%d triples consumed instead of 3", consumed)
+	}
+
+	// A reservation that is not the next one of the store is rejected
+	if _, err := ts.Reserve(&Reservation{ID: 0, First: 0, Count: 3}); err == nil {
+		t.Fatal("made a reservation twice")
+	}
+	if _, err := ts.Reserve(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Reserve(r); err == nil {
+		t.Fatal("made a reservation twice")
+	}
+}
+
+// TestTripleStoreMACKey checks that the store keeps the MAC key share of the
+// authenticated batches of a run.
+func TestTripleStoreMACKey(t *testing.T) {
+	lp, err := NewLocalParty(0, map[PartyID]string{0: "", 1: ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "store")
+	ts, err := OpenTripleStore(path, lp, 65537)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := []Triple{{1, 2, 2, 3, 4, 5}}
+	if _, err := ts.Append(RunID{1}, SessionKey{ProtocolMHETripleGen, 0}, batch, true); !errors.Is(err, ErrMACKeyMissing) {
+		t.Fatalf("got error %v instead of %v", err, ErrMACKeyMissing)
+	}
+	if err := ts.AppendMACKey(RunID{1}, 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.AppendMACKey(RunID{1}, 43); err == nil {
+		t.Fatal("stored another MAC key for the run")
+	}
+	if _, err := ts.Append(RunID{1}, SessionKey{ProtocolMHETripleGen, 0}, batch, true); err != nil {
+		t.Fatal(err)
+	}
+	ts.Close()
+
+	if ts, err = OpenTripleStore(path, lp, 65537); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	if share, ok := ts.MACKeyShare(RunID{1}); !ok || share != 42 {
+		t.Fatalf("MAC key share %d, %v instead of 42", share, ok)
+	}
+	if _, ok := ts.MACKeyShare(RunID{2}); ok {
+		t.Fatal("MAC key share of another run")
+	}
+	triples, err := reserve(ts, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(triples, batch) {
+		t.Fatalf("reserved %v instead of %v", triples, batch)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// thresholdKeySeed is the common seed of the CRP of the collective public key.
+var thresholdKeySeed = deriveSeed("threshold key")
+
+// ThresholdKey is the share of a party of the collective secret key s, the sum
+// of the secret keys of all the parties, in a t-out-of-N Shamir sharing: Share
+// is the evaluation at ID+1 of a polynomial of degree t-1 whose constant term
+// is s, so that any t parties U recover s as the sum of their shares weighted
+// by their Lagrange coefficients for U. PublicKey is the collective public
+// key, under which the parties encrypt their inputs without knowing which of
+// them will decrypt.
+type ThresholdKey struct {
+	Threshold int
+	Share     *ring.Poly
+	PublicKey *rlwe.PublicKey
+}
+
+// ThresholdKeyGenProtocol shares the secret key of each party among all the
+// parties, which requires a connection between every pair of parties, and
+// generates the collective public key along the tree, aggregated up to the
+// root and then sent down to every party. The shares are encrypted end to end
+// under a key agreed by an ephemeral P-256 Diffie-Hellman exchange between
+// each pair of parties, whose public keys are authenticated by the signatures
+// of the envelopes or by the TLS connections between the parties.
+type ThresholdKeyGenProtocol struct {
+	*LocalParty
+	*rlwe.SecretKey
+	*dbfv.CKGProtocol
+
+	Chan     chan MHETripleGenMessage
+	Parent   *MHETripleGenRemote
+	Children map[PartyID]*MHETripleGenRemote
+	Remotes  map[PartyID]*MHETripleGenRemote // of all the other parties, Parent and Children included
+
+	binding
+
+	threshold int
+	rq, rqp   *ring.Ring
+	params    bfv.Parameters
+}
+
+func (lp *LocalParty) NewThresholdKeyGenProtocol(params bfv.Parameters, sk *rlwe.SecretKey, threshold int, tree Tree) *ThresholdKeyGenProtocol {
+	tkg := new(ThresholdKeyGenProtocol)
+	tkg.LocalParty = lp
+	tkg.SecretKey = sk
+	tkg.CKGProtocol = dbfv.NewCKGProtocol(params)
+	tkg.threshold = threshold
+	tkg.rq = params.RingQ()
+	tkg.rqp = params.RingQP()
+	tkg.params = params
+
+	tkg.Chan = make(chan MHETripleGenMessage, 32)
+
+	tkg.Remotes = make(map[PartyID]*MHETripleGenRemote)
+	for id := range lp.Peers {
+		if id != lp.ID {
+			tkg.Remotes[id] = &MHETripleGenRemote{ID: id, Chan: make(chan MHETripleGenMessage, 32)}
+		}
+	}
+	if lp.ID != tree[lp.ID].Parent {
+		tkg.Parent = tkg.Remotes[tree[lp.ID].Parent]
+	}
+	tkg.Children = make(map[PartyID]*MHETripleGenRemote)
+	for _, child := range tree[lp.ID].Children {
+		tkg.Children[child] = tkg.Remotes[child]
+	}
+	return tkg
+}
+
+// Run returns the threshold key of the party. It stops with an error if ctx
+// is cancelled, if a peer fails, or if nothing is received from the peers for
+// READ_TIMEOUT.
+func (tkg *ThresholdKeyGenProtocol) Run(ctx context.Context) (*ThresholdKey, error) {
+	key, err := tkg.listen(ctx)
+	if errUnbind := tkg.unbindNetwork(); err == nil {
+		err = errUnbind
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (tkg *ThresholdKeyGenProtocol) listen(ctx context.Context) (*ThresholdKey, error) {
+
+	// Each party sends to every other party an ephemeral public key in round
+	// 0, and its share of its secret key, encrypted under the key agreed with
+	// the party, in round 1
+	shares, err := tkg.shareSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	key := &ThresholdKey{Threshold: tkg.threshold, Share: shares[tkg.ID]}
+	curve := elliptic.P256()
+	priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shareKeys := make(map[PartyID]*shareKey, len(tkg.Remotes))
+	waiting := make(awaited)
+	for id, rp := range tkg.Remotes {
+		rp.Chan <- MHETripleGenMessage{PartyID: tkg.ID, Data: elliptic.Marshal(curve, x, y), Round: 0}
+		waiting.expect(0, 0, id)
+		waiting.expect(0, 1, id)
+	}
+
+	// And its share of the collective public key, aggregated up the tree in
+	// round 2, from which the root sends the public key down in round 3
+	crp, err := readCRP(tkg.rqp, thresholdKeySeed, 0)
+	if err != nil {
+		return nil, err
+	}
+	ckgShare := tkg.AllocateShares()
+	tkg.GenShare(tkg.SecretKey, crp, ckgShare)
+	var aggregated int
+	relay := func() {
+		data, _ := ckgShare.MarshalBinary()
+		if tkg.Parent != nil {
+			tkg.Parent.Chan <- MHETripleGenMessage{PartyID: tkg.ID, Data: data, Round: 2}
+			waiting.expect(0, 3, tkg.Parent.ID)
+			return
+		}
+		key.PublicKey = bfv.NewPublicKey(tkg.params)
+		tkg.GenPublicKey(ckgShare, crp, key.PublicKey)
+		for _, rp := range tkg.Children {
+			rp.Chan <- MHETripleGenMessage{PartyID: tkg.ID, Data: data, Round: 3}
+		}
+	}
+	for _, rp := range tkg.Children {
+		waiting.expect(0, 2, rp.ID)
+	}
+	if len(tkg.Children) == 0 {
+		relay()
+	}
+
+	for len(waiting) > 0 {
+		m, err := tkg.next(ctx, waiting)
+		if err != nil {
+			return nil, err
+		}
+		switch m.Round {
+		case 0:
+			px, py := elliptic.Unmarshal(curve, m.Data)
+			if px == nil {
+				return nil, tkg.messageError(m, fmt.Errorf("%w: invalid ephemeral key", ErrMalformedMessage))
+			}
+			shared, _ := curve.ScalarMult(px, py, priv)
+			shareKeys[m.PartyID] = tkg.newShareKey(shared.FillBytes(make([]byte, 32)), m.PartyID)
+			data, _ := shares[m.PartyID].MarshalBinary()
+			tkg.Remotes[m.PartyID].Chan <- MHETripleGenMessage{PartyID: tkg.ID, Data: shareKeys[m.PartyID].seal(data), Round: 1}
+		case 1:
+			keys, agreed := shareKeys[m.PartyID]
+			if !agreed {
+				return nil, tkg.messageError(m, ErrUnexpectedMessage)
+			}
+			data, err := keys.open(m.Data)
+			if err != nil {
+				return nil, tkg.messageError(m, err)
+			}
+			share, err := unmarshalPoly(data, tkg.rq)
+			if err != nil {
+				return nil, tkg.messageError(m, err)
+			}
+			tkg.rq.Add(key.Share, share, key.Share)
+		case 2:
+			share, err := unmarshalPoly(m.Data, tkg.rqp)
+			if err != nil {
+				return nil, tkg.messageError(m, err)
+			}
+			tkg.AggregateShares(ckgShare, &drlwe.CKGShare{Poly: share}, ckgShare)
+			if aggregated++; aggregated == len(tkg.Children) {
+				relay()
+			}
+		case 3:
+			pk0, err := unmarshalPoly(m.Data, tkg.rqp)
+			if err != nil {
+				return nil, tkg.messageError(m, err)
+			}
+			key.PublicKey = bfv.NewPublicKey(tkg.params)
+			tkg.GenPublicKey(&drlwe.CKGShare{Poly: pk0}, crp, key.PublicKey)
+			for _, rp := range tkg.Children {
+				rp.Chan <- MHETripleGenMessage{PartyID: tkg.ID, Data: m.Data, Round: 3}
+			}
+		}
+	}
+	return key, nil
+}
+
+// shareKey holds the AES-GCM keys of the shares exchanged with a peer, one for
+// each direction. Each key encrypts a single share, under a zero nonce.
+type shareKey struct {
+	send, receive cipher.AEAD
+}
+
+// newShareKey derives the keys of the shares exchanged with peer from their
+// shared Diffie-Hellman secret, the run and the session.
+func (tkg *ThresholdKeyGenProtocol) newShareKey(shared []byte, peer PartyID) *shareKey {
+	derive := func(sender, receiver PartyID) cipher.AEAD {
+		h := sha256.New()
+		h.Write([]byte("threshold share"))
+		run := tkg.session.mux.Run()
+		h.Write(run[:])
+		for _, v := range []uint64{uint64(tkg.session.Protocol), tkg.session.Session, uint64(sender), uint64(receiver)} {
+			h.Write(appendUint64(nil, v))
+		}
+		h.Write(shared)
+		block, _ := aes.NewCipher(h.Sum(nil))
+		aead, _ := cipher.NewGCM(block)
+		return aead
+	}
+	return &shareKey{send: derive(tkg.ID, peer), receive: derive(peer, tkg.ID)}
+}
+
+func (sk *shareKey) seal(data []byte) []byte {
+	return sk.send.Seal(nil, make([]byte, sk.send.NonceSize()), data, nil)
+}
+
+func (sk *shareKey) open(data []byte) ([]byte, error) {
+	plain, err := sk.receive.Open(nil, make([]byte, sk.receive.NonceSize()), data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decrypt the share: %s", ErrMalformedMessage, err)
+	}
+	return plain, nil
+}
+
+// shareSecretKey returns the shares of the secret key of the party for every
+// party, the evaluations at ID+1 of a random polynomial of degree t-1 whose
+// constant term is the secret key, restricted to the ring of the ciphertexts.
+func (tkg *ThresholdKeyGenProtocol) shareSecretKey() (map[PartyID]*ring.Poly, error) {
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		return nil, err
+	}
+	sampler := ring.NewUniformSampler(prng, tkg.rq)
+	coeffs := make([]*ring.Poly, tkg.threshold)
+	coeffs[0] = tkg.rq.NewPoly()
+	for i := range tkg.rq.Modulus {
+		copy(coeffs[0].Coeffs[i], tkg.SecretKey.Value.Coeffs[i])
+	}
+	for k := 1; k < len(coeffs); k++ {
+		coeffs[k] = sampler.ReadNew()
+	}
+
+	shares := make(map[PartyID]*ring.Poly, len(tkg.Peers))
+	for id := range tkg.Peers {
+		share := coeffs[len(coeffs)-1].CopyNew()
+		for k := len(coeffs) - 2; k >= 0; k-- {
+			tkg.rq.MulScalar(share, uint64(id)+1, share)
+			tkg.rq.Add(share, coeffs[k], share)
+		}
+		shares[id] = share
+	}
+	return shares, nil
+}
+
+// lagrangeCoefficient returns the coefficient modulo q of the share of party
+// id in the recovery of a secret from the shares of the parties.
+func lagrangeCoefficient(id PartyID, parties []PartyID, q *big.Int) *big.Int {
+	num, den := big.NewInt(1), big.NewInt(1)
+	xi := new(big.Int).SetUint64(uint64(id) + 1)
+	for _, other := range parties {
+		if other == id {
+			continue
+		}
+		xj := new(big.Int).SetUint64(uint64(other) + 1)
+		num.Mul(num, xj)
+		den.Mul(den, new(big.Int).Sub(xj, xi))
+	}
+	den.Mod(den, q)
+	return num.Mul(num, den.ModInverse(den, q)).Mod(num, q)
+}
+
+// unmarshalPoly decodes a polynomial of the ring r, which must be all of data.
+func unmarshalPoly(data []byte, r *ring.Ring) (*ring.Poly, error) {
+	n, err := checkPolyEncoding(data, r)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(data)-n)
+	}
+	p := new(ring.Poly)
+	if err := p.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// marshalParties encodes a set of parties as their count followed by their IDs.
+func marshalParties(parties []PartyID) []byte {
+	data := make([]byte, 2+8*len(parties))
+	binary.BigEndian.PutUint16(data, uint16(len(parties)))
+	for i, id := range parties {
+		binary.BigEndian.PutUint64(data[2+8*i:], uint64(id))
+	}
+	return data
+}
+
+// unmarshalParties decodes a set of parties among nParties at the start of
+// data, sorted by ID, and returns the rest of data.
+func unmarshalParties(data []byte, nParties int) ([]PartyID, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("%w: missing parties", ErrMalformedMessage)
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if n > nParties || len(data) < 2+8*n {
+		return nil, nil, fmt.Errorf("%w: invalid set of parties", ErrMalformedMessage)
+	}
+	parties := make([]PartyID, n)
+	seen := make(map[PartyID]bool, n)
+	for i := range parties {
+		parties[i] = PartyID(binary.BigEndian.Uint64(data[2+8*i:]))
+		if int(parties[i]) >= nParties || seen[parties[i]] {
+			return nil, nil, fmt.Errorf("%w: invalid set of parties", ErrMalformedMessage)
+		}
+		seen[parties[i]] = true
+	}
+	sort.Slice(parties, func(i, j int) bool { return parties[i] < parties[j] })
+	return parties, data[2+8*n:], nil
+}
+
+// height returns the height of the subtree of id, 0 for a leaf.
+func (tree Tree) height(id PartyID) (h int) {
+	for _, child := range tree[id].Children {
+		if hc := tree.height(child) + 1; hc > h {
+			h = hc
+		}
+	}
+	return h
+}
+
+// inSubtree reports whether id is in the subtree of root.
+func (tree Tree) inSubtree(id, root PartyID) bool {
+	for {
+		if id == root {
+			return true
+		}
+		node, exists := tree[id]
+		if !exists || node.Parent == id {
+			return false
+		}
+		id = node.Parent
+	}
+}
+
+// next returns the next expected message of the session, or the error that stops the protocol.
+func (tkg *ThresholdKeyGenProtocol) next(ctx context.Context, waiting awaited) (MHETripleGenMessage, error) {
+	timer := time.NewTimer(READ_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-tkg.Chan:
+			if m.err != nil {
+				if err := waiting.failure(tkg.session.SessionKey, m.err); err != nil {
+					return m, err
+				}
+				continue
+			}
+			if !waiting.receive(m.PartyID, m.Batch, uint64(m.Round)) {
+				return m, tkg.messageError(m, ErrUnexpectedMessage)
+			}
+			return m, nil
+		case err := <-tkg.sendErrs:
+			return MHETripleGenMessage{}, err
+		case <-timer.C:
+			return MHETripleGenMessage{}, waiting.timeout(tkg.session.SessionKey)
+		case <-ctx.Done():
+			return MHETripleGenMessage{}, ctx.Err()
+		}
+	}
+}
+
+func (tkg *ThresholdKeyGenProtocol) messageError(m MHETripleGenMessage, err error) error {
+	return &ProtocolError{Session: tkg.session.SessionKey, Peer: m.PartyID, Batch: m.Batch, Round: uint64(m.Round), Err: err}
+}
+
+func (tkg *ThresholdKeyGenProtocol) BindNetwork(sess *Session) {
+	var remotes []*MHETripleGenRemote
+	for _, rp := range tkg.Remotes {
+		remotes = append(remotes, rp)
+	}
+	tkg.bindMessages(sess, tkg.Chan, remotes, nil)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// TestShareSecretKey checks that a set of parties recovers the secret key of
+// a party from their shares and Lagrange coefficients if and only if they
+// reach the threshold.
+func TestShareSecretKey(t *testing.T) {
+	params := tplParameters(false)
+	rq := params.RingQ()
+	for _, tc := range []struct {
+		name      string
+		nParties  int
+		threshold int
+		parties   []PartyID
+		recovered bool
+	}{
+		{"2 of 3", 3, 2, []PartyID{0, 2}, true},
+		{"3 of 3 with a threshold of 2", 3, 2, []PartyID{0, 1, 2}, true},
+		{"3 of 5", 5, 3, []PartyID{1, 3, 4}, true},
+		{"4 of 5 with a threshold of 3", 5, 3, []PartyID{0, 1, 2, 4}, true},
+		{"5 of 5", 5, 5, []PartyID{0, 1, 2, 3, 4}, true},
+		{"2 of 5 with a threshold of 3", 5, 3, []PartyID{2, 4}, false},
+		{"4 of 5 with a threshold of 5", 5, 5, []PartyID{0, 1, 2, 3}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			peers := make(map[PartyID]string, tc.nParties)
+			for i := 0; i < tc.nParties; i++ {
+				peers[PartyID(i)] = ""
+			}
+			lp, err := NewLocalParty(1, peers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sk := bfv.NewKeyGenerator(params).GenSecretKey()
+			tkg := lp.NewThresholdKeyGenProtocol(params, sk, tc.threshold, NewTree(peers, 2))
+			shares, err := tkg.shareSecretKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shares) != tc.nParties {
+				t.Fatalf("%d shares for %d parties", len(shares), tc.nParties)
+			}
+
+			recovered := rq.NewPoly()
+			weighted := rq.NewPoly()
+			for _, id := range tc.parties {
+				rq.MulScalarBigint(shares[id], lagrangeCoefficient(id, tc.parties, rq.ModulusBigint), weighted)
+				rq.Add(recovered, weighted, recovered)
+			}
+			equal := true
+			for i := range rq.Modulus {
+				for j, c := range recovered.Coeffs[i] {
+					equal = equal && c == sk.Value.Coeffs[i][j]
+				}
+			}
+			if equal != tc.recovered {
+				t.Fatalf("recovered the secret key: %t, expected %t", equal, tc.recovered)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The identity of a party is bound to its certificate through a DNS name
+// of the form party-[party id], which is also the String() of the parties.
+const identityFormat = "party-%d"
+
+// TLSConfig returns the mutually authenticated TLS configuration of party id,
+// or nil if the topology does not enable TLS.
+func (topo *Topology) TLSConfig(id PartyID) (*tls.Config, error) {
+	if topo.CA == "" {
+		return nil, nil
+	}
+	pc, known := topo.Party(id)
+	if !known {
+		return nil, fmt.Errorf("party %d is not in the topology", id)
+	}
+
+	caPEM, err := os.ReadFile(topo.path(topo.CA))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", topo.CA)
+	}
+
+	cert, err := tls.LoadX509KeyPair(topo.path(pc.Cert), topo.path(pc.Key))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the certificate of party %d: %s", id, err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// useCertificates enables TLS in the topology assigned by a coordinator, with
+// the CA and the certificates of the parties of certs, such as the topology
+// written by gencerts, whose party IDs are the assigned ones.
+func (topo *Topology) useCertificates(certs *Topology) error {
+	if certs.CA == "" {
+		return fmt.Errorf("the topology of the certificates has no CA")
+	}
+	cert := make(map[PartyID]PartyConfig, len(certs.Parties))
+	for _, pc := range certs.Parties {
+		cert[pc.ID] = pc
+	}
+	topo.CA = certs.path(certs.CA)
+	for i, pc := range topo.Parties {
+		c, ok := cert[pc.ID]
+		if !ok || c.Cert == "" || c.Key == "" {
+			return fmt.Errorf("party %d has no TLS certificate", pc.ID)
+		}
+		topo.Parties[i].Cert, topo.Parties[i].Key = certs.path(c.Cert), certs.path(c.Key)
+	}
+	return topo.Validate()
+}
+
+// peerIdentity returns the party ID bound to the verified certificate of the
+// remote end of conn.
+func peerIdentity(conn *tls.Conn) (PartyID, error) {
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return 0, fmt.Errorf("peer presented no verified certificate")
+	}
+	for _, name := range state.VerifiedChains[0][0].DNSNames {
+		var id PartyID
+		if n, err := fmt.Sscanf(name, identityFormat, &id); err == nil && n == 1 && name == fmt.Sprintf(identityFormat, id) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("peer certificate is not bound to a party ID")
+}
+
+// GenerateCertificates creates, in dir, a CA and a certificate for each party
+// of the topology, and writes to dir/topology.json a copy of the topology
+// enabling TLS with those certificates.
+func GenerateCertificates(topo *Topology, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	topo.rebase(dir)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tpl CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+	topo.CA = "ca.pem"
+	if err := writePEM(filepath.Join(dir, topo.CA), "CERTIFICATE", caDER); err != nil {
+		return err
+	}
+
+	for i := range topo.Parties {
+		pc := &topo.Parties[i]
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		identity := fmt.Sprintf(identityFormat, pc.ID)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(pc.ID) + 2),
+			Subject:      pkix.Name{CommonName: identity},
+			DNSNames:     []string{identity},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(1, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		pc.Cert = identity + ".pem"
+		pc.Key = identity + "-key.pem"
+		if err := writePEM(filepath.Join(dir, pc.Cert), "CERTIFICATE", der); err != nil {
+			return err
+		}
+		if err := writePEM(filepath.Join(dir, pc.Key), "EC PRIVATE KEY", keyDER); err != nil {
+			return err
+		}
+	}
+	return topo.Save(filepath.Join(dir, "topology.json"))
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Roles a party can take in a topology. The relay, if any, forwards the
+// messages of the other parties, which then only connect to it.
+const (
+	RoleParty = "party"
+	RoleRelay = "relay"
+)
+
+// PartyConfig is the topology entry of a single party: the address it listens
+// on for incoming connections, the address the other parties dial to reach it,
+// and its role in the experiment. Cert and Key are the PEM files of the party's
+// TLS certificate and private key. SigningKey is the PEM file of the key the
+// party signs its messages with, and VerifyKey the corresponding public key.
+type PartyConfig struct {
+	ID         PartyID `json:"id"`
+	Listen     string  `json:"listen"`
+	Addr       string  `json:"addr"`
+	Role       string  `json:"role"`
+	Cert       string  `json:"cert,omitempty"`
+	Key        string  `json:"key,omitempty"`
+	SigningKey string  `json:"signing_key,omitempty"`
+	VerifyKey  string  `json:"verify_key,omitempty"`
+}
+
+// Topology describes the set of parties of an experiment and how to reach them.
+// Setting CA to the PEM file of the certificate authority enables TLS between
+// the parties. Relative file paths are relative to the topology file.
+// WAN is the emulated profile of every link between two parties, which
+// Links can override for given pairs of parties.
+type Topology struct {
+	CA      string        `json:"ca,omitempty"`
+	Parties []PartyConfig `json:"parties"`
+	WAN     *LinkProfile  `json:"wan,omitempty"`
+	Links   []LinkConfig  `json:"links,omitempty"`
+
+	dir string
+}
+
+// LoadTopology reads and validates a JSON topology file.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read topology: %s", err)
+	}
+	topo := new(Topology)
+	if err := json.Unmarshal(data, topo); err != nil {
+		return nil, fmt.Errorf("cannot parse topology %s: %s", path, err)
+	}
+	if err := topo.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %s", path, err)
+	}
+	topo.dir = filepath.Dir(path)
+	return topo, nil
+}
+
+// Save writes the topology to a JSON file.
+func (topo *Topology) Save(path string) error {
+	data, err := json.MarshalIndent(topo, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func (topo *Topology) path(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(topo.dir, file)
+}
+
+// rebase makes the file paths of the topology relative to dir, where a copy
+// of the topology is about to be saved.
+func (topo *Topology) rebase(dir string) {
+	rebase := func(file *string) {
+		if *file == "" {
+			return
+		}
+		path, err := filepath.Abs(topo.path(*file))
+		if err != nil {
+			return
+		}
+		if absDir, err := filepath.Abs(dir); err == nil {
+			if rel, err := filepath.Rel(absDir, path); err == nil {
+				path = rel
+			}
+		}
+		*file = path
+	}
+	rebase(&topo.CA)
+	for i := range topo.Parties {
+		rebase(&topo.Parties[i].Cert)
+		rebase(&topo.Parties[i].Key)
+		rebase(&topo.Parties[i].SigningKey)
+	}
+	topo.dir = dir
+}
+
+// NewDockerTopology returns the topology of nParties parties running in the
+// mpc-net docker network, where party i is the container mpc-party-i.
+func NewDockerTopology(nParties uint64) *Topology {
+	topo := new(Topology)
+	for i := uint64(0); i < nParties; i++ {
+		topo.Parties = append(topo.Parties, PartyConfig{
+			ID:     PartyID(i),
+			Listen: fmt.Sprintf(":%d", BasePort),
+			Addr:   fmt.Sprintf("mpc-party-%d:%d", i, BasePort),
+			Role:   RoleParty,
+		})
+	}
+	return topo
+}
+
+// Validate checks that the party IDs are exactly 0 to n-1, as expected by
+// NewTree, that there is at most one relay, with another ID, and that every
+// party can be reached.
+func (topo *Topology) Validate() error {
+	seen := make(map[PartyID]bool, len(topo.Parties))
+	relays := 0
+	for i := range topo.Parties {
+		pc := &topo.Parties[i]
+		if pc.Role == "" {
+			pc.Role = RoleParty
+		}
+		if pc.Role != RoleParty && pc.Role != RoleRelay {
+			return fmt.Errorf("party %d has unknown role %q", pc.ID, pc.Role)
+		}
+		if _, listed := seen[pc.ID]; listed {
+			return fmt.Errorf("party %d is listed twice", pc.ID)
+		}
+		seen[pc.ID] = pc.Role == RoleParty
+		if pc.Role == RoleRelay {
+			relays++
+		}
+		if pc.Addr == "" {
+			return fmt.Errorf("party %d has no address", pc.ID)
+		}
+		if pc.Listen == "" {
+			return fmt.Errorf("party %d has no listen address", pc.ID)
+		}
+		if topo.CA != "" && (pc.Cert == "" || pc.Key == "") {
+			return fmt.Errorf("party %d has no TLS certificate", pc.ID)
+		}
+		if pc.VerifyKey != "" {
+			if _, err := parseVerifyKey(pc.VerifyKey); err != nil {
+				return fmt.Errorf("party %d has an invalid verification key: %s", pc.ID, err)
+			}
+		}
+	}
+	signed := 0
+	for _, pc := range topo.Parties {
+		if pc.Role == RoleParty && pc.VerifyKey != "" {
+			signed++
+		}
+	}
+	if signed > 0 && signed != topo.NumParties() {
+		return fmt.Errorf("only %d of the %d parties have a verification key", signed, topo.NumParties())
+	}
+	if relays > 1 {
+		return fmt.Errorf("the topology has %d relays", relays)
+	}
+	for i := 0; i < topo.NumParties(); i++ {
+		if !seen[PartyID(i)] {
+			return fmt.Errorf("party IDs should range from 0 to %d, missing %d", topo.NumParties()-1, i)
+		}
+	}
+	if topo.WAN != nil {
+		if err := topo.WAN.validate(); err != nil {
+			return fmt.Errorf("invalid wan profile: %s", err)
+		}
+	}
+	for _, lc := range topo.Links {
+		if !seen[lc.Parties[0]] || !seen[lc.Parties[1]] || lc.Parties[0] == lc.Parties[1] {
+			return fmt.Errorf("invalid link between parties %d and %d", lc.Parties[0], lc.Parties[1])
+		}
+		if err := lc.validate(); err != nil {
+			return fmt.Errorf("invalid link between parties %d and %d: %s", lc.Parties[0], lc.Parties[1], err)
+		}
+	}
+	return nil
+}
+
+// Party returns the topology entry of party id.
+func (topo *Topology) Party(id PartyID) (*PartyConfig, bool) {
+	for i := range topo.Parties {
+		if topo.Parties[i].ID == id {
+			return &topo.Parties[i], true
+		}
+	}
+	return nil, false
+}
+
+// NumParties returns the number of parties of the topology, the relay excluded.
+func (topo *Topology) NumParties() (n int) {
+	for _, pc := range topo.Parties {
+		if pc.Role != RoleRelay {
+			n++
+		}
+	}
+	return
+}
+
+// Relay returns the topology entry of the relay, if any.
+func (topo *Topology) Relay() (*PartyConfig, bool) {
+	for i := range topo.Parties {
+		if topo.Parties[i].Role == RoleRelay {
+			return &topo.Parties[i], true
+		}
+	}
+	return nil, false
+}
+
+// checkRelay checks that, if the topology has a relay, every party has a
+// verification key, since the relay could otherwise alter the envelopes it
+// forwards, or let another host take the place of a party.
+func (topo *Topology) checkRelay() error {
+	if _, isRelayed := topo.Relay(); !isRelayed {
+		return nil
+	}
+	for _, pc := range topo.Parties {
+		if pc.Role == RoleParty && pc.VerifyKey == "" {
+			return fmt.Errorf("party %d has no verification key, which a topology with a relay requires", pc.ID)
+		}
+	}
+	return nil
+}
+
+// Peers returns the dial addresses of all the parties, the relay excluded,
+// indexed by party ID.
+func (topo *Topology) Peers() map[PartyID]string {
+	peers := make(map[PartyID]string, len(topo.Parties))
+	for _, pc := range topo.Parties {
+		if pc.Role != RoleRelay {
+			peers[pc.ID] = pc.Addr
+		}
+	}
+	return peers
+}
+
+// NewLocalParty creates the local party id with the rest of the topology as its peers.
+func (topo *Topology) NewLocalParty(id PartyID) (*LocalParty, error) {
+	pc, known := topo.Party(id)
+	if !known {
+		return nil, fmt.Errorf("party %d is not in the topology", id)
+	}
+	if pc.Role == RoleRelay {
+		return nil, fmt.Errorf("party %d is the relay", id)
+	}
+	lp, err := NewLocalParty(id, topo.Peers())
+	if err != nil {
+		return nil, err
+	}
+	lp.Listen = pc.Listen
+	if err := topo.checkRelay(); err != nil {
+		return nil, err
+	}
+
+	// The messages are signed if the topology lists the keys of the parties
+	signingKey, verifyKeys, err := topo.SigningKeys(id)
+	if err != nil {
+		return nil, err
+	}
+	lp.SigningKey = signingKey
+	for pid, rp := range lp.Peers {
+		rp.VerifyKey = verifyKeys[pid]
+	}
+	return lp, nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// TranscriptVersion is the version of the format of the transcripts.
+const TranscriptVersion = 1
+
+// A transcript starts with the header
+//
+//	"TPLT" | version (1) | party ID (8) | number of parties (8)
+//
+// in big endian, followed by the envelopes sent and received by the party, in
+// their wire format. The envelopes of a session are in the order they were
+// sent by the party and delivered to the session, so that the inbound ones
+// are in the order the protocol consumed them.
+const transcriptMagic = "TPLT"
+
+var (
+	ErrTranscriptFormat = errors.New("not a transcript")
+	ErrTranscriptEnd    = errors.New("end of the transcript")
+	ErrReplayDiverged   = errors.New("replay diverged from the transcript")
+)
+
+// TranscriptWriter records the envelopes of a party to a file.
+type TranscriptWriter struct {
+	lock sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	err  error
+}
+
+// CreateTranscript creates the transcript file of lp at path.
+func CreateTranscript(path string, lp *LocalParty) (*TranscriptWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	tw := &TranscriptWriter{f: f, w: bufio.NewWriter(f)}
+	header := make([]byte, len(transcriptMagic)+1+8+8)
+	copy(header, transcriptMagic)
+	header[4] = TranscriptVersion
+	binary.BigEndian.PutUint64(header[5:], uint64(lp.ID))
+	binary.BigEndian.PutUint64(header[13:], uint64(len(lp.Peers)))
+	if _, err := tw.w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return tw, nil
+}
+
+// Record appends env to the transcript. The first write error is returned by Close.
+func (tw *TranscriptWriter) Record(env *Envelope) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.err == nil {
+		_, tw.err = tw.w.Write(env.MarshalBinary())
+	}
+}
+
+// Close flushes the transcript and closes its file.
+func (tw *TranscriptWriter) Close() error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	if tw.err == nil {
+		tw.err = tw.w.Flush()
+	}
+	if err := tw.f.Close(); tw.err == nil {
+		tw.err = err
+	}
+	return tw.err
+}
+
+// transcriptPath returns the path of the transcript of party id when several
+// parties record their transcript, as [path]_p[party id][ext].
+func transcriptPath(path string, id PartyID) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_p%d%s", strings.TrimSuffix(path, ext), id, ext)
+}
+
+// Transcript is the record of the envelopes sent and received by a party.
+// Truncated is set if the last envelope was cut short, as when the party
+// was killed while recording it.
+type Transcript struct {
+	ID        PartyID
+	NParties  int
+	Envelopes []*Envelope
+	Truncated bool
+}
+
+// LoadTranscript reads the transcript file at path.
+func LoadTranscript(path string) (*Transcript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTranscript(bufio.NewReader(f))
+}
+
+// ReadTranscript decodes a transcript from r.
+func ReadTranscript(r io.Reader) (*Transcript, error) {
+	header := make([]byte, len(transcriptMagic)+1+8+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTranscriptFormat, err)
+	}
+	if string(header[:4]) != transcriptMagic || header[4] != TranscriptVersion {
+		return nil, ErrTranscriptFormat
+	}
+	t := &Transcript{
+		ID:       PartyID(binary.BigEndian.Uint64(header[5:])),
+		NParties: int(binary.BigEndian.Uint64(header[13:])),
+	}
+	for {
+		env, err := ReadEnvelope(r)
+		if err == io.EOF {
+			return t, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			t.Truncated = true
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.Envelopes = append(t.Envelopes, env)
+	}
+}
+
+// Sessions returns the sessions of the transcript, in the order of their
+// first envelope, with their number of envelopes.
+func (t *Transcript) Sessions() (keys []SessionKey, count map[SessionKey]int) {
+	count = make(map[SessionKey]int)
+	for _, env := range t.Envelopes {
+		key := SessionKey{Protocol: env.Protocol, Session: env.Session}
+		if count[key] == 0 {
+			keys = append(keys, key)
+		}
+		count[key]++
+	}
+	return
+}
+
+// ParseSessionKey parses a session key in the format of its String method.
+func ParseSessionKey(s string) (SessionKey, error) {
+	i := strings.LastIndexByte(s, '/')
+	if i < 0 {
+		return SessionKey{}, fmt.Errorf("invalid session %q, expected protocol/session", s)
+	}
+	session, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return SessionKey{}, fmt.Errorf("invalid session %q: %s", s, err)
+	}
+	for _, p := range []ProtocolID{ProtocolTripleGen, ProtocolMHETripleGen, ProtocolRkg, ProtocolMACKeyGen, ProtocolTripleCheck, ProtocolOnline, ProtocolThresholdKeyGen, ProtocolRefill, ProtocolRunID} {
+		if p.String() == s[:i] {
+			return SessionKey{Protocol: p, Session: session}, nil
+		}
+	}
+	return SessionKey{}, fmt.Errorf("unknown protocol %q", s[:i])
+}
+
+// replay checks the envelopes sent by the replayed protocol against the ones
+// of the transcript, in order for each receiver.
+type replay struct {
+	lock     sync.Mutex
+	expected map[PartyID][]*Envelope
+	sent     int
+	err      error
+}
+
+func (r *replay) send(to PartyID, env *Envelope) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sent++
+	if len(r.expected[to]) == 0 {
+		r.diverged(fmt.Errorf("%w: unexpected %s", ErrReplayDiverged, env))
+		return nil
+	}
+	recorded := r.expected[to][0]
+	r.expected[to] = r.expected[to][1:]
+	if env.Round != recorded.Round || len(env.Payload) != len(recorded.Payload) {
+		r.diverged(fmt.Errorf("%w: sent %s instead of %s", ErrReplayDiverged, env, recorded))
+	}
+	return nil
+}
+
+// diverged keeps the first divergence. It is called with the lock held.
+func (r *replay) diverged(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// ReplayTranscript runs a fresh instance of the protocol of session key as
+// party t.ID, without a network. The envelopes received by the party in the
+// session are delivered in the order of the transcript, after which the peers
+// fail with ErrTranscriptEnd, and the envelopes sent by the instance are
+// checked against the ones of the transcript. Since the instance samples its
+// own secrets, only the rounds, receivers and sizes of the envelopes it sends
+// are checked, and not their content.
+// It returns the error of the protocol if it fails, as the recorded party did
+// if it received the same envelopes.
+func ReplayTranscript(ctx context.Context, t *Transcript, key SessionKey, params bfv.Parameters) error {
+	peers := make(map[PartyID]string, t.NParties)
+	for i := 0; i < t.NParties; i++ {
+		peers[PartyID(i)] = ""
+	}
+	lp, err := NewLocalParty(t.ID, peers)
+	if err != nil {
+		return err
+	}
+	tree := NewTree(peers, 2)
+
+	r := &replay{expected: make(map[PartyID][]*Envelope)}
+	var inbound []*Envelope
+	var nBatches uint64
+	var run RunID
+	for _, env := range t.Envelopes {
+		if env.Protocol != key.Protocol || env.Session != key.Session {
+			continue
+		}
+		run = env.Run
+		if env.Batch >= nBatches {
+			nBatches = env.Batch + 1
+		}
+		if env.Receiver == lp.ID {
+			inbound = append(inbound, env)
+		} else if env.Sender == lp.ID {
+			r.expected[env.Receiver] = append(r.expected[env.Receiver], env)
+		}
+	}
+	if len(inbound) == 0 && len(r.expected) == 0 {
+		return fmt.Errorf("session %s is not in the transcript", key)
+	}
+
+	mux := newMux(lp, nil)
+	mux.outbox = r.send
+	mux.SetRun(run)
+	sess, err := mux.Session(key.Protocol, key.Session)
+	if err != nil {
+		return err
+	}
+	for _, env := range inbound {
+		sess.deliver(env)
+	}
+	for _, id := range sortedPeers(lp) {
+		sess.fail(&PeerError{Peer: id, Err: ErrTranscriptEnd})
+	}
+
+	fmt.Printf("replaying %s as %s: %d envelopes received in %d batches\n", key, lp, len(inbound), nBatches)
+	sk := bfv.NewKeyGenerator(params).GenSecretKey()
+	switch key.Protocol {
+	case ProtocolTripleGen:
+		if t.proven(key) {
+			return fmt.Errorf("cannot replay %s, whose responses are proven for the queries of the recorded party", key)
+		}
+		tgp := lp.NewTripleGenProtocol(params, sk)
+		tgp.BindNetwork(sess)
+		go discardTriples(tgp.Triples)
+		err = tgp.Run(ctx, nBatches*params.N())
+	case ProtocolMHETripleGen:
+		if t.threshold() {
+			return fmt.Errorf("cannot replay %s, whose batches depend on the peers that straggled", key)
+		}
+		// The relinearization key only needs to be valid for the local secret key
+		rlk := bfv.NewKeyGenerator(params).GenRelinearizationKey(sk, 1)
+		tgp := lp.NewMHETripleGenProtocol(params, sk, rlk, tree)
+		if t.authenticated() {
+			// As does the encryption of the MAC key at the root
+			tgp.MACKey = &MACKey{Share: sampleUniformVector(1, params.T())[0]}
+			if lp.ID == tree[lp.ID].Parent {
+				plain := bfv.NewPlaintext(params)
+				tgp.EncodeUint(make([]uint64, params.N()), plain)
+				tgp.MACKey.Enc = bfv.NewEncryptorFromSk(params, sk).EncryptNew(plain)
+			}
+		}
+		tgp.BindNetwork(sess)
+		go discardTriples(tgp.Triples)
+		err = tgp.Run(ctx, nBatches*params.N())
+	case ProtocolRkg:
+		rkg := lp.NewRkgProtocol(params, sk, tree)
+		rkg.BindNetwork(sess)
+		_, err = rkg.Run(ctx)
+	case ProtocolMACKeyGen:
+		mkg := lp.NewMACKeyGenProtocol(params, sk, tree)
+		mkg.BindNetwork(sess)
+		_, err = mkg.Run(ctx)
+	case ProtocolThresholdKeyGen:
+		return fmt.Errorf("cannot replay %s, whose shares are encrypted under the ephemeral keys of the recorded party", key)
+	default:
+		return fmt.Errorf("cannot replay protocol %s", key.Protocol)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	for _, id := range sortedPeers(lp) {
+		if len(r.expected[id]) > 0 {
+			return fmt.Errorf("%w: %s not sent", ErrReplayDiverged, r.expected[id][0])
+		}
+	}
+	fmt.Printf("replay of %s ok: %d envelopes sent\n", key, r.sent)
+	return nil
+}
+
+// authenticated reports whether the recorded party generated a MAC key, and
+// thus authenticated triples.
+func (t *Transcript) authenticated() bool {
+	for _, env := range t.Envelopes {
+		if env.Protocol == ProtocolMACKeyGen {
+			return true
+		}
+	}
+	return false
+}
+
+// threshold reports whether the recorded party generated a threshold key, and
+// thus ran the threshold variant of the MHE triple generation.
+func (t *Transcript) threshold() bool {
+	for _, env := range t.Envelopes {
+		if env.Protocol == ProtocolThresholdKeyGen {
+			return true
+		}
+	}
+	return false
+}
+
+// proven reports whether the queries and responses of the triple generation
+// session key were proven.
+func (t *Transcript) proven(key SessionKey) bool {
+	for _, env := range t.Envelopes {
+		if env.Protocol == key.Protocol && env.Session == key.Session && env.Round == tripleGenRoundQueryProof {
+			return true
+		}
+	}
+	return false
+}
+
+// discardTriples consumes the triples of a replayed protocol.
+func discardTriples(triples chan Triple) {
+	for range triples {
+	}
+}
+
+// sortedPeers returns the IDs of the peers of lp in increasing order.
+func sortedPeers(lp *LocalParty) []PartyID {
+	ids := make([]PartyID, 0, len(lp.Peers))
+	for id := range lp.Peers {
+		if id != lp.ID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// ListTranscript prints the sessions of the transcript to w.
+func ListTranscript(t *Transcript, w io.Writer) error {
+	keys, count := t.Sessions()
+	truncated := ""
+	if t.Truncated {
+		truncated = ", truncated"
+	}
+	if _, err := fmt.Fprintf(w, "party-%d of %d parties%s\n", t.ID, t.NParties, truncated); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "\t%s: %d envelopes\n", key, count[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wanPacketSize is the size of the packets to which the loss rate applies.
+const wanPacketSize = 1500
+
+// wanChunkSize is the maximum number of bytes scheduled at once by an EmulatedConn.
+const wanChunkSize = 64 * 1024
+
+// Duration is a time.Duration read from JSON strings such as "10ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Bandwidth is a rate in bits per second, read from JSON strings such as "100Mbps".
+type Bandwidth float64
+
+// ParseBandwidth parses rates of the form [number](bps|Kbps|Mbps|Gbps).
+func ParseBandwidth(s string) (Bandwidth, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{{"Gbps", 1e9}, {"Mbps", 1e6}, {"Kbps", 1e3}, {"bps", 1}}
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, unit.suffix), 64)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid bandwidth %q", s)
+			}
+			return Bandwidth(v * unit.factor), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid bandwidth %q, expected a unit in bps, Kbps, Mbps or Gbps", s)
+}
+
+func (b *Bandwidth) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*b, err = ParseBandwidth(s)
+	return err
+}
+
+func (b Bandwidth) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%gbps", float64(b)))
+}
+
+// LinkProfile describes the emulated conditions of the link between two
+// parties, applied to each direction: the one-way latency, a jitter added
+// uniformly at random to the latency, the bandwidth (0 means unlimited) and
+// the packet loss rate. A lost packet delays the rest of the stream by one
+// round-trip time, as a retransmission would.
+type LinkProfile struct {
+	Latency   Duration  `json:"latency"`
+	Jitter    Duration  `json:"jitter,omitempty"`
+	Bandwidth Bandwidth `json:"bandwidth,omitempty"`
+	Loss      float64   `json:"loss,omitempty"`
+}
+
+// ParseLinkProfile parses profiles of the form "latency=10ms,bandwidth=100Mbps,jitter=1ms,loss=0.001".
+func ParseLinkProfile(s string) (*LinkProfile, error) {
+	profile := new(LinkProfile)
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid link profile field %q", field)
+		}
+		var err error
+		var d time.Duration
+		switch kv[0] {
+		case "latency":
+			d, err = time.ParseDuration(kv[1])
+			profile.Latency = Duration(d)
+		case "jitter":
+			d, err = time.ParseDuration(kv[1])
+			profile.Jitter = Duration(d)
+		case "bandwidth":
+			profile.Bandwidth, err = ParseBandwidth(kv[1])
+		case "loss":
+			profile.Loss, err = strconv.ParseFloat(kv[1], 64)
+		default:
+			err = fmt.Errorf("unknown link profile field %q", kv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return profile, profile.validate()
+}
+
+func (lp *LinkProfile) validate() error {
+	if lp.Latency < 0 || lp.Jitter < 0 || lp.Bandwidth < 0 {
+		return fmt.Errorf("link profile values should be positive")
+	}
+	if lp.Loss < 0 || lp.Loss >= 1 {
+		return fmt.Errorf("loss rate should be in [0, 1)")
+	}
+	return nil
+}
+
+// LinkConfig sets the profile of the link between two parties.
+type LinkConfig struct {
+	Parties [2]PartyID `json:"parties"`
+	LinkProfile
+}
+
+// LinkProfiles returns the profiles of the links of party id with its
+// peers, indexed by peer. Links without profile are not emulated.
+func (topo *Topology) LinkProfiles(id PartyID) map[PartyID]*LinkProfile {
+	profiles := make(map[PartyID]*LinkProfile)
+	if topo.WAN != nil {
+		for pid := range topo.Peers() {
+			if pid != id {
+				profiles[pid] = topo.WAN
+			}
+		}
+	}
+	for i := range topo.Links {
+		lc := &topo.Links[i]
+		switch id {
+		case lc.Parties[0]:
+			profiles[lc.Parties[1]] = &lc.LinkProfile
+		case lc.Parties[1]:
+			profiles[lc.Parties[0]] = &lc.LinkProfile
+		}
+	}
+	return profiles
+}
+
+// EmulatedNetwork applies the profiles of the links to the connections of
+// another Network.
+type EmulatedNetwork struct {
+	Network
+	profiles map[PartyID]*LinkProfile
+
+	lock  sync.Mutex
+	conns map[PartyID]*EmulatedConn
+}
+
+// NewEmulatedNetwork wraps the network nw, where profiles gives the
+// profile of the link with each peer. Peers without profile are not affected.
+func NewEmulatedNetwork(nw Network, profiles map[PartyID]*LinkProfile) *EmulatedNetwork {
+	return &EmulatedNetwork{
+		Network:  nw,
+		profiles: profiles,
+		conns:    make(map[PartyID]*EmulatedConn),
+	}
+}
+
+func (enw *EmulatedNetwork) Conn(id PartyID) net.Conn {
+	enw.lock.Lock()
+	defer enw.lock.Unlock()
+	return enw.wrap(id, enw.Network.Conn(id))
+}
+
+func (enw *EmulatedNetwork) Reconnect(id PartyID) (net.Conn, error) {
+	conn, err := enw.Network.Reconnect(id)
+	if err != nil {
+		return nil, err
+	}
+	enw.lock.Lock()
+	defer enw.lock.Unlock()
+	return enw.wrap(id, conn), nil
+}
+
+func (enw *EmulatedNetwork) wrap(id PartyID, conn net.Conn) net.Conn {
+	profile, emulated := enw.profiles[id]
+	if conn == nil || !emulated {
+		return conn
+	}
+	if ec, exists := enw.conns[id]; exists && ec.Conn == conn {
+		return ec
+	}
+	ec := NewEmulatedConn(conn, profile)
+	enw.conns[id] = ec
+	return ec
+}
+
+func (enw *EmulatedNetwork) Close() error {
+	enw.lock.Lock()
+	for _, ec := range enw.conns {
+		ec.flush()
+	}
+	enw.lock.Unlock()
+	return enw.Network.Close()
+}
+
+type wanChunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// EmulatedConn delays the writes to a connection according to a link profile.
+// Write blocks for the time needed to send the data at the link bandwidth,
+// and the data is written to the underlying connection once its latency
+// has elapsed, in order.
+type EmulatedConn struct {
+	net.Conn
+	profile *LinkProfile
+	rand    *rand.Rand
+
+	writeLock sync.Mutex
+	busyUntil time.Time // end of the transmission of the data written so far
+	lastAt    time.Time // delivery time of the last chunk
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   []wanChunk
+	err     error
+	stopped bool
+	idle    bool
+}
+
+func NewEmulatedConn(conn net.Conn, profile *LinkProfile) *EmulatedConn {
+	ec := &EmulatedConn{
+		Conn:    conn,
+		profile: profile,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		idle:    true,
+	}
+	ec.cond = sync.NewCond(&ec.lock)
+	go ec.deliver()
+	return ec
+}
+
+func (ec *EmulatedConn) Write(b []byte) (n int, err error) {
+	ec.writeLock.Lock()
+	defer ec.writeLock.Unlock()
+
+	for n < len(b) {
+		size := len(b) - n
+		if size > wanChunkSize {
+			size = wanChunkSize
+		}
+
+		now := time.Now()
+		if ec.busyUntil.Before(now) {
+			ec.busyUntil = now
+		}
+		if ec.profile.Bandwidth > 0 {
+			ec.busyUntil = ec.busyUntil.Add(time.Duration(float64(size*8) / float64(ec.profile.Bandwidth) * float64(time.Second)))
+		}
+
+		delay := time.Duration(ec.profile.Latency)
+		if ec.profile.Jitter > 0 {
+			delay += time.Duration(ec.rand.Int63n(int64(ec.profile.Jitter)))
+		}
+		for p := 0; p < size; p += wanPacketSize {
+			if ec.rand.Float64() < ec.profile.Loss {
+				delay += 2 * time.Duration(ec.profile.Latency)
+			}
+		}
+		deliverAt := ec.busyUntil.Add(delay)
+		if deliverAt.Before(ec.lastAt) {
+			deliverAt = ec.lastAt
+		}
+		ec.lastAt = deliverAt
+
+		chunk := wanChunk{data: append([]byte(nil), b[n:n+size]...), deliverAt: deliverAt}
+		ec.lock.Lock()
+		if ec.err != nil {
+			err = ec.err
+			ec.lock.Unlock()
+			return
+		}
+		ec.queue = append(ec.queue, chunk)
+		ec.idle = false
+		ec.cond.Broadcast()
+		ec.lock.Unlock()
+
+		n += size
+		time.Sleep(time.Until(ec.busyUntil))
+	}
+	return
+}
+
+func (ec *EmulatedConn) deliver() {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	for {
+		for len(ec.queue) == 0 && !ec.stopped {
+			ec.idle = true
+			ec.cond.Broadcast()
+			ec.cond.Wait()
+		}
+		if ec.stopped {
+			return
+		}
+		chunk := ec.queue[0]
+		ec.queue = ec.queue[1:]
+		ec.lock.Unlock()
+
+		time.Sleep(time.Until(chunk.deliverAt))
+		_, err := ec.Conn.Write(chunk.data)
+
+		ec.lock.Lock()
+		if err != nil && ec.err == nil {
+			ec.err = err
+			ec.queue = nil
+		}
+	}
+}
+
+// flush waits for the delivery of the data written so far.
+func (ec *EmulatedConn) flush() {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	for !ec.idle && ec.err == nil {
+		ec.cond.Wait()
+	}
+}
+
+// Close delivers the data written so far and closes the connection.
+func (ec *EmulatedConn) Close() error {
+	ec.flush()
+	ec.lock.Lock()
+	ec.stopped = true
+	ec.cond.Broadcast()
+	ec.lock.Unlock()
+	return ec.Conn.Close()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// ZK_REPETITIONS is the number of parallel repetitions of the proofs, each of
+// which has a soundness error of 1/2N for challenges ±X^k, 2^-14 with N = 8192.
+const ZK_REPETITIONS = 10
+
+// ZK_SLACK is the number of bits by which the masks of the proofs exceed the
+// bounds of the witnesses. A proof is restarted when a response leaves the
+// range that hides the witness, which happens with a probability of about
+// 2^-ZK_SLACK per coefficient.
+const ZK_SLACK = 40
+
+var ErrInvalidProof = errors.New("invalid proof")
+
+// linearRelation is the statement of a proof: the knowledge of witness
+// polynomials w_l of infinity norm at most Bounds[l] such that
+// sum_l A[k][l]*w_l = U[k] in R_Q for each equation k. The polynomials are in
+// the NTT domain, A in the Montgomery form as well, and a nil A[k][l] is zero.
+type linearRelation struct {
+	A      [][]*ring.Poly
+	U      []*ring.Poly
+	Bounds []uint64
+}
+
+// proofSystem proves linear relations in zero knowledge, with the Fiat-Shamir
+// transform of a Σ-protocol with rejection sampling. The prover commits to
+// W = A*y for uniform masks y, and answers the challenge c = ±X^k with
+// z = y + c*w, which it only reveals if it is in the range where z does not
+// depend on w. A proof is the hash from which the challenges derive, followed
+// by z, from which the verifier recomputes W = A*z - c*U.
+//
+// The extraction divides by the difference of two challenges, of which 2 is a
+// multiple by a polynomial of norm 1, so that a proof shows that the relation
+// holds for twice U with witnesses of norm up to 2N times the bound of z.
+type proofSystem struct {
+	rq   *ring.Ring
+	prng utils.PRNG
+}
+
+func newProofSystem(rq *ring.Ring) (*proofSystem, error) {
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		return nil, err
+	}
+	return &proofSystem{rq: rq, prng: prng}, nil
+}
+
+// maskBits returns the size of the masks of a witness of the bound.
+func maskBits(bound uint64) uint {
+	return uint(bits.Len64(bound)) + ZK_SLACK
+}
+
+// responseBound returns the bound of the responses for a witness of the
+// bound, within which they are uniform whatever the witness.
+func responseBound(bound uint64) uint64 {
+	return 1<<maskBits(bound) - 1 - bound
+}
+
+// responseWidth returns the number of bytes of a coefficient of a response.
+func responseWidth(bound uint64) int {
+	return int(maskBits(bound)+1+7) / 8
+}
+
+// prove returns the proof of the relation for the witness, bound to context.
+func (ps *proofSystem) prove(rel *linearRelation, witness [][]int64, context []byte) ([]byte, error) {
+	for l, w := range witness {
+		if norm(w) > rel.Bounds[l] {
+			return nil, fmt.Errorf("witness %d exceeds its bound %d", l, rel.Bounds[l])
+		}
+	}
+
+	buf := make([]byte, 8)
+	for {
+		masks := make([][][]int64, ZK_REPETITIONS)
+		commitments := make([][]*ring.Poly, ZK_REPETITIONS)
+		for r := range masks {
+			masks[r] = make([][]int64, len(witness))
+			for l := range witness {
+				k := maskBits(rel.Bounds[l])
+				masks[r][l] = make([]int64, ps.rq.N)
+				for i := range masks[r][l] {
+					ps.prng.Clock(buf)
+					masks[r][l][i] = int64(binary.BigEndian.Uint64(buf)&(1<<(k+1)-1)) - 1<<k
+				}
+			}
+			commitments[r] = ps.apply(rel, masks[r])
+		}
+		digest, err := ps.hash(rel, context, commitments)
+		if err != nil {
+			return nil, err
+		}
+		challenges, err := ps.challenges(digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// The masks become the responses
+		accepted := true
+		for r, c := range challenges {
+			for l, w := range witness {
+				addMonomial(masks[r][l], w, c)
+				accepted = accepted && norm(masks[r][l]) <= responseBound(rel.Bounds[l])
+			}
+		}
+		if accepted {
+			return ps.encode(rel, digest, masks), nil
+		}
+	}
+}
+
+// verify checks the proof of the relation bound to context.
+func (ps *proofSystem) verify(rel *linearRelation, proof []byte, context []byte) error {
+	digest, responses, err := ps.decode(rel, proof)
+	if err != nil {
+		return err
+	}
+	challenges, err := ps.challenges(digest)
+	if err != nil {
+		return err
+	}
+	commitments := make([][]*ring.Poly, ZK_REPETITIONS)
+	for r, c := range challenges {
+		commitments[r] = ps.apply(rel, responses[r])
+		monomial := ps.monomialNTT(c)
+		for k, u := range rel.U {
+			ps.rq.MulCoeffsMontgomeryAndSub(u, monomial, commitments[r][k])
+		}
+	}
+	recomputed, err := ps.hash(rel, context, commitments)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(recomputed, digest) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// apply returns A*v, in the NTT domain.
+func (ps *proofSystem) apply(rel *linearRelation, v [][]int64) []*ring.Poly {
+	polys := make([]*ring.Poly, len(v))
+	for l := range v {
+		polys[l] = ps.rq.NewPoly()
+		ps.rq.SetCoefficientsInt64(v[l], polys[l])
+		ps.rq.NTT(polys[l], polys[l])
+	}
+	out := make([]*ring.Poly, len(rel.U))
+	for k := range rel.A {
+		out[k] = ps.rq.NewPoly()
+		for l, a := range rel.A[k] {
+			if a != nil {
+				ps.rq.MulCoeffsMontgomeryAndAdd(polys[l], a, out[k])
+			}
+		}
+	}
+	return out
+}
+
+// hash returns the hash of the context, the relation and the commitments.
+func (ps *proofSystem) hash(rel *linearRelation, context []byte, commitments [][]*ring.Poly) ([]byte, error) {
+	h := sha256.New()
+	h.Write(appendUint64(nil, uint64(len(context))))
+	h.Write(context)
+	var polys []*ring.Poly
+	for k := range rel.A {
+		for _, a := range rel.A[k] {
+			if a != nil {
+				polys = append(polys, a)
+			}
+		}
+		polys = append(polys, rel.U[k])
+	}
+	for _, w := range commitments {
+		polys = append(polys, w...)
+	}
+	for _, p := range polys {
+		data, err := p.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		h.Write(data)
+	}
+	return h.Sum(nil), nil
+}
+
+// challenges returns the challenges ±X^k derived from the digest, as k in
+// [0, N) for X^k and in [N, 2N) for -X^(k-N).
+func (ps *proofSystem) challenges(digest []byte) ([]uint64, error) {
+	prng, err := utils.NewKeyedPRNG(digest)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8)
+	c := make([]uint64, ZK_REPETITIONS)
+	for r := range c {
+		prng.Clock(buf)
+		c[r] = binary.BigEndian.Uint64(buf) & (2*ps.rq.N - 1)
+	}
+	return c, nil
+}
+
+// monomialNTT returns the challenge c in the NTT and Montgomery domains.
+func (ps *proofSystem) monomialNTT(c uint64) *ring.Poly {
+	p := ps.rq.NewPoly()
+	for i, qi := range ps.rq.Modulus {
+		if c < ps.rq.N {
+			p.Coeffs[i][c] = 1
+		} else {
+			p.Coeffs[i][c-ps.rq.N] = qi - 1
+		}
+	}
+	ps.rq.NTT(p, p)
+	ps.rq.MForm(p, p)
+	return p
+}
+
+// addMonomial adds the product of w by the challenge c to z, in Z[X]/(X^N+1).
+func addMonomial(z, w []int64, c uint64) {
+	n := uint64(len(w))
+	sign := int64(1)
+	if c >= n {
+		sign, c = -1, c-n
+	}
+	for i, v := range w {
+		j := uint64(i) + c
+		if j >= n {
+			z[j-n] -= sign * v
+		} else {
+			z[j] += sign * v
+		}
+	}
+}
+
+// encode encodes the proof as
+//
+//	digest (32) | responses
+//
+// where the responses are encoded by repetition and witness, each coefficient
+// in the two's complement on responseWidth bytes.
+func (ps *proofSystem) encode(rel *linearRelation, digest []byte, responses [][][]int64) []byte {
+	data := append([]byte(nil), digest...)
+	for r := range responses {
+		for l, z := range responses[r] {
+			width := responseWidth(rel.Bounds[l])
+			buf := make([]byte, 8)
+			for _, v := range z {
+				binary.BigEndian.PutUint64(buf, uint64(v))
+				data = append(data, buf[8-width:]...)
+			}
+		}
+	}
+	return data
+}
+
+// decode decodes a proof of the relation, and checks the bounds of its responses.
+func (ps *proofSystem) decode(rel *linearRelation, data []byte) ([]byte, [][][]int64, error) {
+	size := sha256.Size
+	for _, bound := range rel.Bounds {
+		size += ZK_REPETITIONS * int(ps.rq.N) * responseWidth(bound)
+	}
+	if len(data) != size {
+		return nil, nil, fmt.Errorf("%w: proof of %d bytes instead of %d", ErrMalformedMessage, len(data), size)
+	}
+	digest := data[:sha256.Size]
+	ptr := sha256.Size
+	responses := make([][][]int64, ZK_REPETITIONS)
+	buf := make([]byte, 8)
+	for r := range responses {
+		responses[r] = make([][]int64, len(rel.Bounds))
+		for l, bound := range rel.Bounds {
+			width := responseWidth(bound)
+			shift := uint(64 - 8*width)
+			z := make([]int64, ps.rq.N)
+			for i := range z {
+				copy(buf[8-width:], data[ptr:ptr+width])
+				z[i] = int64(binary.BigEndian.Uint64(buf)<<shift) >> shift
+				ptr += width
+			}
+			if norm(z) > responseBound(bound) {
+				return nil, nil, fmt.Errorf("%w: response out of bounds", ErrInvalidProof)
+			}
+			responses[r][l] = z
+		}
+	}
+	return digest, responses, nil
+}
+
+// norm returns the infinity norm of v.
+func norm(v []int64) uint64 {
+	var max uint64
+	for _, x := range v {
+		if x < 0 {
+			x = -x
+		}
+		if uint64(x) > max {
+			max = uint64(x)
+		}
+	}
+	return max
+}
+
+// centered returns the coefficients of p, which are assumed small, in
+// (-q_0/2, q_0/2].
+func centered(rq *ring.Ring, p *ring.Poly) []int64 {
+	q0 := rq.Modulus[0]
+	v := make([]int64, rq.N)
+	for i, c := range p.Coeffs[0] {
+		if c > q0/2 {
+			v[i] = -int64(q0 - c)
+		} else {
+			v[i] = int64(c)
+		}
+	}
+	return v
+}
+
+// constantNTT returns the constant polynomial c in the NTT and Montgomery domains.
+func constantNTT(rq *ring.Ring, c *big.Int) *ring.Poly {
+	p := rq.NewPoly()
+	rq.AddScalarBigint(p, c, p)
+	rq.MForm(p, p)
+	return p
+}
+
+// proofContext returns the context a proof is bound to: the session, batch
+// and round of its envelope, and the parties it concerns.
+func proofContext(key SessionKey, batch, round uint64, parties ...PartyID) []byte {
+	return []byte(fmt.Sprintf("%s|%d|%d|%v", key, batch, round, parties))
+}
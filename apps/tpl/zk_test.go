@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// testRelation returns the relation a*w = u of a uniform a and a witness w of
+// the bound, with the witness.
+func testRelation(ps *proofSystem, bound uint64) (*linearRelation, [][]int64) {
+	a := ring.NewUniformSampler(ps.prng, ps.rq).ReadNew()
+	ps.rq.MForm(a, a)
+	w := make([]int64, ps.rq.N)
+	for i := range w {
+		w[i] = int64(i%int(2*bound+1)) - int64(bound)
+	}
+	rel := &linearRelation{A: [][]*ring.Poly{{a}}, U: make([]*ring.Poly, 1), Bounds: []uint64{bound}}
+	rel.U = ps.apply(rel, [][]int64{w})
+	return rel, [][]int64{w}
+}
+
+func TestProofCompleteness(t *testing.T) {
+	ps, err := newProofSystem(tplParameters(false).RingQ())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bound := range []uint64{1, 20, 1 << 16} {
+		rel, witness := testRelation(ps, bound)
+		proof, err := ps.prove(rel, witness, []byte("context"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ps.verify(rel, proof, []byte("context")); err != nil {
+			t.Fatalf("proof for the bound %d: %s", bound, err)
+		}
+	}
+}
+
+func TestProofSoundness(t *testing.T) {
+	ps, err := newProofSystem(tplParameters(false).RingQ())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, witness := testRelation(ps, 20)
+	proof, err := ps.prove(rel, witness, []byte("context"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tamperResponse adds delta to the first coefficient of the response of
+	// the repetition r
+	tamperResponse := func(r int, delta int64) func(proof []byte) []byte {
+		return func(proof []byte) []byte {
+			digest, responses, err := ps.decode(rel, proof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses[r][0][0] += delta
+			return ps.encode(rel, digest, responses)
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		tamper  func(proof []byte) []byte
+		context string
+		err     error
+	}{
+		{"response", tamperResponse(0, 1), "context", ErrInvalidProof},
+		{"last response", tamperResponse(ZK_REPETITIONS-1, -1), "context", ErrInvalidProof},
+		{"response out of bounds", tamperResponse(0, int64(responseBound(20))+1), "context", ErrInvalidProof},
+		{"digest", func(proof []byte) []byte {
+			proof[0] ^= 1
+			return proof
+		}, "context", ErrInvalidProof},
+		{"truncated", func(proof []byte) []byte {
+			return proof[:len(proof)-1]
+		}, "context", ErrMalformedMessage},
+		{"context", func(proof []byte) []byte { return proof }, "other context", ErrInvalidProof},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tampered := tc.tamper(append([]byte(nil), proof...))
+			if err := ps.verify(rel, tampered, []byte(tc.context)); !errors.Is(err, tc.err) {
+				t.Fatalf("got error %v instead of %v", err, tc.err)
+			}
+		})
+	}
+
+	t.Run("statement", func(t *testing.T) {
+		other := &linearRelation{A: rel.A, U: []*ring.Poly{rel.U[0].CopyNew()}, Bounds: rel.Bounds}
+		other.U[0].Coeffs[0][0]++
+		if err := ps.verify(other, proof, []byte("context")); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("got error %v instead of %v", err, ErrInvalidProof)
+		}
+	})
+
+	t.Run("witness out of bounds", func(t *testing.T) {
+		witness := [][]int64{append([]int64(nil), witness[0]...)}
+		witness[0][0] = 21
+		if _, err := ps.prove(rel, witness, []byte("context")); err == nil {
+			t.Fatal("proved a witness out of its bound")
+		}
+	})
+}